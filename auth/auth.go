@@ -0,0 +1,295 @@
+// Package auth issues and validates login tokens
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+
+	"example/gochat/types"
+)
+
+// TokenAuth issues and validates the jwt used by protectMiddleware, tokens
+// are signed with the hmac secret unless an asymmetric signing key is loaded
+type TokenAuth struct {
+	// tokens are only accepted from this issuer for this audience
+	Issuer   string
+	Audience string
+	// tolerated clock skew between servers when checking exp, nbf and iat
+	Leeway time.Duration
+	// how long issued tokens are valid, zero issues tokens without exp
+	Lifetime time.Duration
+
+	secret []byte
+	// previous hmac secrets still accepted during a rotation
+	previousSecrets [][]byte
+	signingKey      *tokenKey
+	keys            map[string]*tokenKey
+}
+
+type tokenKey struct {
+	id      string
+	method  jwt.SigningMethod
+	private crypto.PrivateKey
+	public  crypto.PublicKey
+}
+
+// MinSecretLength is the shortest hmac secret Validate accepts, 32 bytes
+// matches the output of the hs256 hash
+const MinSecretLength = 32
+
+// Validate reports a configuration that can't sign tokens safely
+func (a *TokenAuth) Validate() error {
+	if a.signingKey == nil && len(a.secret) == 0 {
+		return errors.New("no hmac secret or signing key configured")
+	}
+	if len(a.secret) > 0 && len(a.secret) < MinSecretLength {
+		return fmt.Errorf("hmac secret is %d bytes, it needs at least %d", len(a.secret), MinSecretLength)
+	}
+	for _, secret := range a.previousSecrets {
+		if len(secret) < MinSecretLength {
+			return fmt.Errorf("a previous hmac secret is %d bytes, it needs at least %d", len(secret), MinSecretLength)
+		}
+	}
+	if a.Issuer == "" || a.Audience == "" {
+		return errors.New("issuer and audience can't be empty")
+	}
+	return nil
+}
+
+func NewTokenAuth(secret string) *TokenAuth {
+	return &TokenAuth{
+		Issuer:   "gochat",
+		Audience: "gochat",
+		Leeway:   30 * time.Second,
+		Lifetime: 7 * 24 * time.Hour,
+		secret:   []byte(secret),
+		keys:     make(map[string]*tokenKey),
+	}
+}
+
+// LoadSigningKey signs new tokens with the rsa or ecdsa private key in the
+// pem file, its public key is published in the jwks
+func (a *TokenAuth) LoadSigningKey(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var private crypto.PrivateKey
+	var public crypto.PublicKey
+	if key, err := jwt.ParseRSAPrivateKeyFromPEM(data); err == nil {
+		private, public = key, &key.PublicKey
+	} else if key, err := jwt.ParseECPrivateKeyFromPEM(data); err == nil {
+		private, public = key, &key.PublicKey
+	} else {
+		return fmt.Errorf("%s: not an rsa or ecdsa private key", path)
+	}
+
+	key, err := newTokenKey(public)
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	key.private = private
+	a.signingKey = key
+	a.keys[key.id] = key
+	return nil
+}
+
+// AddPreviousSecret keeps accepting hmac tokens signed with an old secret,
+// new tokens are always signed with the current one
+func (a *TokenAuth) AddPreviousSecret(secret string) {
+	if secret != "" {
+		a.previousSecrets = append(a.previousSecrets, []byte(secret))
+	}
+}
+
+// LoadVerifyKey accepts tokens signed by a previous key during rotation
+func (a *TokenAuth) LoadVerifyKey(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var public crypto.PublicKey
+	if key, err := jwt.ParseRSAPublicKeyFromPEM(data); err == nil {
+		public = key
+	} else if key, err := jwt.ParseECPublicKeyFromPEM(data); err == nil {
+		public = key
+	} else {
+		return fmt.Errorf("%s: not an rsa or ecdsa public key", path)
+	}
+
+	key, err := newTokenKey(public)
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	a.keys[key.id] = key
+	return nil
+}
+
+func newTokenKey(public crypto.PublicKey) (*tokenKey, error) {
+	key := &tokenKey{public: public}
+	switch k := public.(type) {
+	case *rsa.PublicKey:
+		key.method = jwt.SigningMethodRS256
+	case *ecdsa.PublicKey:
+		switch k.Curve {
+		case elliptic.P256():
+			key.method = jwt.SigningMethodES256
+		case elliptic.P384():
+			key.method = jwt.SigningMethodES384
+		case elliptic.P521():
+			key.method = jwt.SigningMethodES512
+		default:
+			return nil, errors.New("unsupported curve")
+		}
+	default:
+		return nil, errors.New("unsupported key type")
+	}
+
+	// the kid is the rfc 7638 thumbprint of the public key
+	thumbprint, err := json.Marshal(toJWK(key))
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(thumbprint)
+	key.id = base64.RawURLEncoding.EncodeToString(sum[:])
+	return key, nil
+}
+
+// CreateToken issues a token for the user, version is the user's token
+// version at the time
+func (a *TokenAuth) CreateToken(id int, version int) (string, error) {
+	now := time.Now()
+	claims := jwt.MapClaims{
+		"userId": id,
+		"ver":    version,
+		"sub":    strconv.Itoa(id),
+		"iss":    a.Issuer,
+		"aud":    a.Audience,
+		"iat":    now.Unix(),
+		"nbf":    now.Unix(),
+	}
+	if a.Lifetime > 0 {
+		claims["exp"] = now.Add(a.Lifetime).Unix()
+	}
+
+	if a.signingKey != nil {
+		token := jwt.NewWithClaims(a.signingKey.method, claims)
+		token.Header["kid"] = a.signingKey.id
+		return token.SignedString(a.signingKey.private)
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	return token.SignedString(a.secret)
+}
+
+// ValidateToken checks the signature and registered claims and returns the
+// user id the token was issued to and its version
+func (a *TokenAuth) ValidateToken(tokenString string) (int, int, error) {
+	parser := jwt.NewParser(
+		jwt.WithIssuer(a.Issuer),
+		jwt.WithAudience(a.Audience),
+		jwt.WithIssuedAt(),
+		jwt.WithLeeway(a.Leeway),
+	)
+	token, err := parser.Parse(tokenString, a.keyFunc)
+	if err != nil {
+		return 0, 0, err
+	}
+	if !token.Valid {
+		return 0, 0, errors.New("invalid token")
+	}
+
+	// sub and userId must agree
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok {
+		return 0, 0, errors.New("invalid claims")
+	}
+	userId, ok := claims["userId"].(float64)
+	if !ok {
+		return 0, 0, errors.New("missing userId claim")
+	}
+	sub, err := claims.GetSubject()
+	if err != nil || sub != strconv.Itoa(int(userId)) {
+		return 0, 0, errors.New("subject doesn't match userId")
+	}
+	// tokens from before versions were added have none
+	version, _ := claims["ver"].(float64)
+	return int(userId), int(version), nil
+}
+
+func (a *TokenAuth) keyFunc(token *jwt.Token) (interface{}, error) {
+	// hmac tokens are checked with the secret
+	if _, ok := token.Method.(*jwt.SigningMethodHMAC); ok {
+		if len(a.secret) == 0 && a.signingKey != nil {
+			return nil, errors.New("hmac tokens are disabled")
+		}
+		if len(a.previousSecrets) == 0 {
+			return a.secret, nil
+		}
+		keys := jwt.VerificationKeySet{Keys: []jwt.VerificationKey{a.secret}}
+		for _, secret := range a.previousSecrets {
+			keys.Keys = append(keys.Keys, secret)
+		}
+		return keys, nil
+	}
+
+	// asymmetric tokens need a known kid with a matching algorithm
+	kid, _ := token.Header["kid"].(string)
+	key, ok := a.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown key id: %q", kid)
+	}
+	if token.Method.Alg() != key.method.Alg() {
+		return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+	}
+	return key.public, nil
+}
+
+// JWKS returns the public keys that verify tokens
+func (a *TokenAuth) JWKS() types.JWKSJSON {
+	jwks := types.JWKSJSON{Keys: []types.JWKJSON{}}
+	for _, key := range a.keys {
+		jwk := toJWK(key)
+		jwk.Kid = key.id
+		jwk.Use = "sig"
+		jwk.Alg = key.method.Alg()
+		jwks.Keys = append(jwks.Keys, jwk)
+	}
+	return jwks
+}
+
+// toJWK returns the required members only, in thumbprint order
+func toJWK(key *tokenKey) types.JWKJSON {
+	switch k := key.public.(type) {
+	case *rsa.PublicKey:
+		return types.JWKJSON{
+			E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(k.E)).Bytes()),
+			Kty: "RSA",
+			N:   base64.RawURLEncoding.EncodeToString(k.N.Bytes()),
+		}
+	case *ecdsa.PublicKey:
+		size := (k.Curve.Params().BitSize + 7) / 8
+		return types.JWKJSON{
+			Crv: k.Curve.Params().Name,
+			Kty: "EC",
+			X:   base64.RawURLEncoding.EncodeToString(k.X.FillBytes(make([]byte, size))),
+			Y:   base64.RawURLEncoding.EncodeToString(k.Y.FillBytes(make([]byte, size))),
+		}
+	}
+	return types.JWKJSON{}
+}
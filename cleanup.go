@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"log"
+	"os"
+	"time"
+
+	"example/gochat/secrets"
+	"example/gochat/server"
+	"example/gochat/storage"
+)
+
+// cleanup runs `gochat cleanup`, which applies the retention rules once
+// and exits so it can run from cron. It opens the same storage as the
+// server with the same settings
+func cleanup(args []string) error {
+	config, err := server.NewConfigLoader(os.Getenv("CONFIG_FILE"))
+	if err != nil {
+		return err
+	}
+	flags := flag.NewFlagSet("cleanup", flag.ExitOnError)
+	dryRun := flags.Bool("dry-run", false, "count what would be deleted without deleting it")
+	messageDays := flags.Int("message-days", config.Get().Retention.MessageDays, "days of messages to keep, 0 keeps them forever")
+	outboxDays := flags.Int("outbox-days", 7, "days of outbox events to keep, 0 keeps them forever")
+	flags.Parse(args)
+	if *messageDays < 0 || *outboxDays < 0 {
+		return errors.New("message-days and outbox-days can't be negative")
+	}
+
+	provider := secrets.FromEnv()
+	dsn, err := secrets.Lookup(context.Background(), provider, "DATABASE_URL", storage.DefaultDSN)
+	if err != nil {
+		return err
+	}
+	readDsns, err := secrets.Lookup(context.Background(), provider, "DATABASE_READ_URLS", "")
+	if err != nil {
+		return err
+	}
+	store, err := openStore(os.Getenv("STORAGE_DRIVER"), dsn, readDsns)
+	if err != nil {
+		return err
+	}
+
+	// days counted back from now
+	now := time.Now()
+	rules := storage.Retention{}
+	if *messageDays > 0 {
+		rules.MessagesBefore = now.AddDate(0, 0, -*messageDays)
+	}
+	if *outboxDays > 0 {
+		rules.OutboxBefore = now.AddDate(0, 0, -*outboxDays)
+	}
+	report, err := store.Cleanup(context.Background(), rules, *dryRun)
+	if err != nil {
+		return err
+	}
+	verb := "deleted"
+	if *dryRun {
+		verb = "would delete"
+	}
+	log.Printf("cleanup: %s %d messages, %d outbox events, %d orphaned chat images", verb, report.Messages, report.OutboxEvents, report.ChatImages)
+	return nil
+}
@@ -0,0 +1,453 @@
+// gochatctl manages a gochat server through its admin api
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"example/gochat/types"
+)
+
+const usage = `usage: gochatctl [flags] <command> [args]
+
+commands:
+  login EMAIL PASSWORD     print a token for GOCHAT_TOKEN
+  stats                    server statistics
+  runtime                  goroutines, heap and gc of the server
+  list-users [QUERY]       all users, or those matching QUERY
+  set-role USER_ID ROLE    make a user user, moderator or admin
+  disable-user USER_ID     sign a user out and block their logins
+  enable-user USER_ID      let a disabled user log in again
+  reset-password USER_ID   print a new random password for a user
+  delete-user USER_ID      delete a user, their messages stay
+  create-bot USERNAME      create a bot account for an integration
+  add-bot BOT_ID CHAT_ID   add a bot to a chat
+  bot-tokens BOT_ID        a bot's api tokens
+  issue-token BOT_ID NAME SCOPE
+                           print a new read or send api token for a bot
+  revoke-token BOT_ID TOKEN_ID
+                           revoke an api token
+  delete-chat CHAT_ID      delete a chat and its messages
+  purge-chat ID [BEFORE]   delete a chat's messages, before an RFC3339 time
+  export-chat ID [FORMAT]  print a chat's messages as csv or json
+  audit                    recent admin actions
+  bans                     banned addresses
+  ban-ip IP                ban an address or cidr range
+  unban-ip IP              lift a ban
+  settings                 print the runtime config
+  set-settings FILE        replace the runtime config, - reads stdin
+  announce TEXT            broadcast an announcement
+
+the token is read from -token or GOCHAT_TOKEN, or a login is made with
+GOCHAT_EMAIL and GOCHAT_PASSWORD
+
+flags:
+`
+
+type client struct {
+	url   string
+	token string
+	http  *http.Client
+}
+
+// do sends a request with a json body and decodes the response into res,
+// or copies it there when res is a writer
+func (c *client) do(method string, path string, body any, res any) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, c.url+path, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// api errors are {"error": {"code": ..., "message": ...}}
+	if resp.StatusCode >= 400 {
+		apiErr := struct {
+			Error struct {
+				Code    string `json:"code"`
+				Message string `json:"message"`
+			} `json:"error"`
+		}{}
+		if err := json.NewDecoder(resp.Body).Decode(&apiErr); err != nil || apiErr.Error.Code == "" {
+			return fmt.Errorf("%s %s: %s", method, path, resp.Status)
+		}
+		return fmt.Errorf("%s: %s", apiErr.Error.Code, apiErr.Error.Message)
+	}
+	if res == nil || resp.StatusCode == http.StatusNoContent {
+		return nil
+	}
+	if w, ok := res.(io.Writer); ok {
+		_, err = io.Copy(w, resp.Body)
+		return err
+	}
+	return json.NewDecoder(resp.Body).Decode(res)
+}
+
+func (c *client) login(email string, password string) (string, error) {
+	res := types.UserJSON{}
+	if err := c.do("POST", "/api/login", types.LoginRequest{Email: email, Password: password}, &res); err != nil {
+		return "", err
+	}
+	return res.Token, nil
+}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		flag.PrintDefaults()
+	}
+	serverUrl := flag.String("url", env("GOCHAT_URL", "http://localhost:3000"), "server url, or GOCHAT_URL")
+	token := flag.String("token", os.Getenv("GOCHAT_TOKEN"), "admin token, or GOCHAT_TOKEN")
+	flag.Parse()
+	args := flag.Args()
+	if len(args) == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	c := &client{url: strings.TrimRight(*serverUrl, "/"), token: *token, http: &http.Client{Timeout: 30 * time.Second}}
+	if err := run(c, args[0], args[1:]); err != nil {
+		fmt.Fprintln(os.Stderr, "gochatctl:", err)
+		os.Exit(1)
+	}
+}
+
+func run(c *client, command string, args []string) error {
+	// every command but login needs a token
+	if command != "login" && c.token == "" {
+		email, password := os.Getenv("GOCHAT_EMAIL"), os.Getenv("GOCHAT_PASSWORD")
+		if email == "" || password == "" {
+			return errors.New("not logged in: set GOCHAT_TOKEN, or GOCHAT_EMAIL and GOCHAT_PASSWORD")
+		}
+		token, err := c.login(email, password)
+		if err != nil {
+			return fmt.Errorf("login: %w", err)
+		}
+		c.token = token
+	}
+
+	switch command {
+	case "login":
+		if err := wantArgs(args, "EMAIL", "PASSWORD"); err != nil {
+			return err
+		}
+		token, err := c.login(args[0], args[1])
+		if err != nil {
+			return err
+		}
+		fmt.Println(token)
+		return nil
+
+	case "stats":
+		stats := types.StatsJSON{}
+		if err := c.do("GET", "/api/admin/stats", nil, &stats); err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintf(w, "users\t%d\n", stats.Users)
+		fmt.Fprintf(w, "chats\t%d\n", stats.Chats)
+		fmt.Fprintf(w, "active chats\t%d\n", stats.ActiveChats)
+		fmt.Fprintf(w, "messages\t%d\n", stats.Messages)
+		fmt.Fprintf(w, "storage\t%d bytes\n", stats.StorageBytes)
+		fmt.Fprintf(w, "connections\t%d\n", stats.Connections)
+		return w.Flush()
+
+	case "runtime":
+		rt := types.RuntimeJSON{}
+		if err := c.do("GET", "/api/admin/runtime", nil, &rt); err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintf(w, "go\t%s\n", rt.GoVersion)
+		fmt.Fprintf(w, "uptime\t%s\n", rt.Uptime)
+		fmt.Fprintf(w, "goroutines\t%d\n", rt.Goroutines)
+		fmt.Fprintf(w, "heap\t%d bytes in use, %d objects\n", rt.HeapInuse, rt.HeapObjects)
+		fmt.Fprintf(w, "sys\t%d bytes\n", rt.Sys)
+		fmt.Fprintf(w, "gc\t%d runs, %s paused\n", rt.NumGC, time.Duration(rt.PauseTotalNs))
+		fmt.Fprintf(w, "ws compression\t%d bytes sent for %d, ratio %.2f\n", rt.CompressedWireBytes, rt.CompressedPayloadBytes, rt.CompressionRatio)
+		return w.Flush()
+
+	case "list-users":
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tUSERNAME\tEMAIL\tROLE\tCHATS\tDISABLED")
+
+		// follow the cursor to the last page
+		query := ""
+		if len(args) > 0 {
+			query = "&q=" + url.QueryEscape(args[0])
+		}
+		cursor := ""
+		for {
+			page := types.ListJSON[types.AdminUserJSON]{}
+			if err := c.do("GET", "/api/admin/users?limit=200&cursor="+cursor+query, nil, &page); err != nil {
+				return err
+			}
+			for _, u := range page.Data {
+				fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%d\t%t\n", u.Id, u.Username, u.Email, u.Role, len(u.Chats), u.Disabled)
+			}
+			if page.NextCursor == "" {
+				break
+			}
+			cursor = page.NextCursor
+		}
+		return w.Flush()
+
+	case "set-role":
+		if err := wantArgs(args, "USER_ID", "ROLE"); err != nil {
+			return err
+		}
+		id, err := strconv.Atoi(args[0])
+		if err != nil {
+			return fmt.Errorf("invalid user id %q", args[0])
+		}
+		return c.do("PUT", fmt.Sprintf("/api/admin/users/%d/role", id), types.RoleRequest{Role: args[1]}, nil)
+
+	case "disable-user", "enable-user", "reset-password", "delete-user":
+		if err := wantArgs(args, "USER_ID"); err != nil {
+			return err
+		}
+		id, err := strconv.Atoi(args[0])
+		if err != nil {
+			return fmt.Errorf("invalid user id %q", args[0])
+		}
+		switch command {
+		case "disable-user", "enable-user":
+			req := types.DisableUserRequest{Disabled: command == "disable-user"}
+			return c.do("PUT", fmt.Sprintf("/api/admin/users/%d/disabled", id), req, nil)
+		case "reset-password":
+			res := types.PasswordResetJSON{}
+			if err := c.do("POST", fmt.Sprintf("/api/admin/users/%d/password-reset", id), nil, &res); err != nil {
+				return err
+			}
+			fmt.Println(res.TemporaryPassword)
+			return nil
+		}
+		return c.do("DELETE", fmt.Sprintf("/api/admin/users/%d", id), nil, nil)
+
+	case "create-bot":
+		if err := wantArgs(args, "USERNAME"); err != nil {
+			return err
+		}
+		bot := types.AdminUserJSON{}
+		if err := c.do("POST", "/api/admin/bots", types.CreateBotRequest{Username: args[0]}, &bot); err != nil {
+			return err
+		}
+		fmt.Printf("created bot %d\n", bot.Id)
+		return nil
+
+	case "add-bot", "bot-tokens", "issue-token", "revoke-token":
+		if len(args) == 0 {
+			return errors.New("expected BOT_ID and the command's arguments")
+		}
+		id, err := strconv.Atoi(args[0])
+		if err != nil {
+			return fmt.Errorf("invalid bot id %q", args[0])
+		}
+		path := fmt.Sprintf("/api/admin/bots/%d", id)
+		switch command {
+		case "add-bot":
+			if err = wantArgs(args, "BOT_ID", "CHAT_ID"); err != nil {
+				return err
+			}
+			chatId, err := strconv.Atoi(args[1])
+			if err != nil {
+				return fmt.Errorf("invalid chat id %q", args[1])
+			}
+			return c.do("POST", path+"/chats", types.JoinChatRequest{Id: chatId}, nil)
+		case "bot-tokens":
+			if err = wantArgs(args, "BOT_ID"); err != nil {
+				return err
+			}
+			page := types.ListJSON[types.APITokenJSON]{}
+			if err = c.do("GET", path+"/tokens", nil, &page); err != nil {
+				return err
+			}
+			w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+			fmt.Fprintln(w, "ID\tNAME\tSCOPE\tCREATED")
+			for _, t := range page.Data {
+				fmt.Fprintf(w, "%d\t%s\t%s\t%s\n", t.Id, t.Name, t.Scope, t.CreatedAt.Format(time.RFC3339))
+			}
+			return w.Flush()
+		case "issue-token":
+			if err = wantArgs(args, "BOT_ID", "NAME", "SCOPE"); err != nil {
+				return err
+			}
+			token := types.APITokenJSON{}
+			if err = c.do("POST", path+"/tokens", types.CreateAPITokenRequest{Name: args[1], Scope: args[2]}, &token); err != nil {
+				return err
+			}
+			fmt.Println(token.Token)
+			return nil
+		}
+		if err = wantArgs(args, "BOT_ID", "TOKEN_ID"); err != nil {
+			return err
+		}
+		tokenId, err := strconv.Atoi(args[1])
+		if err != nil {
+			return fmt.Errorf("invalid token id %q", args[1])
+		}
+		return c.do("DELETE", fmt.Sprintf("%s/tokens/%d", path, tokenId), nil, nil)
+
+	case "delete-chat":
+		if err := wantArgs(args, "CHAT_ID"); err != nil {
+			return err
+		}
+		id, err := strconv.Atoi(args[0])
+		if err != nil {
+			return fmt.Errorf("invalid chat id %q", args[0])
+		}
+		return c.do("DELETE", fmt.Sprintf("/api/admin/chats/%d", id), nil, nil)
+
+	case "purge-chat":
+		if len(args) < 1 || len(args) > 2 {
+			return errors.New("expected CHAT_ID and optionally BEFORE")
+		}
+		id, err := strconv.Atoi(args[0])
+		if err != nil {
+			return fmt.Errorf("invalid chat id %q", args[0])
+		}
+		req := types.PurgeRequest{}
+		if len(args) == 2 {
+			req.Before = args[1]
+		}
+		res := types.PurgeJSON{}
+		if err = c.do("POST", fmt.Sprintf("/api/admin/chats/%d/purge", id), req, &res); err != nil {
+			return err
+		}
+		fmt.Printf("deleted %d messages\n", res.Deleted)
+		return nil
+
+	case "export-chat":
+		if len(args) < 1 || len(args) > 2 {
+			return errors.New("expected CHAT_ID and optionally FORMAT")
+		}
+		id, err := strconv.Atoi(args[0])
+		if err != nil {
+			return fmt.Errorf("invalid chat id %q", args[0])
+		}
+		path := fmt.Sprintf("/api/admin/chats/%d/export", id)
+		if len(args) == 2 {
+			path += "?format=" + url.QueryEscape(args[1])
+		}
+		// long chats take longer than the usual timeout
+		c.http.Timeout = 0
+		return c.do("GET", path, nil, os.Stdout)
+
+	case "audit":
+		page := types.ListJSON[types.AuditEntryJSON]{}
+		if err := c.do("GET", "/api/admin/audit", nil, &page); err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "TIME\tACTOR\tACTION\tCHAT\tDATA")
+		for _, e := range page.Data {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\n", e.CreatedAt.Format(time.RFC3339), e.Actor.Username, e.Action, e.ChatId, e.Data)
+		}
+		return w.Flush()
+
+	case "bans", "ban-ip", "unban-ip":
+		banned := []string{}
+		var err error
+		switch command {
+		case "bans":
+			err = c.do("GET", "/api/admin/bans", nil, &banned)
+		case "ban-ip":
+			if err = wantArgs(args, "IP"); err == nil {
+				err = c.do("POST", "/api/admin/bans", types.BanRequest{Ip: args[0]}, &banned)
+			}
+		case "unban-ip":
+			if err = wantArgs(args, "IP"); err == nil {
+				err = c.do("DELETE", "/api/admin/bans?ip="+url.QueryEscape(args[0]), nil, &banned)
+			}
+		}
+		if err != nil {
+			return err
+		}
+		for _, ip := range banned {
+			fmt.Println(ip)
+		}
+		return nil
+
+	case "settings", "set-settings":
+		var settings json.RawMessage
+		var err error
+		if command == "settings" {
+			err = c.do("GET", "/api/admin/settings", nil, &settings)
+		} else {
+			if err = wantArgs(args, "FILE"); err != nil {
+				return err
+			}
+			var data []byte
+			if args[0] == "-" {
+				data, err = io.ReadAll(os.Stdin)
+			} else {
+				data, err = os.ReadFile(args[0])
+			}
+			if err != nil {
+				return err
+			}
+			if !json.Valid(data) {
+				return fmt.Errorf("%s: not valid json", args[0])
+			}
+			err = c.do("PUT", "/api/admin/settings", json.RawMessage(data), &settings)
+		}
+		if err != nil {
+			return err
+		}
+		out := bytes.Buffer{}
+		if err = json.Indent(&out, settings, "", "  "); err != nil {
+			return err
+		}
+		fmt.Println(out.String())
+		return nil
+
+	case "announce":
+		if len(args) == 0 {
+			return errors.New("usage: announce TEXT")
+		}
+		return c.do("POST", "/api/admin/announcements", types.AnnouncementRequest{Text: strings.Join(args, " ")}, nil)
+	}
+	return fmt.Errorf("unknown command %q, run gochatctl -h for the list", command)
+}
+
+// wantArgs checks that a command got exactly the named arguments
+func wantArgs(args []string, names ...string) error {
+	if len(args) != len(names) {
+		return fmt.Errorf("expected %d arguments: %s", len(names), strings.Join(names, " "))
+	}
+	return nil
+}
+
+func env(name string, fallback string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return fallback
+}
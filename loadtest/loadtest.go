@@ -0,0 +1,319 @@
+// Package loadtest drives a running gochat server with simulated users
+// and reports the latency of each kind of request
+package loadtest
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"example/gochat/types"
+)
+
+type Config struct {
+	URL      string
+	Users    int
+	Chats    int
+	Rate     float64 // messages per second across all users
+	Duration time.Duration
+}
+
+// Main runs `gochat loadtest`
+func Main(args []string) error {
+	config := Config{}
+	flags := flag.NewFlagSet("loadtest", flag.ExitOnError)
+	flags.StringVar(&config.URL, "url", "http://localhost:3000", "server to test")
+	flags.IntVar(&config.Users, "users", 50, "simulated users")
+	flags.IntVar(&config.Chats, "chats", 5, "chats the users are spread over")
+	flags.Float64Var(&config.Rate, "rate", 20, "messages per second")
+	flags.DurationVar(&config.Duration, "duration", 30*time.Second, "how long to send messages")
+	flags.Parse(args)
+	if config.Users < 1 || config.Chats < 1 || config.Rate <= 0 || config.Duration <= 0 {
+		return errors.New("users, chats, rate and duration must be positive")
+	}
+
+	// stopping early still prints the report
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	report, err := Run(ctx, config)
+	if report != nil {
+		report.Print(os.Stdout)
+	}
+	return err
+}
+
+type user struct {
+	token string
+	chat  int
+}
+
+type runner struct {
+	config   Config
+	http     *http.Client
+	recorder *recorder
+}
+
+// Run registers the users, spreads them over new chats and sends
+// messages at the configured rate until the duration is over
+func Run(ctx context.Context, config Config) (*Report, error) {
+	config.URL = strings.TrimRight(config.URL, "/")
+	r := &runner{
+		config:   config,
+		http:     &http.Client{Timeout: 30 * time.Second},
+		recorder: newRecorder(),
+	}
+
+	// unique names so runs can be repeated against the same server
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return nil, err
+	}
+	runId := hex.EncodeToString(suffix)
+
+	// register
+	users := make([]*user, config.Users)
+	r.parallel(ctx, config.Users, func(i int) {
+		name := fmt.Sprintf("lt%s-%d", runId, i)
+		res := types.UserJSON{}
+		if r.request(ctx, "register", "", "POST", "/api/register", types.RegisterRequest{Username: name, Email: name + "@loadtest.invalid", Password: "loadtest-" + runId}, &res) == nil {
+			users[i] = &user{token: res.Token}
+		}
+	})
+	active := []*user{}
+	for _, u := range users {
+		if u != nil {
+			active = append(active, u)
+		}
+	}
+	if len(active) == 0 {
+		return r.recorder.report(), errors.New("no user could register")
+	}
+
+	// the first user creates the chats
+	chats := []int{}
+	for i := 0; i < config.Chats && ctx.Err() == nil; i++ {
+		chat := types.ChatJSON{}
+		req := types.CreateChatRequest{Name: fmt.Sprintf("loadtest %s %d", runId, i), Visibility: types.VisibilityPrivate}
+		if r.request(ctx, "create_chat", active[0].token, "POST", "/api/chats/create", req, &chat) == nil {
+			chats = append(chats, chat.Id)
+		}
+	}
+	if len(chats) == 0 {
+		return r.recorder.report(), errors.New("no chat could be created")
+	}
+
+	// everyone else joins one of them
+	r.parallel(ctx, len(active), func(i int) {
+		u := active[i]
+		u.chat = chats[i%len(chats)]
+		if i == 0 {
+			return
+		}
+		r.request(ctx, "join", u.token, "POST", fmt.Sprintf("/api/chats/%d", u.chat), types.JoinChatRequest{Id: u.chat}, nil)
+	})
+
+	// send at the target rate, users take turns
+	start := time.Now()
+	ticker := time.NewTicker(time.Duration(float64(time.Second) / config.Rate))
+	defer ticker.Stop()
+	deadline := time.NewTimer(config.Duration)
+	defer deadline.Stop()
+	wg := sync.WaitGroup{}
+	for i := 0; ; i++ {
+		select {
+		case <-ctx.Done():
+		case <-deadline.C:
+		case <-ticker.C:
+			u := active[i%len(active)]
+			wg.Add(1)
+			go func(n int) {
+				defer wg.Done()
+				msg := types.SendMessageRequest{Text: fmt.Sprintf("load test message %d", n)}
+				r.request(ctx, "send", u.token, "POST", fmt.Sprintf("/api/chats/%d/messages", u.chat), msg, nil)
+			}(i)
+			continue
+		}
+		break
+	}
+	wg.Wait()
+
+	report := r.recorder.report()
+	report.SendDuration = time.Since(start)
+	return report, ctx.Err()
+}
+
+// parallel calls fn for 0..n-1 with a bounded number of requests in flight
+func (r *runner) parallel(ctx context.Context, n int, fn func(int)) {
+	sem := make(chan struct{}, 16)
+	wg := sync.WaitGroup{}
+	for i := 0; i < n && ctx.Err() == nil; i++ {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(i int) {
+			defer func() { <-sem; wg.Done() }()
+			fn(i)
+		}(i)
+	}
+	wg.Wait()
+}
+
+// request sends one api request and records how long it took
+func (r *runner) request(ctx context.Context, op string, token string, method string, path string, body any, res any) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, method, r.config.URL+path, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	start := time.Now()
+	resp, err := r.http.Do(req)
+	if err != nil {
+		if ctx.Err() == nil {
+			r.recorder.fail(op, "network")
+		}
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		io.Copy(io.Discard, resp.Body)
+		r.recorder.fail(op, resp.Status)
+		return fmt.Errorf("%s %s: %s", method, path, resp.Status)
+	}
+	if res != nil {
+		err = json.NewDecoder(resp.Body).Decode(res)
+	} else {
+		_, err = io.Copy(io.Discard, resp.Body)
+	}
+	if err != nil {
+		r.recorder.fail(op, "bad response")
+		return err
+	}
+	r.recorder.record(op, time.Since(start))
+	return nil
+}
+
+type recorder struct {
+	mu        sync.Mutex
+	ops       []string
+	latencies map[string][]time.Duration
+	errors    map[string]map[string]int
+}
+
+func newRecorder() *recorder {
+	return &recorder{latencies: map[string][]time.Duration{}, errors: map[string]map[string]int{}}
+}
+
+func (r *recorder) add(op string) {
+	if _, ok := r.errors[op]; !ok {
+		r.ops = append(r.ops, op)
+		r.errors[op] = map[string]int{}
+	}
+}
+
+func (r *recorder) record(op string, d time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.add(op)
+	r.latencies[op] = append(r.latencies[op], d)
+}
+
+func (r *recorder) fail(op string, reason string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.add(op)
+	r.errors[op][reason]++
+}
+
+type OpReport struct {
+	Name   string
+	Ok     int
+	Errors map[string]int
+	P50    time.Duration
+	P90    time.Duration
+	P99    time.Duration
+	Max    time.Duration
+}
+
+type Report struct {
+	Ops          []OpReport
+	SendDuration time.Duration
+}
+
+func (r *recorder) report() *Report {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	report := &Report{}
+	for _, op := range r.ops {
+		latencies := r.latencies[op]
+		sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+		report.Ops = append(report.Ops, OpReport{
+			Name:   op,
+			Ok:     len(latencies),
+			Errors: r.errors[op],
+			P50:    percentile(latencies, 50),
+			P90:    percentile(latencies, 90),
+			P99:    percentile(latencies, 99),
+			Max:    percentile(latencies, 100),
+		})
+	}
+	return report
+}
+
+// percentile uses the nearest rank of the sorted latencies
+func percentile(sorted []time.Duration, p int) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := (p*len(sorted) + 99) / 100
+	return sorted[max(rank, 1)-1]
+}
+
+func (r *Report) Print(w io.Writer) {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "op\tok\terrors\tp50\tp90\tp99\tmax\t")
+	for _, op := range r.Ops {
+		failed := 0
+		for _, n := range op.Errors {
+			failed += n
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%s\t%s\t%s\t%s\t\n", op.Name, op.Ok, failed, ms(op.P50), ms(op.P90), ms(op.P99), ms(op.Max))
+	}
+	tw.Flush()
+
+	// achieved rate and what went wrong
+	for _, op := range r.Ops {
+		if op.Name == "send" && r.SendDuration > 0 {
+			fmt.Fprintf(w, "\nsent %.1f messages/s\n", float64(op.Ok)/r.SendDuration.Seconds())
+		}
+	}
+	for _, op := range r.Ops {
+		for reason, n := range op.Errors {
+			fmt.Fprintf(w, "%s: %d x %s\n", op.Name, n, reason)
+		}
+	}
+}
+
+func ms(d time.Duration) string {
+	return fmt.Sprintf("%.1fms", float64(d)/float64(time.Millisecond))
+}
@@ -1,16 +1,384 @@
 package main
 
-import "log"
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+	// time zone database for hosts without one
+	_ "time/tzdata"
+
+	"example/gochat/auth"
+	"example/gochat/loadtest"
+	"example/gochat/secrets"
+	"example/gochat/server"
+	"example/gochat/storage"
+)
 
 func main() {
-	store, err := NewPostgresStore()
+	// subcommands, anything else starts the server
+	if len(os.Args) > 1 && os.Args[1] == "loadtest" {
+		if err := loadtest.Main(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "cleanup" {
+		if err := cleanup(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	config, err := server.NewConfigLoader(os.Getenv("CONFIG_FILE"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	go config.WatchSignals()
+
+	// credentials come from the environment, *_FILE, SECRETS_DIR or vault
+	provider := secrets.FromEnv()
+	dsn, err := secrets.Lookup(context.Background(), provider, "DATABASE_URL", storage.DefaultDSN)
+	if err != nil {
+		log.Fatal(err)
+	}
+	readDsns, err := secrets.Lookup(context.Background(), provider, "DATABASE_READ_URLS", "")
+	if err != nil {
+		log.Fatal(err)
+	}
+	jwtSecret, err := secrets.Lookup(context.Background(), provider, "JWT_SECRET", "")
+	if err != nil {
+		log.Fatal(err)
+	}
+	previousSecrets, err := secrets.Lookup(context.Background(), provider, "JWT_PREVIOUS_SECRETS", "")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// settings are all checked before starting so every mistake is
+	// reported at once
+	problems := []string{}
+	fail := func(format string, args ...any) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	// token signing, an asymmetric key enables the jwks endpoint
+	tokens := auth.NewTokenAuth(jwtSecret)
+	for _, secret := range strings.Split(previousSecrets, ",") {
+		tokens.AddPreviousSecret(strings.TrimSpace(secret))
+	}
+	if issuer := os.Getenv("JWT_ISSUER"); issuer != "" {
+		tokens.Issuer = issuer
+	}
+	if audience := os.Getenv("JWT_AUDIENCE"); audience != "" {
+		tokens.Audience = audience
+	}
+	if leeway := os.Getenv("JWT_LEEWAY"); leeway != "" {
+		d, err := time.ParseDuration(leeway)
+		if err != nil || d < 0 {
+			fail("JWT_LEEWAY: must be a duration like 30s, got %q", leeway)
+		}
+		tokens.Leeway = d
+	}
+	if lifetime := os.Getenv("JWT_LIFETIME"); lifetime != "" {
+		d, err := time.ParseDuration(lifetime)
+		if err != nil || d < 0 {
+			fail("JWT_LIFETIME: must be a duration like 24h, got %q", lifetime)
+		}
+		tokens.Lifetime = d
+	}
+	if keyFile := os.Getenv("JWT_SIGNING_KEY_FILE"); keyFile != "" {
+		if err := tokens.LoadSigningKey(keyFile); err != nil {
+			fail("JWT_SIGNING_KEY_FILE: %v", err)
+		}
+	}
+	if keyFiles := os.Getenv("JWT_VERIFY_KEY_FILES"); keyFiles != "" {
+		for _, keyFile := range strings.Split(keyFiles, ",") {
+			if err := tokens.LoadVerifyKey(keyFile); err != nil {
+				fail("JWT_VERIFY_KEY_FILES: %v", err)
+			}
+		}
+	}
+
+	if err := tokens.Validate(); err != nil {
+		fail("JWT_SECRET: %v; set a random secret of at least %d characters, e.g. from `openssl rand -hex 32`, or JWT_SIGNING_KEY_FILE", err, auth.MinSecretLength)
+	}
+
+	// optional features need all of their settings
+	if os.Getenv("TLS_CERT_FILE") != "" && os.Getenv("TLS_KEY_FILE") == "" {
+		fail("TLS_KEY_FILE: required when TLS_CERT_FILE is set")
+	}
+	if os.Getenv("WEBAUTHN_RP_ID") != "" && os.Getenv("WEBAUTHN_ORIGINS") == "" {
+		fail("WEBAUTHN_ORIGINS: required when WEBAUTHN_RP_ID is set, e.g. https://chat.example.com")
+	}
+	if os.Getenv("APNS_KEY_FILE") != "" {
+		for _, name := range []string{"APNS_KEY_ID", "APNS_TEAM_ID", "APNS_TOPIC"} {
+			if os.Getenv(name) == "" {
+				fail("%s: required when APNS_KEY_FILE is set", name)
+			}
+		}
+	}
+	// connection and request timeouts, 0 turns one off
+	timeouts := server.DefaultTimeouts()
+	for _, setting := range []struct {
+		name  string
+		value *time.Duration
+	}{
+		{"HTTP_READ_TIMEOUT", &timeouts.Read},
+		{"HTTP_WRITE_TIMEOUT", &timeouts.Write},
+		{"HTTP_IDLE_TIMEOUT", &timeouts.Idle},
+		{"HTTP_HANDLER_TIMEOUT", &timeouts.Handler},
+	} {
+		if value := os.Getenv(setting.name); value != "" {
+			d, err := time.ParseDuration(value)
+			if err != nil || d < 0 {
+				fail("%s: must be a duration like 30s, got %q", setting.name, value)
+			}
+			*setting.value = d
+		}
+	}
+	if timeouts.Write > 0 && timeouts.Handler >= timeouts.Write {
+		fail("HTTP_HANDLER_TIMEOUT: must be shorter than HTTP_WRITE_TIMEOUT (%s) so the 504 can still be written", timeouts.Write)
+	}
+	driver := os.Getenv("STORAGE_DRIVER")
+	if driver != "" && driver != "postgres" && driver != "bolt" {
+		fail("STORAGE_DRIVER: must be postgres or bolt, got %q", driver)
+	}
+	broker := os.Getenv("EVENT_BROKER")
+	if broker != "" && broker != "postgres" {
+		fail("EVENT_BROKER: must be postgres, got %q", broker)
+	}
+	if broker == "postgres" && driver == "bolt" {
+		fail("EVENT_BROKER: postgres needs STORAGE_DRIVER=postgres")
+	}
+	stream := os.Getenv("EVENT_STREAM")
+	if stream != "" && stream != "nats" && stream != "kafka" {
+		fail("EVENT_STREAM: must be nats or kafka, got %q", stream)
+	}
+	streamUrl, err := secrets.Lookup(context.Background(), provider, "EVENT_STREAM_URL", "")
+	if err != nil {
+		log.Fatal(err)
+	}
+	if stream != "" && streamUrl == "" {
+		fail("EVENT_STREAM_URL: required when EVENT_STREAM is set, e.g. nats://localhost:4222 or the kafka rest proxy http://localhost:8082")
+	}
+	// logins checked against a directory
+	authBackend := os.Getenv("AUTH_BACKEND")
+	if authBackend != "" && authBackend != "local" && authBackend != "ldap" {
+		fail("AUTH_BACKEND: must be local or ldap, got %q", authBackend)
+	}
+	ldapBindPassword, err := secrets.Lookup(context.Background(), provider, "LDAP_BIND_PASSWORD", "")
 	if err != nil {
 		log.Fatal(err)
 	}
-	if err = store.Init(); err != nil {
+	var ldapAuth *server.LDAPAuth
+	if authBackend == "ldap" {
+		ldapAuth, err = server.NewLDAPAuth(server.LDAPConfig{
+			Url:             os.Getenv("LDAP_URL"),
+			StartTLS:        os.Getenv("LDAP_START_TLS") == "true",
+			BindDN:          os.Getenv("LDAP_BIND_DN"),
+			BindPassword:    ldapBindPassword,
+			BaseDN:          os.Getenv("LDAP_BASE_DN"),
+			UserFilter:      os.Getenv("LDAP_USER_FILTER"),
+			UsernameAttr:    os.Getenv("LDAP_USERNAME_ATTR"),
+			EmailAttr:       os.Getenv("LDAP_EMAIL_ATTR"),
+			DisplayNameAttr: os.Getenv("LDAP_DISPLAY_NAME_ATTR"),
+			Workspace:       os.Getenv("LDAP_WORKSPACE"),
+		})
+		if err != nil {
+			fail("LDAP_URL, LDAP_BASE_DN or LDAP_USER_FILTER: %v", err)
+		}
+	}
+	// single sign-on with an openid connect provider
+	oidcClientSecret, err := secrets.Lookup(context.Background(), provider, "OIDC_CLIENT_SECRET", "")
+	if err != nil {
+		log.Fatal(err)
+	}
+	var oidcAuth *server.OIDCAuth
+	if issuer := os.Getenv("OIDC_ISSUER"); issuer != "" {
+		groupChats, err := server.ParseGroupChats(os.Getenv("OIDC_GROUP_CHATS"))
+		if err != nil {
+			fail("OIDC_GROUP_CHATS: %v", err)
+		}
+		oidcAuth, err = server.NewOIDCAuth(server.OIDCConfig{
+			Issuer:       issuer,
+			ClientId:     os.Getenv("OIDC_CLIENT_ID"),
+			ClientSecret: oidcClientSecret,
+			RedirectUrl:  os.Getenv("OIDC_REDIRECT_URL"),
+			GroupsClaim:  os.Getenv("OIDC_GROUPS_CLAIM"),
+			TrustEmail:   os.Getenv("OIDC_TRUST_EMAIL") == "true",
+			GroupChats:   groupChats,
+			Workspace:    os.Getenv("OIDC_WORKSPACE"),
+		})
+		if err != nil {
+			fail("OIDC_ISSUER, OIDC_CLIENT_ID or OIDC_REDIRECT_URL: %v", err)
+		}
+	}
+	// provisioning by identity providers over scim
+	scimToken, err := secrets.Lookup(context.Background(), provider, "SCIM_TOKEN", "")
+	if err != nil {
+		log.Fatal(err)
+	}
+	if scimToken != "" && len(scimToken) < auth.MinSecretLength {
+		fail("SCIM_TOKEN: must be at least %d characters, e.g. from `openssl rand -hex 32`", auth.MinSecretLength)
+	}
+	sentryDsn, err := secrets.Lookup(context.Background(), provider, "SENTRY_DSN", "")
+	if err != nil {
+		log.Fatal(err)
+	}
+	var reporter *server.SentryReporter
+	if sentryDsn != "" {
+		if reporter, err = server.NewSentryReporter(sentryDsn, os.Getenv("SENTRY_ENVIRONMENT")); err != nil {
+			fail("SENTRY_DSN: %v", err)
+		}
+	}
+	if len(problems) > 0 {
+		for _, problem := range problems {
+			log.Println("config error:", problem)
+		}
+		log.Fatalf("%d configuration errors, not starting", len(problems))
+	}
+
+	store, err := openStore(driver, dsn, readDsns)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err = server.BootstrapAdmins(context.Background(), store); err != nil {
 		log.Fatal(err)
 	}
 
-	server := NewApiServer(":3000", store)
-	server.Run()
+	// stop hitting the database after 5 failures in a row, probe it every 5s
+	breaker := storage.NewBreaker(5, 5*time.Second, store.Ping)
+	opts := []server.Option{
+		server.WithStorage(storage.NewBreakerStore(store, breaker)),
+		server.WithConfig(config),
+		server.WithAuth(tokens),
+		server.WithTimeouts(timeouts),
+	}
+
+	// several instances share their events through postgres
+	if broker == "postgres" {
+		b, err := storage.NewPostgresBroker(dsn)
+		if err != nil {
+			log.Fatalf("broker: can't connect: %v", err)
+		}
+		defer b.Close()
+		opts = append(opts, server.WithBroker(b))
+	}
+
+	// chat events for downstream systems
+	if stream != "" {
+		topic := os.Getenv("EVENT_STREAM_TOPIC")
+		if topic == "" {
+			topic = "gochat.events"
+		}
+		var es server.EventStream
+		if stream == "nats" {
+			es, err = server.NewNATSStream(streamUrl, topic)
+		} else {
+			es, err = server.NewKafkaRestStream(streamUrl, topic)
+		}
+		if err != nil {
+			log.Fatalf("EVENT_STREAM_URL: %v", err)
+		}
+		opts = append(opts, server.WithEventStream(es))
+	}
+
+	if ldapAuth != nil {
+		opts = append(opts, server.WithLDAP(ldapAuth))
+	}
+	if oidcAuth != nil {
+		opts = append(opts, server.WithOIDC(oidcAuth))
+	}
+	if scimToken != "" {
+		opts = append(opts, server.WithSCIM(scimToken, os.Getenv("SCIM_WORKSPACE")))
+	}
+
+	// panics and errors to sentry or a compatible tracker
+	if reporter != nil {
+		opts = append(opts, server.WithErrorReporter(reporter))
+	}
+
+	// serve https when a certificate is configured
+	if certFile := os.Getenv("TLS_CERT_FILE"); certFile != "" {
+		certs, err := server.NewCertReloader(certFile, os.Getenv("TLS_KEY_FILE"))
+		if err != nil {
+			log.Fatal(err)
+		}
+		go certs.Watch(time.Minute)
+		opts = append(opts, server.WithTLS(certs))
+	}
+	addr := os.Getenv("LISTEN_ADDR")
+	if addr == "" {
+		addr = ":3000"
+	}
+	srv := server.NewServer(addr, opts...)
+
+	// passkey login
+	if rpId := os.Getenv("WEBAUTHN_RP_ID"); rpId != "" {
+		if err := srv.EnablePasskeys(rpId, strings.Split(os.Getenv("WEBAUTHN_ORIGINS"), ",")); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// mobile push
+	if credentialsFile := os.Getenv("FCM_CREDENTIALS_FILE"); credentialsFile != "" {
+		fcm, err := server.NewFCMSender(credentialsFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		srv.AddPushSender(server.PlatformFCM, fcm)
+	}
+	if keyFile := os.Getenv("APNS_KEY_FILE"); keyFile != "" {
+		apns, err := server.NewAPNsSender(keyFile, os.Getenv("APNS_KEY_ID"), os.Getenv("APNS_TEAM_ID"), os.Getenv("APNS_TOPIC"), os.Getenv("APNS_SANDBOX") == "true")
+		if err != nil {
+			log.Fatal(err)
+		}
+		srv.AddPushSender(server.PlatformAPNs, apns)
+	}
+
+	// serve until interrupted, then finish running requests
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if err := srv.Start(ctx); err != nil {
+		log.Fatal(err)
+	}
+	log.Println("server stopped")
+}
+
+// openStore opens the storage of the driver and creates its tables
+func openStore(driver string, dsn string, readDsns string) (storage.Backend, error) {
+	// postgres by default, bolt keeps everything in one local file
+	var store storage.Backend
+	var err error
+	if driver == "bolt" {
+		path := os.Getenv("BOLT_PATH")
+		if path == "" {
+			path = "gochat.db"
+		}
+		if store, err = storage.NewBoltStore(path); err != nil {
+			return nil, fmt.Errorf("database: can't open: %v; check BOLT_PATH and that no other server has the file open", err)
+		}
+	} else if store, err = storage.NewPostgresStore(dsn, replicaDsns(readDsns)...); err != nil {
+		return nil, fmt.Errorf("database: can't connect: %v; check DATABASE_URL and that postgres is running", err)
+	}
+	if err = store.Init(context.Background()); err != nil {
+		return nil, fmt.Errorf("database: creating tables failed: %v; the database user needs create permissions", err)
+	}
+	return store, nil
+}
+
+// replicaDsns splits the comma separated DATABASE_READ_URLS
+func replicaDsns(value string) []string {
+	dsns := []string{}
+	for _, dsn := range strings.Split(value, ",") {
+		if dsn = strings.TrimSpace(dsn); dsn != "" {
+			dsns = append(dsns, dsn)
+		}
+	}
+	return dsns
 }
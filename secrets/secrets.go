@@ -0,0 +1,176 @@
+// Package secrets loads credentials from the environment, mounted secret
+// files or a vault server
+package secrets
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrNotFound is returned when a provider doesn't have the secret
+var ErrNotFound = errors.New("secret not found")
+
+// Provider looks up a secret by its name, e.g. JWT_SECRET
+type Provider interface {
+	Get(ctx context.Context, name string) (string, error)
+}
+
+// Env reads NAME from the environment, or the file NAME_FILE points to
+// as done for docker and kubernetes secrets
+type Env struct{}
+
+func (Env) Get(_ context.Context, name string) (string, error) {
+	if path := os.Getenv(name + "_FILE"); path != "" {
+		return readFile(path)
+	}
+	if value, ok := os.LookupEnv(name); ok {
+		return value, nil
+	}
+	return "", ErrNotFound
+}
+
+// Dir reads secrets from files named after the lowercased secret in a
+// directory, e.g. /run/secrets/jwt_secret
+type Dir string
+
+func (d Dir) Get(_ context.Context, name string) (string, error) {
+	value, err := readFile(filepath.Join(string(d), strings.ToLower(name)))
+	if errors.Is(err, os.ErrNotExist) {
+		return "", ErrNotFound
+	}
+	return value, err
+}
+
+func readFile(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	// editors and echo leave a trailing newline
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+// Vault reads the keys of one kv v2 secret, fetched once and cached
+type Vault struct {
+	addr   string
+	token  string
+	path   string
+	client *http.Client
+
+	once   sync.Once
+	values map[string]string
+	err    error
+}
+
+// NewVault reads secrets from the kv v2 secret at path, e.g.
+// secret/data/gochat, on the vault server at addr
+func NewVault(addr, token, path string) *Vault {
+	return &Vault{
+		addr:   strings.TrimRight(addr, "/"),
+		token:  token,
+		path:   strings.Trim(path, "/"),
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (v *Vault) Get(ctx context.Context, name string) (string, error) {
+	v.once.Do(func() { v.values, v.err = v.fetch(ctx) })
+	if v.err != nil {
+		return "", v.err
+	}
+	value, ok := v.values[name]
+	if !ok {
+		return "", ErrNotFound
+	}
+	return value, nil
+}
+
+func (v *Vault) fetch(ctx context.Context) (map[string]string, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", v.addr+"/v1/"+v.path, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Vault-Token", v.token)
+	res, err := v.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("vault: %w", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("vault: reading %s: %s", v.path, res.Status)
+	}
+
+	body := struct {
+		Data struct {
+			Data map[string]string `json:"data"`
+		} `json:"data"`
+	}{}
+	if err = json.NewDecoder(res.Body).Decode(&body); err != nil {
+		return nil, fmt.Errorf("vault: %w", err)
+	}
+	return body.Data.Data, nil
+}
+
+// Chain asks each provider in order and returns the first secret found
+type Chain []Provider
+
+func (c Chain) Get(ctx context.Context, name string) (string, error) {
+	for _, p := range c {
+		value, err := p.Get(ctx, name)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		return value, err
+	}
+	return "", ErrNotFound
+}
+
+// FromEnv returns the providers configured in the environment: the
+// environment itself, SECRETS_DIR when set and vault when VAULT_ADDR is set
+// (with VAULT_TOKEN and VAULT_SECRET_PATH, default secret/data/gochat)
+func FromEnv() Provider {
+	chain := Chain{Env{}}
+	if dir := os.Getenv("SECRETS_DIR"); dir != "" {
+		chain = append(chain, Dir(dir))
+	}
+	if addr := os.Getenv("VAULT_ADDR"); addr != "" {
+		path := os.Getenv("VAULT_SECRET_PATH")
+		if path == "" {
+			path = "secret/data/gochat"
+		}
+		token, err := Env{}.Get(context.Background(), "VAULT_TOKEN")
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			chain = append(chain, failing{err})
+			return chain
+		}
+		chain = append(chain, NewVault(addr, token, path))
+	}
+	return chain
+}
+
+// failing reports a provider that couldn't be set up on first use
+type failing struct{ err error }
+
+func (f failing) Get(context.Context, string) (string, error) {
+	return "", f.err
+}
+
+// Lookup returns the secret or fallback when no provider has it
+func Lookup(ctx context.Context, p Provider, name string, fallback string) (string, error) {
+	value, err := p.Get(ctx, name)
+	if errors.Is(err, ErrNotFound) {
+		return fallback, nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", name, err)
+	}
+	return value, nil
+}
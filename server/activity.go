@@ -0,0 +1,57 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+
+	"example/gochat/types"
+)
+
+// recordActivity adds an entry to the activity feed of the users,
+// failures are only logged
+func (s *Server) recordActivity(ctx context.Context, usersId []int, activityType string, chatId int, data any) {
+	if len(usersId) == 0 {
+		return
+	}
+	if err := s.store.AddActivity(ctx, usersId, activityType, chatId, data); err != nil {
+		s.logger.Printf("[%s] error: add %s activity failed: %v", requestId(ctx), activityType, err)
+	}
+}
+
+// handleActivity lists the caller's activity newest first
+func (s *Server) handleActivity(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		WriteError(w, errMethodNotAllowed(r.Method))
+		return
+	}
+
+	// get user from req context
+	user, ok := r.Context().Value(userContextKey).(*types.User)
+	if !ok {
+		WriteError(w, errNotAuthorized)
+		return
+	}
+
+	// get page, the cursor is the id of the last entry returned
+	cursor, limit, err := getPage(r)
+	if err != nil {
+		WriteError(w, errInvalidCursor)
+		return
+	}
+
+	// get activity
+	activity, err := s.store.GetActivity(r.Context(), user.Id, int64(cursor), limit)
+	if err != nil {
+		WriteError(w, errInternal)
+		s.logf(r, "error: get activity failed: %v", err)
+		return
+	}
+
+	// response
+	res := types.ListJSON[types.ActivityJSON]{Data: activity, Total: len(activity)}
+	if len(activity) == limit {
+		res.NextCursor = strconv.FormatInt(activity[len(activity)-1].Id, 10)
+	}
+	WriteJSON(w, http.StatusOK, res)
+}
@@ -0,0 +1,725 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"example/gochat/storage"
+	"example/gochat/types"
+)
+
+// roleMiddleware lets through users with at least the given global role
+func (s *Server) roleMiddleware(role string, next http.HandlerFunc) http.HandlerFunc {
+	return s.protectMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		// get user from req context
+		user, ok := r.Context().Value(userContextKey).(*types.User)
+		if !ok || !user.HasRole(role) {
+			WriteError(w, errForbidden)
+			return
+		}
+		next(w, r)
+	})
+}
+
+func (s *Server) adminMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return s.roleMiddleware(types.RoleAdmin, next)
+}
+
+func (s *Server) handleAdminStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		WriteError(w, errMethodNotAllowed(r.Method))
+		return
+	}
+
+	// get stats
+	stats, err := s.store.GetStats(r.Context())
+	if err != nil {
+		WriteError(w, errInternal)
+		s.logf(r, "error: get stats failed: %v", err)
+		return
+	}
+
+	stats.Connections = s.hub.Count()
+
+	// response
+	WriteJSON(w, http.StatusOK, stats)
+}
+
+func (s *Server) handleAdminAnnouncement(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		WriteError(w, errMethodNotAllowed(r.Method))
+		return
+	}
+
+	// get req
+	req := new(types.AnnouncementRequest)
+	json.NewDecoder(r.Body).Decode(req)
+	if req.Text == "" || len(req.Text) > 1000 {
+		WriteError(w, errInvalidAnnouncement)
+		return
+	}
+
+	// store announcement
+	announcement, err := s.store.CreateAnnouncement(r.Context(), req.Text)
+	if err != nil {
+		WriteError(w, errInternal)
+		s.logf(r, "error: create announcement failed: %v", err)
+		return
+	}
+
+	// push to connected clients of the workspace, those it reaches don't
+	// need it again on login
+	workspace, _ := storage.WorkspaceFrom(r.Context())
+	s.hub.Announce(workspace, announcement)
+
+	// response
+	WriteJSON(w, http.StatusCreated, announcement)
+}
+
+func (s *Server) handleAdminUserRole(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "PUT" {
+		WriteError(w, errMethodNotAllowed(r.Method))
+		return
+	}
+
+	// get user id
+	id, err := getUserId(r)
+	if err != nil {
+		WriteError(w, errUserNotFound)
+		return
+	}
+
+	// get admin from req context
+	admin, ok := r.Context().Value(userContextKey).(*types.User)
+	if !ok {
+		WriteError(w, errNotAuthorized)
+		return
+	}
+	if admin.Id == id {
+		WriteError(w, errOwnRole)
+		return
+	}
+
+	// get req
+	req := new(types.RoleRequest)
+	json.NewDecoder(r.Body).Decode(req)
+	if !types.ValidRole(req.Role) {
+		WriteError(w, errInvalidRole)
+		return
+	}
+
+	// update role
+	if err = s.store.UpdateUserRole(r.Context(), id, req.Role); err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			WriteError(w, errUserNotFound)
+			return
+		}
+		WriteError(w, errInternal)
+		s.logf(r, "error: update user role failed: %v", err)
+		return
+	}
+	by := types.AuthorJSON{Id: admin.Id, Username: admin.Username, DisplayName: admin.DisplayName}
+	s.recordActivity(r.Context(), []int{id}, types.ActivityRoleChanged, 0, map[string]any{"role": req.Role, "by": by})
+
+	// response
+	WriteJSON(w, http.StatusOK, req)
+}
+
+// handleAdminUsers lists every user or those whose username, email or
+// display name contain ?q=, ordered by id
+func (s *Server) handleAdminUsers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		WriteError(w, errMethodNotAllowed(r.Method))
+		return
+	}
+
+	// get page and query
+	cursor, limit, err := getPage(r)
+	if err != nil {
+		WriteError(w, errInvalidCursor)
+		return
+	}
+	q := strings.TrimSpace(r.URL.Query().Get("q"))
+	if len(q) > 300 {
+		WriteError(w, errInvalidSearch)
+		return
+	}
+
+	// get users
+	users, total, err := s.store.ListUsers(r.Context(), q, cursor, limit)
+	if err != nil {
+		WriteError(w, errInternal)
+		s.logf(r, "error: list users failed: %v", err)
+		return
+	}
+
+	// response
+	res := types.ListJSON[types.AdminUserJSON]{Data: []types.AdminUserJSON{}, Total: total}
+	for _, u := range users {
+		res.Data = append(res.Data, types.AdminUserJSON{Id: u.Id, Username: u.Username, Email: u.Email, Role: u.Role, TimeZone: u.TimeZone, Chats: u.Chats, Disabled: u.Disabled, Bot: u.Bot})
+	}
+	if len(users) == limit {
+		res.NextCursor = strconv.Itoa(users[len(users)-1].Id)
+	}
+	WriteJSON(w, http.StatusOK, res)
+}
+
+// adminTarget reads the user id of an admin request about another user,
+// admins can't act on their own account
+func adminTarget(w http.ResponseWriter, r *http.Request) (int, bool) {
+	id, err := getUserId(r)
+	if err != nil {
+		WriteError(w, errUserNotFound)
+		return 0, false
+	}
+	admin, ok := r.Context().Value(userContextKey).(*types.User)
+	if !ok {
+		WriteError(w, errNotAuthorized)
+		return 0, false
+	}
+	if admin.Id == id {
+		WriteError(w, errOwnAccount)
+		return 0, false
+	}
+	return id, true
+}
+
+// handleAdminUserDisabled disables a user, who is signed out everywhere
+// and can't log in, or enables them again
+func (s *Server) handleAdminUserDisabled(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "PUT" {
+		WriteError(w, errMethodNotAllowed(r.Method))
+		return
+	}
+
+	// get user id
+	id, ok := adminTarget(w, r)
+	if !ok {
+		return
+	}
+
+	// get req
+	req := new(types.DisableUserRequest)
+	json.NewDecoder(r.Body).Decode(req)
+
+	// update user
+	if err := s.store.SetUserDisabled(r.Context(), id, req.Disabled); err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			WriteError(w, errUserNotFound)
+			return
+		}
+		WriteError(w, errInternal)
+		s.logf(r, "error: set user disabled failed: %v", err)
+		return
+	}
+	if req.Disabled {
+		s.hub.Disconnect(id)
+	}
+
+	// response
+	WriteJSON(w, http.StatusOK, req)
+}
+
+// handleAdminPasswordReset replaces the password of a user with a random
+// one, for a compromised account. Their tokens are revoked and the admin
+// hands them the new password, which they can change
+func (s *Server) handleAdminPasswordReset(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		WriteError(w, errMethodNotAllowed(r.Method))
+		return
+	}
+
+	if s.ldap != nil {
+		WriteError(w, errDirectoryPasswords)
+		return
+	}
+
+	// get user id
+	id, ok := adminTarget(w, r)
+	if !ok {
+		return
+	}
+
+	// bots only have api tokens
+	target, err := s.store.GetUserById(r.Context(), id)
+	if err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			WriteError(w, errUserNotFound)
+			return
+		}
+		WriteError(w, errInternal)
+		s.logf(r, "error: get user failed: %v", err)
+		return
+	}
+	if target.Bot {
+		WriteError(w, errBotPassword)
+		return
+	}
+
+	// generate password
+	b := make([]byte, 12)
+	if _, err := rand.Read(b); err != nil {
+		WriteError(w, errInternal)
+		s.logf(r, "error: generate password failed: %v", err)
+		return
+	}
+	password := base64.RawURLEncoding.EncodeToString(b)
+	encPass, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		WriteError(w, errInternal)
+		s.logf(r, "error: bcrypt encryption error: %v", err)
+		return
+	}
+
+	// store password
+	if err = s.store.SetPassword(r.Context(), id, string(encPass)); err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			WriteError(w, errUserNotFound)
+			return
+		}
+		WriteError(w, errInternal)
+		s.logf(r, "error: set password failed: %v", err)
+		return
+	}
+	s.hub.Disconnect(id)
+
+	// response
+	WriteJSON(w, http.StatusOK, types.PasswordResetJSON{TemporaryPassword: password})
+}
+
+// handleAdminDeleteUser deletes a user, their messages stay
+func (s *Server) handleAdminDeleteUser(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "DELETE" {
+		WriteError(w, errMethodNotAllowed(r.Method))
+		return
+	}
+
+	// get user
+	id, ok := adminTarget(w, r)
+	if !ok {
+		return
+	}
+	user, err := s.store.GetUserById(r.Context(), id)
+	if err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			WriteError(w, errUserNotFound)
+			return
+		}
+		WriteError(w, errInternal)
+		s.logf(r, "error: get user failed: %v", err)
+		return
+	}
+
+	// delete user
+	if err = s.deleteUser(r.Context(), user); err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			WriteError(w, errUserNotFound)
+			return
+		}
+		WriteError(w, errInternal)
+		s.logf(r, "error: delete user failed: %v", err)
+		return
+	}
+
+	// response
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// deleteUser deletes a user, signs them out and lets their chats see them
+// leave
+func (s *Server) deleteUser(ctx context.Context, user *types.User) error {
+	if err := s.store.DeleteUser(ctx, user.Id); err != nil {
+		return err
+	}
+	s.hub.Disconnect(user.Id)
+	author := types.AuthorJSON{Id: user.Id, Username: user.Username, DisplayName: user.DisplayName}
+	for _, chatId := range user.Chats {
+		s.recordChange(ctx, chatId, user.Id, ChangeMemberLeft, author)
+	}
+	return nil
+}
+
+// handleAdminDeleteChat deletes a chat and everything in it
+func (s *Server) handleAdminDeleteChat(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "DELETE" {
+		WriteError(w, errMethodNotAllowed(r.Method))
+		return
+	}
+
+	// get chat
+	id, err := getChatId(r)
+	if err != nil {
+		WriteError(w, errChatNotFound)
+		return
+	}
+	chat, err := s.store.GetChatById(r.Context(), id)
+	if err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			WriteError(w, errChatNotFound)
+			return
+		}
+		WriteError(w, errInternal)
+		s.logf(r, "error: get chat failed: %v", err)
+		return
+	}
+
+	// delete chat
+	if err = s.store.DeleteChat(r.Context(), id); err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			WriteError(w, errChatNotFound)
+			return
+		}
+		WriteError(w, errInternal)
+		s.logf(r, "error: delete chat failed: %v", err)
+		return
+	}
+
+	// let connected members drop it
+	usersId := []int{}
+	for _, u := range chat.Users {
+		usersId = append(usersId, u.Id)
+	}
+	s.hub.SendToUsers(usersId, types.EventJSON{Type: "chat_deleted", Data: map[string]int{"chatId": id}})
+	s.hub.RemoveChat(id)
+
+	// response
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// messages purged per transaction, so a large chat doesn't hold locks for
+// long
+const purgeBatch = 1000
+
+// handleAdminPurgeChat deletes the messages of a chat, all of them or those
+// sent before a time, keeping the chat and its members
+func (s *Server) handleAdminPurgeChat(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		WriteError(w, errMethodNotAllowed(r.Method))
+		return
+	}
+
+	// get chat id
+	id, err := getChatId(r)
+	if err != nil {
+		WriteError(w, errChatNotFound)
+		return
+	}
+
+	// get req, a bad time must not purge everything
+	req := new(types.PurgeRequest)
+	json.NewDecoder(r.Body).Decode(req)
+	before := time.Time{}
+	if req.Before != "" {
+		if before, err = time.Parse(time.RFC3339, req.Before); err != nil {
+			WriteError(w, errInvalidTime)
+			return
+		}
+	}
+
+	// get chat
+	chat, err := s.store.GetChatById(r.Context(), id)
+	if err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			WriteError(w, errChatNotFound)
+			return
+		}
+		WriteError(w, errInternal)
+		s.logf(r, "error: get chat failed: %v", err)
+		return
+	}
+
+	// delete in batches, what was deleted before a failure is audited too
+	deleted := 0
+	for {
+		var n int
+		n, err = s.store.PurgeMessages(r.Context(), id, before, purgeBatch)
+		deleted += n
+		if err != nil || n < purgeBatch {
+			break
+		}
+	}
+	data := map[string]any{"deleted": deleted}
+	if !before.IsZero() {
+		data["before"] = before.UTC()
+	}
+	s.audit(r, types.AuditChatPurged, id, data)
+	if err != nil {
+		WriteError(w, errInternal)
+		s.logf(r, "error: purge messages failed after %d: %v", deleted, err)
+		return
+	}
+
+	// let connected members drop them
+	usersId := []int{}
+	for _, u := range chat.Users {
+		usersId = append(usersId, u.Id)
+	}
+	event := map[string]any{"chatId": id}
+	if !before.IsZero() {
+		event["before"] = before.UTC()
+	}
+	s.hub.SendToUsers(usersId, types.EventJSON{Type: "messages_purged", Data: event})
+
+	// response
+	WriteJSON(w, http.StatusOK, types.PurgeJSON{Deleted: deleted})
+}
+
+// handleAdminBans lists, adds and removes banned addresses, they are
+// kept in the config file with the other settings
+func (s *Server) handleAdminBans(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		WriteJSON(w, http.StatusOK, s.config.Get().BannedIps)
+	case "POST", "DELETE":
+		// get req
+		req := new(types.BanRequest)
+		if r.Method == "POST" {
+			json.NewDecoder(r.Body).Decode(req)
+		} else {
+			req.Ip = r.URL.Query().Get("ip")
+		}
+		ipNet, err := ParseBan(req.Ip)
+		if err != nil {
+			WriteError(w, errInvalidBan)
+			return
+		}
+
+		// update config, entries are compared normalized
+		config, err := s.config.Update(func(c *Config) {
+			banned := []string{}
+			for _, ip := range c.BannedIps {
+				if other, err := ParseBan(ip); err != nil || other.String() != ipNet.String() {
+					banned = append(banned, ip)
+				}
+			}
+			if r.Method == "POST" {
+				banned = append(banned, req.Ip)
+			}
+			c.BannedIps = banned
+		})
+		if err != nil {
+			WriteError(w, errInternal)
+			s.logf(r, "error: update bans failed: %v", err)
+			return
+		}
+
+		// response
+		WriteJSON(w, http.StatusOK, config.BannedIps)
+	default:
+		WriteError(w, errMethodNotAllowed(r.Method))
+	}
+}
+
+// handleAdminSettings shows or replaces the runtime config
+func (s *Server) handleAdminSettings(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		WriteJSON(w, http.StatusOK, s.config.Get())
+	case "PUT":
+		// get req, fields left out keep their defaults
+		req := DefaultConfig()
+		if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+			WriteError(w, errInvalidSettings(err))
+			return
+		}
+		if err := req.Validate(); err != nil {
+			WriteError(w, errInvalidSettings(err))
+			return
+		}
+
+		// update config
+		config, err := s.config.Update(func(c *Config) { *c = *req })
+		if err != nil {
+			WriteError(w, errInternal)
+			s.logf(r, "error: update settings failed: %v", err)
+			return
+		}
+
+		// response
+		WriteJSON(w, http.StatusOK, config)
+	default:
+		WriteError(w, errMethodNotAllowed(r.Method))
+	}
+}
+
+// BootstrapAdmins gives the admin role to the users listed in ADMIN_EMAILS
+func BootstrapAdmins(ctx context.Context, store storage.Storage) error {
+	emails := []string{}
+	for _, email := range strings.Split(os.Getenv("ADMIN_EMAILS"), ",") {
+		if email = strings.TrimSpace(email); email != "" {
+			emails = append(emails, email)
+		}
+	}
+	if len(emails) == 0 {
+		return nil
+	}
+	return store.SetRoleByEmail(ctx, emails, types.RoleAdmin)
+}
+
+// exportColumns are the columns of a chat export, one row per message
+var exportColumns = []string{"id", "timestamp", "author_id", "author", "display_name", "text", "edited_at"}
+
+// messages written between flushes of an export. Writes block while the
+// client is behind, which holds back reading more of the chat
+const exportFlushEvery = 100
+
+// exportWriter writes the messages of an export in one format
+type exportWriter interface {
+	contentType() string
+	begin() error
+	write(types.MessageJSON) error
+	// flush hands buffered messages to the response
+	flush() error
+	end() error
+}
+
+type csvExport struct {
+	out *csv.Writer
+}
+
+func (e *csvExport) contentType() string { return "text/csv; charset=utf-8" }
+
+func (e *csvExport) begin() error { return e.out.Write(exportColumns) }
+
+func (e *csvExport) write(m types.MessageJSON) error {
+	editedAt := ""
+	if m.EditedAt != nil {
+		editedAt = m.EditedAt.Format(time.RFC3339Nano)
+	}
+	return e.out.Write([]string{strconv.FormatInt(m.Id, 10), m.CreatedAt.Format(time.RFC3339Nano), strconv.Itoa(m.Author.Id), m.Author.Username, m.Author.DisplayName, m.Text, editedAt})
+}
+
+func (e *csvExport) flush() error {
+	e.out.Flush()
+	return e.out.Error()
+}
+
+func (e *csvExport) end() error { return e.flush() }
+
+// jsonExport writes an array of messages one element at a time
+type jsonExport struct {
+	w     io.Writer
+	enc   *json.Encoder
+	wrote bool
+}
+
+func (e *jsonExport) contentType() string { return "application/json" }
+
+func (e *jsonExport) begin() error {
+	_, err := io.WriteString(e.w, "[")
+	return err
+}
+
+func (e *jsonExport) write(m types.MessageJSON) error {
+	if e.wrote {
+		if _, err := io.WriteString(e.w, ","); err != nil {
+			return err
+		}
+	}
+	e.wrote = true
+	return e.enc.Encode(m)
+}
+
+func (e *jsonExport) flush() error { return nil }
+
+func (e *jsonExport) end() error {
+	_, err := io.WriteString(e.w, "]\n")
+	return err
+}
+
+// handleAdminExportChat streams the messages of a chat as csv or a json
+// array for compliance reviews, messages are written as they are read
+func (s *Server) handleAdminExportChat(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		WriteError(w, errMethodNotAllowed(r.Method))
+		return
+	}
+
+	// get chat id
+	id, err := getChatId(r)
+	if err != nil {
+		WriteError(w, errChatNotFound)
+		return
+	}
+
+	// get format
+	format := r.URL.Query().Get("format")
+	var export exportWriter
+	switch format {
+	case "", "csv":
+		format, export = "csv", &csvExport{out: csv.NewWriter(w)}
+	case "json":
+		export = &jsonExport{w: w, enc: json.NewEncoder(w)}
+	default:
+		WriteError(w, errInvalidFormat)
+		return
+	}
+
+	// the response starts with the first message, until then errors can
+	// still be answered. It takes as long as the chat is long
+	rc := http.NewResponseController(w)
+	rc.SetWriteDeadline(time.Time{})
+	started := false
+	begin := func() error {
+		started = true
+		w.Header().Set("Content-Type", export.contentType())
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="chat-%d.%s"`, id, format))
+		return export.begin()
+	}
+	rows := 0
+	err = s.store.ExportMessages(r.Context(), id, func(m types.MessageJSON) error {
+		if !started {
+			if err := begin(); err != nil {
+				return err
+			}
+		}
+		if err := export.write(m); err != nil {
+			return err
+		}
+		rows++
+		// a flush failing means the client is gone
+		if rows%exportFlushEvery == 0 {
+			if err := export.flush(); err != nil {
+				return err
+			}
+			return rc.Flush()
+		}
+		return nil
+	})
+	if err == nil && !started {
+		err = begin()
+	}
+	if err != nil && !started {
+		if errors.Is(err, storage.ErrNotFound) {
+			WriteError(w, errChatNotFound)
+			return
+		}
+		WriteError(w, errInternal)
+		s.logf(r, "error: export chat failed: %v", err)
+		return
+	}
+	if err != nil {
+		// drop the connection so the client can't take a cut off file for
+		// the whole chat
+		s.logf(r, "error: export chat failed after %d messages: %v", rows, err)
+		panic(http.ErrAbortHandler)
+	}
+	if err = export.end(); err != nil {
+		s.logf(r, "error: export chat failed after %d messages: %v", rows, err)
+		return
+	}
+	s.audit(r, types.AuditChatExported, id, map[string]any{"messages": rows})
+}
@@ -0,0 +1,1908 @@
+// Package server is the http and websocket api of gochat
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+	"golang.org/x/crypto/bcrypt"
+
+	"example/gochat/auth"
+	"example/gochat/storage"
+	"example/gochat/types"
+)
+
+type ContextKey string
+
+const shutdownTimeout = 10 * time.Second
+
+const (
+	userContextKey      ContextKey = "user"
+	requestIdContextKey ContextKey = "requestId"
+	errorsContextKey    ContextKey = "errors"
+	responseContextKey  ContextKey = "response"
+)
+
+type Server struct {
+	listenAddr string
+	http       *http.Server
+	logger     *log.Logger
+	middleware []mux.MiddlewareFunc
+	store      storage.Storage
+	hub        *Hub
+	config     *ConfigLoader
+	limiter    *RateLimiter
+	joins      *JoinGuard
+	certs      *CertReloader
+	notifier   *Notifier
+	webauthn   *webauthn.WebAuthn
+	passkeys   *PasskeySessions
+	auth       *auth.TokenAuth
+	breaker    *storage.Breaker
+	broker     Broker
+	stream     EventStream
+	timeouts   Timeouts
+	reporter   ErrorReporter
+	reporting  chan struct{}
+	plugins    []Plugin
+	responders *responders
+	quotas     *quotas
+	ldap       *LDAPAuth
+	oidc       *OIDCAuth
+	// sha256 of the scim bearer token, nil when provisioning is off
+	scimToken []byte
+	// slug of the workspace scim provisions, the default one when empty
+	scimWorkspace string
+	// user id -> last time their activity was stored
+	lastSeen sync.Map
+	started  time.Time
+}
+
+// Option configures a Server
+type Option func(*Server)
+
+// WithStorage sets the store, it is required
+func WithStorage(store storage.Storage) Option {
+	return func(s *Server) {
+		s.store = store
+	}
+}
+
+// WithConfig sets the runtime config, defaults are used without it
+func WithConfig(config *ConfigLoader) Option {
+	return func(s *Server) {
+		s.config = config
+	}
+}
+
+// WithAuth sets how tokens are issued and validated
+func WithAuth(tokens *auth.TokenAuth) Option {
+	return func(s *Server) {
+		s.auth = tokens
+	}
+}
+
+// WithLogger sets the logger, the standard logger is used without it
+func WithLogger(logger *log.Logger) Option {
+	return func(s *Server) {
+		s.logger = logger
+	}
+}
+
+// WithMiddleware runs mw on every request after the built in middleware
+func WithMiddleware(mw ...mux.MiddlewareFunc) Option {
+	return func(s *Server) {
+		s.middleware = append(s.middleware, mw...)
+	}
+}
+
+// WithTLS serves https with certificates from the reloader
+func WithTLS(certs *CertReloader) Option {
+	return func(s *Server) {
+		s.certs = certs
+	}
+}
+
+func NewServer(addr string, opts ...Option) *Server {
+	s := &Server{
+		listenAddr: addr,
+		logger:     log.Default(),
+		limiter:    NewRateLimiter(),
+		joins:      NewJoinGuard(),
+		passkeys:   NewPasskeySessions(),
+		timeouts:   DefaultTimeouts(),
+		started:    time.Now(),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	if s.config == nil {
+		s.config, _ = NewConfigLoader("")
+	}
+	if s.auth == nil {
+		s.auth = auth.NewTokenAuth("")
+	}
+
+	// fail fast while the storage circuit is open
+	if breakerStore, ok := s.store.(*storage.BreakerStore); ok {
+		s.breaker = breakerStore.Breaker()
+	}
+	// requests only see their workspace
+	if s.store != nil {
+		s.store = storage.NewWorkspaceStore(s.store)
+	}
+
+	s.responders = newResponders(s)
+	s.quotas = newQuotas(s)
+	s.plugins = append([]Plugin{wordFilter{config: s.config}, s.quotas, webhooks{s: s}, newRemotePlugins(s), s.responders}, s.plugins...)
+	s.hub = NewHub(s.logger)
+	s.hub.broker = s.broker
+	s.notifier = NewNotifier(s.store, s.hub, s.logger)
+
+	s.http = &http.Server{
+		Addr:              addr,
+		Handler:           s.routes(),
+		ReadHeaderTimeout: readHeaderTimeout,
+		ReadTimeout:       s.timeouts.Read,
+		WriteTimeout:      s.timeouts.Write,
+		IdleTimeout:       s.timeouts.Idle,
+		ErrorLog:          s.logger,
+	}
+	if s.certs != nil {
+		s.http.TLSConfig = &tls.Config{GetCertificate: s.certs.GetCertificate}
+	}
+	return s
+}
+
+// Start serves requests until Shutdown is called or ctx is done
+func (s *Server) Start(ctx context.Context) error {
+	if s.store == nil {
+		return errors.New("server: no storage configured")
+	}
+
+	// shut down gracefully when ctx is done
+	stop := context.AfterFunc(ctx, func() {
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := s.Shutdown(ctx); err != nil {
+			s.errorf("error: shutdown failed: %v", err)
+		}
+	})
+	defer stop()
+
+	// background jobs work across the workspaces
+	ctx = storage.Unscoped(ctx)
+	go s.refreshTrending(ctx)
+	go s.maintainMessages(ctx)
+	s.runPlugins(ctx)
+	if s.broker != nil {
+		go s.hub.listen(ctx)
+		go s.hub.announce(ctx)
+	}
+
+	ln, err := Listen(s.listenAddr)
+	if err != nil {
+		return err
+	}
+	if s.certs != nil {
+		s.logger.Println("server running with tls at:", s.listenAddr)
+		err = s.http.ServeTLS(ln, "", "")
+	} else {
+		s.logger.Println("server running at:", s.listenAddr)
+		err = s.http.Serve(ln)
+	}
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+// Shutdown stops accepting requests, waits for running ones to finish
+// and closes the websocket connections
+func (s *Server) Shutdown(ctx context.Context) error {
+	err := s.http.Shutdown(ctx)
+	s.hub.Close()
+	return err
+}
+
+// Handler returns the http handler of the api, for serving it from
+// another http.Server
+func (s *Server) Handler() http.Handler {
+	return s.http.Handler
+}
+
+func (s *Server) routes() http.Handler {
+	r := mux.NewRouter()
+	r.Use(requestIdMiddleware, s.recoverMiddleware, s.logMiddleware, s.banMiddleware, s.rateLimitMiddleware, s.breakerMiddleware, s.compressionMiddleware, s.timeoutMiddleware)
+	r.Use(s.middleware...)
+
+	// serve frontend
+	r.HandleFunc("/", s.handleHomePage)                                                    // show login/register, home
+	r.HandleFunc("/chat/{chatId}", s.protectMiddleware(s.handleChatPage))                  // show chat page
+	r.HandleFunc("/feeds/chats/{chatId:[0-9]+}.atom", s.guestMiddleware(s.handleChatFeed)) // atom feed of announcements
+
+	// load balancer checks
+	r.HandleFunc("/healthz", s.handleHealth) // process is up
+	r.HandleFunc("/readyz", s.handleReady)   // takes connections
+
+	// provisioning by identity providers
+	r.HandleFunc("/scim/v2/Users", s.scimMiddleware(s.handleSCIMUsers))                // search/provision users
+	r.HandleFunc("/scim/v2/Users/{userId:[0-9]+}", s.scimMiddleware(s.handleSCIMUser)) // show/update/deprovision user
+
+	// api calls
+	r.HandleFunc("/api/messages/search", s.protectMiddleware(s.handleSearchMessages))                                    // search own chats' messages
+	r.HandleFunc("/api/chats", s.protectMiddleware(s.handleChats))                                                       // list own chats
+	r.HandleFunc("/api/chats/create", s.protectMiddleware(s.handleCreateChat))                                           // create chat
+	r.HandleFunc("/api/chats/batch", s.protectMiddleware(s.handleBatchChats))                                            // get chat summaries
+	r.HandleFunc("/api/chats/directory", s.guestMiddleware(s.handleDirectory))                                           // browse public chats
+	r.HandleFunc("/api/chats/trending", s.guestMiddleware(s.handleTrending))                                             // most active public chats
+	r.HandleFunc("/api/chats/search", s.guestMiddleware(s.handleSearchChats))                                            // search chats by name/topic
+	r.HandleFunc("/api/chats/{chatId}", s.guestMiddleware(s.handleChat))                                                 // get/join/leave chat
+	r.HandleFunc("/api/chats/{chatId}/messages", s.guestMiddleware(s.handleMessages))                                    // list/send messages
+	r.HandleFunc("/api/chats/{chatId}/messages/{messageId}", s.protectMiddleware(s.handleEditMessage))                   // edit own message
+	r.HandleFunc("/api/chats/{chatId}/messages/{messageId}/history", s.protectMiddleware(s.handleMessageHistory))        // previous versions
+	r.HandleFunc("/api/chats/{chatId}/messages/{messageId}/reactions", s.guestMiddleware(s.handleReactions))             // summary/react/unreact
+	r.HandleFunc("/api/chats/{chatId}/messages/{messageId}/bookmark", s.protectMiddleware(s.handleBookmark))             // bookmark/unbookmark
+	r.HandleFunc("/api/chats/{chatId}/mute", s.protectMiddleware(s.handleMuteChat))                                      // mute/unmute push
+	r.HandleFunc("/api/chats/{chatId}/members", s.guestMiddleware(s.handleMembers))                                      // list members
+	r.HandleFunc("/api/chats/{chatId}/members/{userId}", s.roleMiddleware(types.RoleModerator, s.handleRemoveMember))    // remove member
+	r.HandleFunc("/api/chats/{chatId}/members/{userId}/role", s.roleMiddleware(types.RoleModerator, s.handleMemberRole)) // make viewer/member/admin
+	r.HandleFunc("/api/chats/{chatId}/visibility", s.roleMiddleware(types.RoleModerator, s.handleChatVisibility))        // make public/private
+	r.HandleFunc("/api/chats/{chatId}/announcement", s.roleMiddleware(types.RoleModerator, s.handleChatAnnouncement))    // publish feed or not
+	r.HandleFunc("/api/chats/{chatId}/tags", s.roleMiddleware(types.RoleModerator, s.handleChatTags))                    // set category/tags
+	r.HandleFunc("/api/chats/{chatId}/info", s.roleMiddleware(types.RoleModerator, s.handleChatInfo))                    // set name/topic
+	r.HandleFunc("/api/chats/{chatId}/{kind:avatar|cover}", s.guestMiddleware(s.handleChatImage))                        // show/upload/remove image
+	r.HandleFunc("/api/chats/{chatId}/read-marker", s.protectMiddleware(s.handleReadMarker))                             // show/set last read message
+	r.HandleFunc("/api/chats/{chatId}/welcome", s.roleMiddleware(types.RoleModerator, s.handleChatWelcome))              // show/set welcome message
+	r.HandleFunc("/api/sync", s.protectMiddleware(s.handleSync))                                                         // changes since cursor
+	r.HandleFunc("/api/me/push-tokens", s.protectMiddleware(s.handlePushTokens))                                         // register/remove device
+	r.HandleFunc("/api/me/privacy", s.protectMiddleware(s.handlePrivacy))                                                // show/hide last seen
+	r.HandleFunc("/api/me/profile", s.protectMiddleware(s.handleProfile))                                                // show/set own profile
+	r.HandleFunc("/api/me/password", s.protectMiddleware(s.handlePassword))                                              // change own password
+	r.HandleFunc("/api/users/{userId}", s.protectMiddleware(s.handleUserProfile))                                        // public profile
+	r.HandleFunc("/api/me/preferences", s.protectMiddleware(s.handlePreferences))                                        // notification settings
+	r.HandleFunc("/api/me/settings", s.protectMiddleware(s.handleSettings))                                              // client settings
+	r.HandleFunc("/api/me/notifications", s.protectMiddleware(s.handleNotifications))                                    // notification inbox
+	r.HandleFunc("/api/me/notifications/read", s.protectMiddleware(s.handleReadNotifications))                           // mark read
+	r.HandleFunc("/api/me/read-all", s.protectMiddleware(s.handleReadAll))                                               // mark chats read
+	r.HandleFunc("/api/me/activity", s.protectMiddleware(s.handleActivity))                                              // activity feed
+	r.HandleFunc("/api/me/bookmarks", s.protectMiddleware(s.handleBookmarks))                                            // bookmarked messages
+	r.HandleFunc("/api/login", s.handleLogin)                                                                            // login
+	r.HandleFunc("/api/register", s.handleRegister)                                                                      // register
+	r.HandleFunc("/api/ws", s.protectMiddleware(s.handleWebsocket))                                                      // realtime events
+	r.HandleFunc("/.well-known/jwks.json", s.handleJWKS)                                                                 // token verification keys
+
+	// passkeys
+	r.HandleFunc("/api/passkeys/register/begin", s.protectMiddleware(s.handlePasskeyRegisterBegin))   // passkey creation options
+	r.HandleFunc("/api/passkeys/register/finish", s.protectMiddleware(s.handlePasskeyRegisterFinish)) // store passkey
+	r.HandleFunc("/api/passkeys/login/begin", s.handlePasskeyLoginBegin)                              // passkey assertion options
+	r.HandleFunc("/api/passkeys/login/finish", s.handlePasskeyLoginFinish)                            // login with passkey
+
+	// single sign-on
+	r.HandleFunc("/api/oidc/login", s.handleOIDCLogin)       // redirect to the identity provider
+	r.HandleFunc("/api/oidc/callback", s.handleOIDCCallback) // login with the identity provider
+
+	// admin api
+	r.HandleFunc("/api/admin/stats", s.adminMiddleware(s.handleAdminStats))                                             // server statistics
+	r.HandleFunc("/api/admin/announcements", s.adminMiddleware(s.handleAdminAnnouncement))                              // broadcast announcement
+	r.HandleFunc("/api/admin/users", s.adminMiddleware(s.handleAdminUsers))                                             // list/search users
+	r.HandleFunc("/api/admin/users/{userId}", s.adminMiddleware(s.handleAdminDeleteUser))                               // delete user
+	r.HandleFunc("/api/admin/users/{userId}/role", s.adminMiddleware(s.handleAdminUserRole))                            // change role
+	r.HandleFunc("/api/admin/users/{userId}/disabled", s.adminMiddleware(s.handleAdminUserDisabled))                    // disable/enable user
+	r.HandleFunc("/api/admin/users/{userId}/password-reset", s.adminMiddleware(s.handleAdminPasswordReset))             // reset password
+	r.HandleFunc("/api/admin/bots", s.adminMiddleware(s.handleAdminBots))                                               // create bot
+	r.HandleFunc("/api/admin/bots/{userId}/chats", s.adminMiddleware(s.handleAdminBotChats))                            // add bot to chat
+	r.HandleFunc("/api/admin/bots/{userId}/tokens", s.adminMiddleware(s.handleAdminBotTokens))                          // list/issue api tokens
+	r.HandleFunc("/api/admin/bots/{userId}/tokens/{tokenId}", s.adminMiddleware(s.handleAdminDeleteBotToken))           // revoke api token
+	r.HandleFunc("/api/admin/chats/{chatId}", s.adminMiddleware(s.handleAdminDeleteChat))                               // delete chat
+	r.HandleFunc("/api/admin/chats/{chatId}/purge", s.adminMiddleware(s.handleAdminPurgeChat))                          // delete messages
+	r.HandleFunc("/api/admin/chats/{chatId}/export", s.adminMiddleware(s.handleAdminExportChat))                        // download messages
+	r.HandleFunc("/api/admin/chats/{chatId}/responders", s.adminMiddleware(s.handleAdminResponders))                    // list/add auto-responders
+	r.HandleFunc("/api/admin/chats/{chatId}/responders/{responderId}", s.adminMiddleware(s.handleAdminDeleteResponder)) // remove auto-responder
+	r.HandleFunc("/api/admin/audit", s.adminMiddleware(s.handleAdminAudit))                                             // admin actions
+	r.HandleFunc("/api/admin/bans", s.operatorMiddleware(s.handleAdminBans))                                            // list/ban/unban ips
+	r.HandleFunc("/api/admin/settings", s.operatorMiddleware(s.handleAdminSettings))                                    // show/replace runtime config
+	r.HandleFunc("/api/admin/workspaces", s.operatorMiddleware(s.handleAdminWorkspaces))                                // list/create workspaces
+	r.HandleFunc("/api/admin/workspaces/{slug}/admins", s.operatorMiddleware(s.handleAdminWorkspaceAdmins))             // make workspace admin
+	r.HandleFunc("/api/admin/workspaces/usage", s.operatorMiddleware(s.handleAdminWorkspacesUsage))                     // usage of every workspace
+	r.HandleFunc("/api/admin/workspaces/{slug}/quota", s.operatorMiddleware(s.handleAdminWorkspaceQuota))               // set quota
+	r.HandleFunc("/api/admin/usage", s.adminMiddleware(s.handleAdminUsage))                                             // own workspace's usage
+	s.debugRoutes(r)
+
+	return r
+}
+
+// AddPushSender enables mobile push for a platform
+func (s *Server) AddPushSender(platform string, sender PushSender) {
+	s.notifier.AddSender(platform, sender)
+}
+
+func (s *Server) handleHomePage(w http.ResponseWriter, r *http.Request) {
+}
+
+func (s *Server) handleChatPage(w http.ResponseWriter, r *http.Request) {
+}
+
+func (s *Server) handleChat(w http.ResponseWriter, r *http.Request) {
+	// guests can only read
+	if _, ok := r.Context().Value(userContextKey).(*types.User); !ok && r.Method != "GET" {
+		WriteError(w, errNotAuthorized)
+		return
+	}
+	if r.Method == "GET" {
+		s.handleGetChat(w, r)
+		return
+	}
+	if r.Method == "POST" {
+		s.handleJoinChat(w, r)
+		return
+	}
+	if r.Method == "DELETE" {
+		s.handleLeaveChat(w, r)
+		return
+	} else {
+		WriteError(w, errMethodNotAllowed(r.Method))
+		return
+	}
+}
+
+func (s *Server) handleMessages(w http.ResponseWriter, r *http.Request) {
+	// guests can only read
+	if _, ok := r.Context().Value(userContextKey).(*types.User); !ok && r.Method != "GET" {
+		WriteError(w, errNotAuthorized)
+		return
+	}
+	if r.Method == "GET" {
+		s.handleGetMessages(w, r)
+		return
+	}
+	if r.Method == "POST" {
+		s.handleSendMessage(w, r)
+		return
+	}
+	WriteError(w, errMethodNotAllowed(r.Method))
+}
+
+func (s *Server) handleCreateChat(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		WriteError(w, errMethodNotAllowed(r.Method))
+		return
+	}
+	if !s.config.Get().Enabled("createChat") {
+		WriteError(w, errChatCreationDisabled)
+		return
+	}
+
+	// get password from front
+	createReq := new(types.CreateChatRequest)
+	json.NewDecoder(r.Body).Decode(createReq)
+	if createReq.Visibility == "" {
+		createReq.Visibility = types.VisibilityPrivate
+	}
+	if !validVisibility(createReq.Visibility) {
+		WriteError(w, errInvalidVisibility)
+		return
+	}
+	category, tags, ok := normalizeTags(createReq.Category, createReq.Tags)
+	if !ok {
+		WriteError(w, errInvalidTags)
+		return
+	}
+	name, topic, ok := normalizeChatInfo(createReq.Name, createReq.Topic)
+	if !ok {
+		WriteError(w, errInvalidChatInfo)
+		return
+	}
+
+	// hash password
+	encPass, err := bcrypt.GenerateFromPassword([]byte(createReq.Password), bcrypt.DefaultCost)
+	if err != nil {
+		WriteError(w, errInternal)
+		s.logf(r, "bcrypt encryption error: %v", err)
+		return
+	}
+
+	// get user from req context
+	user, ok := r.Context().Value(userContextKey).(*types.User)
+	if !ok {
+		WriteError(w, errNotAuthorized)
+		return
+	}
+
+	// create chat
+	newChat := types.Chat{Name: name, Topic: topic, Password: string(encPass), Visibility: createReq.Visibility}
+	chat, err := s.store.CreateChat(r.Context(), newChat, *user)
+	if err != nil {
+		WriteError(w, errInternal)
+		s.logf(r, "error: chat creation failed: %v", err)
+		return
+	}
+	if category != "" || len(tags) > 0 {
+		if err = s.store.SetChatTags(r.Context(), chat.Id, category, tags); err != nil {
+			WriteError(w, errInternal)
+			s.logf(r, "error: set chat tags failed: %v", err)
+			return
+		}
+		chat.Category, chat.Tags = category, tags
+	}
+
+	s.recordChange(r.Context(), chat.Id, user.Id, ChangeChatCreated, chat.ToJSON())
+	s.hub.Join(user.Id, chat.Id)
+
+	// response
+	WriteJSON(w, http.StatusCreated, chat.ToJSON())
+}
+
+func (s *Server) handleBatchChats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		WriteError(w, errMethodNotAllowed(r.Method))
+		return
+	}
+
+	// get ids from front
+	batchReq := new(types.BatchChatsRequest)
+	json.NewDecoder(r.Body).Decode(batchReq)
+	if len(batchReq.Ids) > 100 {
+		WriteError(w, errTooManyChats)
+		return
+	}
+
+	// get user from req context
+	user, ok := r.Context().Value(userContextKey).(*types.User)
+	if !ok {
+		WriteError(w, errNotAuthorized)
+		return
+	}
+
+	// keep the chats the user is in
+	ids := []int{}
+	for _, id := range batchReq.Ids {
+		for _, cid := range user.Chats {
+			if cid == id {
+				ids = append(ids, id)
+				break
+			}
+		}
+	}
+
+	// get summaries
+	summaries, err := s.store.GetChatSummaries(r.Context(), user.Id, ids)
+	if err != nil {
+		WriteError(w, errInternal)
+		s.logf(r, "error: get chat summaries failed: %v", err)
+		return
+	}
+
+	// response
+	WriteJSON(w, http.StatusOK, types.ListJSON[types.ChatSummaryJSON]{Data: summaries, Total: len(summaries)})
+}
+
+// handleChats pages through the chats of the user, the cursor is an offset
+func (s *Server) handleChats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		WriteError(w, errMethodNotAllowed(r.Method))
+		return
+	}
+	cursor, limit, err := getPage(r)
+	if err != nil {
+		WriteError(w, errInvalidCursor)
+		return
+	}
+	sort := r.URL.Query().Get("sort")
+	switch sort {
+	case "":
+		sort = storage.ChatsByActivity
+	case storage.ChatsByActivity, storage.ChatsByName:
+	default:
+		WriteError(w, errInvalidSort)
+		return
+	}
+
+	// get user from req context
+	user, ok := r.Context().Value(userContextKey).(*types.User)
+	if !ok {
+		WriteError(w, errNotAuthorized)
+		return
+	}
+
+	// get summaries
+	summaries, err := s.store.GetUserChats(r.Context(), user.Id, sort, cursor, limit)
+	if err != nil {
+		WriteError(w, errInternal)
+		s.logf(r, "error: get user chats failed: %v", err)
+		return
+	}
+
+	// response
+	res := types.ListJSON[types.ChatSummaryJSON]{Data: summaries, Total: len(user.Chats)}
+	if len(summaries) == limit {
+		res.NextCursor = strconv.Itoa(cursor + limit)
+	}
+	WriteJSON(w, http.StatusOK, res)
+}
+
+func (s *Server) handleGetChat(w http.ResponseWriter, r *http.Request) {
+	// get chat id
+	id, err := getChatId(r)
+	if err != nil {
+		WriteError(w, errChatNotFound)
+		return
+	}
+
+	// get user from req context, guests have none
+	user, _ := r.Context().Value(userContextKey).(*types.User)
+
+	// get chat
+	chat, err := s.store.GetChatById(r.Context(), id)
+	if err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			WriteError(w, errChatNotFound)
+			return
+		}
+		WriteError(w, errInternal)
+		s.logf(r, "error: get chat failed: %v", err)
+		return
+	}
+	if !canRead(user, chat) {
+		WriteError(w, errChatNotFound)
+		return
+	}
+
+	// response, polling clients get a 304 if nothing changed
+	WriteJSONWithETag(w, r, http.StatusOK, chat.ToJSON())
+}
+
+func (s *Server) handleJoinChat(w http.ResponseWriter, r *http.Request) {
+	// get join request
+	joinReq := new(types.JoinChatRequest)
+	json.NewDecoder(r.Body).Decode(joinReq)
+
+	// get chat
+	chat, err := s.store.GetChatById(r.Context(), joinReq.Id)
+	if err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			WriteError(w, errChatNotFound)
+			return
+		}
+		WriteError(w, errInternal)
+		s.logf(r, "error: get chat failed: %v", err)
+		return
+	}
+
+	// get user
+	user, ok := r.Context().Value(userContextKey).(*types.User)
+	if !ok {
+		WriteError(w, errNotAuthorized)
+		return
+	}
+
+	// refuse users locked out of the chat before comparing the password
+	ip := s.clientIp(r)
+	limits := s.config.Get().RateLimit
+	attempt, wait := s.joins.Attempt(chat.Id, user.Id, ip, limits.JoinAttempts, time.Duration(limits.JoinLockoutSeconds)*time.Second)
+	if wait > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+		WriteError(w, errJoinLocked)
+		return
+	}
+
+	// check for password
+	if ok := chat.ValidatePassword(joinReq.Password); !ok {
+		if attempt.Locked() {
+			s.audit(r, types.AuditChatJoinLocked, chat.Id, map[string]any{"userId": user.Id, "ip": ip})
+		}
+		WriteError(w, errNotAuthorized)
+		return
+	}
+	s.joins.Refund(attempt)
+
+	// check for user in chat
+	eq := false
+	for _, uid := range user.Chats {
+		if uid == joinReq.Id {
+			eq = true
+			break
+		}
+	}
+	if eq {
+		return
+	}
+
+	// add user to chat, unless a plugin vetoes it
+	if err := s.onUserJoin(r.Context(), JoinEvent{User: user, Chat: chat}); err != nil {
+		s.writeVeto(w, r, err)
+		return
+	}
+	if err := s.store.AddMember(r.Context(), chat.Id, user.Id); err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			WriteError(w, errChatNotFound)
+			return
+		}
+		// a racing request of the user joined first and records it
+		if errors.Is(err, storage.ErrConflict) {
+			return
+		}
+		WriteError(w, errInternal)
+		s.logf(r, "error: add member failed: %v", err)
+		return
+	}
+	chat.Users = append(chat.Users, types.AuthorJSON{Id: user.Id, Username: user.Username, DisplayName: user.DisplayName})
+	s.recordChange(r.Context(), chat.Id, user.Id, ChangeMemberJoined, types.AuthorJSON{Id: user.Id, Username: user.Username, DisplayName: user.DisplayName})
+	s.hub.Join(user.Id, chat.Id)
+	s.recordActivity(r.Context(), []int{user.Id}, types.ActivityAddedToChat, chat.Id, map[string]any{"chatName": chat.Name})
+
+	// greet the new member with a system notification
+	if chat.Welcome != "" {
+		s.notify(r.Context(), []int{user.Id}, types.NotificationSystem, chat.Id, map[string]any{"chatName": chat.Name, "text": chat.Welcome})
+	}
+
+	// response
+	WriteJSON(w, http.StatusOK, chat.ToJSON())
+}
+
+func (s *Server) handleLeaveChat(w http.ResponseWriter, r *http.Request) {
+	// get chat id
+	id, err := getChatId(r)
+	if err != nil {
+		WriteError(w, errChatNotFound)
+		return
+	}
+
+	// get chat
+	chat, err := s.store.GetChatById(r.Context(), id)
+	if err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			WriteError(w, errChatNotFound)
+			return
+		}
+		WriteError(w, errInternal)
+		s.logf(r, "error: get chat failed: %v", err)
+		return
+	}
+
+	// get user from req context
+	user, ok := r.Context().Value(userContextKey).(*types.User)
+	if !ok {
+		WriteError(w, errNotAuthorized)
+		return
+	}
+
+	// check for user in chat
+	eq := false
+	for _, uid := range user.Chats {
+		if uid == id {
+			eq = true
+			break
+		}
+	}
+	if !eq {
+		WriteError(w, errChatNotFound)
+		return
+	}
+
+	// delete user from chat
+	if err := s.store.RemoveMember(r.Context(), chat.Id, user.Id); err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			WriteError(w, errChatNotFound)
+			return
+		}
+		WriteError(w, errInternal)
+		s.logf(r, "error: remove member failed: %v", err)
+		return
+	}
+	s.recordChange(r.Context(), chat.Id, user.Id, ChangeMemberLeft, types.AuthorJSON{Id: user.Id, Username: user.Username, DisplayName: user.DisplayName})
+	s.hub.Leave(user.Id, chat.Id)
+
+	// response
+	WriteJSON(w, http.StatusOK, "chat deleted")
+}
+
+// handleGetMessages pages through the messages of a chat newest first
+func (s *Server) handleGetMessages(w http.ResponseWriter, r *http.Request) {
+	// get chat id
+	id, err := getChatId(r)
+	if err != nil {
+		WriteError(w, errChatNotFound)
+		return
+	}
+
+	// get user from req context, guests have none
+	user, _ := r.Context().Value(userContextKey).(*types.User)
+
+	// get page and time range
+	cursor, limit, err := getPage(r)
+	if err != nil {
+		WriteError(w, errInvalidCursor)
+		return
+	}
+	before, err := getTime(r, "before")
+	if err != nil {
+		WriteError(w, errInvalidTime)
+		return
+	}
+	after, err := getTime(r, "after")
+	if err != nil {
+		WriteError(w, errInvalidTime)
+		return
+	}
+	around, err := getTime(r, "around")
+	if err != nil {
+		WriteError(w, errInvalidTime)
+		return
+	}
+
+	// get chat
+	chat, err := s.store.GetChatById(r.Context(), id)
+	if err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			WriteError(w, errChatNotFound)
+			return
+		}
+		WriteError(w, errInternal)
+		s.logf(r, "error: get chat failed: %v", err)
+		return
+	}
+	if !canRead(user, chat) {
+		WriteError(w, errChatNotFound)
+		return
+	}
+
+	// messages are stored in the order they were sent, so the time
+	// range is a slice of them
+	first, end := 0, len(chat.Messages)
+	if !after.IsZero() {
+		first = sort.Search(len(chat.Messages), func(i int) bool { return chat.Messages[i].CreatedAt.After(after) })
+	}
+	if !before.IsZero() {
+		end = sort.Search(len(chat.Messages), func(i int) bool { return !chat.Messages[i].CreatedAt.Before(before) })
+	}
+
+	res := types.ListJSON[types.MessageJSON]{Data: []types.MessageJSON{}, Total: max(end-first, 0)}
+
+	// slice a page oldest first with the first message at or after around
+	// in the middle, the cursors continue it either way
+	if !around.IsZero() {
+		middle := sort.Search(len(chat.Messages), func(i int) bool { return !chat.Messages[i].CreatedAt.Before(around) })
+		stop := min(max(middle-limit/2, first)+limit, end)
+		start := max(stop-limit, first)
+		for i := start; i < stop; i++ {
+			res.Data = append(res.Data, chat.Messages[i])
+		}
+		if stop < end {
+			res.NextCursor = strconv.Itoa(stop)
+		}
+		if start > first {
+			res.PrevCursor = strconv.Itoa(start)
+		}
+		s.attachReceipts(r.Context(), len(chat.Users), res.Data)
+		WriteJSON(w, http.StatusOK, res)
+		return
+	}
+
+	// slice page oldest first, the cursor is the position of the next message
+	if r.URL.Query().Get("order") == "asc" {
+		start := max(first, cursor)
+		stop := min(start+limit, end)
+		for i := start; i < stop; i++ {
+			res.Data = append(res.Data, chat.Messages[i])
+		}
+		if stop < end {
+			res.NextCursor = strconv.Itoa(stop)
+		}
+		s.attachReceipts(r.Context(), len(chat.Users), res.Data)
+		WriteJSON(w, http.StatusOK, res)
+		return
+	}
+
+	// slice page newest first, the cursor is the position of the oldest message returned
+	if cursor > 0 && cursor < end {
+		end = cursor
+	}
+	start := max(end-limit, first)
+	for i := end - 1; i >= start; i-- {
+		res.Data = append(res.Data, chat.Messages[i])
+	}
+	if start > first {
+		res.NextCursor = strconv.Itoa(start)
+	}
+
+	// response
+	s.attachReceipts(r.Context(), len(chat.Users), res.Data)
+	WriteJSON(w, http.StatusOK, res)
+}
+
+func (s *Server) handleSendMessage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		WriteError(w, errMethodNotAllowed(r.Method))
+		return
+	}
+
+	// get chat id
+	id, err := getChatId(r)
+	if err != nil {
+		WriteError(w, errChatNotFound)
+		return
+	}
+
+	// get user from req context
+	user, ok := r.Context().Value(userContextKey).(*types.User)
+	if !ok {
+		WriteError(w, errNotAuthorized)
+		return
+	}
+
+	// check for user in chat
+	eq := false
+	for _, uid := range user.Chats {
+		if uid == id {
+			eq = true
+			break
+		}
+	}
+	if !eq {
+		WriteError(w, errChatNotFound)
+		return
+	}
+
+	// get chat
+	chat, err := s.store.GetChatById(r.Context(), id)
+	if err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			WriteError(w, errChatNotFound)
+			return
+		}
+		WriteError(w, errInternal)
+		s.logf(r, "error: get chat failed: %v", err)
+		return
+	}
+
+	// viewers can't post
+	role, err := s.store.GetMemberRole(r.Context(), id, user.Id)
+	if err != nil {
+		WriteError(w, errInternal)
+		s.logf(r, "error: get member role failed: %v", err)
+		return
+	}
+	if role == types.MemberRoleViewer {
+		WriteError(w, errReadOnly)
+		return
+	}
+
+	// get message
+	req := new(types.SendMessageRequest)
+	json.NewDecoder(r.Body).Decode(req)
+	if req.Text == "" || len(req.Text) > 2000 {
+		WriteError(w, errInvalidMessage)
+		return
+	}
+
+	// store and send message, unless a plugin vetoes it
+	message, err := s.sendMessage(r.Context(), user, chat, req.Text)
+	var veto *vetoError
+	if errors.As(err, &veto) {
+		s.writeVeto(w, r, err)
+		return
+	}
+	if errors.Is(err, storage.ErrNotFound) {
+		WriteError(w, errChatNotFound)
+		return
+	}
+	if err != nil {
+		WriteError(w, errInternal)
+		s.logf(r, "error: add message failed: %v", err)
+		return
+	}
+
+	// response
+	WriteJSON(w, http.StatusCreated, message)
+}
+
+// sendMessage stores a new message of the user in the chat and sends it to
+// the members, with the message hooks around it. A hook's veto is returned
+// as a *vetoError, and nothing is stored then
+func (s *Server) sendMessage(ctx context.Context, user *types.User, chat *types.Chat, text string) (types.MessageJSON, error) {
+	message := types.MessageJSON{ChatId: chat.Id, Text: text, Author: types.AuthorJSON{Id: user.Id, Username: user.Username, DisplayName: user.DisplayName}, CreatedAt: time.Now().UTC().Truncate(time.Millisecond)}
+	if err := s.onMessageCreate(ctx, MessageEvent{User: user, Chat: chat, Message: message}); err != nil {
+		return message, err
+	}
+	id, err := s.store.AddMessage(ctx, message)
+	if err != nil {
+		return message, err
+	}
+	message.Id = id
+	s.touchLastSeen(ctx, user.Id)
+	if err = s.store.MarkRead(ctx, user.Id, message.Id); err != nil {
+		s.logger.Printf("[%s] error: mark read failed: %v", requestId(ctx), err)
+	}
+	s.deliverMessage(ctx, chat, &message)
+	s.onMessageCreated(ctx, MessageEvent{User: user, Chat: chat, Message: message})
+	return message, nil
+}
+
+// deliverMessage records a stored message as a change and pushes it to the
+// chat members, the change id lets devices ack delivery
+func (s *Server) deliverMessage(ctx context.Context, chat *types.Chat, message *types.MessageJSON) {
+	changeId := s.recordChange(ctx, chat.Id, message.Author.Id, ChangeMessageCreated, *message)
+	usersId := []int{}
+	for _, a := range chat.Users {
+		usersId = append(usersId, a.Id)
+	}
+	s.createReceipts(ctx, message, usersId)
+	s.notifyMentions(ctx, chat, *message)
+	s.hub.SendToChat(chat.Id, message.Id, types.EventJSON{Id: changeId, Type: "message", Data: *message})
+	s.sendPreview(chat.Id, usersId, message)
+	s.notifier.NotifyMessage(ctx, chat, *message)
+}
+
+// handleMembers pages through the members of a chat by user id, with
+// their role, when they joined and whether they are connected
+func (s *Server) handleMembers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		WriteError(w, errMethodNotAllowed(r.Method))
+		return
+	}
+
+	// get chat id
+	id, err := getChatId(r)
+	if err != nil {
+		WriteError(w, errChatNotFound)
+		return
+	}
+	cursor, limit, err := getPage(r)
+	if err != nil {
+		WriteError(w, errInvalidCursor)
+		return
+	}
+
+	// get user from req context, guests have none
+	user, _ := r.Context().Value(userContextKey).(*types.User)
+
+	// get chat
+	chat, err := s.store.GetChatById(r.Context(), id)
+	if err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			WriteError(w, errChatNotFound)
+			return
+		}
+		WriteError(w, errInternal)
+		s.logf(r, "error: get chat failed: %v", err)
+		return
+	}
+	if !canRead(user, chat) {
+		WriteError(w, errChatNotFound)
+		return
+	}
+
+	// get members
+	members, total, err := s.store.GetMembers(r.Context(), id, cursor, limit)
+	if err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			WriteError(w, errChatNotFound)
+			return
+		}
+		WriteError(w, errInternal)
+		s.logf(r, "error: get members failed: %v", err)
+		return
+	}
+	online := map[int]bool{}
+	for _, userId := range s.hub.UserIds() {
+		online[userId] = true
+	}
+	for i := range members {
+		members[i].Online = online[members[i].Id]
+	}
+
+	// response
+	res := types.ListJSON[types.MemberJSON]{Data: members, Total: total}
+	if len(members) == limit {
+		res.NextCursor = strconv.Itoa(members[len(members)-1].Id)
+	}
+	WriteJSON(w, http.StatusOK, res)
+}
+
+func (s *Server) handleRemoveMember(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "DELETE" {
+		WriteError(w, errMethodNotAllowed(r.Method))
+		return
+	}
+
+	// get chat and user ids
+	id, err := getChatId(r)
+	if err != nil {
+		WriteError(w, errChatNotFound)
+		return
+	}
+	userId, err := getUserId(r)
+	if err != nil {
+		WriteError(w, errUserNotFound)
+		return
+	}
+
+	// get chat and member, from the primary which has the latest members
+	chat, err := s.store.GetChatById(storage.Primary(r.Context()), id)
+	if err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			WriteError(w, errChatNotFound)
+			return
+		}
+		WriteError(w, errInternal)
+		s.logf(r, "error: get chat failed: %v", err)
+		return
+	}
+	member, err := s.store.GetUserById(r.Context(), userId)
+	if err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			WriteError(w, errUserNotFound)
+			return
+		}
+		WriteError(w, errInternal)
+		s.logf(r, "error: get user failed: %v", err)
+		return
+	}
+
+	// delete member from chat
+	if !slices.ContainsFunc(chat.Users, func(a types.AuthorJSON) bool { return a.Id == member.Id }) {
+		WriteError(w, errUserNotFound)
+		return
+	}
+	if err := s.store.RemoveMember(r.Context(), chat.Id, member.Id); err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			WriteError(w, errUserNotFound)
+			return
+		}
+		WriteError(w, errInternal)
+		s.logf(r, "error: remove member failed: %v", err)
+		return
+	}
+	chat.Users = slices.DeleteFunc(chat.Users, func(a types.AuthorJSON) bool { return a.Id == member.Id })
+	s.recordChange(r.Context(), chat.Id, member.Id, ChangeMemberLeft, types.AuthorJSON{Id: member.Id, Username: member.Username, DisplayName: member.DisplayName})
+	s.hub.Leave(member.Id, chat.Id)
+
+	// response
+	WriteJSON(w, http.StatusOK, chat.ToJSON())
+}
+
+// handleMemberRole changes the membership role of a member of a chat
+func (s *Server) handleMemberRole(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "PUT" {
+		WriteError(w, errMethodNotAllowed(r.Method))
+		return
+	}
+
+	// get chat and user ids
+	id, err := getChatId(r)
+	if err != nil {
+		WriteError(w, errChatNotFound)
+		return
+	}
+	userId, err := getUserId(r)
+	if err != nil {
+		WriteError(w, errUserNotFound)
+		return
+	}
+
+	// get role from front
+	req := new(types.RoleRequest)
+	json.NewDecoder(r.Body).Decode(req)
+	if req.Role != types.MemberRoleMember && req.Role != types.MemberRoleViewer && req.Role != types.MemberRoleAdmin {
+		WriteError(w, errInvalidMemberRole)
+		return
+	}
+
+	// get chat
+	chat, err := s.store.GetChatById(r.Context(), id)
+	if err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			WriteError(w, errChatNotFound)
+			return
+		}
+		WriteError(w, errInternal)
+		s.logf(r, "error: get chat failed: %v", err)
+		return
+	}
+
+	// check for member in chat
+	found := false
+	for _, a := range chat.Users {
+		if a.Id == userId {
+			found = true
+			break
+		}
+	}
+	if !found {
+		WriteError(w, errUserNotFound)
+		return
+	}
+
+	// update role
+	if err = s.store.SetMemberRole(r.Context(), id, userId, req.Role); err != nil {
+		WriteError(w, errInternal)
+		s.logf(r, "error: set member role failed: %v", err)
+		return
+	}
+	if moderator, ok := r.Context().Value(userContextKey).(*types.User); ok {
+		by := types.AuthorJSON{Id: moderator.Id, Username: moderator.Username, DisplayName: moderator.DisplayName}
+		s.recordActivity(r.Context(), []int{userId}, types.ActivityRoleChanged, id, map[string]any{"role": req.Role, "by": by})
+	}
+
+	// response
+	WriteJSON(w, http.StatusOK, req)
+}
+
+// handleChatTags replaces the category and tags of a chat
+func (s *Server) handleChatTags(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "PUT" {
+		WriteError(w, errMethodNotAllowed(r.Method))
+		return
+	}
+
+	// get chat id
+	id, err := getChatId(r)
+	if err != nil {
+		WriteError(w, errChatNotFound)
+		return
+	}
+
+	// get tags from front
+	req := new(types.TagsRequest)
+	json.NewDecoder(r.Body).Decode(req)
+	category, tags, ok := normalizeTags(req.Category, req.Tags)
+	if !ok {
+		WriteError(w, errInvalidTags)
+		return
+	}
+
+	// update chat
+	if err = s.store.SetChatTags(r.Context(), id, category, tags); err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			WriteError(w, errChatNotFound)
+			return
+		}
+		WriteError(w, errInternal)
+		s.logf(r, "error: set chat tags failed: %v", err)
+		return
+	}
+
+	// response
+	WriteJSON(w, http.StatusOK, types.TagsRequest{Category: category, Tags: tags})
+}
+
+// handleChatInfo sets the name and topic of a chat
+func (s *Server) handleChatInfo(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "PUT" {
+		WriteError(w, errMethodNotAllowed(r.Method))
+		return
+	}
+
+	// get chat id
+	id, err := getChatId(r)
+	if err != nil {
+		WriteError(w, errChatNotFound)
+		return
+	}
+
+	// get name and topic from front
+	req := new(types.UpdateChatRequest)
+	json.NewDecoder(r.Body).Decode(req)
+	name, topic, ok := normalizeChatInfo(req.Name, req.Topic)
+	if !ok {
+		WriteError(w, errInvalidChatInfo)
+		return
+	}
+
+	// update chat
+	if err = s.store.SetChatInfo(r.Context(), id, name, topic); err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			WriteError(w, errChatNotFound)
+			return
+		}
+		WriteError(w, errInternal)
+		s.logf(r, "error: set chat info failed: %v", err)
+		return
+	}
+
+	// response
+	WriteJSON(w, http.StatusOK, types.UpdateChatRequest{Name: name, Topic: topic})
+}
+
+// handleChatWelcome shows or sets the message new members get when they
+// join, an empty text turns it off
+func (s *Server) handleChatWelcome(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "PUT" {
+		WriteError(w, errMethodNotAllowed(r.Method))
+		return
+	}
+
+	// get chat id
+	id, err := getChatId(r)
+	if err != nil {
+		WriteError(w, errChatNotFound)
+		return
+	}
+
+	// show welcome
+	if r.Method == "GET" {
+		chat, err := s.store.GetChatById(r.Context(), id)
+		if err != nil {
+			if errors.Is(err, storage.ErrNotFound) {
+				WriteError(w, errChatNotFound)
+				return
+			}
+			WriteError(w, errInternal)
+			s.logf(r, "error: get chat failed: %v", err)
+			return
+		}
+		WriteJSON(w, http.StatusOK, types.WelcomeRequest{Text: chat.Welcome})
+		return
+	}
+
+	// get text from front
+	req := new(types.WelcomeRequest)
+	json.NewDecoder(r.Body).Decode(req)
+	text := strings.TrimSpace(req.Text)
+	if utf8.RuneCountInString(text) > maxWelcomeLen {
+		WriteError(w, errInvalidWelcome)
+		return
+	}
+
+	// update chat
+	if err = s.store.SetChatWelcome(r.Context(), id, text); err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			WriteError(w, errChatNotFound)
+			return
+		}
+		WriteError(w, errInternal)
+		s.logf(r, "error: set chat welcome failed: %v", err)
+		return
+	}
+
+	// response
+	WriteJSON(w, http.StatusOK, types.WelcomeRequest{Text: text})
+}
+
+// handleSearchChats fuzzy searches chat names and topics, guests only see
+// public chats
+func (s *Server) handleSearchChats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		WriteError(w, errMethodNotAllowed(r.Method))
+		return
+	}
+
+	// get query
+	q := strings.TrimSpace(r.URL.Query().Get("q"))
+	if q == "" || len(q) > maxTopicLen {
+		WriteError(w, errInvalidSearch)
+		return
+	}
+	_, limit, err := getPage(r)
+	if err != nil {
+		WriteError(w, errInvalidCursor)
+		return
+	}
+
+	// own chats are searched too
+	chats := []int{}
+	if user, ok := r.Context().Value(userContextKey).(*types.User); ok {
+		chats = user.Chats
+	}
+
+	// search chats
+	result, err := s.store.SearchChats(r.Context(), q, chats, limit)
+	if err != nil {
+		WriteError(w, errInternal)
+		s.logf(r, "error: search chats failed: %v", err)
+		return
+	}
+
+	// response
+	WriteJSON(w, http.StatusOK, types.ListJSON[types.ChatInfoJSON]{Data: result, Total: len(result)})
+}
+
+// handleDirectory lists public chats newest first, ?tag= and ?category=
+// filter the list
+func (s *Server) handleDirectory(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		WriteError(w, errMethodNotAllowed(r.Method))
+		return
+	}
+
+	// get page, the cursor is the id of the last chat returned
+	cursor, limit, err := getPage(r)
+	if err != nil {
+		WriteError(w, errInvalidCursor)
+		return
+	}
+	tag := strings.ToLower(strings.TrimSpace(r.URL.Query().Get("tag")))
+	category := strings.TrimSpace(r.URL.Query().Get("category"))
+
+	// get chats
+	chats, total, err := s.store.GetPublicChats(r.Context(), tag, category, cursor, limit)
+	if err != nil {
+		WriteError(w, errInternal)
+		s.logf(r, "error: get public chats failed: %v", err)
+		return
+	}
+
+	// response
+	res := types.ListJSON[types.ChatInfoJSON]{Data: chats, Total: total}
+	if len(chats) == limit {
+		res.NextCursor = strconv.Itoa(chats[len(chats)-1].Id)
+	}
+	WriteJSON(w, http.StatusOK, res)
+}
+
+// handleChatVisibility makes a chat public or private
+func (s *Server) handleChatVisibility(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "PUT" {
+		WriteError(w, errMethodNotAllowed(r.Method))
+		return
+	}
+
+	// get chat id
+	id, err := getChatId(r)
+	if err != nil {
+		WriteError(w, errChatNotFound)
+		return
+	}
+
+	// get visibility from front
+	req := new(types.VisibilityRequest)
+	json.NewDecoder(r.Body).Decode(req)
+	if !validVisibility(req.Visibility) {
+		WriteError(w, errInvalidVisibility)
+		return
+	}
+
+	// update chat
+	if err = s.store.SetChatVisibility(r.Context(), id, req.Visibility); err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			WriteError(w, errChatNotFound)
+			return
+		}
+		WriteError(w, errInternal)
+		s.logf(r, "error: set chat visibility failed: %v", err)
+		return
+	}
+
+	// response
+	WriteJSON(w, http.StatusOK, req)
+}
+
+// handleChatAnnouncement marks a chat as announcements, which publishes an
+// atom feed of it while it is public
+func (s *Server) handleChatAnnouncement(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "PUT" {
+		WriteError(w, errMethodNotAllowed(r.Method))
+		return
+	}
+
+	// get chat id
+	id, err := getChatId(r)
+	if err != nil {
+		WriteError(w, errChatNotFound)
+		return
+	}
+
+	// get flag from front
+	req := new(types.ChatAnnouncementRequest)
+	json.NewDecoder(r.Body).Decode(req)
+
+	// update chat
+	if err = s.store.SetChatAnnouncement(r.Context(), id, req.Announcement); err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			WriteError(w, errChatNotFound)
+			return
+		}
+		WriteError(w, errInternal)
+		s.logf(r, "error: set chat announcement failed: %v", err)
+		return
+	}
+
+	// response
+	WriteJSON(w, http.StatusOK, req)
+}
+
+func (s *Server) handleLogin(w http.ResponseWriter, r *http.Request) {
+	// check req method
+	if r.Method != "POST" {
+		WriteError(w, errMethodNotAllowed(r.Method))
+		return
+	}
+
+	// get req
+	login := new(types.LoginRequest)
+	json.NewDecoder(r.Body).Decode(login)
+	login.Email = normalizeEmail(login.Email)
+
+	// directory logins
+	if s.ldap != nil {
+		user, apiErr := s.ldapUser(r.Context(), login.Email, login.Password)
+		if apiErr != nil {
+			WriteError(w, apiErr)
+			return
+		}
+		s.writeLoginResponse(w, r, user)
+		return
+	}
+
+	// check if user exists, in whichever workspace
+	user, err := s.store.GetUserByEmail(storage.Unscoped(r.Context()), login.Email)
+	if err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			WriteError(w, errUserNotFound)
+			return
+		}
+		WriteError(w, errInternal)
+		s.logf(r, "error: get user failed: %v", err)
+		return
+	}
+
+	// check password
+	if ok := user.ValidatePassword(login.Password); !ok {
+		WriteError(w, errInvalidPassword)
+		return
+	}
+
+	// response
+	s.writeLoginResponse(w, r, user)
+}
+
+// writeLoginResponse issues a token and sends the user with their chats,
+// shared by every login method
+func (s *Server) writeLoginResponse(w http.ResponseWriter, r *http.Request, user *types.User) {
+	// the rest of the login sees the user's workspace
+	r = r.WithContext(withUser(r.Context(), user))
+	if user.Disabled {
+		WriteError(w, errAccountDisabled)
+		return
+	}
+	if err := s.onLogin(r.Context(), user); err != nil {
+		s.writeVeto(w, r, err)
+		return
+	}
+
+	// generate token
+	token, err := s.auth.CreateToken(user.Id, user.TokenVersion)
+	if err != nil {
+		WriteError(w, errInternal)
+		s.logf(r, "jwt error: %v", err)
+		return
+	}
+
+	chats, err := s.store.GetChats(r.Context(), user.Chats)
+	if err != nil {
+		WriteError(w, errInternal)
+		s.logf(r, "get chats error: %v", err)
+		return
+	}
+
+	chatsjs := []types.ChatJSON{}
+	for _, c := range chats {
+		chatsjs = append(chatsjs, c.ToJSON())
+	}
+
+	// get announcements sent while offline
+	announcements, err := s.store.GetUnseenAnnouncements(r.Context(), user.Id)
+	if err != nil {
+		WriteError(w, errInternal)
+		s.logf(r, "get announcements error: %v", err)
+		return
+	}
+	if len(announcements) > 0 {
+		last := announcements[len(announcements)-1].Id
+		if err = s.store.MarkAnnouncementSeen(r.Context(), []int{user.Id}, last); err != nil {
+			s.logf(r, "mark announcements error: %v", err)
+		}
+	}
+
+	// response
+	res := types.UserJSON{Id: user.Id, Username: user.Username, DisplayName: user.DisplayName, Email: user.Email, Role: user.Role, WorkspaceId: user.WorkspaceId, TimeZone: user.TimeZone, Chats: chatsjs, Announcements: announcements, Token: token}
+	WriteJSON(w, http.StatusCreated, res)
+}
+
+func (s *Server) handleJWKS(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		WriteError(w, errMethodNotAllowed(r.Method))
+		return
+	}
+
+	// only asymmetric keys can be published
+	jwks := s.auth.JWKS()
+	if len(jwks.Keys) == 0 {
+		WriteError(w, errNotFound)
+		return
+	}
+
+	// response
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	WriteJSON(w, http.StatusOK, jwks)
+}
+
+// usernames start with a letter and are handles for mentions and login
+var usernamePattern = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_.-]{2,19}$`)
+
+// reservedUsernames can't be registered, also with other case or with
+// dots, dashes and underscores in them
+var reservedUsernames = []string{
+	"admin", "administrator", "moderator", "system", "support", "help",
+	"root", "staff", "security", "official", "gochat", "everyone", "here",
+}
+
+// checkUsername returns why a username can't be taken, nil if it can
+func checkUsername(username string) *ApiError {
+	if !usernamePattern.MatchString(username) {
+		return errInvalidUsername
+	}
+	bare := strings.ToLower(strings.NewReplacer("_", "", ".", "", "-", "").Replace(username))
+	if slices.Contains(reservedUsernames, bare) {
+		return errUsernameNotAllowed
+	}
+	return nil
+}
+
+// normalizeEmail trims and lowercases an email, lookups ignore case
+// anyway but new accounts are stored this way
+func normalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+func (s *Server) handleRegister(w http.ResponseWriter, r *http.Request) {
+	// check req method
+	if r.Method != "POST" {
+		WriteError(w, errMethodNotAllowed(r.Method))
+		return
+	}
+
+	// directory users are created when they first log in
+	if !s.config.Get().Enabled("registration") || s.ldap != nil {
+		WriteError(w, errRegistrationDisabled)
+		return
+	}
+
+	// get req
+	reg := new(types.RegisterRequest)
+	json.NewDecoder(r.Body).Decode(reg)
+	reg.Email = normalizeEmail(reg.Email)
+
+	// check for blocked words in username
+	if s.config.Get().HasFilteredWord(reg.Username) {
+		WriteError(w, errUsernameNotAllowed)
+		return
+	}
+
+	// check the username format and the email length
+	if apiErr := checkUsername(reg.Username); apiErr != nil {
+		WriteError(w, apiErr)
+		return
+	}
+	if len(reg.Email) > 50 {
+		WriteError(w, errUserFieldsTooLong)
+		return
+	}
+
+	// get the workspace, usernames and emails are unique across all of them
+	ctx := storage.WithWorkspace(r.Context(), storage.DefaultWorkspace)
+	if reg.Workspace != "" {
+		ws, err := s.store.GetWorkspaceBySlug(r.Context(), reg.Workspace)
+		if errors.Is(err, storage.ErrNotFound) {
+			WriteError(w, errWorkspaceNotFound)
+			return
+		}
+		if err != nil {
+			WriteError(w, errInternal)
+			s.logf(r, "error: get workspace failed: %v", err)
+			return
+		}
+		ctx = storage.WithWorkspace(r.Context(), ws.Id)
+	}
+
+	// check if user exists before hashing, CreateUser catches the races
+	_, err := s.store.GetUserByEmail(storage.Unscoped(r.Context()), reg.Email)
+	if err == nil {
+		WriteError(w, errUserExists)
+		return
+	}
+	if !errors.Is(err, storage.ErrNotFound) {
+		WriteError(w, errInternal)
+		s.logf(r, "error: get user failed: %v", err)
+		return
+	}
+
+	// hash password
+	encPass, err := bcrypt.GenerateFromPassword([]byte(reg.Password), bcrypt.DefaultCost)
+	if err != nil {
+		WriteError(w, errInternal)
+		s.logf(r, "error: bcrypt encryption error: %v", err)
+		return
+	}
+
+	// create user in db, the email or username may have been taken since
+	// and the workspace may be full
+	user, err := s.createUser(ctx, reg.Username, reg.Email, string(encPass))
+	var apiErr *ApiError
+	if errors.As(err, &apiErr) {
+		WriteError(w, apiErr)
+		return
+	}
+	if errors.Is(err, storage.ErrConflict) {
+		WriteError(w, errUserExists)
+		return
+	}
+	if err != nil {
+		WriteError(w, errInternal)
+		s.logf(r, "error: create user failed: %v", err)
+		return
+	}
+
+	// generate token
+	token, err := s.auth.CreateToken(user.Id, user.TokenVersion)
+	if err != nil {
+		WriteError(w, errInternal)
+		s.logf(r, "jwt error: %v", err)
+		return
+	}
+
+	// response
+	res := types.UserJSON{Id: user.Id, Username: user.Username, DisplayName: user.DisplayName, Email: user.Email, Role: user.Role, WorkspaceId: user.WorkspaceId, TimeZone: user.TimeZone, Chats: []types.ChatJSON{}, Announcements: []types.AnnouncementJSON{}, Token: token}
+	WriteJSON(w, http.StatusCreated, res)
+}
+
+func (s *Server) protectMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// check for http header
+		header := r.Header.Get("Authorization")
+		if header == "" && websocket.IsWebSocketUpgrade(r) {
+			// browsers can't set headers on websocket requests
+			header = "Bearer " + r.URL.Query().Get("token")
+		}
+		if !strings.HasPrefix(header, "Bearer ") {
+			WriteError(w, errNotAuthorized)
+			return
+		}
+
+		// bots authenticate with api tokens
+		tokenString := strings.TrimPrefix(header, "Bearer ")
+		if strings.HasPrefix(tokenString, apiTokenPrefix) {
+			user, ok := s.apiTokenUser(w, r, tokenString)
+			if ok {
+				next(w, r.WithContext(withUser(r.Context(), user)))
+			}
+			return
+		}
+
+		// validate token and get userId
+		userId, version, err := s.auth.ValidateToken(tokenString)
+		if err != nil {
+			WriteError(w, errNotAuthorized)
+			return
+		}
+		// the token's user is found in any workspace, their calls are
+		// scoped to it
+		user, err := s.store.GetUserById(storage.Unscoped(r.Context()), userId)
+		if errors.Is(err, storage.ErrNotFound) {
+			WriteError(w, errNotAuthorized)
+			return
+		}
+		if err != nil {
+			s.logf(r, "protect error: getUserById err: %v", err)
+			WriteError(w, errInternal)
+			return
+		}
+		if user.Disabled {
+			WriteError(w, errAccountDisabled)
+			return
+		}
+		// revoked by a password change
+		if version != user.TokenVersion {
+			WriteError(w, errNotAuthorized)
+			return
+		}
+
+		// call the next func with user in context
+		next(w, r.WithContext(withUser(r.Context(), user)))
+	}
+}
+
+// withUser puts the user in the context and keeps the store calls made
+// with it inside their workspace
+func withUser(ctx context.Context, user *types.User) context.Context {
+	return storage.WithWorkspace(context.WithValue(ctx, userContextKey, user), user.WorkspaceId)
+}
+
+// guestMiddleware lets requests without a token through without a user in
+// the context, the handler decides what guests can do. Guests see the
+// default workspace
+func (s *Server) guestMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	protected := s.protectMiddleware(next)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") == "" {
+			next(w, r.WithContext(storage.WithWorkspace(r.Context(), storage.DefaultWorkspace)))
+			return
+		}
+		protected(w, r)
+	}
+}
+
+func WriteJSON(w http.ResponseWriter, status int, v any) {
+	// headers must be set before the status is written
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("error: json encoding failed: %v", err)
+	}
+}
+
+// WriteJSONWithETag tags the payload with a hash of its content and
+// answers conditional requests with 304 when the client copy is current
+func WriteJSONWithETag(w http.ResponseWriter, r *http.Request, status int, v any) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("error: json encoding failed: %v", err)
+		WriteError(w, errInternal)
+		return
+	}
+	sum := sha256.Sum256(data)
+	etag := fmt.Sprintf(`"%x"`, sum[:16])
+
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "no-cache")
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(append(data, '\n'))
+}
+
+func etagMatches(header string, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == etag || candidate == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// canRead reports whether user, nil for guests, can read the chat
+func canRead(user *types.User, chat *types.Chat) bool {
+	if chat.Visibility == types.VisibilityPublic {
+		return true
+	}
+	if user == nil {
+		return false
+	}
+	for _, id := range user.Chats {
+		if id == chat.Id {
+			return true
+		}
+	}
+	return false
+}
+
+const (
+	maxTags        = 10
+	maxTagLength   = 30
+	maxCategoryLen = 50
+)
+
+// normalizeTags trims the category and lowercases and dedups the tags,
+// tags can only have letters, digits and dashes
+func normalizeTags(category string, tags []string) (string, []string, bool) {
+	category = strings.TrimSpace(category)
+	if len(category) > maxCategoryLen || len(tags) > maxTags {
+		return "", nil, false
+	}
+
+	result := []string{}
+	seen := map[string]bool{}
+	for _, tag := range tags {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if tag == "" || len(tag) > maxTagLength {
+			return "", nil, false
+		}
+		for _, c := range tag {
+			if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-') {
+				return "", nil, false
+			}
+		}
+		if !seen[tag] {
+			seen[tag] = true
+			result = append(result, tag)
+		}
+	}
+	return category, result, true
+}
+
+const (
+	maxNameLen    = 100
+	maxTopicLen   = 300
+	maxWelcomeLen = 1000
+)
+
+// normalizeChatInfo trims the name and topic and checks their lengths
+func normalizeChatInfo(name string, topic string) (string, string, bool) {
+	name, topic = strings.TrimSpace(name), strings.TrimSpace(topic)
+	if utf8.RuneCountInString(name) > maxNameLen || utf8.RuneCountInString(topic) > maxTopicLen {
+		return "", "", false
+	}
+	return name, topic, true
+}
+
+func validVisibility(visibility string) bool {
+	return visibility == types.VisibilityPrivate || visibility == types.VisibilityPublic
+}
+
+// getTime parses an optional RFC3339 query parameter
+func getTime(r *http.Request, key string) (time.Time, error) {
+	value := r.URL.Query().Get(key)
+	if value == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+func getUserId(r *http.Request) (int, error) {
+	ids := mux.Vars(r)["userId"]
+	id, err := strconv.Atoi(ids)
+	if err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+const (
+	defaultPageSize = 50
+	maxPageSize     = 200
+)
+
+// getPage reads the ?cursor= and ?limit= query parameters of list endpoints
+func getPage(r *http.Request) (int, int, error) {
+	cursor, limit := 0, defaultPageSize
+	if c := r.URL.Query().Get("cursor"); c != "" {
+		var err error
+		if cursor, err = strconv.Atoi(c); err != nil || cursor < 0 {
+			return 0, 0, errors.New("invalid cursor")
+		}
+	}
+	if l := r.URL.Query().Get("limit"); l != "" {
+		var err error
+		if limit, err = strconv.Atoi(l); err != nil || limit < 1 {
+			return 0, 0, errors.New("invalid limit")
+		}
+		limit = min(limit, maxPageSize)
+	}
+	return cursor, limit, nil
+}
+
+func getMessageId(r *http.Request) (int64, error) {
+	return strconv.ParseInt(mux.Vars(r)["messageId"], 10, 64)
+}
+
+func getChatId(r *http.Request) (int, error) {
+	ids := mux.Vars(r)["chatId"]
+	id, err := strconv.Atoi(ids)
+	if err != nil {
+		return 0, err
+	}
+	return id, nil
+}
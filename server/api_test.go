@@ -0,0 +1,53 @@
+package server
+
+import (
+	"context"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"example/gochat/storage"
+	"example/gochat/types"
+)
+
+// testServer returns a server on a bolt store of its own with the runtime
+// config in the JSON config, it isn't started
+func testServer(t *testing.T, config string, opts ...Option) *Server {
+	t.Helper()
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.json")
+	if err := os.WriteFile(path, []byte(config), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	loader, err := NewConfigLoader(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := storage.NewBoltStore(filepath.Join(dir, "gochat.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	if err = store.Init(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	opts = append([]Option{WithStorage(store), WithConfig(loader), WithLogger(log.New(io.Discard, "", 0))}, opts...)
+	return NewServer("127.0.0.1:0", opts...)
+}
+
+// testChat creates a user in the default workspace with a chat of their own
+func testChat(t *testing.T, s *Server) (context.Context, *types.User, *types.Chat) {
+	t.Helper()
+	ctx := storage.WithWorkspace(context.Background(), storage.DefaultWorkspace)
+	user, err := s.store.CreateUser(ctx, "alice", "alice@example.com", "hash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	chat, err := s.store.CreateChat(ctx, types.Chat{Name: "room", Visibility: types.VisibilityPublic}, *user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ctx, user, chat
+}
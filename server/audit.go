@@ -0,0 +1,53 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+
+	"example/gochat/types"
+)
+
+// audit records an admin action, it already happened so a failure is only
+// logged
+func (s *Server) audit(r *http.Request, action string, chatId int, data any) {
+	admin, ok := r.Context().Value(userContextKey).(*types.User)
+	if !ok {
+		return
+	}
+	actor := types.AuthorJSON{Id: admin.Id, Username: admin.Username}
+	// the admin may have gone away during a long action
+	if err := s.store.AddAuditEntry(context.WithoutCancel(r.Context()), actor, action, chatId, data); err != nil {
+		s.logf(r, "error: add audit entry %s failed: %v", action, err)
+	}
+}
+
+// handleAdminAudit pages through the audit log newest first
+func (s *Server) handleAdminAudit(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		WriteError(w, errMethodNotAllowed(r.Method))
+		return
+	}
+
+	// get page, the cursor is the id of the last entry returned
+	cursor, limit, err := getPage(r)
+	if err != nil {
+		WriteError(w, errInvalidCursor)
+		return
+	}
+
+	// get entries
+	entries, err := s.store.GetAuditLog(r.Context(), int64(cursor), limit)
+	if err != nil {
+		WriteError(w, errInternal)
+		s.logf(r, "error: get audit log failed: %v", err)
+		return
+	}
+
+	// response
+	res := types.ListJSON[types.AuditEntryJSON]{Data: entries, Total: len(entries)}
+	if len(entries) == limit {
+		res.NextCursor = strconv.FormatInt(entries[len(entries)-1].Id, 10)
+	}
+	WriteJSON(w, http.StatusOK, res)
+}
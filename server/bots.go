@@ -0,0 +1,310 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+
+	"example/gochat/storage"
+	"example/gochat/types"
+)
+
+// api tokens start with this, which tells them apart from login tokens
+const apiTokenPrefix = "gcb_"
+
+// newAPIToken returns a random token and the hash it is stored under
+func newAPIToken() (string, []byte, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", nil, err
+	}
+	token := apiTokenPrefix + base64.RawURLEncoding.EncodeToString(b)
+	return token, hashAPIToken(token), nil
+}
+
+func hashAPIToken(token string) []byte {
+	sum := sha256.Sum256([]byte(token))
+	return sum[:]
+}
+
+// scopeAllows reports whether a token of the scope may make the request
+func scopeAllows(scope string, r *http.Request) bool {
+	switch scope {
+	case types.ScopeRead:
+		return r.Method == "GET" || r.Method == "HEAD"
+	case types.ScopeSend:
+		route := mux.CurrentRoute(r)
+		if route == nil || r.Method != "POST" {
+			return false
+		}
+		template, err := route.GetPathTemplate()
+		return err == nil && template == "/api/chats/{chatId}/messages"
+	}
+	return false
+}
+
+// apiTokenUser returns the bot of an api token, or writes why the request
+// can't be made with it
+func (s *Server) apiTokenUser(w http.ResponseWriter, r *http.Request, token string) (*types.User, bool) {
+	// the token and its bot are found in any workspace, the calls made
+	// with it are scoped to the bot's
+	ctx := storage.Unscoped(r.Context())
+	userId, scope, err := s.store.GetAPIToken(ctx, hashAPIToken(token))
+	if errors.Is(err, storage.ErrNotFound) {
+		WriteError(w, errNotAuthorized)
+		return nil, false
+	}
+	if err != nil {
+		WriteError(w, errInternal)
+		s.logf(r, "protect error: getAPIToken err: %v", err)
+		return nil, false
+	}
+	user, err := s.store.GetUserById(ctx, userId)
+	if errors.Is(err, storage.ErrNotFound) {
+		WriteError(w, errNotAuthorized)
+		return nil, false
+	}
+	if err != nil {
+		WriteError(w, errInternal)
+		s.logf(r, "protect error: getUserById err: %v", err)
+		return nil, false
+	}
+	if user.Disabled {
+		WriteError(w, errAccountDisabled)
+		return nil, false
+	}
+	if !scopeAllows(scope, r) {
+		WriteError(w, errTokenScope)
+		return nil, false
+	}
+	return user, true
+}
+
+// handleAdminBots creates a bot account, which can only be used with the
+// api tokens issued to it
+func (s *Server) handleAdminBots(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		WriteError(w, errMethodNotAllowed(r.Method))
+		return
+	}
+
+	// get req
+	req := new(types.CreateBotRequest)
+	json.NewDecoder(r.Body).Decode(req)
+	if s.config.Get().HasFilteredWord(req.Username) {
+		WriteError(w, errUsernameNotAllowed)
+		return
+	}
+	if apiErr := checkUsername(req.Username); apiErr != nil {
+		WriteError(w, apiErr)
+		return
+	}
+
+	// create bot, unless the workspace is full
+	bot, err := s.createBot(r.Context(), req.Username)
+	if err != nil {
+		var apiErr *ApiError
+		if errors.As(err, &apiErr) {
+			WriteError(w, apiErr)
+			return
+		}
+		if errors.Is(err, storage.ErrConflict) {
+			WriteError(w, errUserExists)
+			return
+		}
+		WriteError(w, errInternal)
+		s.logf(r, "error: create bot failed: %v", err)
+		return
+	}
+	s.audit(r, types.AuditBotCreated, 0, map[string]any{"userId": bot.Id, "username": bot.Username})
+
+	// response
+	WriteJSON(w, http.StatusCreated, types.AdminUserJSON{Id: bot.Id, Username: bot.Username, Email: bot.Email, Role: bot.Role, TimeZone: bot.TimeZone, Chats: bot.Chats, Bot: true})
+}
+
+// getBot returns the bot of the request path, or writes why there is none
+func (s *Server) getBot(w http.ResponseWriter, r *http.Request) (*types.User, bool) {
+	id, err := getUserId(r)
+	if err != nil {
+		WriteError(w, errBotNotFound)
+		return nil, false
+	}
+	bot, err := s.store.GetUserById(r.Context(), id)
+	if err != nil && !errors.Is(err, storage.ErrNotFound) {
+		WriteError(w, errInternal)
+		s.logf(r, "error: get user failed: %v", err)
+		return nil, false
+	}
+	if err != nil || !bot.Bot {
+		WriteError(w, errBotNotFound)
+		return nil, false
+	}
+	return bot, true
+}
+
+// handleAdminBotChats adds a bot to a chat, bots can't join on their own.
+// Moderators remove them like other members
+func (s *Server) handleAdminBotChats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		WriteError(w, errMethodNotAllowed(r.Method))
+		return
+	}
+
+	// get bot
+	bot, ok := s.getBot(w, r)
+	if !ok {
+		return
+	}
+
+	// get chat
+	req := new(types.JoinChatRequest)
+	json.NewDecoder(r.Body).Decode(req)
+	chat, err := s.store.GetChatById(r.Context(), req.Id)
+	if err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			WriteError(w, errChatNotFound)
+			return
+		}
+		WriteError(w, errInternal)
+		s.logf(r, "error: get chat failed: %v", err)
+		return
+	}
+
+	// add bot to chat
+	for _, id := range bot.Chats {
+		if id == chat.Id {
+			WriteJSON(w, http.StatusOK, chat.ToJSON())
+			return
+		}
+	}
+	if err := s.onUserJoin(r.Context(), JoinEvent{User: bot, Chat: chat}); err != nil {
+		s.writeVeto(w, r, err)
+		return
+	}
+	if err := s.store.AddMember(r.Context(), chat.Id, bot.Id); err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			WriteError(w, errChatNotFound)
+			return
+		}
+		if errors.Is(err, storage.ErrConflict) {
+			WriteJSON(w, http.StatusOK, chat.ToJSON())
+			return
+		}
+		WriteError(w, errInternal)
+		s.logf(r, "error: add member failed: %v", err)
+		return
+	}
+	author := types.AuthorJSON{Id: bot.Id, Username: bot.Username, DisplayName: bot.DisplayName}
+	chat.Users = append(chat.Users, author)
+	s.recordChange(r.Context(), chat.Id, bot.Id, ChangeMemberJoined, author)
+	s.hub.Join(bot.Id, chat.Id)
+
+	// response
+	WriteJSON(w, http.StatusOK, chat.ToJSON())
+}
+
+// handleAdminBotTokens lists the api tokens of a bot or issues a new one,
+// whose secret is only shown in this response
+func (s *Server) handleAdminBotTokens(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "POST" {
+		WriteError(w, errMethodNotAllowed(r.Method))
+		return
+	}
+
+	// get bot
+	bot, ok := s.getBot(w, r)
+	if !ok {
+		return
+	}
+
+	// list tokens
+	if r.Method == "GET" {
+		tokens, err := s.store.GetAPITokens(r.Context(), bot.Id)
+		if err != nil {
+			WriteError(w, errInternal)
+			s.logf(r, "error: get api tokens failed: %v", err)
+			return
+		}
+		WriteJSON(w, http.StatusOK, types.ListJSON[types.APITokenJSON]{Data: tokens, Total: len(tokens)})
+		return
+	}
+
+	// get req
+	req := new(types.CreateAPITokenRequest)
+	json.NewDecoder(r.Body).Decode(req)
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" || utf8.RuneCountInString(req.Name) > 50 || (req.Scope != types.ScopeRead && req.Scope != types.ScopeSend) {
+		WriteError(w, errInvalidAPIToken)
+		return
+	}
+
+	// issue token
+	secret, hash, err := newAPIToken()
+	if err != nil {
+		WriteError(w, errInternal)
+		s.logf(r, "error: generate api token failed: %v", err)
+		return
+	}
+	token, err := s.store.CreateAPIToken(r.Context(), bot.Id, req.Name, req.Scope, hash)
+	if err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			WriteError(w, errBotNotFound)
+			return
+		}
+		WriteError(w, errInternal)
+		s.logf(r, "error: create api token failed: %v", err)
+		return
+	}
+	s.audit(r, types.AuditAPITokenIssued, 0, map[string]any{"userId": bot.Id, "tokenId": token.Id, "name": token.Name, "scope": token.Scope})
+
+	// response
+	token.Token = secret
+	WriteJSON(w, http.StatusCreated, token)
+}
+
+// handleAdminDeleteBotToken revokes an api token, requests made with it
+// are refused from then on
+func (s *Server) handleAdminDeleteBotToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "DELETE" {
+		WriteError(w, errMethodNotAllowed(r.Method))
+		return
+	}
+
+	// get bot and token id
+	userId, err := getUserId(r)
+	if err != nil {
+		WriteError(w, errAPITokenNotFound)
+		return
+	}
+	tokenId, err := strconv.Atoi(mux.Vars(r)["tokenId"])
+	if err != nil {
+		WriteError(w, errAPITokenNotFound)
+		return
+	}
+
+	// delete token
+	if err = s.store.DeleteAPIToken(r.Context(), userId, tokenId); err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			WriteError(w, errAPITokenNotFound)
+			return
+		}
+		WriteError(w, errInternal)
+		s.logf(r, "error: delete api token failed: %v", err)
+		return
+	}
+	s.audit(r, types.AuditAPITokenRevoked, 0, map[string]any{"userId": userId, "tokenId": tokenId})
+
+	// the bot's websockets may have been opened with it
+	s.hub.Disconnect(userId)
+
+	// response
+	w.WriteHeader(http.StatusNoContent)
+}
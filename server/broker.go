@@ -0,0 +1,218 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"time"
+
+	"example/gochat/types"
+)
+
+const (
+	// a publish that takes longer is given up, local clients already have
+	// the event
+	publishTimeout = 5 * time.Second
+	// how often each instance tells the others who is connected to it
+	statusInterval = 10 * time.Second
+	// an instance not heard from this long is taken as gone
+	statusExpiry = 3 * statusInterval
+)
+
+// Broker carries hub events to the other server instances, each of them
+// delivers what it receives to its own clients. Without one a server only
+// reaches the clients connected to it
+type Broker interface {
+	// Publish sends a payload to every instance, the sender may get it back
+	Publish(context.Context, []byte) error
+	// Listen calls deliver with every published payload until ctx is done
+	Listen(context.Context, func([]byte)) error
+}
+
+// WithBroker shares events with the other instances through broker
+func WithBroker(broker Broker) Option {
+	return func(s *Server) {
+		s.broker = broker
+	}
+}
+
+// hubEvent is an event on its way to the other instances
+type hubEvent struct {
+	// instance that sent it, which ignores it when it comes back
+	Origin string `json:"origin"`
+	// to every client of the workspace
+	All       bool `json:"all,omitempty"`
+	Workspace int  `json:"workspace,omitempty"`
+	// the id of the announcement the event carries
+	Announcement int `json:"announcement,omitempty"`
+	// or to the connections of these users
+	UserIds []int `json:"userIds,omitempty"`
+	// or to the members of a chat, chat events go into the replay buffer
+	ChatId    int   `json:"chatId,omitempty"`
+	MessageId int64 `json:"messageId,omitempty"`
+	Event     struct {
+		Id   int64           `json:"id,omitempty"`
+		Type string          `json:"type"`
+		Data json.RawMessage `json:"data"`
+	} `json:"event"`
+	// or the status of the sending instance instead of an event
+	Node *nodeStatus `json:"node,omitempty"`
+	// or the user whose connections to close
+	Disconnect int `json:"disconnect,omitempty"`
+	// or a member who joined or left a chat
+	Membership *hubMembership `json:"membership,omitempty"`
+}
+
+// hubMembership changes which connections get a chat's events, without a
+// user it drops the chat
+type hubMembership struct {
+	ChatId int  `json:"chatId"`
+	UserId int  `json:"userId,omitempty"`
+	Joined bool `json:"joined,omitempty"`
+}
+
+// nodeStatus is what an instance last told about its connections
+type nodeStatus struct {
+	UserIds     []int `json:"userIds"`
+	Connections int   `json:"connections"`
+	// sent when shutting down
+	Leaving bool `json:"leaving,omitempty"`
+	expires time.Time
+}
+
+func newOrigin() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// publish hands an event the local clients already got to the broker
+func (h *Hub) publish(e hubEvent, event types.EventJSON) {
+	if h.broker == nil {
+		return
+	}
+	data, err := json.Marshal(event.Data)
+	if err != nil {
+		h.logger.Printf("error: hub json encoding failed: %v", err)
+		return
+	}
+	e.Event.Id, e.Event.Type, e.Event.Data = event.Id, event.Type, data
+	if err = h.relay(e); err != nil {
+		h.logger.Printf("error: publish %s event failed: %v", event.Type, err)
+	}
+}
+
+// relayMembership tells the other instances about a membership change
+func (h *Hub) relayMembership(m hubMembership) {
+	if h.broker == nil {
+		return
+	}
+	if err := h.relay(hubEvent{Membership: &m}); err != nil {
+		h.logger.Printf("error: publish membership failed: %v", err)
+	}
+}
+
+func (h *Hub) relay(e hubEvent) error {
+	e.Origin = h.origin
+	payload, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), publishTimeout)
+	defer cancel()
+	return h.broker.Publish(ctx, payload)
+}
+
+// receive delivers an event published by another instance
+func (h *Hub) receive(payload []byte) {
+	e := hubEvent{}
+	if err := json.Unmarshal(payload, &e); err != nil {
+		h.logger.Printf("error: broker event decoding failed: %v", err)
+		return
+	}
+	if e.Origin == h.origin {
+		return
+	}
+	if e.Node != nil {
+		h.updateNode(e.Origin, *e.Node)
+		return
+	}
+	if e.Disconnect != 0 {
+		h.disconnect(e.Disconnect)
+		return
+	}
+	if e.Membership != nil {
+		h.updateMembership(*e.Membership)
+		return
+	}
+
+	// data stays raw json, it is only encoded again for protobuf clients
+	event := types.EventJSON{Id: e.Event.Id, Type: e.Event.Type, Data: e.Event.Data}
+	switch {
+	case e.All:
+		h.send(event, e.Announcement, func(c *Client) bool { return c.user.WorkspaceId == e.Workspace })
+	case e.ChatId != 0:
+		h.replayMu.Lock()
+		h.replay.add(e.ChatId, e.MessageId, event, time.Now())
+		h.sendToChat(e.ChatId, event)
+		h.replayMu.Unlock()
+	default:
+		h.sendToUsers(e.UserIds, event)
+	}
+}
+
+// listen delivers the events of the other instances until ctx is done
+func (h *Hub) listen(ctx context.Context) {
+	if err := h.broker.Listen(ctx, h.receive); err != nil && ctx.Err() == nil {
+		h.logger.Printf("error: broker stopped: %v", err)
+	}
+}
+
+// announce sends the status of this instance to the others until ctx is
+// done, then tells them it is leaving
+func (h *Hub) announce(ctx context.Context) {
+	ticker := time.NewTicker(statusInterval)
+	defer ticker.Stop()
+	for {
+		status := nodeStatus{UserIds: h.localUserIds(), Connections: h.Count()}
+		if err := h.relay(hubEvent{Node: &status}); err != nil && ctx.Err() == nil {
+			h.logger.Printf("error: publish status failed: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			if err := h.relay(hubEvent{Node: &nodeStatus{Leaving: true}}); err != nil {
+				h.logger.Printf("error: publish status failed: %v", err)
+			}
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (h *Hub) updateNode(origin string, status nodeStatus) {
+	h.nodesMu.Lock()
+	defer h.nodesMu.Unlock()
+	if status.Leaving {
+		delete(h.nodes, origin)
+		return
+	}
+	status.expires = time.Now().Add(statusExpiry)
+	h.nodes[origin] = status
+}
+
+// liveNodes returns the other instances heard from lately
+func (h *Hub) liveNodes() []nodeStatus {
+	h.nodesMu.Lock()
+	defer h.nodesMu.Unlock()
+	now := time.Now()
+	nodes := []nodeStatus{}
+	for origin, node := range h.nodes {
+		if now.After(node.expires) {
+			delete(h.nodes, origin)
+			continue
+		}
+		nodes = append(nodes, node)
+	}
+	return nodes
+}
@@ -0,0 +1,245 @@
+package server
+
+import (
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/gorilla/websocket"
+)
+
+// compressionStats counts what connections using permessage-deflate
+// write, to tell how much the compression saves
+type compressionStats struct {
+	// bytes of the messages before compression
+	payload atomic.Int64
+	// bytes written to the sockets, frame headers and pings included
+	wire atomic.Int64
+}
+
+// Ratio is wire bytes per payload byte, 0 before anything was sent
+func (s *compressionStats) Ratio() float64 {
+	payload := s.payload.Load()
+	if payload == 0 {
+		return 0
+	}
+	return float64(s.wire.Load()) / float64(payload)
+}
+
+// offersDeflate reports whether the client asked for permessage-deflate,
+// which the upgrader then accepts
+func offersDeflate(r *http.Request) bool {
+	for _, value := range r.Header.Values("Sec-Websocket-Extensions") {
+		if strings.Contains(strings.ToLower(value), "permessage-deflate") {
+			return true
+		}
+	}
+	return false
+}
+
+// countingWriter hands the upgrader a connection that counts the bytes
+// written to it
+type countingWriter struct {
+	http.ResponseWriter
+	stats *compressionStats
+}
+
+func (w countingWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response does not implement http.Hijacker")
+	}
+	conn, brw, err := h.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	return countingConn{Conn: conn, stats: w.stats}, brw, nil
+}
+
+type countingConn struct {
+	net.Conn
+	stats *compressionStats
+}
+
+func (c countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.stats.wire.Add(int64(n))
+	return n, err
+}
+
+// write sends an encoded event, compressed when the connection negotiated
+// compression and the event is at least the threshold
+func (c *Client) write(data []byte) error {
+	if c.compressAbove > 0 {
+		c.conn.EnableWriteCompression(len(data) >= c.compressAbove)
+		c.hub.compression.payload.Add(int64(len(data)))
+	}
+	if c.protobuf {
+		return c.conn.WriteMessage(websocket.BinaryMessage, data)
+	}
+	return c.conn.WriteMessage(websocket.TextMessage, data)
+}
+
+// compressedTypes are the response types worth compressing
+var compressedTypes = []string{"application/json", "text/csv"}
+
+// compressionMiddleware gzips json responses of at least the threshold for
+// clients that accept it. Responses are held back until they reach the
+// threshold or end, smaller ones go out as they are
+func (s *Server) compressionMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		threshold := s.config.Get().CompressionThreshold
+		if threshold == 0 || r.Method == "HEAD" || r.Header.Get("Upgrade") != "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		gw := &gzipWriter{ResponseWriter: w, threshold: threshold, accepts: acceptsGzip(r), status: http.StatusOK}
+		defer gw.close()
+		next.ServeHTTP(gw, r)
+	})
+}
+
+// acceptsGzip reports whether Accept-Encoding allows gzip, by name or *,
+// with a quality above 0
+func acceptsGzip(r *http.Request) bool {
+	qualities := map[string]float64{}
+	for _, value := range r.Header.Values("Accept-Encoding") {
+		for _, coding := range strings.Split(value, ",") {
+			name, params, _ := strings.Cut(coding, ";")
+			q := 1.0
+			if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+				if parsed, err := strconv.ParseFloat(v, 64); err == nil {
+					q = parsed
+				}
+			}
+			qualities[strings.ToLower(strings.TrimSpace(name))] = q
+		}
+	}
+	if q, ok := qualities["gzip"]; ok {
+		return q > 0
+	}
+	return qualities["*"] > 0
+}
+
+type gzipWriter struct {
+	http.ResponseWriter
+	threshold int
+	accepts   bool
+	status    int
+	// set once the status is given, until then it is buffered
+	headerSet bool
+	// what was written while it could still go out uncompressed
+	buf []byte
+	// whether the response can still be compressed
+	buffering bool
+	gz        *gzip.Writer
+	// the response is passed on, compressed by gz or as it is
+	started bool
+}
+
+func (w *gzipWriter) WriteHeader(status int) {
+	if w.headerSet {
+		return
+	}
+	w.headerSet, w.status = true, status
+
+	// only successful responses of compressible types can be compressed
+	header := w.Header()
+	contentType, _, _ := strings.Cut(header.Get("Content-Type"), ";")
+	compressible := slices.Contains(compressedTypes, strings.TrimSpace(contentType)) && header.Get("Content-Encoding") == ""
+	if compressible {
+		header.Add("Vary", "Accept-Encoding")
+	}
+	if !compressible || !w.accepts || status < 200 || status == http.StatusNoContent || status == http.StatusNotModified {
+		w.start(false)
+		return
+	}
+	w.buffering = true
+}
+
+func (w *gzipWriter) Write(b []byte) (int, error) {
+	if !w.headerSet {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.buffering {
+		w.buf = append(w.buf, b...)
+		if len(w.buf) < w.threshold {
+			return len(b), nil
+		}
+		w.start(true)
+		return len(b), w.flushBuffer()
+	}
+	if w.gz != nil {
+		return w.gz.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// start passes the status on, with the compression headers when compress
+// is set
+func (w *gzipWriter) start(compress bool) {
+	w.buffering, w.started = false, true
+	if compress {
+		header := w.Header()
+		header.Set("Content-Encoding", "gzip")
+		header.Del("Content-Length")
+		// the compressed body is a different representation
+		if etag := header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+			header.Set("ETag", "W/"+etag)
+		}
+		w.gz = gzip.NewWriter(w.ResponseWriter)
+	}
+	w.ResponseWriter.WriteHeader(w.status)
+}
+
+func (w *gzipWriter) flushBuffer() error {
+	buf := w.buf
+	w.buf = nil
+	if w.gz != nil {
+		_, err := w.gz.Write(buf)
+		return err
+	}
+	_, err := w.ResponseWriter.Write(buf)
+	return err
+}
+
+// Flush sends what was written so far, compressed if it could be
+func (w *gzipWriter) Flush() {
+	if !w.headerSet {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.buffering {
+		w.start(true)
+		w.flushBuffer()
+	}
+	if w.gz != nil {
+		w.gz.Flush()
+	}
+	http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+// close ends the response, a buffered one goes out as it is
+func (w *gzipWriter) close() {
+	if !w.headerSet && !w.started {
+		// nothing was written, net/http answers 200 itself
+		return
+	}
+	if w.buffering {
+		w.start(false)
+		w.flushBuffer()
+	}
+	if w.gz != nil {
+		w.gz.Close()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the connection
+func (w *gzipWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,344 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+)
+
+const (
+	LogLevelDebug = "debug"
+	LogLevelInfo  = "info"
+)
+
+// Config holds the settings that can be changed at runtime
+type Config struct {
+	LogLevel   string          `json:"logLevel"`
+	RateLimit  RateLimitConfig `json:"rateLimit"`
+	WordFilter []string        `json:"wordFilter"`
+	Features   map[string]bool `json:"features"`
+	// cidrs of proxies whose X-Forwarded-For and X-Real-IP are believed
+	TrustedProxies []string `json:"trustedProxies"`
+	// addresses or cidrs refused before any other handling
+	BannedIps []string        `json:"bannedIps"`
+	Retention RetentionConfig `json:"retention"`
+	Websocket WebsocketConfig `json:"websocket"`
+	// endpoints the integration events of the outbox are posted to
+	Webhooks []WebhookConfig `json:"webhooks"`
+	// out of process plugins called over http before the actions they hook
+	Plugins []PluginConfig `json:"plugins"`
+	// json responses of at least this many bytes are gzipped for clients
+	// that accept it, 0 turns compression off
+	CompressionThreshold int `json:"compressionThreshold"`
+
+	proxies []*net.IPNet
+	banned  []*net.IPNet
+}
+
+type RetentionConfig struct {
+	// days of messages to keep, 0 keeps them forever
+	MessageDays int `json:"messageDays"`
+}
+
+// WebsocketConfig applies to connections opened after it is loaded
+type WebsocketConfig struct {
+	// seconds between pings from the server, 0 sends none
+	PingSeconds int `json:"pingSeconds"`
+	// seconds without a message or pong before a connection is dropped,
+	// 0 keeps idle connections
+	IdleSeconds int `json:"idleSeconds"`
+	// connections per user, opening one more closes the oldest, 0 for no limit
+	MaxConnectionsPerUser int `json:"maxConnectionsPerUser"`
+	// connections this instance takes, more are refused and /readyz fails
+	// so the load balancer sends them to another instance, 0 for no limit
+	MaxConnections int `json:"maxConnections"`
+	// messages of at least this many bytes are sent with permessage-deflate
+	// to clients that support it, 0 turns compression off
+	CompressionThreshold int `json:"compressionThreshold"`
+}
+
+type WebhookConfig struct {
+	// names the delivery cursor, a renamed webhook starts with new events
+	Name string `json:"name"`
+	Url  string `json:"url"`
+	// signs each body with hmac-sha256 when set
+	Secret string `json:"secret"`
+	// event types to send, all of them when empty
+	Events []string `json:"events"`
+}
+
+type PluginConfig struct {
+	// names the plugin in logs
+	Name string `json:"name"`
+	Url  string `json:"url"`
+	// signs each body with hmac-sha256 when set
+	Secret string `json:"secret"`
+	// message.create, user.join or login
+	Hooks []string `json:"hooks"`
+	// when set a plugin that fails or times out vetoes, otherwise it is
+	// skipped
+	Required bool `json:"required"`
+}
+
+type RateLimitConfig struct {
+	// requests per minute per client, 0 disables the limit
+	RequestsPerMinute int `json:"requestsPerMinute"`
+	// wrong passwords a user can give for a chat before they can't join it
+	// for a while, 0 disables the lockout
+	JoinAttempts int `json:"joinAttempts"`
+	// seconds a lockout lasts, also how long wrong passwords are counted
+	JoinLockoutSeconds int `json:"joinLockoutSeconds"`
+}
+
+func DefaultConfig() *Config {
+	return &Config{
+		LogLevel:             LogLevelInfo,
+		RateLimit:            RateLimitConfig{RequestsPerMinute: 300, JoinAttempts: 5, JoinLockoutSeconds: 300},
+		WordFilter:           []string{},
+		Features:             map[string]bool{},
+		TrustedProxies:       []string{},
+		BannedIps:            []string{},
+		Webhooks:             []WebhookConfig{},
+		Plugins:              []PluginConfig{},
+		Websocket:            WebsocketConfig{PingSeconds: 30, IdleSeconds: 75, MaxConnectionsPerUser: 10, CompressionThreshold: 512},
+		CompressionThreshold: 1024,
+	}
+}
+
+func (c *Config) Validate() error {
+	switch c.LogLevel {
+	case LogLevelDebug, LogLevelInfo:
+	default:
+		return fmt.Errorf("invalid logLevel %q", c.LogLevel)
+	}
+	if c.RateLimit.RequestsPerMinute < 0 {
+		return errors.New("rateLimit.requestsPerMinute can't be negative")
+	}
+	if c.RateLimit.JoinAttempts < 0 || c.RateLimit.JoinLockoutSeconds < 0 {
+		return errors.New("rateLimit.joinAttempts and rateLimit.joinLockoutSeconds can't be negative")
+	}
+	if c.RateLimit.JoinAttempts > 0 && c.RateLimit.JoinLockoutSeconds == 0 {
+		return errors.New("rateLimit.joinAttempts needs rateLimit.joinLockoutSeconds")
+	}
+	if c.CompressionThreshold < 0 {
+		return errors.New("compressionThreshold can't be negative")
+	}
+	if c.Retention.MessageDays < 0 {
+		return errors.New("retention.messageDays can't be negative")
+	}
+	if c.Websocket.PingSeconds < 0 || c.Websocket.IdleSeconds < 0 || c.Websocket.MaxConnectionsPerUser < 0 || c.Websocket.MaxConnections < 0 || c.Websocket.CompressionThreshold < 0 {
+		return errors.New("websocket settings can't be negative")
+	}
+	if c.Websocket.IdleSeconds > 0 && c.Websocket.IdleSeconds <= c.Websocket.PingSeconds {
+		return errors.New("websocket.idleSeconds must be longer than websocket.pingSeconds, or pongs can't keep connections alive")
+	}
+	if c.Websocket.IdleSeconds > 0 && c.Websocket.PingSeconds == 0 {
+		return errors.New("websocket.idleSeconds needs websocket.pingSeconds, or quiet clients are dropped")
+	}
+	for _, word := range c.WordFilter {
+		if strings.TrimSpace(word) == "" {
+			return errors.New("wordFilter can't contain empty words")
+		}
+	}
+	names := map[string]bool{}
+	for _, hook := range c.Webhooks {
+		if hook.Name == "" || names[hook.Name] {
+			return fmt.Errorf("webhooks: names must be set and unique, got %q", hook.Name)
+		}
+		names[hook.Name] = true
+		if u, err := url.Parse(hook.Url); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("webhooks: %s: invalid url %q", hook.Name, hook.Url)
+		}
+	}
+	names = map[string]bool{}
+	for _, plugin := range c.Plugins {
+		if plugin.Name == "" || names[plugin.Name] {
+			return fmt.Errorf("plugins: names must be set and unique, got %q", plugin.Name)
+		}
+		names[plugin.Name] = true
+		if u, err := url.Parse(plugin.Url); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("plugins: %s: invalid url %q", plugin.Name, plugin.Url)
+		}
+		for _, hook := range plugin.Hooks {
+			if hook != HookMessageCreate && hook != HookUserJoin && hook != HookLogin {
+				return fmt.Errorf("plugins: %s: unknown hook %q, expected message.create, user.join or login", plugin.Name, hook)
+			}
+		}
+	}
+	c.proxies = nil
+	for _, cidr := range c.TrustedProxies {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return fmt.Errorf("trustedProxies: %w", err)
+		}
+		c.proxies = append(c.proxies, ipNet)
+	}
+	c.banned = nil
+	for _, ip := range c.BannedIps {
+		ipNet, err := ParseBan(ip)
+		if err != nil {
+			return fmt.Errorf("bannedIps: %w", err)
+		}
+		c.banned = append(c.banned, ipNet)
+	}
+	return nil
+}
+
+// ParseBan parses a single address or a cidr range
+func ParseBan(s string) (*net.IPNet, error) {
+	if strings.Contains(s, "/") {
+		_, ipNet, err := net.ParseCIDR(s)
+		return ipNet, err
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid address %q", s)
+	}
+	bits := 8 * net.IPv6len
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, bits = ip4, 8*net.IPv4len
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+}
+
+// Banned reports whether ip is in one of the banned ranges
+func (c *Config) Banned(ip net.IP) bool {
+	for _, ipNet := range c.banned {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// TrustedProxy reports whether ip is in one of the trusted proxy ranges
+func (c *Config) TrustedProxy(ip net.IP) bool {
+	for _, ipNet := range c.proxies {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Enabled reports whether a feature flag is on, flags default to on
+func (c *Config) Enabled(feature string) bool {
+	enabled, ok := c.Features[feature]
+	return !ok || enabled
+}
+
+// HasFilteredWord reports whether text contains a word from the word filter
+func (c *Config) HasFilteredWord(text string) bool {
+	text = strings.ToLower(text)
+	for _, word := range c.WordFilter {
+		if strings.Contains(text, strings.ToLower(word)) {
+			return true
+		}
+	}
+	return false
+}
+
+type ConfigLoader struct {
+	path    string
+	current atomic.Pointer[Config]
+	// serializes updates so concurrent ones aren't lost
+	mu sync.Mutex
+}
+
+func NewConfigLoader(path string) (*ConfigLoader, error) {
+	loader := &ConfigLoader{path: path}
+	if err := loader.Reload(); err != nil {
+		return nil, err
+	}
+	return loader, nil
+}
+
+// Get returns the active config, it must not be modified
+func (l *ConfigLoader) Get() *Config {
+	return l.current.Load()
+}
+
+// Reload reads and validates the config file and swaps it in,
+// the active config is kept if anything fails
+func (l *ConfigLoader) Reload() error {
+	config := DefaultConfig()
+
+	// read file, defaults are used when no file is configured
+	if l.path != "" {
+		data, err := os.ReadFile(l.path)
+		if err != nil {
+			return fmt.Errorf("config: %w", err)
+		}
+		if err = json.Unmarshal(data, config); err != nil {
+			return fmt.Errorf("config: %s: %w", l.path, err)
+		}
+	}
+
+	if err := config.Validate(); err != nil {
+		return fmt.Errorf("config: %s: %w", l.path, err)
+	}
+
+	l.current.Store(config)
+	return nil
+}
+
+// Update applies fn to a copy of the active config, validates it, writes
+// it back to the config file and swaps it in
+func (l *ConfigLoader) Update(fn func(*Config)) (*Config, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// copy active config
+	data, err := json.Marshal(l.Get())
+	if err != nil {
+		return nil, err
+	}
+	config := DefaultConfig()
+	if err = json.Unmarshal(data, config); err != nil {
+		return nil, err
+	}
+
+	fn(config)
+	if err = config.Validate(); err != nil {
+		return nil, err
+	}
+
+	// write file, renamed over the old one so a crash can't leave half of it
+	if l.path != "" {
+		if data, err = json.MarshalIndent(config, "", "  "); err != nil {
+			return nil, err
+		}
+		tmp := l.path + ".tmp"
+		if err = os.WriteFile(tmp, append(data, '\n'), 0600); err != nil {
+			return nil, fmt.Errorf("config: %w", err)
+		}
+		if err = os.Rename(tmp, l.path); err != nil {
+			return nil, fmt.Errorf("config: %w", err)
+		}
+	}
+
+	l.current.Store(config)
+	return config, nil
+}
+
+// WatchSignals reloads the config every time the process receives SIGHUP
+func (l *ConfigLoader) WatchSignals() {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGHUP)
+	for range sig {
+		if err := l.Reload(); err != nil {
+			log.Printf("error: config reload failed: %v", err)
+			continue
+		}
+		log.Println("config reloaded")
+	}
+}
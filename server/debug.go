@@ -0,0 +1,78 @@
+package server
+
+import (
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"example/gochat/types"
+)
+
+// debugRoutes serves net/http/pprof to admins, e.g.
+// go tool pprof -http=: -H "Authorization: Bearer $TOKEN" https://host/debug/pprof/heap
+func (s *Server) debugRoutes(r *mux.Router) {
+	r.HandleFunc("/debug/pprof/cmdline", s.adminMiddleware(pprof.Cmdline))                  // command line
+	r.HandleFunc("/debug/pprof/profile", s.adminMiddleware(s.profiling(pprof.Profile, 30))) // cpu profile
+	r.HandleFunc("/debug/pprof/symbol", s.adminMiddleware(pprof.Symbol))                    // symbol lookup
+	r.HandleFunc("/debug/pprof/trace", s.adminMiddleware(s.profiling(pprof.Trace, 1)))      // execution trace
+	r.PathPrefix("/debug/pprof/").HandlerFunc(s.adminMiddleware(pprof.Index))               // index, heap, goroutine...
+	r.HandleFunc("/api/admin/runtime", s.adminMiddleware(s.handleAdminRuntime))             // goroutines, heap, gc
+}
+
+// profiling moves the write deadline of a profile or trace past the
+// ?seconds= it runs for, seconds by default, so the write timeout doesn't
+// cut it off
+func (s *Server) profiling(next http.HandlerFunc, seconds float64) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		d := seconds
+		if v, err := strconv.ParseFloat(r.FormValue("seconds"), 64); err == nil && v > 0 {
+			d = v
+		}
+		if s.timeouts.Write > 0 {
+			http.NewResponseController(w).SetWriteDeadline(time.Now().Add(s.timeouts.Write + time.Duration(d*float64(time.Second))))
+		}
+		next(w, r)
+	}
+}
+
+// handleAdminRuntime reports the go runtime numbers worth watching for
+// leaks and gc pressure
+func (s *Server) handleAdminRuntime(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		WriteError(w, errMethodNotAllowed(r.Method))
+		return
+	}
+
+	// read stats, this briefly stops the world
+	mem := runtime.MemStats{}
+	runtime.ReadMemStats(&mem)
+
+	res := types.RuntimeJSON{
+		GoVersion:    runtime.Version(),
+		Uptime:       time.Since(s.started).Round(time.Second).String(),
+		Goroutines:   runtime.NumGoroutine(),
+		GOMAXPROCS:   runtime.GOMAXPROCS(0),
+		HeapAlloc:    mem.HeapAlloc,
+		HeapInuse:    mem.HeapInuse,
+		HeapObjects:  mem.HeapObjects,
+		Sys:          mem.Sys,
+		NumGC:        mem.NumGC,
+		PauseTotalNs: mem.PauseTotalNs,
+		Connections:  s.hub.Count(),
+
+		CompressedPayloadBytes: s.hub.compression.payload.Load(),
+		CompressedWireBytes:    s.hub.compression.wire.Load(),
+		CompressionRatio:       s.hub.compression.Ratio(),
+	}
+	if mem.LastGC > 0 {
+		lastGC := time.Unix(0, int64(mem.LastGC)).UTC()
+		res.LastGC = &lastGC
+	}
+
+	// response
+	WriteJSON(w, http.StatusOK, res)
+}
@@ -0,0 +1,300 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"example/gochat/types"
+)
+
+const (
+	// reports on their way at once, more are dropped so a flood of errors
+	// can't pile up goroutines
+	maxReporting  = 8
+	reportTimeout = 10 * time.Second
+)
+
+// ErrorReporter ships server errors to an error tracker
+type ErrorReporter interface {
+	Report(context.Context, ErrorEvent) error
+}
+
+// ErrorEvent is an error with what is known about where it happened
+type ErrorEvent struct {
+	Message string
+	Time    time.Time
+	// stack of the panic, oldest call first, empty for logged errors
+	Stack []runtime.Frame
+	// the request being served, nil for background work
+	Request   *http.Request
+	RequestId string
+	UserId    int
+}
+
+// WithErrorReporter sends panics and logged errors to reporter, with the
+// request they happened in
+func WithErrorReporter(reporter ErrorReporter) Option {
+	return func(s *Server) {
+		s.reporter = reporter
+		s.reporting = make(chan struct{}, maxReporting)
+	}
+}
+
+// report hands an error to the reporter in the background
+func (s *Server) report(r *http.Request, message string, stack []runtime.Frame) {
+	if s.reporter == nil {
+		return
+	}
+	event := ErrorEvent{Message: message, Time: time.Now(), Stack: stack}
+	if r != nil {
+		event.Request, event.RequestId = r, requestId(r.Context())
+		if user, ok := r.Context().Value(userContextKey).(*types.User); ok {
+			event.UserId = user.Id
+		}
+	}
+	select {
+	case s.reporting <- struct{}{}:
+	default:
+		return
+	}
+	go func() {
+		defer func() { <-s.reporting }()
+		ctx, cancel := context.WithTimeout(context.Background(), reportTimeout)
+		defer cancel()
+		if err := s.reporter.Report(ctx, event); err != nil {
+			s.logger.Printf("error reporter failed: %v", err)
+		}
+	}()
+}
+
+// the messages of a request kept for its report, the first ones say most
+const maxRequestErrors = 20
+
+// requestErrors collects what a request logged, it is reported once the
+// request is answered with a server error
+type requestErrors struct {
+	mu sync.Mutex
+	// the latest request logged with, it knows the user once they are
+	// authenticated
+	request *http.Request
+	logged  []string
+}
+
+func (e *requestErrors) add(r *http.Request, message string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.request = r
+	if len(e.logged) < maxRequestErrors {
+		e.logged = append(e.logged, message)
+	}
+}
+
+// report returns the request to report and what it logged, the status
+// when it logged nothing
+func (e *requestErrors) report(status int) (*http.Request, string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if len(e.logged) == 0 {
+		return e.request, fmt.Sprintf("%d %s", status, http.StatusText(status))
+	}
+	return e.request, strings.Join(e.logged, "\n")
+}
+
+// errorf logs an error of background work and reports it
+func (s *Server) errorf(format string, v ...any) {
+	s.logger.Printf(format, v...)
+	s.report(nil, fmt.Sprintf(format, v...), nil)
+}
+
+// recoverMiddleware answers a panicking request with a 500 instead of
+// dropping the connection, and logs and reports the panic with its stack.
+// Requests answered with any other server error are reported with what
+// they logged, whatever the handler or middleware that answered
+func (s *Server) recoverMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		errs := &requestErrors{request: r}
+		r = r.WithContext(context.WithValue(r.Context(), errorsContextKey, errs))
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		w = rec
+		defer func() {
+			p := recover()
+			if p == nil {
+				if rec.status >= http.StatusInternalServerError {
+					req, message := errs.report(rec.status)
+					s.report(req, message, nil)
+				}
+				return
+			}
+			// handlers abort responses they can't finish with this
+			if p == http.ErrAbortHandler {
+				panic(p)
+			}
+			s.logger.Printf("[%s] panic: %v\n%s", requestId(r.Context()), p, debug.Stack())
+			s.report(r, fmt.Sprintf("panic: %v", p), callers())
+			WriteError(w, errInternal)
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// callers returns the stack of a recovered panic, oldest call first,
+// without the runtime frames that handle the panic
+func callers() []runtime.Frame {
+	pcs := make([]uintptr, 64)
+	n := runtime.Callers(3, pcs)
+	frames := runtime.CallersFrames(pcs[:n])
+	stack := []runtime.Frame{}
+	for {
+		frame, more := frames.Next()
+		if !strings.HasPrefix(frame.Function, "runtime.") {
+			stack = append(stack, frame)
+		}
+		if !more {
+			break
+		}
+	}
+	for i, j := 0, len(stack)-1; i < j; i, j = i+1, j-1 {
+		stack[i], stack[j] = stack[j], stack[i]
+	}
+	return stack
+}
+
+// SentryReporter sends errors to sentry, or a tracker speaking its api
+// such as GlitchTip, through the envelope endpoint
+type SentryReporter struct {
+	endpoint    string
+	auth        string
+	environment string
+	serverName  string
+	client      *http.Client
+}
+
+// NewSentryReporter takes a dsn like https://key@o1.ingest.sentry.io/123,
+// environment tells apart the deployments sending to one project
+func NewSentryReporter(dsn string, environment string) (*SentryReporter, error) {
+	u, err := url.Parse(dsn)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.User.Username() == "" {
+		return nil, errors.New("sentry: invalid dsn, expected https://key@host/project")
+	}
+	prefix, project := path.Split(strings.TrimRight(u.Path, "/"))
+	if _, err := strconv.Atoi(project); err != nil {
+		return nil, errors.New("sentry: the dsn must end with the project id")
+	}
+	auth := "Sentry sentry_version=7, sentry_client=gochat/1.0, sentry_key=" + u.User.Username()
+	if secret, ok := u.User.Password(); ok {
+		auth += ", sentry_secret=" + secret
+	}
+	hostname, _ := os.Hostname()
+	return &SentryReporter{
+		endpoint:    fmt.Sprintf("%s://%s%sapi/%s/envelope/", u.Scheme, u.Host, prefix, project),
+		auth:        auth,
+		environment: environment,
+		serverName:  hostname,
+		client:      &http.Client{Timeout: reportTimeout},
+	}, nil
+}
+
+// request headers sent along, others may carry credentials
+var reportedHeaders = []string{"User-Agent", "Content-Type", "Content-Length", "Accept", "Referer", "Origin"}
+
+func (s *SentryReporter) Report(ctx context.Context, e ErrorEvent) error {
+	id := make([]byte, 16)
+	rand.Read(id)
+	eventId := hex.EncodeToString(id)
+	event := map[string]any{
+		"event_id":    eventId,
+		"timestamp":   e.Time.UTC().Format(time.RFC3339Nano),
+		"platform":    "go",
+		"logger":      "gochat",
+		"level":       "error",
+		"server_name": s.serverName,
+		"message":     map[string]string{"formatted": e.Message},
+	}
+	if s.environment != "" {
+		event["environment"] = s.environment
+	}
+	if len(e.Stack) > 0 {
+		frames := []map[string]any{}
+		for _, f := range e.Stack {
+			frames = append(frames, map[string]any{
+				"function": f.Function,
+				"abs_path": f.File,
+				"lineno":   f.Line,
+				"in_app":   strings.HasPrefix(f.Function, "example/gochat/"),
+			})
+		}
+		event["level"] = "fatal"
+		event["exception"] = map[string]any{"values": []map[string]any{{
+			"type":       "panic",
+			"value":      e.Message,
+			"stacktrace": map[string]any{"frames": frames},
+		}}}
+	}
+	if e.Request != nil {
+		headers := map[string]string{}
+		for _, name := range reportedHeaders {
+			if value := e.Request.Header.Get(name); value != "" {
+				headers[name] = value
+			}
+		}
+		// tokens can be passed in the query
+		query := e.Request.URL.Query()
+		if query.Has("token") {
+			query.Set("token", "[Filtered]")
+		}
+		event["request"] = map[string]any{
+			"method":       e.Request.Method,
+			"url":          e.Request.URL.Path,
+			"query_string": query.Encode(),
+			"headers":      headers,
+		}
+		event["tags"] = map[string]string{"request_id": e.RequestId}
+	}
+	if e.UserId != 0 {
+		event["user"] = map[string]string{"id": strconv.Itoa(e.UserId)}
+	}
+
+	// an envelope is a header line, then the header and payload of each item
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	body := bytes.Buffer{}
+	fmt.Fprintf(&body, "{\"event_id\":%q,\"sent_at\":%q}\n", eventId, time.Now().UTC().Format(time.RFC3339Nano))
+	fmt.Fprintf(&body, "{\"type\":\"event\",\"length\":%d}\n", len(payload))
+	body.Write(payload)
+	body.WriteString("\n")
+
+	req, err := http.NewRequestWithContext(ctx, "POST", s.endpoint, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-sentry-envelope")
+	req.Header.Set("X-Sentry-Auth", s.auth)
+	res, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	io.Copy(io.Discard, res.Body)
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("sentry: status %d", res.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,141 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// ApiError is returned by every handler as {"error": {"code": ..., "message": ...}},
+// clients should switch on the code, the message is for humans
+type ApiError struct {
+	Status    int    `json:"-"`
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	RequestId string `json:"requestId,omitempty"`
+}
+
+func (e *ApiError) Error() string {
+	return e.Message
+}
+
+type ApiErrorJSON struct {
+	Error *ApiError `json:"error"`
+}
+
+func NewApiError(status int, code, message string) *ApiError {
+	return &ApiError{Status: status, Code: code, Message: message}
+}
+
+var (
+	// general
+	errInternal           = NewApiError(http.StatusInternalServerError, "internal_error", "internal server error")
+	errNotAuthorized      = NewApiError(http.StatusUnauthorized, "not_authorized", "not authorized")
+	errForbidden          = NewApiError(http.StatusForbidden, "forbidden", "forbidden")
+	errNotFound           = NewApiError(http.StatusNotFound, "not_found", "page not found")
+	errTooManyRequests    = NewApiError(http.StatusTooManyRequests, "too_many_requests", "too many requests")
+	errServiceUnavailable = NewApiError(http.StatusServiceUnavailable, "service_unavailable", "service unavailable")
+	errRejected           = NewApiError(http.StatusForbidden, "rejected", "the request was rejected")
+	errPluginUnavailable  = NewApiError(http.StatusServiceUnavailable, "plugin_unavailable", "a plugin this server needs isn't answering, try again")
+	errTimeout            = NewApiError(http.StatusGatewayTimeout, "timeout", "the request took too long, try again")
+	errInvalidCursor      = NewApiError(http.StatusBadRequest, "invalid_cursor", "invalid cursor")
+	errInvalidTime        = NewApiError(http.StatusBadRequest, "invalid_time", "times must be RFC3339, e.g. 2024-01-02T15:04:05Z")
+	errInvalidSort        = NewApiError(http.StatusBadRequest, "invalid_sort", "sort must be activity or name")
+	errInvalidFormat      = NewApiError(http.StatusBadRequest, "invalid_format", "format must be csv or json")
+
+	// users
+	errUserNotFound         = NewApiError(http.StatusNotFound, "user_not_found", "user not found")
+	errUserExists           = NewApiError(http.StatusConflict, "user_exists", "a user with this email or username already exists")
+	errInvalidPassword      = NewApiError(http.StatusBadRequest, "invalid_password", "invalid password")
+	errUsernameNotAllowed   = NewApiError(http.StatusBadRequest, "username_not_allowed", "username is not allowed")
+	errInvalidUsername      = NewApiError(http.StatusBadRequest, "invalid_username", "usernames are 3 to 20 letters, digits, dots, dashes or underscores and start with a letter")
+	errInvalidDisplayName   = NewApiError(http.StatusBadRequest, "invalid_display_name", "display names are up to 50 characters without control characters")
+	errInvalidProfile       = NewApiError(http.StatusBadRequest, "invalid_profile", "bio is up to 300 characters, pronouns up to 30 and link must be an http or https url up to 200")
+	errProfileNotAllowed    = NewApiError(http.StatusBadRequest, "profile_not_allowed", "profile contains a blocked word")
+	errUserFieldsTooLong    = NewApiError(http.StatusBadRequest, "user_fields_too_long", "email can't be longer than 50 characters")
+	errRegistrationDisabled = NewApiError(http.StatusForbidden, "registration_disabled", "registration is disabled")
+	errInvalidRole          = NewApiError(http.StatusBadRequest, "invalid_role", "role must be user, moderator or admin")
+	errOwnRole              = NewApiError(http.StatusBadRequest, "own_role", "can't change your own role")
+	errBanned               = NewApiError(http.StatusForbidden, "banned", "your address is banned")
+	errAccountDisabled      = NewApiError(http.StatusForbidden, "account_disabled", "this account is disabled")
+	errOwnAccount           = NewApiError(http.StatusBadRequest, "own_account", "can't disable, delete or reset your own account")
+	errInvalidNewPassword   = NewApiError(http.StatusBadRequest, "invalid_new_password", "new password must be between 1 and 72 bytes")
+	errDirectoryUnavailable = NewApiError(http.StatusServiceUnavailable, "directory_unavailable", "the login directory can't be reached, try again")
+	errDirectoryAccount     = NewApiError(http.StatusForbidden, "directory_account", "your directory account can't be used here, ask an admin")
+	errDirectoryPasswords   = NewApiError(http.StatusBadRequest, "directory_passwords", "passwords are managed by the login directory")
+	errSSODisabled          = NewApiError(http.StatusNotFound, "sso_disabled", "single sign-on is not set up")
+	errSSOUnavailable       = NewApiError(http.StatusServiceUnavailable, "sso_unavailable", "the identity provider can't be reached, try again")
+	errSSOFailed            = NewApiError(http.StatusUnauthorized, "sso_failed", "single sign-on failed, try again")
+	errSSOExpired           = NewApiError(http.StatusBadRequest, "sso_expired", "the sign-on took too long or was already used, start again")
+	errInvalidBan           = NewApiError(http.StatusBadRequest, "invalid_ban", "ip must be an address or a cidr range")
+	errBotNotFound          = NewApiError(http.StatusNotFound, "bot_not_found", "bot not found")
+	errBotPassword          = NewApiError(http.StatusBadRequest, "bot_password", "bots have no password, they use api tokens")
+	errInvalidAPIToken      = NewApiError(http.StatusBadRequest, "invalid_api_token", "token name must be between 1 and 50 characters and scope read or send")
+	errAPITokenNotFound     = NewApiError(http.StatusNotFound, "api_token_not_found", "api token not found")
+	errTokenScope           = NewApiError(http.StatusForbidden, "token_scope", "the api token's scope doesn't allow this request")
+
+	// chats
+	errChatNotFound         = NewApiError(http.StatusNotFound, "chat_not_found", "chat not found")
+	errInvalidMemberRole    = NewApiError(http.StatusBadRequest, "invalid_member_role", "role must be member, viewer or admin")
+	errJoinLocked           = NewApiError(http.StatusTooManyRequests, "join_locked", "too many wrong passwords for this chat, try again later")
+	errReadOnly             = NewApiError(http.StatusForbidden, "read_only", "viewers can't post in this chat")
+	errInvalidChatInfo      = NewApiError(http.StatusBadRequest, "invalid_chat_info", "name can be up to 100 and topic up to 300 characters")
+	errInvalidImage         = NewApiError(http.StatusBadRequest, "invalid_image", "images must be png, jpeg or gif, up to 5 MB and 4096 pixels a side")
+	errImageNotFound        = NewApiError(http.StatusNotFound, "image_not_found", "the chat has no such image")
+	errInvalidWelcome       = NewApiError(http.StatusBadRequest, "invalid_welcome", "welcome messages can be up to 1000 characters")
+	errInvalidResponder     = NewApiError(http.StatusBadRequest, "invalid_responder", "trigger is 1 to 100 characters, response a template of 1 to 2000 and cooldownSeconds up to a day")
+	errResponderNotFound    = NewApiError(http.StatusNotFound, "responder_not_found", "auto-responder not found")
+	errBotNotMember         = NewApiError(http.StatusBadRequest, "bot_not_member", "add the bot to the chat first")
+	errInvalidSearch        = NewApiError(http.StatusBadRequest, "invalid_search", "search query must be between 1 and 300 characters")
+	errInvalidSearchFilter  = NewApiError(http.StatusBadRequest, "invalid_search_filter", "has can only be link, messages have no attachments")
+	errInvalidTags          = NewApiError(http.StatusBadRequest, "invalid_tags", "up to 10 tags of letters, digits and dashes and a category of up to 50 characters")
+	errInvalidVisibility    = NewApiError(http.StatusBadRequest, "invalid_visibility", "visibility must be private or public")
+	errChatCreationDisabled = NewApiError(http.StatusForbidden, "chat_creation_disabled", "chat creation is disabled")
+	errTooManyChats         = NewApiError(http.StatusBadRequest, "too_many_chats", "can't fetch more than 100 chats at once")
+	errInvalidMessage       = NewApiError(http.StatusBadRequest, "invalid_message", "message must be between 1 and 2000 characters")
+	errMessageNotFound      = NewApiError(http.StatusNotFound, "message_not_found", "message not found")
+	errInvalidEmoji         = NewApiError(http.StatusBadRequest, "invalid_emoji", "emoji must be between 1 and 32 characters without spaces")
+	errBlockedWord          = NewApiError(http.StatusBadRequest, "blocked_word", "message contains a blocked word")
+	errInvalidAnnouncement  = NewApiError(http.StatusBadRequest, "invalid_announcement", "announcement text must be between 1 and 1000 characters")
+	errInvalidUserSettings  = NewApiError(http.StatusBadRequest, "invalid_settings", "settings are a json object with keys of up to 64 letters, digits, dots, dashes or underscores and values of up to 4096 bytes")
+	errTooManySettings      = NewApiError(http.StatusBadRequest, "too_many_settings", "at most 100 settings can be stored")
+	errInvalidPreferences   = NewApiError(http.StatusBadRequest, "invalid_preferences", "notify must be all, mentions or none, quiet hours HH:MM on days 0-6 and timeZone an IANA name")
+	errInvalidResume        = NewApiError(http.StatusBadRequest, "invalid_resume", "resume is up to 100 chatId:messageId pairs separated by commas")
+	errInvalidDevice        = NewApiError(http.StatusBadRequest, "invalid_device", "device id can't be longer than 64 characters")
+	errServerFull           = NewApiError(http.StatusServiceUnavailable, "server_full", "this server has no room for more connections, try again")
+
+	// workspaces
+	errWorkspaceNotFound = NewApiError(http.StatusNotFound, "workspace_not_found", "workspace not found")
+	errWorkspaceExists   = NewApiError(http.StatusConflict, "workspace_exists", "a workspace with this slug already exists")
+	errInvalidQuota      = NewApiError(http.StatusBadRequest, "invalid_quota", "quotas can't be negative, 0 is unlimited")
+	errInvalidMonth      = NewApiError(http.StatusBadRequest, "invalid_month", "month must be YYYY-MM")
+	errInvalidWorkspace  = NewApiError(http.StatusBadRequest, "invalid_workspace", "name is 1 to 100 characters and slug 2 to 30 lowercase letters, digits and dashes")
+
+	// push
+	errInvalidPlatform = NewApiError(http.StatusBadRequest, "invalid_platform", "platform must be fcm or apns")
+	errBadPushToken    = NewApiError(http.StatusBadRequest, "invalid_push_token", "invalid push token")
+
+	// passkeys
+	errPasskeysDisabled      = NewApiError(http.StatusNotFound, "passkeys_disabled", "passkeys are not enabled")
+	errPasskeySessionExpired = NewApiError(http.StatusBadRequest, "passkey_session_expired", "passkey session expired")
+	errPasskeyRegistration   = NewApiError(http.StatusBadRequest, "passkey_registration_failed", "passkey registration failed")
+)
+
+func errMethodNotAllowed(method string) *ApiError {
+	return NewApiError(http.StatusMethodNotAllowed, "method_not_allowed", fmt.Sprintf("method %s not allowed", method))
+}
+
+func errQuotaExceeded(quota string) *ApiError {
+	return NewApiError(http.StatusForbidden, "quota_exceeded", fmt.Sprintf("the workspace has reached its %s quota", quota))
+}
+
+func errInvalidSettings(err error) *ApiError {
+	return NewApiError(http.StatusBadRequest, "invalid_settings", err.Error())
+}
+
+// WriteError writes err as a json error response, with the request id
+// so users can reference it in bug reports
+func WriteError(w http.ResponseWriter, err *ApiError) {
+	res := *err
+	res.RequestId = w.Header().Get("X-Request-ID")
+	WriteJSON(w, res.Status, ApiErrorJSON{Error: &res})
+}
@@ -0,0 +1,177 @@
+package server
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"example/gochat/storage"
+	"example/gochat/types"
+)
+
+const (
+	// newest messages in a feed
+	feedEntries = 50
+	// entry titles are the start of the message
+	feedTitleLen = 80
+)
+
+type atomFeed struct {
+	XMLName  xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	Id       string      `xml:"id"`
+	Title    string      `xml:"title"`
+	Subtitle string      `xml:"subtitle,omitempty"`
+	Updated  string      `xml:"updated"`
+	Links    []atomLink  `xml:"link"`
+	Entries  []atomEntry `xml:"entry"`
+}
+
+type atomLink struct {
+	Rel  string `xml:"rel,attr,omitempty"`
+	Type string `xml:"type,attr,omitempty"`
+	Href string `xml:"href,attr"`
+}
+
+type atomEntry struct {
+	Id        string      `xml:"id"`
+	Title     string      `xml:"title"`
+	Updated   string      `xml:"updated"`
+	Published string      `xml:"published"`
+	Author    atomAuthor  `xml:"author"`
+	Link      atomLink    `xml:"link"`
+	Content   atomContent `xml:"content"`
+}
+
+type atomAuthor struct {
+	Name string `xml:"name"`
+}
+
+type atomContent struct {
+	Type string `xml:"type,attr"`
+	Text string `xml:",chardata"`
+}
+
+// handleChatFeed serves the newest messages of a public announcement chat
+// as an atom feed, so it can be followed without an account
+func (s *Server) handleChatFeed(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		WriteError(w, errMethodNotAllowed(r.Method))
+		return
+	}
+
+	// get chat id
+	id, err := getChatId(r)
+	if err != nil {
+		WriteError(w, errChatNotFound)
+		return
+	}
+
+	// get chat, other chats have no feed
+	chat, err := s.store.GetChatById(r.Context(), id)
+	if err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			WriteError(w, errChatNotFound)
+			return
+		}
+		WriteError(w, errInternal)
+		s.logf(r, "error: get chat failed: %v", err)
+		return
+	}
+	if chat.FeedUrl() == "" {
+		WriteError(w, errChatNotFound)
+		return
+	}
+
+	// newest first
+	base := s.baseUrl(r)
+	chatUrl := fmt.Sprintf("%s/chat/%d", base, chat.Id)
+	feed := atomFeed{
+		Id:       base + chat.FeedUrl(),
+		Title:    chat.Name,
+		Subtitle: chat.Topic,
+		Links: []atomLink{
+			{Rel: "self", Type: "application/atom+xml", Href: base + chat.FeedUrl()},
+			{Rel: "alternate", Type: "text/html", Href: chatUrl},
+		},
+		Entries: []atomEntry{},
+	}
+	updated := time.Time{}
+	for i := len(chat.Messages) - 1; i >= 0 && len(feed.Entries) < feedEntries; i-- {
+		msg := chat.Messages[i]
+		edited := msg.CreatedAt
+		if msg.EditedAt != nil {
+			edited = *msg.EditedAt
+		}
+		if edited.After(updated) {
+			updated = edited
+		}
+		url := fmt.Sprintf("%s?message=%d", chatUrl, msg.Id)
+		feed.Entries = append(feed.Entries, atomEntry{
+			Id:        url,
+			Title:     feedTitle(msg.Text),
+			Updated:   edited.UTC().Format(time.RFC3339),
+			Published: msg.CreatedAt.UTC().Format(time.RFC3339),
+			Author:    atomAuthor{Name: authorName(msg.Author)},
+			Link:      atomLink{Rel: "alternate", Type: "text/html", Href: url},
+			Content:   atomContent{Type: "text", Text: msg.Text},
+		})
+	}
+	if updated.IsZero() {
+		updated = time.Now()
+	}
+	feed.Updated = updated.UTC().Format(time.RFC3339)
+
+	data, err := xml.MarshalIndent(feed, "", "  ")
+	if err != nil {
+		WriteError(w, errInternal)
+		s.logf(r, "error: atom encoding failed: %v", err)
+		return
+	}
+
+	// response
+	w.Header().Set("Content-Type", "application/atom+xml; charset=utf-8")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(xml.Header))
+	w.Write(append(data, '\n'))
+}
+
+// feedTitle is the first line of the text, cut to feedTitleLen characters
+func feedTitle(text string) string {
+	title, _, _ := strings.Cut(strings.TrimSpace(text), "\n")
+	if utf8.RuneCountInString(title) > feedTitleLen {
+		title = string([]rune(title)[:feedTitleLen-1]) + "…"
+	}
+	return title
+}
+
+func authorName(author types.AuthorJSON) string {
+	if author.DisplayName != "" {
+		return author.DisplayName
+	}
+	return author.Username
+}
+
+// baseUrl is the scheme and host the client used, X-Forwarded-Proto is
+// only read from trusted proxies
+func (s *Server) baseUrl(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if ip := net.ParseIP(host); ip == nil || s.config.Get().TrustedProxy(ip) {
+		if proto := r.Header.Get("X-Forwarded-Proto"); proto == "http" || proto == "https" {
+			scheme = proto
+		}
+	}
+	return scheme + "://" + r.Host
+}
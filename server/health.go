@@ -0,0 +1,49 @@
+package server
+
+import (
+	"net/http"
+
+	"example/gochat/types"
+)
+
+// handleHealth answers as long as the process serves requests, for
+// liveness checks that restart it otherwise
+func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		WriteError(w, errMethodNotAllowed(r.Method))
+		return
+	}
+	WriteJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// handleReady fails while storage is down or the instance is full, so
+// the load balancer sends new connections elsewhere. Any instance can
+// serve any chat, events reach the others through the broker
+func (s *Server) handleReady(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		WriteError(w, errMethodNotAllowed(r.Method))
+		return
+	}
+
+	res := types.ReadyJSON{
+		Status:         "ok",
+		Connections:    s.hub.Count(),
+		MaxConnections: s.config.Get().Websocket.MaxConnections,
+		Nodes:          1,
+	}
+	res.ClusterConnections = res.Connections
+	for _, node := range s.hub.liveNodes() {
+		res.Nodes++
+		res.ClusterConnections += node.Connections
+	}
+
+	// response
+	status := http.StatusOK
+	switch {
+	case s.breaker != nil && s.breaker.Open():
+		res.Status, status = "unavailable", http.StatusServiceUnavailable
+	case res.MaxConnections > 0 && res.Connections >= res.MaxConnections:
+		res.Status, status = "full", http.StatusServiceUnavailable
+	}
+	WriteJSON(w, status, res)
+}
@@ -0,0 +1,222 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/draw"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"example/gochat/storage"
+	"example/gochat/types"
+)
+
+const (
+	// uploads larger than this are refused before decoding
+	maxImageBytes = 5 << 20
+	// and images with a side longer than this
+	maxImageSide = 4096
+)
+
+// chatImageSizes is what each kind of image is cropped and scaled to
+var chatImageSizes = map[string]image.Point{
+	types.ChatImageAvatar: {256, 256},
+	types.ChatImageCover:  {1200, 400},
+}
+
+// avatars keep transparency, covers are usually photos
+var chatImageTypes = map[string]string{
+	types.ChatImageAvatar: "image/png",
+	types.ChatImageCover:  "image/jpeg",
+}
+
+// handleChatImage serves the avatar or cover of a chat to whoever can
+// read it, moderators upload a png, jpeg or gif as the request body or
+// remove the image
+func (s *Server) handleChatImage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "PUT" && r.Method != "DELETE" {
+		WriteError(w, errMethodNotAllowed(r.Method))
+		return
+	}
+
+	// get chat id and kind
+	id, err := getChatId(r)
+	if err != nil {
+		WriteError(w, errChatNotFound)
+		return
+	}
+	kind := mux.Vars(r)["kind"]
+
+	// get user from req context, guests have none
+	user, _ := r.Context().Value(userContextKey).(*types.User)
+	if r.Method != "GET" {
+		if user == nil {
+			WriteError(w, errNotAuthorized)
+			return
+		}
+		if !user.HasRole(types.RoleModerator) {
+			WriteError(w, errForbidden)
+			return
+		}
+	}
+
+	switch r.Method {
+	case "GET":
+		// get chat
+		chat, err := s.store.GetChatById(r.Context(), id)
+		if err != nil {
+			if errors.Is(err, storage.ErrNotFound) {
+				WriteError(w, errChatNotFound)
+				return
+			}
+			WriteError(w, errInternal)
+			s.logf(r, "error: get chat failed: %v", err)
+			return
+		}
+		if !canRead(user, chat) {
+			WriteError(w, errChatNotFound)
+			return
+		}
+
+		// get image
+		data, updatedAt, err := s.store.GetChatImage(r.Context(), id, kind)
+		if err != nil {
+			if errors.Is(err, storage.ErrNotFound) {
+				WriteError(w, errImageNotFound)
+				return
+			}
+			WriteError(w, errInternal)
+			s.logf(r, "error: get chat image failed: %v", err)
+			return
+		}
+
+		// response, the url changes with the image
+		cache := "private"
+		if chat.Visibility == types.VisibilityPublic {
+			cache = "public"
+		}
+		w.Header().Set("Content-Type", chatImageTypes[kind])
+		w.Header().Set("Cache-Control", cache+", max-age=31536000, immutable")
+		http.ServeContent(w, r, "", updatedAt, bytes.NewReader(data))
+
+	case "PUT":
+		// get image from front
+		data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxImageBytes))
+		if err != nil {
+			WriteError(w, errInvalidImage)
+			return
+		}
+		data, err = resizeImage(data, chatImageSizes[kind], chatImageTypes[kind])
+		if err != nil {
+			WriteError(w, errInvalidImage)
+			return
+		}
+
+		// the workspace may be out of storage
+		workspace, _ := storage.WorkspaceFrom(r.Context())
+		if err = s.quotas.check(r.Context(), workspace, usageDelta{bytes: int64(len(data))}); err != nil {
+			s.writeVeto(w, r, err)
+			return
+		}
+
+		// store image
+		now := time.Now().UTC()
+		if err = s.store.SetChatImage(r.Context(), id, kind, data, now); err != nil {
+			if errors.Is(err, storage.ErrNotFound) {
+				WriteError(w, errChatNotFound)
+				return
+			}
+			WriteError(w, errInternal)
+			s.logf(r, "error: set chat image failed: %v", err)
+			return
+		}
+		s.quotas.add(workspace, usageDelta{bytes: int64(len(data))})
+
+		// response
+		chat := types.Chat{Id: id, Images: map[string]int64{kind: now.Unix()}}
+		WriteJSON(w, http.StatusOK, map[string]string{"url": chat.ImageUrl(kind)})
+
+	case "DELETE":
+		if err = s.store.DeleteChatImage(r.Context(), id, kind); err != nil {
+			if errors.Is(err, storage.ErrNotFound) {
+				WriteError(w, errImageNotFound)
+				return
+			}
+			WriteError(w, errInternal)
+			s.logf(r, "error: delete chat image failed: %v", err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// resizeImage decodes an uploaded image, crops it to the aspect of size
+// around the center, scales it to size and encodes it as contentType
+func resizeImage(data []byte, size image.Point, contentType string) ([]byte, error) {
+	// check dimensions before decoding the pixels
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if config.Width < 1 || config.Height < 1 || config.Width > maxImageSide || config.Height > maxImageSide {
+		return nil, errors.New("image too large")
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	// work on plain rgba pixels
+	bounds := img.Bounds()
+	src := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(src, src.Bounds(), img, bounds.Min, draw.Src)
+
+	// largest centered crop with the target aspect
+	cw, ch := src.Rect.Dx(), src.Rect.Dx()*size.Y/size.X
+	if ch > src.Rect.Dy() {
+		cw, ch = src.Rect.Dy()*size.X/size.Y, src.Rect.Dy()
+	}
+	crop := image.Rect(0, 0, max(cw, 1), max(ch, 1)).Add(image.Pt((src.Rect.Dx()-cw)/2, (src.Rect.Dy()-ch)/2))
+
+	// each target pixel averages the source pixels it covers
+	dst := image.NewRGBA(image.Rect(0, 0, size.X, size.Y))
+	for y := 0; y < size.Y; y++ {
+		y0 := crop.Min.Y + y*crop.Dy()/size.Y
+		y1 := max(crop.Min.Y+(y+1)*crop.Dy()/size.Y, y0+1)
+		for x := 0; x < size.X; x++ {
+			x0 := crop.Min.X + x*crop.Dx()/size.X
+			x1 := max(crop.Min.X+(x+1)*crop.Dx()/size.X, x0+1)
+			var sum [4]int
+			for sy := y0; sy < y1; sy++ {
+				row := src.Pix[src.PixOffset(x0, sy):src.PixOffset(x1, sy)]
+				for i := 0; i < len(row); i += 4 {
+					sum[0] += int(row[i])
+					sum[1] += int(row[i+1])
+					sum[2] += int(row[i+2])
+					sum[3] += int(row[i+3])
+				}
+			}
+			n := (x1 - x0) * (y1 - y0)
+			i := dst.PixOffset(x, y)
+			for c := range sum {
+				dst.Pix[i+c] = uint8(sum[c] / n)
+			}
+		}
+	}
+
+	// encode
+	out := bytes.Buffer{}
+	if contentType == "image/jpeg" {
+		err = jpeg.Encode(&out, dst, &jpeg.Options{Quality: 85})
+	} else {
+		err = png.Encode(&out, dst)
+	}
+	return out.Bytes(), err
+}
@@ -0,0 +1,145 @@
+package server
+
+import (
+	"slices"
+	"sync"
+	"time"
+)
+
+// an address is locked out of a chat after this many times the per user
+// limit of wrong passwords, so guessing from many accounts doesn't get
+// around it. Users joining from elsewhere aren't affected
+const joinAddressFactor = 10
+
+// JoinGuard counts wrong chat passwords and locks joining a chat for a
+// while once there are too many, by user and by client address. Counts are
+// kept in memory, each instance locks on its own
+type JoinGuard struct {
+	mu       sync.Mutex
+	attempts map[joinKey]*joinAttempts
+	swept    time.Time
+}
+
+// joinKey is a user's attempts at a chat, or with ip set the attempts of
+// every user from that address
+type joinKey struct {
+	chatId int
+	userId int
+	ip     string
+}
+
+type joinAttempts struct {
+	failures int
+	// failures are counted from this time until the lockout has passed
+	since  time.Time
+	locked time.Time
+}
+
+func NewJoinGuard() *JoinGuard {
+	return &JoinGuard{
+		attempts: make(map[joinKey]*joinAttempts),
+	}
+}
+
+// JoinAttempt is a password comparison let through by Attempt
+type JoinAttempt struct {
+	chatId int
+	userId int
+	ip     string
+	limit  int
+	// the keys this attempt locked, a right password unlocks them again
+	locked []joinKey
+}
+
+// Locked reports whether the attempt locked the user or their address out,
+// once its password turned out wrong
+func (a JoinAttempt) Locked() bool {
+	return len(a.locked) > 0
+}
+
+// Attempt counts an attempt at the chat's password as wrong before it is
+// compared, so concurrent attempts can't get past the limit, and returns how
+// long the user can't join the chat from ip instead if they are locked out.
+// limit is the wrong passwords a user has within lockout before that. The
+// attempt is refunded once the password turns out right
+func (g *JoinGuard) Attempt(chatId, userId int, ip string, limit int, lockout time.Duration) (JoinAttempt, time.Duration) {
+	attempt := JoinAttempt{chatId: chatId, userId: userId, ip: ip, limit: limit}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	now := time.Now()
+	keys := []joinKey{{chatId: chatId, userId: userId}, {chatId: chatId, ip: ip}}
+	var wait time.Duration
+	for _, key := range keys {
+		if a, ok := g.attempts[key]; ok && now.Before(a.locked) {
+			wait = max(wait, a.locked.Sub(now))
+		}
+	}
+	if wait > 0 || limit == 0 {
+		return attempt, wait
+	}
+
+	g.sweep(now, lockout)
+	for _, key := range keys {
+		a, ok := g.attempts[key]
+		if !ok || now.Sub(a.since) > lockout && now.After(a.locked) {
+			a = &joinAttempts{since: now}
+			g.attempts[key] = a
+		}
+		a.failures++
+		if a.failures >= key.limit(limit) {
+			a.locked = now.Add(lockout)
+			a.failures = 0
+			a.since = now
+			attempt.locked = append(attempt.locked, key)
+		}
+	}
+	return attempt, 0
+}
+
+// Refund takes back an attempt whose password was right: the user's wrong
+// passwords are forgotten and the address's count goes back down
+func (g *JoinGuard) Refund(attempt JoinAttempt) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	delete(g.attempts, joinKey{chatId: attempt.chatId, userId: attempt.userId})
+	if attempt.limit == 0 {
+		return
+	}
+	key := joinKey{chatId: attempt.chatId, ip: attempt.ip}
+	a, ok := g.attempts[key]
+	if !ok {
+		return
+	}
+	if slices.Contains(attempt.locked, key) {
+		a.locked = time.Time{}
+		a.failures = key.limit(attempt.limit) - 1
+	} else if a.failures > 0 {
+		a.failures--
+	}
+}
+
+// limit returns the wrong passwords allowed for the key, more for an address
+// than for a user
+func (k joinKey) limit(limit int) int {
+	if k.ip != "" {
+		return limit * joinAddressFactor
+	}
+	return limit
+}
+
+// sweep drops the counts that stopped mattering once a minute, so guessing
+// at many chats doesn't grow the map for good
+func (g *JoinGuard) sweep(now time.Time, lockout time.Duration) {
+	if now.Sub(g.swept) < time.Minute {
+		return
+	}
+	g.swept = now
+	for key, a := range g.attempts {
+		if now.Sub(a.since) > lockout && now.After(a.locked) {
+			delete(g.attempts, key)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package server
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestJoinGuardConcurrentAttempts(t *testing.T) {
+	g := NewJoinGuard()
+	const limit = 3
+
+	var allowed, locked atomic.Int32
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			attempt, wait := g.Attempt(1, 1, "10.0.0.1", limit, time.Minute)
+			if wait > 0 {
+				return
+			}
+			allowed.Add(1)
+			if attempt.Locked() {
+				locked.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if n := allowed.Load(); n != limit {
+		t.Errorf("%d attempts compared, want %d", n, limit)
+	}
+	if n := locked.Load(); n != 1 {
+		t.Errorf("%d attempts locked the user out, want 1", n)
+	}
+}
+
+func TestJoinGuardRefund(t *testing.T) {
+	g := NewJoinGuard()
+	const limit = 3
+
+	for i := 0; i < limit-1; i++ {
+		if _, wait := g.Attempt(1, 1, "10.0.0.1", limit, time.Minute); wait > 0 {
+			t.Fatalf("attempt %d locked out", i+1)
+		}
+	}
+	// the last attempt before the lockout has the right password
+	attempt, wait := g.Attempt(1, 1, "10.0.0.1", limit, time.Minute)
+	if wait > 0 || !attempt.Locked() {
+		t.Fatalf("got wait %v locked %v, want the attempt to lock", wait, attempt.Locked())
+	}
+	g.Refund(attempt)
+
+	for i := 0; i < limit-1; i++ {
+		if _, wait := g.Attempt(1, 1, "10.0.0.1", limit, time.Minute); wait > 0 {
+			t.Fatalf("attempt %d after a right password locked out", i+1)
+		}
+	}
+}
+
+func TestJoinGuardRefundAddress(t *testing.T) {
+	g := NewJoinGuard()
+	const limit = 1
+	addressLimit := limit * joinAddressFactor
+
+	// users guessing from one address up to one short of its limit
+	for i := 0; i < addressLimit-1; i++ {
+		g.Attempt(1, 100+i, "10.0.0.1", limit, time.Minute)
+	}
+	// a right password at the limit doesn't lock the address
+	attempt, wait := g.Attempt(1, 1, "10.0.0.1", limit, time.Minute)
+	if wait > 0 {
+		t.Fatalf("address locked before its limit")
+	}
+	g.Refund(attempt)
+
+	if _, wait := g.Attempt(1, 2, "10.0.0.1", limit, time.Minute); wait > 0 {
+		t.Errorf("address locked by a right password")
+	}
+	if _, wait := g.Attempt(1, 3, "10.0.0.1", limit, time.Minute); wait == 0 {
+		t.Errorf("address not locked after its limit")
+	}
+}
@@ -0,0 +1,215 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+
+	"example/gochat/storage"
+	"example/gochat/types"
+)
+
+// directory connections, searches and binds give up after this
+const ldapTimeout = 5 * time.Second
+
+// ErrInvalidCredentials is returned when the directory refuses a login
+var ErrInvalidCredentials = errors.New("ldap: invalid credentials")
+
+// LDAPConfig selects the directory logins are checked against
+type LDAPConfig struct {
+	// ldap://host:389 or ldaps://host:636
+	Url string
+	// upgrades ldap:// connections with StartTLS
+	StartTLS bool
+	// slug of the workspace its users are in, the default one when empty
+	Workspace string
+	// the account that searches for users, anonymous when empty
+	BindDN       string
+	BindPassword string
+	BaseDN       string
+	// %s is replaced with what the user typed, e.g. (mail=%s) or for
+	// active directory (|(sAMAccountName=%s)(userPrincipalName=%s))
+	UserFilter string
+	// attributes of the user entry
+	UsernameAttr    string
+	EmailAttr       string
+	DisplayNameAttr string
+}
+
+// LDAPAuth checks logins against an ldap directory, such as active
+// directory, in place of local passwords
+type LDAPAuth struct {
+	config LDAPConfig
+	host   string
+}
+
+// directoryUser is the entry of a user who logged in
+type directoryUser struct {
+	Username    string
+	Email       string
+	DisplayName string
+}
+
+// NewLDAPAuth checks the config and fills in the defaults, it doesn't
+// connect until the first login
+func NewLDAPAuth(config LDAPConfig) (*LDAPAuth, error) {
+	u, err := url.Parse(config.Url)
+	if err != nil || (u.Scheme != "ldap" && u.Scheme != "ldaps") || u.Host == "" {
+		return nil, fmt.Errorf("invalid url %q, expected ldap://host:389 or ldaps://host:636", config.Url)
+	}
+	if config.BaseDN == "" {
+		return nil, errors.New("a base dn is required, e.g. dc=example,dc=com")
+	}
+	if config.UserFilter == "" {
+		config.UserFilter = "(mail=%s)"
+	}
+	if !strings.Contains(config.UserFilter, "%s") {
+		return nil, fmt.Errorf("user filter %q must contain %%s", config.UserFilter)
+	}
+	if config.UsernameAttr == "" {
+		config.UsernameAttr = "uid"
+	}
+	if config.EmailAttr == "" {
+		config.EmailAttr = "mail"
+	}
+	if config.DisplayNameAttr == "" {
+		config.DisplayNameAttr = "displayName"
+	}
+	return &LDAPAuth{config: config, host: u.Hostname()}, nil
+}
+
+// WithLDAP checks logins against a directory, local passwords and
+// registration are turned off
+func WithLDAP(ldap *LDAPAuth) Option {
+	return func(s *Server) {
+		s.ldap = ldap
+	}
+}
+
+// Authenticate finds the user by what they typed and binds as them with
+// the password, ErrInvalidCredentials when there is no single such user or
+// the password is wrong
+func (a *LDAPAuth) Authenticate(ctx context.Context, login string, password string) (*directoryUser, error) {
+	// an empty password would be an unauthenticated bind, which succeeds
+	if login == "" || password == "" {
+		return nil, ErrInvalidCredentials
+	}
+
+	tlsConfig := &tls.Config{ServerName: a.host}
+	conn, err := ldap.DialURL(a.config.Url, ldap.DialWithDialer(&net.Dialer{Timeout: ldapTimeout}), ldap.DialWithTLSConfig(tlsConfig))
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetTimeout(ldapTimeout)
+	if a.config.StartTLS {
+		if err = conn.StartTLS(tlsConfig); err != nil {
+			return nil, err
+		}
+	}
+
+	// find the user
+	if a.config.BindDN != "" {
+		if err = conn.Bind(a.config.BindDN, a.config.BindPassword); err != nil {
+			return nil, fmt.Errorf("search bind: %w", err)
+		}
+	}
+	filter := strings.ReplaceAll(a.config.UserFilter, "%s", ldap.EscapeFilter(login))
+	attrs := []string{a.config.UsernameAttr, a.config.EmailAttr, a.config.DisplayNameAttr}
+	req := ldap.NewSearchRequest(a.config.BaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, int(ldapTimeout.Seconds()), false, filter, attrs, nil)
+	res, err := conn.Search(req)
+	if ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded) {
+		return nil, ErrInvalidCredentials
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(res.Entries) != 1 {
+		return nil, ErrInvalidCredentials
+	}
+	entry := res.Entries[0]
+
+	// the password is right if the user can bind with it
+	if err = conn.Bind(entry.DN, password); err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return nil, ErrInvalidCredentials
+		}
+		return nil, err
+	}
+	user := &directoryUser{
+		Username:    entry.GetAttributeValue(a.config.UsernameAttr),
+		Email:       normalizeEmail(entry.GetAttributeValue(a.config.EmailAttr)),
+		DisplayName: strings.TrimSpace(entry.GetAttributeValue(a.config.DisplayNameAttr)),
+	}
+	// accounts without mail get a stable address the local user is found by
+	if user.Email == "" {
+		user.Email = strings.ToLower(user.Username) + "@directory.invalid"
+	}
+	return user, nil
+}
+
+// ldapUser returns the local user of a directory login, created the first
+// time they log in in the directory's workspace
+func (s *Server) ldapUser(ctx context.Context, login string, password string) (*types.User, *ApiError) {
+	entry, err := s.ldap.Authenticate(ctx, login, password)
+	if errors.Is(err, ErrInvalidCredentials) {
+		return nil, errInvalidPassword
+	}
+	if err != nil {
+		s.errorf("error: ldap login failed: %v", err)
+		return nil, errDirectoryUnavailable
+	}
+	if ctx, err = s.providerWorkspace(ctx, s.ldap.config.Workspace); err != nil {
+		s.errorf("error: ldap: %v", err)
+		return nil, errInternal
+	}
+	return s.directoryLogin(ctx, entry)
+}
+
+// directoryLogin returns the local user of a directory or single sign-on
+// account by its email, created the first time they log in. ctx is scoped
+// to the workspace of the directory or provider, users of other workspaces
+// aren't found
+func (s *Server) directoryLogin(ctx context.Context, entry *directoryUser) (*types.User, *ApiError) {
+	user, err := s.store.GetUserByEmail(ctx, entry.Email)
+	if err == nil {
+		return user, nil
+	}
+	if !errors.Is(err, storage.ErrNotFound) {
+		s.errorf("error: get user failed: %v", err)
+		return nil, errInternal
+	}
+
+	// first login, the local user has no password of its own
+	if checkUsername(entry.Username) != nil || len(entry.Email) > 50 {
+		s.errorf("error: directory user %q <%s> can't be provisioned, the username or email doesn't fit", entry.Username, entry.Email)
+		return nil, errDirectoryAccount
+	}
+	user, err = s.createUser(ctx, entry.Username, entry.Email, "")
+	var apiErr *ApiError
+	if errors.As(err, &apiErr) {
+		return nil, apiErr
+	}
+	if errors.Is(err, storage.ErrConflict) {
+		return nil, errUserExists
+	}
+	if err != nil {
+		s.errorf("error: create user failed: %v", err)
+		return nil, errInternal
+	}
+	profile := types.ProfileRequest{DisplayName: entry.DisplayName}
+	if profile.DisplayName != "" && s.checkProfile(&profile) == nil {
+		if err = s.store.SetProfile(ctx, user.Id, profile); err != nil {
+			s.errorf("error: set profile failed: %v", err)
+		}
+		user.DisplayName = profile.DisplayName
+	}
+	return user, nil
+}
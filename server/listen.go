@@ -0,0 +1,56 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// first file descriptor passed by systemd socket activation
+const listenFdsStart = 3
+
+// Listen opens the listener for a listen address:
+//
+//	:3000 or host:port  tcp
+//	unix:/path/to.sock  unix socket, a stale socket file is removed first
+//	systemd             the first socket passed by systemd
+//	systemd:name        the socket passed with FileDescriptorName=name
+func Listen(addr string) (net.Listener, error) {
+	switch {
+	case strings.HasPrefix(addr, "unix:"):
+		path := strings.TrimPrefix(addr, "unix:")
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+		return net.Listen("unix", path)
+	case addr == "systemd" || strings.HasPrefix(addr, "systemd:"):
+		return systemdListener(strings.TrimPrefix(strings.TrimPrefix(addr, "systemd"), ":"))
+	}
+	return net.Listen("tcp", addr)
+}
+
+// systemdListener returns an inherited socket, see sd_listen_fds(3)
+func systemdListener(name string) (net.Listener, error) {
+	if pid, err := strconv.Atoi(os.Getenv("LISTEN_PID")); err != nil || pid != os.Getpid() {
+		return nil, errors.New("listen: no sockets passed by systemd")
+	}
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count < 1 {
+		return nil, errors.New("listen: no sockets passed by systemd")
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+
+	for i := 0; i < count; i++ {
+		if name != "" && (i >= len(names) || names[i] != name) {
+			continue
+		}
+		f := os.NewFile(uintptr(listenFdsStart+i), "systemd-socket")
+		ln, err := net.FileListener(f)
+		f.Close()
+		return ln, err
+	}
+	return nil, fmt.Errorf("listen: no socket named %q passed by systemd", name)
+}
@@ -0,0 +1,501 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"example/gochat/storage"
+	"example/gochat/types"
+)
+
+const maintenanceInterval = time.Hour
+
+// maintainMessages prepares message storage for the coming month and
+// applies the retention config every maintenanceInterval until ctx is done
+func (s *Server) maintainMessages(ctx context.Context) {
+	ticker := time.NewTicker(maintenanceInterval)
+	defer ticker.Stop()
+	for {
+		retention := time.Duration(s.config.Get().Retention.MessageDays) * 24 * time.Hour
+		if err := s.store.MaintainMessages(ctx, time.Now(), retention); err != nil && ctx.Err() == nil {
+			s.errorf("error: maintain messages failed: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// handleSearchMessages finds messages in the caller's chats, or in the one
+// given with ?chat=, by text, author, time and whether they hold a link
+func (s *Server) handleSearchMessages(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		WriteError(w, errMethodNotAllowed(r.Method))
+		return
+	}
+
+	// get user from req context
+	user, ok := r.Context().Value(userContextKey).(*types.User)
+	if !ok {
+		WriteError(w, errNotAuthorized)
+		return
+	}
+
+	// get filters
+	query := r.URL.Query()
+	search := storage.MessageSearch{
+		ChatIds: user.Chats,
+		Text:    strings.TrimSpace(query.Get("q")),
+		Author:  strings.TrimPrefix(strings.TrimSpace(query.Get("author")), "@"),
+	}
+	if len(search.Text) > maxTopicLen {
+		WriteError(w, errInvalidSearch)
+		return
+	}
+	if c := query.Get("chat"); c != "" {
+		id, err := strconv.Atoi(c)
+		if err != nil || !slices.Contains(user.Chats, id) {
+			WriteError(w, errChatNotFound)
+			return
+		}
+		search.ChatIds = []int{id}
+	}
+	var err error
+	if search.After, err = getTime(r, "after"); err != nil {
+		WriteError(w, errInvalidTime)
+		return
+	}
+	if search.Before, err = getTime(r, "before"); err != nil {
+		WriteError(w, errInvalidTime)
+		return
+	}
+	if has := query.Get("has"); has != "" {
+		for _, h := range strings.Split(has, ",") {
+			if h != "link" {
+				WriteError(w, errInvalidSearchFilter)
+				return
+			}
+			search.HasLink = true
+		}
+	}
+	cursor, limit, err := getPage(r)
+	if err != nil {
+		WriteError(w, errInvalidCursor)
+		return
+	}
+	search.BeforeId, search.Limit = int64(cursor), limit
+
+	// search messages
+	messages, err := s.store.SearchMessages(r.Context(), search)
+	if err != nil {
+		WriteError(w, errInternal)
+		s.logf(r, "error: search messages failed: %v", err)
+		return
+	}
+
+	// response, the cursor is the id of the last message returned
+	res := types.ListJSON[types.MessageJSON]{Data: messages, Total: len(messages)}
+	if len(messages) == limit {
+		res.NextCursor = strconv.FormatInt(messages[len(messages)-1].Id, 10)
+	}
+	WriteJSON(w, http.StatusOK, res)
+}
+
+// sendPreview tells the members the new preview of a chat whose last
+// message changed, so chat lists update without loading the summaries
+func (s *Server) sendPreview(chatId int, usersId []int, last *types.MessageJSON) {
+	s.hub.SendToUsers(usersId, types.EventJSON{Type: "chat_preview", Data: types.ChatPreviewJSON{ChatId: chatId, Preview: last.Preview()}})
+}
+
+// handleEditMessage lets authors change the text of their messages,
+// the previous text is kept in the edit history
+func (s *Server) handleEditMessage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "PUT" {
+		WriteError(w, errMethodNotAllowed(r.Method))
+		return
+	}
+
+	// get chat and message id
+	id, err := getChatId(r)
+	if err != nil {
+		WriteError(w, errChatNotFound)
+		return
+	}
+	messageId, err := getMessageId(r)
+	if err != nil {
+		WriteError(w, errMessageNotFound)
+		return
+	}
+
+	// get user from req context
+	user, ok := r.Context().Value(userContextKey).(*types.User)
+	if !ok {
+		WriteError(w, errNotAuthorized)
+		return
+	}
+
+	// check for user in chat
+	eq := false
+	for _, uid := range user.Chats {
+		if uid == id {
+			eq = true
+			break
+		}
+	}
+	if !eq {
+		WriteError(w, errChatNotFound)
+		return
+	}
+
+	// get text
+	req := new(types.SendMessageRequest)
+	json.NewDecoder(r.Body).Decode(req)
+	if req.Text == "" || len(req.Text) > 2000 {
+		WriteError(w, errInvalidMessage)
+		return
+	}
+	if s.config.Get().HasFilteredWord(req.Text) {
+		WriteError(w, errBlockedWord)
+		return
+	}
+
+	// edit message, only the author's own messages are found
+	message, err := s.store.EditMessage(r.Context(), id, messageId, user.Id, req.Text, time.Now().Truncate(time.Millisecond))
+	if err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			WriteError(w, errMessageNotFound)
+			return
+		}
+		WriteError(w, errInternal)
+		s.logf(r, "error: edit message failed: %v", err)
+		return
+	}
+	changeId := s.recordChange(r.Context(), id, user.Id, ChangeMessageEdited, message)
+
+	// push to chat members
+	s.hub.SendToChat(id, 0, types.EventJSON{Id: changeId, Type: "message_edited", Data: message})
+	chat, err := s.store.GetChatById(r.Context(), id)
+	if err != nil {
+		s.logf(r, "error: get chat failed: %v", err)
+	} else {
+		usersId := []int{}
+		for _, a := range chat.Users {
+			usersId = append(usersId, a.Id)
+		}
+		if n := len(chat.Messages); n > 0 && chat.Messages[n-1].Id == message.Id {
+			s.sendPreview(id, usersId, message)
+		}
+	}
+
+	// response
+	WriteJSON(w, http.StatusOK, message)
+}
+
+// handleMessageHistory lists the previous versions of a message to the
+// admins of its chat
+func (s *Server) handleMessageHistory(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		WriteError(w, errMethodNotAllowed(r.Method))
+		return
+	}
+
+	// get chat and message id
+	id, err := getChatId(r)
+	if err != nil {
+		WriteError(w, errChatNotFound)
+		return
+	}
+	messageId, err := getMessageId(r)
+	if err != nil {
+		WriteError(w, errMessageNotFound)
+		return
+	}
+
+	// check for chat admin
+	user, ok := r.Context().Value(userContextKey).(*types.User)
+	if !ok {
+		WriteError(w, errNotAuthorized)
+		return
+	}
+	if !slices.Contains(user.Chats, id) {
+		WriteError(w, errChatNotFound)
+		return
+	}
+	role, err := s.store.GetMemberRole(r.Context(), id, user.Id)
+	if err != nil {
+		WriteError(w, errInternal)
+		s.logf(r, "error: get member role failed: %v", err)
+		return
+	}
+	if role != types.MemberRoleAdmin {
+		WriteError(w, errForbidden)
+		return
+	}
+
+	// get history
+	edits, err := s.store.GetMessageHistory(r.Context(), id, messageId)
+	if err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			WriteError(w, errMessageNotFound)
+			return
+		}
+		WriteError(w, errInternal)
+		s.logf(r, "error: get message history failed: %v", err)
+		return
+	}
+
+	// response
+	WriteJSON(w, http.StatusOK, types.ListJSON[types.MessageEditJSON]{Data: edits, Total: len(edits)})
+}
+
+// handleReactions returns the per emoji counts of a message on GET, or the
+// users who reacted with ?emoji=, and adds or removes the caller's
+// reaction on POST and DELETE
+func (s *Server) handleReactions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "POST" && r.Method != "DELETE" {
+		WriteError(w, errMethodNotAllowed(r.Method))
+		return
+	}
+
+	// get chat and message id
+	id, err := getChatId(r)
+	if err != nil {
+		WriteError(w, errChatNotFound)
+		return
+	}
+	messageId, err := getMessageId(r)
+	if err != nil {
+		WriteError(w, errMessageNotFound)
+		return
+	}
+
+	// get user from req context, guests have none and can only read
+	user, _ := r.Context().Value(userContextKey).(*types.User)
+	if user == nil && r.Method != "GET" {
+		WriteError(w, errNotAuthorized)
+		return
+	}
+
+	if r.Method == "GET" {
+		s.handleGetReactions(w, r, id, messageId, user)
+		return
+	}
+
+	// check for user in chat, viewers can't react
+	eq := false
+	for _, uid := range user.Chats {
+		if uid == id {
+			eq = true
+			break
+		}
+	}
+	if !eq {
+		WriteError(w, errChatNotFound)
+		return
+	}
+	role, err := s.store.GetMemberRole(r.Context(), id, user.Id)
+	if err != nil {
+		WriteError(w, errInternal)
+		s.logf(r, "error: get member role failed: %v", err)
+		return
+	}
+	if role == types.MemberRoleViewer {
+		WriteError(w, errReadOnly)
+		return
+	}
+
+	// get emoji
+	req := new(types.ReactionRequest)
+	json.NewDecoder(r.Body).Decode(req)
+	if req.Emoji == "" || len(req.Emoji) > 32 || strings.ContainsAny(req.Emoji, " \t\n") {
+		WriteError(w, errInvalidEmoji)
+		return
+	}
+
+	// POST reacts, DELETE takes it back
+	added := r.Method == "POST"
+	if added {
+		err = s.store.AddReaction(r.Context(), id, messageId, user.Id, req.Emoji)
+	} else {
+		err = s.store.RemoveReaction(r.Context(), id, messageId, user.Id, req.Emoji)
+	}
+	if err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			WriteError(w, errMessageNotFound)
+			return
+		}
+		WriteError(w, errInternal)
+		s.logf(r, "error: update reaction failed: %v", err)
+		return
+	}
+
+	// push to chat members
+	event := types.ReactionEventJSON{ChatId: id, MessageId: messageId, UserId: user.Id, Emoji: req.Emoji, Added: added}
+	s.hub.SendToChat(id, 0, types.EventJSON{Type: "reaction", Data: event})
+
+	// response
+	WriteJSON(w, http.StatusOK, event)
+}
+
+func (s *Server) handleGetReactions(w http.ResponseWriter, r *http.Request, id int, messageId int64, user *types.User) {
+	// get chat
+	chat, err := s.store.GetChatById(r.Context(), id)
+	if err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			WriteError(w, errChatNotFound)
+			return
+		}
+		WriteError(w, errInternal)
+		s.logf(r, "error: get chat failed: %v", err)
+		return
+	}
+	if !canRead(user, chat) {
+		WriteError(w, errChatNotFound)
+		return
+	}
+
+	// who reacted with one emoji, paged by user id
+	if emoji := r.URL.Query().Get("emoji"); emoji != "" {
+		cursor, limit, err := getPage(r)
+		if err != nil {
+			WriteError(w, errInvalidCursor)
+			return
+		}
+		users, err := s.store.GetReactionUsers(r.Context(), id, messageId, emoji, cursor, limit)
+		if err != nil {
+			WriteError(w, errInternal)
+			s.logf(r, "error: get reaction users failed: %v", err)
+			return
+		}
+		res := types.ListJSON[types.AuthorJSON]{Data: users, Total: len(users)}
+		if len(users) == limit {
+			res.NextCursor = strconv.Itoa(users[len(users)-1].Id)
+		}
+		WriteJSON(w, http.StatusOK, res)
+		return
+	}
+
+	// counts per emoji
+	userId := 0
+	if user != nil {
+		userId = user.Id
+	}
+	reactions, err := s.store.GetReactionSummary(r.Context(), id, messageId, userId)
+	if err != nil {
+		WriteError(w, errInternal)
+		s.logf(r, "error: get reaction summary failed: %v", err)
+		return
+	}
+
+	// response
+	WriteJSON(w, http.StatusOK, types.ListJSON[types.ReactionJSON]{Data: reactions, Total: len(reactions)})
+}
+
+// handleBookmark bookmarks a message on POST and removes the bookmark
+// on DELETE
+func (s *Server) handleBookmark(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" && r.Method != "DELETE" {
+		WriteError(w, errMethodNotAllowed(r.Method))
+		return
+	}
+
+	// get chat and message id
+	id, err := getChatId(r)
+	if err != nil {
+		WriteError(w, errChatNotFound)
+		return
+	}
+	messageId, err := getMessageId(r)
+	if err != nil {
+		WriteError(w, errMessageNotFound)
+		return
+	}
+
+	// get user from req context
+	user, ok := r.Context().Value(userContextKey).(*types.User)
+	if !ok {
+		WriteError(w, errNotAuthorized)
+		return
+	}
+
+	// check for user in chat
+	eq := false
+	for _, uid := range user.Chats {
+		if uid == id {
+			eq = true
+			break
+		}
+	}
+	if !eq {
+		WriteError(w, errChatNotFound)
+		return
+	}
+
+	if r.Method == "POST" {
+		err = s.store.CreateBookmark(r.Context(), user.Id, id, messageId)
+	} else {
+		err = s.store.DeleteBookmark(r.Context(), user.Id, messageId)
+	}
+	if err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			WriteError(w, errMessageNotFound)
+			return
+		}
+		WriteError(w, errInternal)
+		s.logf(r, "error: update bookmark failed: %v", err)
+		return
+	}
+
+	// response
+	if r.Method == "POST" {
+		WriteJSON(w, http.StatusCreated, "message bookmarked")
+		return
+	}
+	WriteJSON(w, http.StatusOK, "bookmark removed")
+}
+
+// handleBookmarks lists the caller's bookmarked messages across their
+// chats, newest bookmark first
+func (s *Server) handleBookmarks(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		WriteError(w, errMethodNotAllowed(r.Method))
+		return
+	}
+
+	// get user from req context
+	user, ok := r.Context().Value(userContextKey).(*types.User)
+	if !ok {
+		WriteError(w, errNotAuthorized)
+		return
+	}
+
+	// get page, the cursor is the id of the last bookmark returned
+	cursor, limit, err := getPage(r)
+	if err != nil {
+		WriteError(w, errInvalidCursor)
+		return
+	}
+
+	// get bookmarks
+	bookmarks, err := s.store.GetBookmarks(r.Context(), user.Id, user.Chats, int64(cursor), limit)
+	if err != nil {
+		WriteError(w, errInternal)
+		s.logf(r, "error: get bookmarks failed: %v", err)
+		return
+	}
+
+	// response
+	res := types.ListJSON[types.BookmarkJSON]{Data: bookmarks, Total: len(bookmarks)}
+	if len(bookmarks) == limit {
+		res.NextCursor = strconv.FormatInt(bookmarks[len(bookmarks)-1].Id, 10)
+	}
+	WriteJSON(w, http.StatusOK, res)
+}
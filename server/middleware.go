@@ -0,0 +1,209 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type RateLimiter struct {
+	mu     sync.Mutex
+	window time.Time
+	counts map[string]int
+}
+
+func NewRateLimiter() *RateLimiter {
+	return &RateLimiter{
+		counts: make(map[string]int),
+	}
+}
+
+// Allow counts a request for key in the current one minute window
+func (l *RateLimiter) Allow(key string, limit int) bool {
+	if limit == 0 {
+		return true
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// start a new window
+	now := time.Now().Truncate(time.Minute)
+	if !now.Equal(l.window) {
+		l.window = now
+		l.counts = make(map[string]int)
+	}
+
+	l.counts[key]++
+	return l.counts[key] <= limit
+}
+
+// banMiddleware refuses clients whose address is in the config's bannedIps
+func (s *Server) banMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ip := net.ParseIP(s.clientIp(r)); ip != nil && s.config.Get().Banned(ip) {
+			WriteError(w, errBanned)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *Server) rateLimitMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		limit := s.config.Get().RateLimit.RequestsPerMinute
+		if !s.limiter.Allow(s.clientIp(r), limit) {
+			w.Header().Set("Retry-After", "60")
+			WriteError(w, errTooManyRequests)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// breakerMiddleware rejects requests while the storage circuit is open
+// instead of letting them queue up on a database that is down
+func (s *Server) breakerMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// health checks answer for themselves
+		if s.breaker != nil && s.breaker.Open() && r.URL.Path != "/healthz" && r.URL.Path != "/readyz" {
+			w.Header().Set("Retry-After", strconv.Itoa(int(s.breaker.Interval().Seconds())))
+			WriteError(w, errServiceUnavailable)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// requestIdMiddleware keeps the X-Request-ID sent by the client or a proxy,
+// or generates one, and echoes it in the response
+func requestIdMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if !validRequestId(id) {
+			id = newRequestId()
+		}
+		w.Header().Set("X-Request-ID", id)
+		ctx := context.WithValue(r.Context(), requestIdContextKey, id)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func newRequestId() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// validRequestId accepts up to 128 printable ascii characters so ids
+// can't be used to inject into logs
+func validRequestId(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for _, c := range id {
+		if c < '!' || c > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// requestId returns the id of the request ctx belongs to
+func requestId(ctx context.Context) string {
+	id, _ := ctx.Value(requestIdContextKey).(string)
+	return id
+}
+
+// logf logs with the request id in front. What a request logs is reported
+// with it when it is answered with a server error
+func (s *Server) logf(r *http.Request, format string, v ...any) {
+	s.logger.Printf("[%s] "+format, append([]any{requestId(r.Context())}, v...)...)
+	if errs, ok := r.Context().Value(errorsContextKey).(*requestErrors); ok {
+		errs.add(r, fmt.Sprintf(format, v...))
+	}
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// Unwrap lets http.ResponseController reach the connection
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// Hijack lets websocket upgrades through the recorder
+func (r *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := r.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response writer can't be hijacked")
+	}
+	return h.Hijack()
+}
+
+func (s *Server) logMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.config.Get().LogLevel != LogLevelDebug {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+		// not through logf, the access log isn't a cause of errors
+		s.logger.Printf("[%s] %s %s %s %d %s", requestId(r.Context()), s.clientIp(r), r.Method, r.URL.Path, rec.status, time.Since(start))
+	})
+}
+
+// clientIp returns the address of the client, forwarding headers are
+// only read from trusted proxies and X-Forwarded-For is walked from the
+// right so a client can't prepend a fake address
+func (s *Server) clientIp(r *http.Request) string {
+	config := s.config.Get()
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	// unix socket peers are a local proxy
+	ip := net.ParseIP(host)
+	if ip != nil && !config.TrustedProxy(ip) {
+		return host
+	}
+
+	if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+		hops := strings.Split(forwarded, ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop := net.ParseIP(strings.TrimSpace(hops[i]))
+			if hop == nil {
+				break
+			}
+			host = hop.String()
+			if !config.TrustedProxy(hop) {
+				break
+			}
+		}
+		return host
+	}
+	if realIp := net.ParseIP(strings.TrimSpace(r.Header.Get("X-Real-IP"))); realIp != nil {
+		return realIp.String()
+	}
+	return host
+}
@@ -0,0 +1,106 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"example/gochat/types"
+)
+
+// notify adds a notification to the inbox of the users and tells the
+// connected ones, failures are only logged
+func (s *Server) notify(ctx context.Context, usersId []int, notificationType string, chatId int, data any) {
+	if len(usersId) == 0 {
+		return
+	}
+	if err := s.store.CreateNotifications(ctx, usersId, notificationType, chatId, data); err != nil {
+		s.logger.Printf("[%s] error: create %s notifications failed: %v", requestId(ctx), notificationType, err)
+		return
+	}
+	s.hub.SendToUsers(usersId, types.EventJSON{Type: "notification", Data: map[string]any{"type": notificationType, "chatId": chatId, "data": data}})
+}
+
+// notifyMentions notifies the members mentioned as @username in a message
+// and adds it to their activity
+func (s *Server) notifyMentions(ctx context.Context, chat *types.Chat, message types.MessageJSON) {
+	usersId := []int{}
+	for _, a := range chat.Users {
+		if a.Id != message.Author.Id && mentions(message.Text, a.Username) {
+			usersId = append(usersId, a.Id)
+		}
+	}
+	s.notify(ctx, usersId, types.NotificationMention, chat.Id, message)
+	s.recordActivity(ctx, usersId, types.ActivityMention, chat.Id, message)
+}
+
+// handleNotifications lists the caller's notifications newest first,
+// ?unread=true leaves out the read ones
+func (s *Server) handleNotifications(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		WriteError(w, errMethodNotAllowed(r.Method))
+		return
+	}
+
+	// get user from req context
+	user, ok := r.Context().Value(userContextKey).(*types.User)
+	if !ok {
+		WriteError(w, errNotAuthorized)
+		return
+	}
+
+	// get page, the cursor is the id of the last notification returned
+	cursor, limit, err := getPage(r)
+	if err != nil {
+		WriteError(w, errInvalidCursor)
+		return
+	}
+	unread := r.URL.Query().Get("unread") == "true"
+
+	// get notifications
+	notifications, err := s.store.GetNotifications(r.Context(), user.Id, unread, int64(cursor), limit)
+	if err != nil {
+		WriteError(w, errInternal)
+		s.logf(r, "error: get notifications failed: %v", err)
+		return
+	}
+
+	// response
+	res := types.ListJSON[types.NotificationJSON]{Data: notifications, Total: len(notifications)}
+	if len(notifications) == limit {
+		res.NextCursor = strconv.FormatInt(notifications[len(notifications)-1].Id, 10)
+	}
+	WriteJSON(w, http.StatusOK, res)
+}
+
+func (s *Server) handleReadNotifications(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		WriteError(w, errMethodNotAllowed(r.Method))
+		return
+	}
+
+	// get user from req context
+	user, ok := r.Context().Value(userContextKey).(*types.User)
+	if !ok {
+		WriteError(w, errNotAuthorized)
+		return
+	}
+
+	// get ids from front
+	req := new(types.ReadNotificationsRequest)
+	json.NewDecoder(r.Body).Decode(req)
+
+	// update notifications
+	if err := s.store.MarkNotificationsRead(r.Context(), user.Id, req.Ids); err != nil {
+		WriteError(w, errInternal)
+		s.logf(r, "error: mark notifications read failed: %v", err)
+		return
+	}
+
+	// tell the other devices, no ids means all
+	s.hub.SendToUsers([]int{user.Id}, types.EventJSON{Type: "notifications_read", Data: map[string]any{"ids": req.Ids}})
+
+	// response
+	WriteJSON(w, http.StatusOK, "notifications marked read")
+}
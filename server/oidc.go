@@ -0,0 +1,413 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+
+	"example/gochat/storage"
+	"example/gochat/types"
+)
+
+const (
+	// users have this long at the identity provider before they come back
+	oidcLoginTTL = 10 * time.Minute
+	// token exchanges and discovery give up after this
+	oidcTimeout = 10 * time.Second
+)
+
+// OIDCConfig selects the identity provider users can sign in with, as an
+// openid connect relying party
+type OIDCConfig struct {
+	// e.g. https://accounts.google.com, its discovery document is fetched
+	// on the first login
+	Issuer       string
+	ClientId     string
+	ClientSecret string
+	// where the provider sends users back to, this server's
+	// /api/oidc/callback
+	RedirectUrl string
+	// slug of the workspace its users are in, the default one when empty
+	Workspace string
+	// the claim with the user's groups, groups when empty
+	GroupsClaim string
+	// accept emails without an email_verified claim, for providers that
+	// only hand out emails they verified but don't say so
+	TrustEmail bool
+	// group -> chats its members are added to when they sign in
+	GroupChats map[string][]int
+}
+
+// OIDCAuth signs users in with an openid connect provider, next to the
+// local logins
+type OIDCAuth struct {
+	config OIDCConfig
+
+	mu       sync.Mutex
+	provider *oidc.Provider
+	// state -> login waiting for the provider's answer
+	logins map[string]oidcLogin
+}
+
+type oidcLogin struct {
+	nonce    string
+	verifier string
+	expires  time.Time
+}
+
+// NewOIDCAuth checks the config, it doesn't contact the provider until the
+// first login
+func NewOIDCAuth(config OIDCConfig) (*OIDCAuth, error) {
+	u, err := url.Parse(config.Issuer)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return nil, fmt.Errorf("invalid issuer %q, expected e.g. https://accounts.example.com", config.Issuer)
+	}
+	if config.ClientId == "" {
+		return nil, errors.New("a client id is required")
+	}
+	u, err = url.Parse(config.RedirectUrl)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return nil, fmt.Errorf("invalid redirect url %q, expected e.g. https://chat.example.com/api/oidc/callback", config.RedirectUrl)
+	}
+	if config.GroupsClaim == "" {
+		config.GroupsClaim = "groups"
+	}
+	return &OIDCAuth{config: config, logins: map[string]oidcLogin{}}, nil
+}
+
+// ParseGroupChats reads a group to chat mapping such as
+// "engineering:3,engineering:4,ops:7"
+func ParseGroupChats(value string) (map[string][]int, error) {
+	groups := map[string][]int{}
+	for _, pair := range strings.Split(value, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		i := strings.LastIndex(pair, ":")
+		if i < 1 {
+			return nil, fmt.Errorf("invalid mapping %q, expected group:chatId", pair)
+		}
+		id, err := strconv.Atoi(pair[i+1:])
+		if err != nil || id < 1 {
+			return nil, fmt.Errorf("invalid chat id in %q", pair)
+		}
+		groups[pair[:i]] = append(groups[pair[:i]], id)
+	}
+	return groups, nil
+}
+
+// WithOIDC lets users sign in with an openid connect provider
+func WithOIDC(oidc *OIDCAuth) Option {
+	return func(s *Server) {
+		s.oidc = oidc
+	}
+}
+
+// discover returns the provider, fetching its discovery document and keys
+// until that succeeds once
+func (a *OIDCAuth) discover(ctx context.Context) (*oidc.Provider, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.provider != nil {
+		return a.provider, nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, oidcTimeout)
+	defer cancel()
+	provider, err := oidc.NewProvider(ctx, a.config.Issuer)
+	if err != nil {
+		return nil, err
+	}
+	a.provider = provider
+	return provider, nil
+}
+
+func (a *OIDCAuth) oauth2(provider *oidc.Provider) *oauth2.Config {
+	return &oauth2.Config{
+		ClientID:     a.config.ClientId,
+		ClientSecret: a.config.ClientSecret,
+		RedirectURL:  a.config.RedirectUrl,
+		Endpoint:     provider.Endpoint(),
+		Scopes:       []string{oidc.ScopeOpenID, "profile", "email"},
+	}
+}
+
+// put keeps a login until the provider sends the user back, by its state
+func (a *OIDCAuth) put(login oidcLogin) (string, error) {
+	state, err := randomString()
+	if err != nil {
+		return "", err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	// drop expired logins
+	now := time.Now()
+	for k, l := range a.logins {
+		if now.After(l.expires) {
+			delete(a.logins, k)
+		}
+	}
+
+	login.expires = now.Add(oidcLoginTTL)
+	a.logins[state] = login
+	return state, nil
+}
+
+// take returns a login once, callbacks can't be replayed
+func (a *OIDCAuth) take(state string) (oidcLogin, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	login, ok := a.logins[state]
+	delete(a.logins, state)
+	if !ok || time.Now().After(login.expires) {
+		return oidcLogin{}, false
+	}
+	return login, true
+}
+
+func randomString() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// oidcClaims are the id token claims users are mapped by
+type oidcClaims struct {
+	Email             string `json:"email"`
+	EmailVerified     *bool  `json:"email_verified"`
+	PreferredUsername string `json:"preferred_username"`
+	Name              string `json:"name"`
+}
+
+// groups returns the groups in the configured claim, a list or a single
+// string
+func (a *OIDCAuth) groups(token *oidc.IDToken) []string {
+	claims := map[string]any{}
+	if err := token.Claims(&claims); err != nil {
+		return nil
+	}
+	switch v := claims[a.config.GroupsClaim].(type) {
+	case string:
+		return []string{v}
+	case []any:
+		groups := []string{}
+		for _, g := range v {
+			if g, ok := g.(string); ok {
+				groups = append(groups, g)
+			}
+		}
+		return groups
+	}
+	return nil
+}
+
+// handleOIDCLogin sends the user to the identity provider
+func (s *Server) handleOIDCLogin(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		WriteError(w, errMethodNotAllowed(r.Method))
+		return
+	}
+	if s.oidc == nil {
+		WriteError(w, errSSODisabled)
+		return
+	}
+
+	// get provider
+	provider, err := s.oidc.discover(r.Context())
+	if err != nil {
+		WriteError(w, errSSOUnavailable)
+		s.logf(r, "error: oidc discovery failed: %v", err)
+		return
+	}
+
+	// remember the login
+	login := oidcLogin{verifier: oauth2.GenerateVerifier()}
+	if login.nonce, err = randomString(); err != nil {
+		WriteError(w, errInternal)
+		s.logf(r, "error: oidc nonce failed: %v", err)
+		return
+	}
+	state, err := s.oidc.put(login)
+	if err != nil {
+		WriteError(w, errInternal)
+		s.logf(r, "error: oidc state failed: %v", err)
+		return
+	}
+
+	// response
+	redirect := s.oidc.oauth2(provider).AuthCodeURL(state, oidc.Nonce(login.nonce), oauth2.S256ChallengeOption(login.verifier))
+	http.Redirect(w, r, redirect, http.StatusFound)
+}
+
+// handleOIDCCallback is where the identity provider sends the user back,
+// it answers like a password login
+func (s *Server) handleOIDCCallback(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		WriteError(w, errMethodNotAllowed(r.Method))
+		return
+	}
+	if s.oidc == nil {
+		WriteError(w, errSSODisabled)
+		return
+	}
+
+	// get login
+	query := r.URL.Query()
+	login, ok := s.oidc.take(query.Get("state"))
+	if !ok {
+		WriteError(w, errSSOExpired)
+		return
+	}
+	if e := query.Get("error"); e != "" {
+		WriteError(w, errSSOFailed)
+		s.logf(r, "oidc login refused: %s: %s", e, query.Get("error_description"))
+		return
+	}
+	provider, err := s.oidc.discover(r.Context())
+	if err != nil {
+		WriteError(w, errSSOUnavailable)
+		s.logf(r, "error: oidc discovery failed: %v", err)
+		return
+	}
+
+	// exchange the code and verify the id token
+	ctx, cancel := context.WithTimeout(r.Context(), oidcTimeout)
+	defer cancel()
+	token, err := s.oidc.oauth2(provider).Exchange(ctx, query.Get("code"), oauth2.VerifierOption(login.verifier))
+	if err != nil {
+		WriteError(w, errSSOFailed)
+		s.logf(r, "oidc code exchange failed: %v", err)
+		return
+	}
+	raw, _ := token.Extra("id_token").(string)
+	idToken, err := provider.Verifier(&oidc.Config{ClientID: s.oidc.config.ClientId}).Verify(ctx, raw)
+	if err != nil || idToken.Nonce != login.nonce {
+		WriteError(w, errSSOFailed)
+		s.logf(r, "oidc id token rejected: %v", err)
+		return
+	}
+
+	// map the claims to a local user
+	claims := oidcClaims{}
+	if err = idToken.Claims(&claims); err != nil {
+		WriteError(w, errSSOFailed)
+		s.logf(r, "oidc claims invalid: %v", err)
+		return
+	}
+	ctx, err = s.providerWorkspace(r.Context(), s.oidc.config.Workspace)
+	if err != nil {
+		WriteError(w, errInternal)
+		s.logf(r, "error: oidc: %v", err)
+		return
+	}
+	user, apiErr := s.oidcUser(ctx, idToken, claims)
+	if apiErr != nil {
+		WriteError(w, apiErr)
+		return
+	}
+	if !user.Disabled {
+		s.joinGroupChats(ctx, user, s.oidc.groups(idToken))
+	}
+
+	// response
+	s.writeLoginResponse(w, r, user)
+}
+
+// oidcUser returns the local user an identity is linked to, in the
+// provider's workspace of ctx. The first time it signs in it is linked to
+// the user with its email, created if there is none, so the email has to
+// be one the provider vouches for. Later logins don't look at the email
+// again, changing it at the provider can't reach another account
+func (s *Server) oidcUser(ctx context.Context, idToken *oidc.IDToken, claims oidcClaims) (*types.User, *ApiError) {
+	id, err := s.store.GetIdentityUser(ctx, idToken.Issuer, idToken.Subject)
+	if err == nil {
+		user, err := s.store.GetUserById(ctx, id)
+		if errors.Is(err, storage.ErrNotFound) {
+			// linked while the provider was set up for another workspace
+			s.errorf("oidc user %q is linked to user %d outside the provider's workspace", idToken.Subject, id)
+			return nil, errDirectoryAccount
+		}
+		if err != nil {
+			s.errorf("error: get user failed: %v", err)
+			return nil, errInternal
+		}
+		return user, nil
+	}
+	if !errors.Is(err, storage.ErrNotFound) {
+		s.errorf("error: get identity failed: %v", err)
+		return nil, errInternal
+	}
+
+	// first login
+	entry := &directoryUser{Email: normalizeEmail(claims.Email), Username: claims.PreferredUsername, DisplayName: strings.TrimSpace(claims.Name)}
+	verified := claims.EmailVerified != nil && *claims.EmailVerified
+	if entry.Email == "" || (!verified && !(s.oidc.config.TrustEmail && claims.EmailVerified == nil)) {
+		s.errorf("oidc user %q has no verified email", idToken.Subject)
+		return nil, errDirectoryAccount
+	}
+	if entry.Username == "" || strings.Contains(entry.Username, "@") {
+		entry.Username, _, _ = strings.Cut(entry.Email, "@")
+	}
+	user, apiErr := s.directoryLogin(ctx, entry)
+	if apiErr != nil {
+		return nil, apiErr
+	}
+	if err = s.store.LinkIdentity(ctx, idToken.Issuer, idToken.Subject, user.Id); err != nil {
+		if errors.Is(err, storage.ErrConflict) {
+			// the email moved to another account at the provider
+			s.errorf("oidc user %q: %s is linked to another account of the provider", idToken.Subject, entry.Email)
+			return nil, errDirectoryAccount
+		}
+		s.errorf("error: link identity failed: %v", err)
+		return nil, errInternal
+	}
+	return user, nil
+}
+
+// joinGroupChats adds the user to the chats mapped to their groups, leaving
+// a group doesn't remove them
+func (s *Server) joinGroupChats(ctx context.Context, user *types.User, groups []string) {
+	for _, group := range groups {
+		for _, id := range s.oidc.config.GroupChats[group] {
+			if slices.Contains(user.Chats, id) {
+				continue
+			}
+			chat, err := s.store.GetChatById(ctx, id)
+			if err != nil {
+				if !errors.Is(err, storage.ErrNotFound) {
+					s.errorf("error: get chat failed: %v", err)
+				}
+				continue
+			}
+			if err = s.onUserJoin(ctx, JoinEvent{User: user, Chat: chat}); err != nil {
+				s.errorf("group %s: join of chat %d vetoed: %v", group, id, err)
+				continue
+			}
+			if err = s.store.AddMember(ctx, chat.Id, user.Id); err != nil {
+				if !errors.Is(err, storage.ErrNotFound) && !errors.Is(err, storage.ErrConflict) {
+					s.errorf("error: add member failed: %v", err)
+				}
+				continue
+			}
+			user.Chats = append(user.Chats, chat.Id)
+			s.recordChange(ctx, chat.Id, user.Id, ChangeMemberJoined, author(user))
+			s.hub.Join(user.Id, chat.Id)
+			s.recordActivity(ctx, []int{user.Id}, types.ActivityAddedToChat, chat.Id, map[string]any{"chatName": chat.Name})
+		}
+	}
+}
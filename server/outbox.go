@@ -0,0 +1,125 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"example/gochat/types"
+)
+
+const (
+	outboxInterval = time.Second
+	outboxBatch    = 100
+	// events no webhook took by then are dropped
+	outboxRetention = 7 * 24 * time.Hour
+	// a webhook or stream that failed is left alone this long
+	outboxRetry    = 30 * time.Second
+	webhookTimeout = 10 * time.Second
+)
+
+// dispatchOutbox posts the outbox events to every configured webhook and
+// the event stream, in order, until ctx is done. A webhook that fails gets
+// the same event again on the next try, so it sees each event once unless
+// the server stops between its answer and the cursor update;
+// X-Gochat-Event-Id lets it drop the repeat
+func (s *Server) dispatchOutbox(ctx context.Context) {
+	ticker := time.NewTicker(outboxInterval)
+	defer ticker.Stop()
+	client := &http.Client{Timeout: webhookTimeout}
+	retryAt := map[string]time.Time{}
+	pruned := time.Time{}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		now := time.Now()
+		for _, hook := range s.config.Get().Webhooks {
+			if now.Before(retryAt[hook.Name]) {
+				continue
+			}
+			err := s.store.DispatchOutbox(ctx, "webhook:"+hook.Name, outboxBatch, func(events []types.OutboxEventJSON) int64 {
+				last := int64(0)
+				for _, event := range events {
+					if err := sendWebhook(ctx, client, hook, event); err != nil {
+						s.errorf("error: webhook %s failed at event %d: %v", hook.Name, event.Id, err)
+						retryAt[hook.Name] = now.Add(outboxRetry)
+						break
+					}
+					last = event.Id
+				}
+				return last
+			})
+			if err != nil && ctx.Err() == nil {
+				s.errorf("error: dispatch outbox failed: %v", err)
+			}
+		}
+		if s.stream != nil && !now.Before(retryAt[streamConsumer]) {
+			err := s.store.DispatchOutbox(ctx, streamConsumer, outboxBatch, func(events []types.OutboxEventJSON) int64 {
+				last, err := s.stream.Publish(ctx, events)
+				if err != nil {
+					s.errorf("error: event stream failed after event %d: %v", last, err)
+					retryAt[streamConsumer] = now.Add(outboxRetry)
+				}
+				return last
+			})
+			if err != nil && ctx.Err() == nil {
+				s.errorf("error: dispatch outbox failed: %v", err)
+			}
+		}
+
+		if now.Sub(pruned) > time.Hour {
+			if err := s.store.PruneOutbox(ctx, now.Add(-outboxRetention)); err != nil && ctx.Err() == nil {
+				s.errorf("error: prune outbox failed: %v", err)
+			}
+			pruned = now
+		}
+	}
+}
+
+// sendWebhook posts one event, events the webhook didn't ask for count as
+// sent
+func sendWebhook(ctx context.Context, client *http.Client, hook WebhookConfig, event types.OutboxEventJSON) error {
+	if len(hook.Events) > 0 && !slices.Contains(hook.Events, event.Type) {
+		return nil
+	}
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", hook.Url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Gochat-Event", event.Type)
+	req.Header.Set("X-Gochat-Event-Id", strconv.FormatInt(event.Id, 10))
+	if hook.Secret != "" {
+		mac := hmac.New(sha256.New, []byte(hook.Secret))
+		mac.Write(body)
+		req.Header.Set("X-Gochat-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	io.Copy(io.Discard, res.Body)
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("status %d", res.StatusCode)
+	}
+	return nil
+}
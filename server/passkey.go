@@ -0,0 +1,279 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+
+	"example/gochat/storage"
+	"example/gochat/types"
+)
+
+const passkeySessionTTL = 5 * time.Minute
+
+// passkeyUser adapts a user and their credentials to webauthn.User
+type passkeyUser struct {
+	user        *types.User
+	credentials []webauthn.Credential
+}
+
+func (u *passkeyUser) WebAuthnID() []byte {
+	return []byte(strconv.Itoa(u.user.Id))
+}
+
+func (u *passkeyUser) WebAuthnName() string {
+	return u.user.Email
+}
+
+func (u *passkeyUser) WebAuthnDisplayName() string {
+	return u.user.Username
+}
+
+func (u *passkeyUser) WebAuthnCredentials() []webauthn.Credential {
+	return u.credentials
+}
+
+func (u *passkeyUser) WebAuthnIcon() string {
+	return ""
+}
+
+type passkeySession struct {
+	data    webauthn.SessionData
+	userId  int
+	expires time.Time
+}
+
+// PasskeySessions keeps ceremony state between the begin and finish calls
+type PasskeySessions struct {
+	mu       sync.Mutex
+	sessions map[string]passkeySession
+}
+
+func NewPasskeySessions() *PasskeySessions {
+	return &PasskeySessions{
+		sessions: make(map[string]passkeySession),
+	}
+}
+
+func (p *PasskeySessions) put(data *webauthn.SessionData, userId int) (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	id := hex.EncodeToString(b)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	// drop expired sessions
+	now := time.Now()
+	for k, session := range p.sessions {
+		if now.After(session.expires) {
+			delete(p.sessions, k)
+		}
+	}
+
+	p.sessions[id] = passkeySession{data: *data, userId: userId, expires: now.Add(passkeySessionTTL)}
+	return id, nil
+}
+
+// take returns a session once, sessions can't be replayed
+func (p *PasskeySessions) take(id string) (passkeySession, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	session, ok := p.sessions[id]
+	delete(p.sessions, id)
+	if !ok || time.Now().After(session.expires) {
+		return passkeySession{}, false
+	}
+	return session, true
+}
+
+// EnablePasskeys turns on the passkey endpoints for the relying party
+func (s *Server) EnablePasskeys(rpId string, origins []string) error {
+	w, err := webauthn.New(&webauthn.Config{
+		RPID:          rpId,
+		RPDisplayName: "gochat",
+		RPOrigins:     origins,
+	})
+	if err != nil {
+		return err
+	}
+	s.webauthn = w
+	return nil
+}
+
+func (s *Server) passkeysEnabled(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != "POST" {
+		WriteError(w, errMethodNotAllowed(r.Method))
+		return false
+	}
+	if s.webauthn == nil {
+		WriteError(w, errPasskeysDisabled)
+		return false
+	}
+	return true
+}
+
+func (s *Server) handlePasskeyRegisterBegin(w http.ResponseWriter, r *http.Request) {
+	if !s.passkeysEnabled(w, r) {
+		return
+	}
+
+	// get user from req context
+	user, ok := r.Context().Value(userContextKey).(*types.User)
+	if !ok {
+		WriteError(w, errNotAuthorized)
+		return
+	}
+
+	// get existing passkeys so they aren't registered twice
+	credentials, err := s.store.GetPasskeys(r.Context(), user.Id)
+	if err != nil {
+		WriteError(w, errInternal)
+		s.logf(r, "error: get passkeys failed: %v", err)
+		return
+	}
+	exclusions := []protocol.CredentialDescriptor{}
+	for _, c := range credentials {
+		exclusions = append(exclusions, c.Descriptor())
+	}
+
+	// start ceremony
+	options, data, err := s.webauthn.BeginRegistration(
+		&passkeyUser{user: user, credentials: credentials},
+		webauthn.WithResidentKeyRequirement(protocol.ResidentKeyRequirementRequired),
+		webauthn.WithExclusions(exclusions),
+	)
+	if err != nil {
+		WriteError(w, errInternal)
+		s.logf(r, "error: begin passkey registration failed: %v", err)
+		return
+	}
+	sessionId, err := s.passkeys.put(data, user.Id)
+	if err != nil {
+		WriteError(w, errInternal)
+		s.logf(r, "error: passkey session failed: %v", err)
+		return
+	}
+
+	// response
+	WriteJSON(w, http.StatusOK, types.PasskeyBeginJSON{SessionId: sessionId, Options: options})
+}
+
+func (s *Server) handlePasskeyRegisterFinish(w http.ResponseWriter, r *http.Request) {
+	if !s.passkeysEnabled(w, r) {
+		return
+	}
+
+	// get user from req context
+	user, ok := r.Context().Value(userContextKey).(*types.User)
+	if !ok {
+		WriteError(w, errNotAuthorized)
+		return
+	}
+
+	// get session
+	session, ok := s.passkeys.take(r.URL.Query().Get("session"))
+	if !ok || session.userId != user.Id {
+		WriteError(w, errPasskeySessionExpired)
+		return
+	}
+
+	// verify attestation
+	credential, err := s.webauthn.FinishRegistration(&passkeyUser{user: user}, session.data, r)
+	if err != nil {
+		WriteError(w, errPasskeyRegistration)
+		s.logf(r, "passkey registration error: %v", err)
+		return
+	}
+
+	// store credential
+	if err = s.store.CreatePasskey(r.Context(), user.Id, *credential); err != nil {
+		WriteError(w, errInternal)
+		s.logf(r, "error: create passkey failed: %v", err)
+		return
+	}
+
+	// response
+	WriteJSON(w, http.StatusCreated, "passkey registered")
+}
+
+func (s *Server) handlePasskeyLoginBegin(w http.ResponseWriter, r *http.Request) {
+	if !s.passkeysEnabled(w, r) {
+		return
+	}
+
+	// start ceremony, the authenticator picks the account
+	options, data, err := s.webauthn.BeginDiscoverableLogin()
+	if err != nil {
+		WriteError(w, errInternal)
+		s.logf(r, "error: begin passkey login failed: %v", err)
+		return
+	}
+	sessionId, err := s.passkeys.put(data, 0)
+	if err != nil {
+		WriteError(w, errInternal)
+		s.logf(r, "error: passkey session failed: %v", err)
+		return
+	}
+
+	// response
+	WriteJSON(w, http.StatusOK, types.PasskeyBeginJSON{SessionId: sessionId, Options: options})
+}
+
+func (s *Server) handlePasskeyLoginFinish(w http.ResponseWriter, r *http.Request) {
+	if !s.passkeysEnabled(w, r) {
+		return
+	}
+
+	// get session
+	session, ok := s.passkeys.take(r.URL.Query().Get("session"))
+	if !ok {
+		WriteError(w, errPasskeySessionExpired)
+		return
+	}
+
+	// find the user from the user handle, in whichever workspace, and
+	// verify the assertion
+	var user *types.User
+	credential, err := s.webauthn.FinishDiscoverableLogin(func(rawId, userHandle []byte) (webauthn.User, error) {
+		id, err := strconv.Atoi(string(userHandle))
+		if err != nil {
+			return nil, err
+		}
+		ctx := storage.Unscoped(r.Context())
+		if user, err = s.store.GetUserById(ctx, id); err != nil {
+			return nil, err
+		}
+		credentials, err := s.store.GetPasskeys(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		return &passkeyUser{user: user, credentials: credentials}, nil
+	}, session.data, r)
+	if err != nil || user == nil {
+		WriteError(w, errNotAuthorized)
+		s.logf(r, "passkey login error: %v", err)
+		return
+	}
+
+	// a counter that went back means the authenticator was cloned
+	if credential.Authenticator.CloneWarning {
+		WriteError(w, errNotAuthorized)
+		s.logf(r, "passkey login error: clone warning for user %d", user.Id)
+		return
+	}
+	if err = s.store.UpdatePasskey(r.Context(), *credential); err != nil {
+		s.logf(r, "error: update passkey failed: %v", err)
+	}
+
+	// response
+	s.writeLoginResponse(w, r, user)
+}
@@ -0,0 +1,178 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"example/gochat/types"
+)
+
+// Plugin extends the server from inside the binary, registered with
+// WithPlugins. A plugin implements any of the hook interfaces below, hooks
+// are called in the order the plugins were registered, the built in ones
+// first
+type Plugin interface {
+	// Name identifies the plugin in logs
+	Name() string
+}
+
+// MessageEvent is a new message, it has no id yet before it is stored. The
+// user and chat must not be modified
+type MessageEvent struct {
+	User    *types.User
+	Chat    *types.Chat
+	Message types.MessageJSON
+}
+
+// JoinEvent is a user about to be added to a chat
+type JoinEvent struct {
+	User *types.User
+	Chat *types.Chat
+}
+
+// MessageCreateHook is called before a new message is stored. An error
+// vetoes it, an *ApiError is sent to the client as it is and anything else
+// is answered with a 403. The later hooks aren't called then
+type MessageCreateHook interface {
+	OnMessageCreate(context.Context, MessageEvent) error
+}
+
+// MessageCreatedHook is called after a new message is stored and sent to
+// the chat, to react to it. It runs with the request, slow work belongs in
+// a goroutine
+type MessageCreatedHook interface {
+	OnMessageCreated(context.Context, MessageEvent)
+}
+
+// UserJoinHook is called before a user joins a chat or an admin adds a
+// bot to one, an error vetoes it like for MessageCreateHook
+type UserJoinHook interface {
+	OnUserJoin(context.Context, JoinEvent) error
+}
+
+// LoginHook is called before a token is issued to a user, whether by
+// password, passkey or password change, an error vetoes it like for
+// MessageCreateHook
+type LoginHook interface {
+	OnLogin(context.Context, *types.User) error
+}
+
+// Runner is a plugin that works in the background, Run is called once
+// when the server starts and should return when ctx is done
+type Runner interface {
+	Run(ctx context.Context)
+}
+
+// WithPlugins registers plugins after the built in ones
+func WithPlugins(plugins ...Plugin) Option {
+	return func(s *Server) {
+		s.plugins = append(s.plugins, plugins...)
+	}
+}
+
+// vetoError is a hook's veto
+type vetoError struct {
+	plugin string
+	err    error
+}
+
+func (e *vetoError) Error() string {
+	return e.plugin + ": " + e.err.Error()
+}
+
+func (e *vetoError) Unwrap() error {
+	return e.err
+}
+
+func (s *Server) onMessageCreate(ctx context.Context, event MessageEvent) error {
+	for _, p := range s.plugins {
+		if hook, ok := p.(MessageCreateHook); ok {
+			if err := hook.OnMessageCreate(ctx, event); err != nil {
+				return &vetoError{plugin: p.Name(), err: err}
+			}
+		}
+	}
+	return nil
+}
+
+func (s *Server) onMessageCreated(ctx context.Context, event MessageEvent) {
+	for _, p := range s.plugins {
+		if hook, ok := p.(MessageCreatedHook); ok {
+			hook.OnMessageCreated(ctx, event)
+		}
+	}
+}
+
+func (s *Server) onUserJoin(ctx context.Context, event JoinEvent) error {
+	for _, p := range s.plugins {
+		if hook, ok := p.(UserJoinHook); ok {
+			if err := hook.OnUserJoin(ctx, event); err != nil {
+				return &vetoError{plugin: p.Name(), err: err}
+			}
+		}
+	}
+	return nil
+}
+
+func (s *Server) onLogin(ctx context.Context, user *types.User) error {
+	for _, p := range s.plugins {
+		if hook, ok := p.(LoginHook); ok {
+			if err := hook.OnLogin(ctx, user); err != nil {
+				return &vetoError{plugin: p.Name(), err: err}
+			}
+		}
+	}
+	return nil
+}
+
+// runPlugins starts the plugins that work in the background
+func (s *Server) runPlugins(ctx context.Context) {
+	for _, p := range s.plugins {
+		if runner, ok := p.(Runner); ok {
+			go runner.Run(ctx)
+		}
+	}
+}
+
+// writeVeto answers a request a hook vetoed
+func (s *Server) writeVeto(w http.ResponseWriter, r *http.Request, err error) {
+	var apiErr *ApiError
+	if errors.As(err, &apiErr) {
+		WriteError(w, apiErr)
+		return
+	}
+	WriteError(w, errRejected)
+	s.logf(r, "plugin veto: %v", err)
+}
+
+// wordFilter rejects messages with a word from the runtime config's word
+// filter
+type wordFilter struct {
+	config *ConfigLoader
+}
+
+func (p wordFilter) Name() string {
+	return "word-filter"
+}
+
+func (p wordFilter) OnMessageCreate(ctx context.Context, event MessageEvent) error {
+	if p.config.Get().HasFilteredWord(event.Message.Text) {
+		return errBlockedWord
+	}
+	return nil
+}
+
+// webhooks delivers the outbox to the configured webhooks and the event
+// stream
+type webhooks struct {
+	s *Server
+}
+
+func (p webhooks) Name() string {
+	return "webhooks"
+}
+
+func (p webhooks) Run(ctx context.Context) {
+	p.s.dispatchOutbox(ctx)
+}
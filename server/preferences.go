@@ -0,0 +1,156 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"example/gochat/types"
+)
+
+// wantsPush reports whether the preferences of a user allow pushing the
+// message at now
+func wantsPush(p types.PreferencesJSON, username string, message types.MessageJSON, now time.Time) bool {
+	switch p.Notify {
+	case types.NotifyNone:
+		return false
+	case types.NotifyMentions:
+		if !mentions(message.Text, username) {
+			return false
+		}
+	}
+	return !inQuietHours(p, now)
+}
+
+func mentions(text string, username string) bool {
+	return username != "" && strings.Contains(strings.ToLower(text), "@"+strings.ToLower(username))
+}
+
+const maxQuietHours = 10
+
+// inQuietHours reports whether now falls in one of the user's quiet hours,
+// read in their time zone
+func inQuietHours(p types.PreferencesJSON, now time.Time) bool {
+	loc, err := time.LoadLocation(p.TimeZone)
+	if err != nil {
+		loc = time.UTC
+	}
+	now = now.In(loc)
+	for _, q := range p.QuietHours {
+		if inWindow(q, now) {
+			return true
+		}
+	}
+	return false
+}
+
+func inWindow(q types.QuietHoursJSON, now time.Time) bool {
+	start, err := time.Parse("15:04", q.Start)
+	if err != nil {
+		return false
+	}
+	end, err := time.Parse("15:04", q.End)
+	if err != nil {
+		return false
+	}
+	minute := now.Hour()*60 + now.Minute()
+	from, to := start.Hour()*60+start.Minute(), end.Hour()*60+end.Minute()
+
+	// the part after midnight belongs to the day the window started
+	day := now.Weekday()
+	inside := minute >= from && minute < to
+	if from > to {
+		inside = minute >= from || minute < to
+		if minute < to {
+			day = (day + 6) % 7
+		}
+	}
+	if !inside {
+		return false
+	}
+	if len(q.Days) == 0 {
+		return true
+	}
+	for _, d := range q.Days {
+		if time.Weekday(d) == day {
+			return true
+		}
+	}
+	return false
+}
+
+func validPreferences(p types.PreferencesJSON) bool {
+	if p.Notify != types.NotifyAll && p.Notify != types.NotifyMentions && p.Notify != types.NotifyNone {
+		return false
+	}
+	if _, err := time.LoadLocation(p.TimeZone); err != nil || p.TimeZone == "" || p.TimeZone == "Local" {
+		return false
+	}
+	if len(p.QuietHours) > maxQuietHours {
+		return false
+	}
+	for _, q := range p.QuietHours {
+		if _, err := time.Parse("15:04", q.Start); err != nil {
+			return false
+		}
+		if _, err := time.Parse("15:04", q.End); err != nil {
+			return false
+		}
+		for _, d := range q.Days {
+			if d < 0 || d > 6 {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// handlePreferences returns the caller's notification preferences on GET
+// and replaces them on PUT
+func (s *Server) handlePreferences(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "PUT" {
+		WriteError(w, errMethodNotAllowed(r.Method))
+		return
+	}
+
+	// get user from req context
+	user, ok := r.Context().Value(userContextKey).(*types.User)
+	if !ok {
+		WriteError(w, errNotAuthorized)
+		return
+	}
+
+	if r.Method == "GET" {
+		prefs, err := s.store.GetPreferences(r.Context(), []int{user.Id})
+		if err != nil {
+			WriteError(w, errInternal)
+			s.logf(r, "error: get preferences failed: %v", err)
+			return
+		}
+		WriteJSON(w, http.StatusOK, prefs[user.Id])
+		return
+	}
+
+	// get preferences from front, missing fields keep the defaults
+	req := types.DefaultPreferences()
+	json.NewDecoder(r.Body).Decode(&req)
+	if req.QuietHours == nil {
+		req.QuietHours = []types.QuietHoursJSON{}
+	}
+	if !validPreferences(req) {
+		WriteError(w, errInvalidPreferences)
+		return
+	}
+
+	// update preferences
+	if err := s.store.SetPreferences(r.Context(), user.Id, req); err != nil {
+		WriteError(w, errInternal)
+		s.logf(r, "error: set preferences failed: %v", err)
+		return
+	}
+	s.syncOwnState(r.Context(), user.Id, ChangePreferencesUpdated, req)
+
+	// response
+	WriteJSON(w, http.StatusOK, req)
+}
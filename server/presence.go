@@ -0,0 +1,54 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"example/gochat/types"
+)
+
+// last seen is stored at most once per interval per user
+const lastSeenInterval = time.Minute
+
+// touchLastSeen records activity of the user, failures are only logged
+func (s *Server) touchLastSeen(ctx context.Context, userId int) {
+	now := time.Now()
+	if last, ok := s.lastSeen.Load(userId); ok && now.Sub(last.(time.Time)) < lastSeenInterval {
+		return
+	}
+	s.lastSeen.Store(userId, now)
+	if err := s.store.TouchLastSeen(ctx, userId, now); err != nil {
+		s.logger.Printf("[%s] error: touch last seen failed: %v", requestId(ctx), err)
+	}
+}
+
+// handlePrivacy lets users hide their last seen time from member lists
+func (s *Server) handlePrivacy(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "PUT" {
+		WriteError(w, errMethodNotAllowed(r.Method))
+		return
+	}
+
+	// get user from req context
+	user, ok := r.Context().Value(userContextKey).(*types.User)
+	if !ok {
+		WriteError(w, errNotAuthorized)
+		return
+	}
+
+	// get settings from front
+	req := new(types.PrivacyRequest)
+	json.NewDecoder(r.Body).Decode(req)
+
+	// update user
+	if err := s.store.SetShowLastSeen(r.Context(), user.Id, req.ShowLastSeen); err != nil {
+		WriteError(w, errInternal)
+		s.logf(r, "error: set show last seen failed: %v", err)
+		return
+	}
+
+	// response
+	WriteJSON(w, http.StatusOK, req)
+}
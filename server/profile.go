@@ -0,0 +1,197 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"example/gochat/storage"
+	"example/gochat/types"
+)
+
+// display names are shown instead of the username and can be changed any
+// time, the username stays the handle for mentions
+const (
+	maxDisplayName = 50
+	maxBio         = 300
+	maxPronouns    = 30
+	maxLink        = 200
+)
+
+// checkText trims a profile field and checks its length and characters
+func checkText(text string, max int) (string, bool) {
+	text = strings.TrimSpace(text)
+	if utf8.RuneCountInString(text) > max {
+		return "", false
+	}
+	for _, c := range text {
+		// bios can have line breaks
+		if unicode.IsControl(c) && c != '\n' {
+			return "", false
+		}
+	}
+	return text, true
+}
+
+// checkProfile cleans up the fields of req in place, links must be http
+// or https urls
+func (s *Server) checkProfile(req *types.ProfileRequest) *ApiError {
+	var ok bool
+	if req.DisplayName, ok = checkText(req.DisplayName, maxDisplayName); !ok || strings.Contains(req.DisplayName, "\n") {
+		return errInvalidDisplayName
+	}
+	if req.Pronouns, ok = checkText(req.Pronouns, maxPronouns); !ok || strings.Contains(req.Pronouns, "\n") {
+		return errInvalidProfile
+	}
+	if req.Bio, ok = checkText(req.Bio, maxBio); !ok {
+		return errInvalidProfile
+	}
+	if req.Link, ok = checkText(req.Link, maxLink); !ok {
+		return errInvalidProfile
+	}
+	if req.Link != "" {
+		u, err := url.Parse(req.Link)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return errInvalidProfile
+		}
+	}
+
+	config := s.config.Get()
+	for _, text := range []string{req.DisplayName, req.Bio, req.Pronouns, req.Link} {
+		if config.HasFilteredWord(text) {
+			return errProfileNotAllowed
+		}
+	}
+	return nil
+}
+
+// handleProfile shows or replaces the profile of the user
+func (s *Server) handleProfile(w http.ResponseWriter, r *http.Request) {
+	// get user from req context
+	user, ok := r.Context().Value(userContextKey).(*types.User)
+	if !ok {
+		WriteError(w, errNotAuthorized)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		s.writeProfile(w, r, user.Id)
+
+	case "PUT":
+		// get profile from front
+		req := new(types.ProfileRequest)
+		json.NewDecoder(r.Body).Decode(req)
+		if apiErr := s.checkProfile(req); apiErr != nil {
+			WriteError(w, apiErr)
+			return
+		}
+
+		// update user
+		if err := s.store.SetProfile(r.Context(), user.Id, *req); err != nil {
+			WriteError(w, errInternal)
+			s.logf(r, "error: set profile failed: %v", err)
+			return
+		}
+		profile := types.ProfileJSON{Id: user.Id, Username: user.Username, DisplayName: req.DisplayName, Bio: req.Bio, Pronouns: req.Pronouns, Link: req.Link}
+		s.syncOwnState(r.Context(), user.Id, ChangeProfileUpdated, profile)
+		s.writeProfile(w, r, user.Id)
+
+	default:
+		WriteError(w, errMethodNotAllowed(r.Method))
+	}
+}
+
+// handleUserProfile shows the public profile of any user, the email is
+// never part of it and last seen only when the user shares it
+func (s *Server) handleUserProfile(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		WriteError(w, errMethodNotAllowed(r.Method))
+		return
+	}
+
+	// get user id from url
+	id, err := getUserId(r)
+	if err != nil {
+		WriteError(w, errUserNotFound)
+		return
+	}
+	s.writeProfile(w, r, id)
+}
+
+func (s *Server) writeProfile(w http.ResponseWriter, r *http.Request, id int) {
+	profile, err := s.store.GetProfile(r.Context(), id)
+	if err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			WriteError(w, errUserNotFound)
+			return
+		}
+		WriteError(w, errInternal)
+		s.logf(r, "error: get profile failed: %v", err)
+		return
+	}
+
+	// response
+	WriteJSON(w, http.StatusOK, profile)
+}
+
+// handlePassword changes the user's own password, every session is signed
+// out and this one gets a new token
+func (s *Server) handlePassword(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "PUT" {
+		WriteError(w, errMethodNotAllowed(r.Method))
+		return
+	}
+
+	if s.ldap != nil {
+		WriteError(w, errDirectoryPasswords)
+		return
+	}
+
+	// get user from req context
+	user, ok := r.Context().Value(userContextKey).(*types.User)
+	if !ok {
+		WriteError(w, errNotAuthorized)
+		return
+	}
+
+	// get req, bcrypt ignores what is past 72 bytes
+	req := new(types.PasswordRequest)
+	json.NewDecoder(r.Body).Decode(req)
+	if !user.ValidatePassword(req.CurrentPassword) {
+		WriteError(w, errInvalidPassword)
+		return
+	}
+	if req.NewPassword == "" || len(req.NewPassword) > 72 {
+		WriteError(w, errInvalidNewPassword)
+		return
+	}
+
+	// store password
+	encPass, err := bcrypt.GenerateFromPassword([]byte(req.NewPassword), bcrypt.DefaultCost)
+	if err != nil {
+		WriteError(w, errInternal)
+		s.logf(r, "error: bcrypt encryption error: %v", err)
+		return
+	}
+	if err = s.store.SetPassword(r.Context(), user.Id, string(encPass)); err != nil {
+		WriteError(w, errInternal)
+		s.logf(r, "error: set password failed: %v", err)
+		return
+	}
+	s.hub.Disconnect(user.Id)
+
+	// response with a token of the new version
+	if user, err = s.store.GetUserById(r.Context(), user.Id); err != nil {
+		WriteError(w, errInternal)
+		s.logf(r, "error: get user failed: %v", err)
+		return
+	}
+	s.writeLoginResponse(w, r, user)
+}
@@ -0,0 +1,145 @@
+package server
+
+import (
+	"encoding/json"
+	"time"
+
+	"example/gochat/types"
+)
+
+// SubprotocolProtobuf switches a websocket to the binary events of
+// events.proto, events are json text frames otherwise. The encoding is
+// written by hand against the protobuf wire format, the schema is small
+// and stable enough not to need generated code
+const (
+	SubprotocolProtobuf = "gochat.protobuf"
+	SubprotocolJSON     = "gochat.json"
+)
+
+// wire types
+const (
+	wireVarint = 0
+	wireBytes  = 2
+)
+
+func appendVarint(b []byte, v uint64) []byte {
+	for v >= 0x80 {
+		b = append(b, byte(v)|0x80)
+		v >>= 7
+	}
+	return append(b, byte(v))
+}
+
+func appendTag(b []byte, field int, wireType int) []byte {
+	return appendVarint(b, uint64(field)<<3|uint64(wireType))
+}
+
+// fields with the default value are left out, as proto3 does
+
+func appendInt(b []byte, field int, v int64) []byte {
+	if v == 0 {
+		return b
+	}
+	return appendVarint(appendTag(b, field, wireVarint), uint64(v))
+}
+
+func appendBool(b []byte, field int, v bool) []byte {
+	if !v {
+		return b
+	}
+	return appendVarint(appendTag(b, field, wireVarint), 1)
+}
+
+func appendBytes(b []byte, field int, v []byte) []byte {
+	b = appendVarint(appendTag(b, field, wireBytes), uint64(len(v)))
+	return append(b, v...)
+}
+
+func appendString(b []byte, field int, v string) []byte {
+	if v == "" {
+		return b
+	}
+	return appendBytes(b, field, []byte(v))
+}
+
+func millis(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixMilli()
+}
+
+func encodeAuthor(a types.AuthorJSON) []byte {
+	b := appendInt(nil, 1, int64(a.Id))
+	b = appendString(b, 2, a.Username)
+	return appendString(b, 3, a.DisplayName)
+}
+
+func encodeMessage(m types.MessageJSON) []byte {
+	b := appendInt(nil, 1, m.Id)
+	b = appendInt(b, 2, int64(m.ChatId))
+	b = appendBytes(b, 3, encodeAuthor(m.Author))
+	b = appendString(b, 4, m.Text)
+	b = appendInt(b, 5, millis(m.CreatedAt))
+	if m.EditedAt != nil {
+		b = appendInt(b, 6, millis(*m.EditedAt))
+	}
+	for _, r := range m.Receipts {
+		receipt := appendInt(nil, 1, r.MessageId)
+		receipt = appendInt(receipt, 2, int64(r.UserId))
+		receipt = appendString(receipt, 3, r.Status)
+		b = appendBytes(b, 7, receipt)
+	}
+	return b
+}
+
+func encodeReaction(r types.ReactionEventJSON) []byte {
+	b := appendInt(nil, 1, int64(r.ChatId))
+	b = appendInt(b, 2, r.MessageId)
+	b = appendInt(b, 3, int64(r.UserId))
+	b = appendString(b, 4, r.Emoji)
+	return appendBool(b, 5, r.Added)
+}
+
+// decodeData returns data as a T, events replayed from the change log
+// carry it as raw json
+func decodeData[T any](data any) (T, error) {
+	if v, ok := data.(T); ok {
+		return v, nil
+	}
+	var v T
+	raw, ok := data.(json.RawMessage)
+	if !ok {
+		var err error
+		if raw, err = json.Marshal(data); err != nil {
+			return v, err
+		}
+	}
+	err := json.Unmarshal(raw, &v)
+	return v, err
+}
+
+// encodeProtobuf encodes an event as an Event of events.proto
+func encodeProtobuf(event types.EventJSON) ([]byte, error) {
+	b := appendInt(nil, 1, event.Id)
+	b = appendString(b, 2, event.Type)
+	switch event.Type {
+	case "message", "message_edited":
+		m, err := decodeData[types.MessageJSON](event.Data)
+		if err != nil {
+			return nil, err
+		}
+		return appendBytes(b, 3, encodeMessage(m)), nil
+	case "reaction":
+		r, err := decodeData[types.ReactionEventJSON](event.Data)
+		if err != nil {
+			return nil, err
+		}
+		return appendBytes(b, 4, encodeReaction(r)), nil
+	}
+	data, err := json.Marshal(event.Data)
+	if err != nil {
+		return nil, err
+	}
+	return appendBytes(b, 15, data), nil
+}
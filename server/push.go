@@ -0,0 +1,470 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+
+	"example/gochat/storage"
+	"example/gochat/types"
+)
+
+const (
+	PlatformFCM  = "fcm"
+	PlatformAPNs = "apns"
+)
+
+var ErrInvalidPushToken = errors.New("push token is no longer valid")
+
+type PushNotification struct {
+	Title  string
+	Body   string
+	ChatId int
+}
+
+type PushSender interface {
+	Send(token string, n PushNotification) error
+}
+
+// Notifier pushes new messages to the mobile devices of chat members
+type Notifier struct {
+	store   storage.Storage
+	hub     *Hub
+	senders map[string]PushSender
+	logger  *log.Logger
+}
+
+func NewNotifier(store storage.Storage, hub *Hub, logger *log.Logger) *Notifier {
+	return &Notifier{
+		store:   store,
+		hub:     hub,
+		senders: make(map[string]PushSender),
+		logger:  logger,
+	}
+}
+
+func (n *Notifier) AddSender(platform string, sender PushSender) {
+	n.senders[platform] = sender
+}
+
+// NotifyMessage pushes the message in the background to members that are
+// not connected over the realtime channel and haven't muted the chat, ctx
+// is the request that sent it
+func (n *Notifier) NotifyMessage(ctx context.Context, chat *types.Chat, message types.MessageJSON) {
+	if len(n.senders) == 0 {
+		return
+	}
+
+	// skip the author and connected users
+	online := map[int]bool{message.Author.Id: true}
+	for _, id := range n.hub.UserIds() {
+		online[id] = true
+	}
+	usersId := []int{}
+	usernames := map[int]string{}
+	for _, a := range chat.Users {
+		if !online[a.Id] {
+			usersId = append(usersId, a.Id)
+			usernames[a.Id] = a.Username
+		}
+	}
+	if len(usersId) == 0 {
+		return
+	}
+
+	body := message.Text
+	if len(body) > 100 {
+		body = body[:100] + "..."
+	}
+	notification := PushNotification{Title: message.Author.Username, Body: body, ChatId: chat.Id}
+
+	// runs after the request is done, so it gets its own deadline and
+	// keeps the request's workspace
+	go func() {
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), time.Minute)
+		defer cancel()
+
+		// skip users whose preferences exclude this message
+		prefs, err := n.store.GetPreferences(ctx, usersId)
+		if err != nil {
+			n.logger.Printf("error: get preferences failed: %v", err)
+			return
+		}
+		now := time.Now()
+		recipients := []int{}
+		for _, id := range usersId {
+			if wantsPush(prefs[id], usernames[id], message, now) {
+				recipients = append(recipients, id)
+			}
+		}
+		if len(recipients) == 0 {
+			return
+		}
+
+		tokens, err := n.store.GetPushTokens(ctx, recipients, chat.Id)
+		if err != nil {
+			n.logger.Printf("error: get push tokens failed: %v", err)
+			return
+		}
+		for _, t := range tokens {
+			sender, ok := n.senders[t.Platform]
+			if !ok {
+				continue
+			}
+			err := sender.Send(t.Token, notification)
+			if errors.Is(err, ErrInvalidPushToken) {
+				if err = n.store.DeletePushToken(ctx, t.UserId, t.Token); err != nil {
+					n.logger.Printf("error: delete push token failed: %v", err)
+				}
+				continue
+			}
+			if err != nil {
+				n.logger.Printf("error: %s push failed: %v", t.Platform, err)
+			}
+		}
+	}()
+}
+
+// FCMSender sends through the firebase cloud messaging v1 api with a
+// service account
+type FCMSender struct {
+	projectId   string
+	clientEmail string
+	tokenUri    string
+	key         *rsa.PrivateKey
+	client      *http.Client
+
+	mu          sync.Mutex
+	accessToken string
+	expiresAt   time.Time
+}
+
+func NewFCMSender(credentialsFile string) (*FCMSender, error) {
+	data, err := os.ReadFile(credentialsFile)
+	if err != nil {
+		return nil, err
+	}
+	creds := struct {
+		ProjectId   string `json:"project_id"`
+		ClientEmail string `json:"client_email"`
+		PrivateKey  string `json:"private_key"`
+		TokenUri    string `json:"token_uri"`
+	}{}
+	if err = json.Unmarshal(data, &creds); err != nil {
+		return nil, fmt.Errorf("fcm credentials: %w", err)
+	}
+	key, err := jwt.ParseRSAPrivateKeyFromPEM([]byte(creds.PrivateKey))
+	if err != nil {
+		return nil, fmt.Errorf("fcm credentials: %w", err)
+	}
+	if creds.TokenUri == "" {
+		creds.TokenUri = "https://oauth2.googleapis.com/token"
+	}
+	return &FCMSender{
+		projectId:   creds.ProjectId,
+		clientEmail: creds.ClientEmail,
+		tokenUri:    creds.TokenUri,
+		key:         key,
+		client:      &http.Client{Timeout: 10 * time.Second},
+	}, nil
+}
+
+// getAccessToken exchanges a signed assertion for an oauth token and
+// caches it until shortly before it expires
+func (f *FCMSender) getAccessToken() (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.accessToken != "" && time.Now().Before(f.expiresAt) {
+		return f.accessToken, nil
+	}
+
+	now := time.Now()
+	assertion, err := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"iss":   f.clientEmail,
+		"scope": "https://www.googleapis.com/auth/firebase.messaging",
+		"aud":   f.tokenUri,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	}).SignedString(f.key)
+	if err != nil {
+		return "", err
+	}
+
+	form := url.Values{
+		"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+		"assertion":  {assertion},
+	}
+	res, err := f.client.PostForm(f.tokenUri, form)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("fcm token exchange: status %d", res.StatusCode)
+	}
+	token := struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}{}
+	if err = json.NewDecoder(res.Body).Decode(&token); err != nil {
+		return "", err
+	}
+
+	f.accessToken = token.AccessToken
+	f.expiresAt = now.Add(time.Duration(token.ExpiresIn)*time.Second - time.Minute)
+	return f.accessToken, nil
+}
+
+func (f *FCMSender) Send(token string, n PushNotification) error {
+	accessToken, err := f.getAccessToken()
+	if err != nil {
+		return err
+	}
+
+	body, err := json.Marshal(map[string]any{
+		"message": map[string]any{
+			"token":        token,
+			"notification": map[string]string{"title": n.Title, "body": n.Body},
+			"data":         map[string]string{"chatId": strconv.Itoa(n.ChatId)},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	endpoint := fmt.Sprintf("https://fcm.googleapis.com/v1/projects/%s/messages:send", f.projectId)
+	req, err := http.NewRequest("POST", endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := f.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusNotFound {
+		return ErrInvalidPushToken
+	}
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("fcm send: status %d", res.StatusCode)
+	}
+	return nil
+}
+
+// APNsSender sends through apple push notifications with a token based
+// provider key
+type APNsSender struct {
+	keyId  string
+	teamId string
+	topic  string
+	host   string
+	key    *ecdsa.PrivateKey
+	client *http.Client
+
+	mu       sync.Mutex
+	token    string
+	issuedAt time.Time
+}
+
+func NewAPNsSender(keyFile, keyId, teamId, topic string, sandbox bool) (*APNsSender, error) {
+	data, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	key, err := jwt.ParseECPrivateKeyFromPEM(data)
+	if err != nil {
+		return nil, fmt.Errorf("apns key: %w", err)
+	}
+	host := "https://api.push.apple.com"
+	if sandbox {
+		host = "https://api.sandbox.push.apple.com"
+	}
+	return &APNsSender{
+		keyId:  keyId,
+		teamId: teamId,
+		topic:  topic,
+		host:   host,
+		key:    key,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}, nil
+}
+
+// providerToken returns a signed token, apple rejects tokens older than
+// an hour and throttles refreshing more than every 20 minutes
+func (a *APNsSender) providerToken() (string, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.token != "" && time.Since(a.issuedAt) < 50*time.Minute {
+		return a.token, nil
+	}
+
+	now := time.Now()
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, jwt.MapClaims{
+		"iss": a.teamId,
+		"iat": now.Unix(),
+	})
+	token.Header["kid"] = a.keyId
+	signed, err := token.SignedString(a.key)
+	if err != nil {
+		return "", err
+	}
+
+	a.token = signed
+	a.issuedAt = now
+	return a.token, nil
+}
+
+func (a *APNsSender) Send(token string, n PushNotification) error {
+	providerToken, err := a.providerToken()
+	if err != nil {
+		return err
+	}
+
+	body, err := json.Marshal(map[string]any{
+		"aps": map[string]any{
+			"alert": map[string]string{"title": n.Title, "body": n.Body},
+			"sound": "default",
+		},
+		"chatId": n.ChatId,
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", a.host+"/3/device/"+token, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "bearer "+providerToken)
+	req.Header.Set("apns-topic", a.topic)
+	req.Header.Set("apns-push-type", "alert")
+
+	res, err := a.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusGone {
+		return ErrInvalidPushToken
+	}
+	if res.StatusCode != http.StatusOK {
+		reason := struct {
+			Reason string `json:"reason"`
+		}{}
+		json.NewDecoder(res.Body).Decode(&reason)
+		if reason.Reason == "BadDeviceToken" {
+			return ErrInvalidPushToken
+		}
+		return fmt.Errorf("apns send: status %d %s", res.StatusCode, reason.Reason)
+	}
+	return nil
+}
+
+func (s *Server) handlePushTokens(w http.ResponseWriter, r *http.Request) {
+	// get user from req context
+	user, ok := r.Context().Value(userContextKey).(*types.User)
+	if !ok {
+		WriteError(w, errNotAuthorized)
+		return
+	}
+
+	// get req
+	req := new(types.PushTokenRequest)
+	json.NewDecoder(r.Body).Decode(req)
+	req.Token = strings.TrimSpace(req.Token)
+	if req.Token == "" || len(req.Token) > 512 {
+		WriteError(w, errBadPushToken)
+		return
+	}
+
+	if r.Method == "POST" {
+		if req.Platform != PlatformFCM && req.Platform != PlatformAPNs {
+			WriteError(w, errInvalidPlatform)
+			return
+		}
+		if err := s.store.CreatePushToken(r.Context(), user.Id, req.Token, req.Platform); err != nil {
+			WriteError(w, errInternal)
+			s.logf(r, "error: create push token failed: %v", err)
+			return
+		}
+		WriteJSON(w, http.StatusCreated, "push token registered")
+		return
+	}
+	if r.Method == "DELETE" {
+		if err := s.store.DeletePushToken(r.Context(), user.Id, req.Token); err != nil {
+			WriteError(w, errInternal)
+			s.logf(r, "error: delete push token failed: %v", err)
+			return
+		}
+		WriteJSON(w, http.StatusOK, "push token deleted")
+		return
+	}
+
+	WriteError(w, errMethodNotAllowed(r.Method))
+}
+
+func (s *Server) handleMuteChat(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" && r.Method != "DELETE" {
+		WriteError(w, errMethodNotAllowed(r.Method))
+		return
+	}
+
+	// get chat id
+	id, err := getChatId(r)
+	if err != nil {
+		WriteError(w, errChatNotFound)
+		return
+	}
+
+	// get user from req context
+	user, ok := r.Context().Value(userContextKey).(*types.User)
+	if !ok {
+		WriteError(w, errNotAuthorized)
+		return
+	}
+
+	// check for user in chat
+	eq := false
+	for _, uid := range user.Chats {
+		if uid == id {
+			eq = true
+			break
+		}
+	}
+	if !eq {
+		WriteError(w, errChatNotFound)
+		return
+	}
+
+	// POST mutes, DELETE unmutes
+	muted := r.Method == "POST"
+	if err = s.store.SetChatMuted(r.Context(), user.Id, id, muted); err != nil {
+		WriteError(w, errInternal)
+		s.logf(r, "error: set chat muted failed: %v", err)
+		return
+	}
+
+	// response
+	if muted {
+		WriteJSON(w, http.StatusOK, "chat muted")
+		return
+	}
+	WriteJSON(w, http.StatusOK, "chat unmuted")
+}
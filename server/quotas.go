@@ -0,0 +1,341 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"example/gochat/storage"
+	"example/gochat/types"
+)
+
+// workspaces' quotas and usage are reused this long, what other instances
+// add shows up after at most this
+const quotasTTL = time.Minute
+
+// the quotas of a workspace, as named in errors and
+// workspace.quota_exceeded events
+const (
+	QuotaMembers  = "members"
+	QuotaMessages = "messages"
+	QuotaStorage  = "storage"
+)
+
+// quotas refuses new members, messages and images of workspaces over
+// their quota. Usage is counted from the store once per quotasTTL and
+// kept up to date in between with what this instance adds
+type quotas struct {
+	s *Server
+
+	mu       sync.Mutex
+	limits   map[int]types.WorkspaceQuotaJSON
+	expires  time.Time
+	usage    map[int]cachedUsage
+	reported map[string]bool
+}
+
+type cachedUsage struct {
+	usage   types.WorkspaceUsageJSON
+	expires time.Time
+}
+
+// usageDelta is what a request adds to a workspace
+type usageDelta struct {
+	members  int
+	messages int
+	bytes    int64
+}
+
+func newQuotas(s *Server) *quotas {
+	return &quotas{s: s, usage: map[int]cachedUsage{}, reported: map[string]bool{}}
+}
+
+func (q *quotas) Name() string {
+	return "quotas"
+}
+
+func (q *quotas) OnMessageCreate(ctx context.Context, event MessageEvent) error {
+	return q.check(ctx, event.User.WorkspaceId, usageDelta{messages: 1, bytes: int64(len(event.Message.Text))})
+}
+
+func (q *quotas) OnMessageCreated(ctx context.Context, event MessageEvent) {
+	q.add(event.User.WorkspaceId, usageDelta{messages: 1, bytes: int64(len(event.Message.Text))})
+}
+
+// createUser creates a user in the workspace of ctx,
+// unless it would take the workspace over its members quota
+func (s *Server) createUser(ctx context.Context, username string, email string, password string) (*types.User, error) {
+	return s.quotas.create(ctx, func() (*types.User, error) {
+		return s.store.CreateUser(ctx, username, email, password)
+	})
+}
+
+// createBot creates a bot in the workspace of ctx, bots count as members
+func (s *Server) createBot(ctx context.Context, username string) (*types.User, error) {
+	return s.quotas.create(ctx, func() (*types.User, error) {
+		return s.store.CreateBot(ctx, username)
+	})
+}
+
+// create checks the members quota of the workspace of ctx, creates a member
+// and counts them. Every user and bot is created through here, the error is
+// an *ApiError when the workspace is full
+func (q *quotas) create(ctx context.Context, create func() (*types.User, error)) (*types.User, error) {
+	workspace, _ := storage.WorkspaceFrom(ctx)
+	if err := q.check(ctx, workspace, usageDelta{members: 1}); err != nil {
+		return nil, err
+	}
+	user, err := create()
+	if err != nil {
+		return nil, err
+	}
+	q.add(workspace, usageDelta{members: 1})
+	return user, nil
+}
+
+// limit returns the quota of a workspace, the default workspace has none
+func (q *quotas) limit(ctx context.Context, workspaceId int) (types.WorkspaceQuotaJSON, error) {
+	if workspaceId == storage.DefaultWorkspace {
+		return types.WorkspaceQuotaJSON{}, nil
+	}
+	q.mu.Lock()
+	limits, fresh := q.limits, time.Now().Before(q.expires)
+	q.mu.Unlock()
+	if fresh {
+		return limits[workspaceId], nil
+	}
+
+	workspaces, err := q.s.store.GetWorkspaces(ctx)
+	if err != nil {
+		return types.WorkspaceQuotaJSON{}, err
+	}
+	limits = map[int]types.WorkspaceQuotaJSON{}
+	for _, w := range workspaces {
+		limits[w.Id] = w.Quota
+	}
+	q.mu.Lock()
+	q.limits, q.expires = limits, time.Now().Add(quotasTTL)
+	q.mu.Unlock()
+	return limits[workspaceId], nil
+}
+
+// get returns the usage of a workspace this month, from the cache while it
+// is fresh
+func (q *quotas) get(ctx context.Context, workspaceId int) (types.WorkspaceUsageJSON, error) {
+	now := time.Now().UTC()
+	q.mu.Lock()
+	cached, ok := q.usage[workspaceId]
+	q.mu.Unlock()
+	if ok && now.Before(cached.expires) && cached.usage.Month == now.Format(storage.MonthFormat) {
+		return cached.usage, nil
+	}
+
+	usage, err := q.s.store.GetWorkspaceUsage(storage.WithWorkspace(ctx, workspaceId), workspaceId, now)
+	if err != nil {
+		return types.WorkspaceUsageJSON{}, err
+	}
+	q.mu.Lock()
+	q.usage[workspaceId] = cachedUsage{usage: *usage, expires: now.Add(quotasTTL)}
+	q.mu.Unlock()
+	return *usage, nil
+}
+
+// check returns an *ApiError when adding to the workspace would take it
+// over a quota. Quotas aren't enforced while the store can't count
+func (q *quotas) check(ctx context.Context, workspaceId int, delta usageDelta) error {
+	limit, err := q.limit(ctx, workspaceId)
+	if err != nil {
+		q.s.errorf("error: get workspaces failed: %v", err)
+		return nil
+	}
+	if limit == (types.WorkspaceQuotaJSON{}) {
+		return nil
+	}
+	usage, err := q.get(ctx, workspaceId)
+	if err != nil {
+		q.s.errorf("error: get workspace usage failed: %v", err)
+		return nil
+	}
+
+	exceeded := types.QuotaExceededJSON{WorkspaceId: workspaceId, Month: usage.Month}
+	switch {
+	case delta.members > 0 && limit.MaxMembers > 0 && usage.Members+delta.members > limit.MaxMembers:
+		exceeded.Quota, exceeded.Limit, exceeded.Usage = QuotaMembers, int64(limit.MaxMembers), int64(usage.Members)
+	case delta.messages > 0 && limit.MaxMessages > 0 && usage.Messages+delta.messages > limit.MaxMessages:
+		exceeded.Quota, exceeded.Limit, exceeded.Usage = QuotaMessages, int64(limit.MaxMessages), int64(usage.Messages)
+	case delta.bytes > 0 && limit.MaxStorageBytes > 0 && usage.StorageBytes+delta.bytes > limit.MaxStorageBytes:
+		exceeded.Quota, exceeded.Limit, exceeded.Usage = QuotaStorage, limit.MaxStorageBytes, usage.StorageBytes
+	default:
+		return nil
+	}
+	q.report(ctx, exceeded)
+	return errQuotaExceeded(exceeded.Quota)
+}
+
+// add counts what this instance added to a workspace until its usage is
+// counted again
+func (q *quotas) add(workspaceId int, delta usageDelta) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	cached, ok := q.usage[workspaceId]
+	if !ok {
+		return
+	}
+	cached.usage.Members += delta.members
+	cached.usage.Messages += delta.messages
+	cached.usage.StorageBytes += delta.bytes
+	q.usage[workspaceId] = cached
+}
+
+// forget drops the cached quotas and usage of a workspace whose quota
+// changed
+func (q *quotas) forget(workspaceId int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.expires = time.Time{}
+	delete(q.usage, workspaceId)
+}
+
+// report adds a workspace.quota_exceeded event for billing the first time
+// this instance refuses something over the quota in a month
+func (q *quotas) report(ctx context.Context, exceeded types.QuotaExceededJSON) {
+	key := fmt.Sprintf("%d:%s:%s", exceeded.WorkspaceId, exceeded.Quota, exceeded.Month)
+	q.mu.Lock()
+	reported := q.reported[key]
+	q.reported[key] = true
+	q.mu.Unlock()
+	if reported {
+		return
+	}
+	if err := q.s.store.AddOutboxEvent(context.WithoutCancel(ctx), types.OutboxQuotaExceeded, 0, exceeded); err != nil {
+		q.s.errorf("error: add quota event failed: %v", err)
+	}
+}
+
+// getMonth returns the month of ?month=, the current one when it is empty
+func getMonth(r *http.Request) (time.Time, error) {
+	v := r.URL.Query().Get("month")
+	if v == "" {
+		return time.Now().UTC(), nil
+	}
+	return time.Parse(storage.MonthFormat, v)
+}
+
+// handleAdminUsage shows the usage and quota of the admin's own workspace
+func (s *Server) handleAdminUsage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		WriteError(w, errMethodNotAllowed(r.Method))
+		return
+	}
+
+	// get month
+	month, err := getMonth(r)
+	if err != nil {
+		WriteError(w, errInvalidMonth)
+		return
+	}
+
+	// get usage
+	workspace, _ := storage.WorkspaceFrom(r.Context())
+	usage, err := s.store.GetWorkspaceUsage(r.Context(), workspace, month)
+	if err != nil {
+		WriteError(w, errInternal)
+		s.logf(r, "error: get workspace usage failed: %v", err)
+		return
+	}
+
+	// response
+	WriteJSON(w, http.StatusOK, usage)
+}
+
+// handleAdminWorkspacesUsage exports the usage of every workspace in a
+// month, the default one first, for billing
+func (s *Server) handleAdminWorkspacesUsage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		WriteError(w, errMethodNotAllowed(r.Method))
+		return
+	}
+
+	// get month
+	month, err := getMonth(r)
+	if err != nil {
+		WriteError(w, errInvalidMonth)
+		return
+	}
+
+	// get usage of each workspace
+	workspaces, err := s.store.GetWorkspaces(r.Context())
+	if err != nil {
+		WriteError(w, errInternal)
+		s.logf(r, "error: get workspaces failed: %v", err)
+		return
+	}
+	ids := []int{storage.DefaultWorkspace}
+	for _, workspace := range workspaces {
+		ids = append(ids, workspace.Id)
+	}
+	list := []types.WorkspaceUsageJSON{}
+	for _, id := range ids {
+		usage, err := s.store.GetWorkspaceUsage(storage.WithWorkspace(r.Context(), id), id, month)
+		if err != nil {
+			WriteError(w, errInternal)
+			s.logf(r, "error: get workspace usage failed: %v", err)
+			return
+		}
+		list = append(list, *usage)
+	}
+
+	// response
+	WriteJSON(w, http.StatusOK, types.ListJSON[types.WorkspaceUsageJSON]{Data: list, Total: len(list)})
+}
+
+// handleAdminWorkspaceQuota sets the quota of a workspace, 0 lifts a limit.
+// Workspaces already over a new quota keep what they have
+func (s *Server) handleAdminWorkspaceQuota(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "PUT" {
+		WriteError(w, errMethodNotAllowed(r.Method))
+		return
+	}
+
+	// get workspace
+	workspace, err := s.store.GetWorkspaceBySlug(r.Context(), mux.Vars(r)["slug"])
+	if err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			WriteError(w, errWorkspaceNotFound)
+			return
+		}
+		WriteError(w, errInternal)
+		s.logf(r, "error: get workspace failed: %v", err)
+		return
+	}
+
+	// get req
+	req := new(types.WorkspaceQuotaJSON)
+	json.NewDecoder(r.Body).Decode(req)
+	if req.MaxMembers < 0 || req.MaxMessages < 0 || req.MaxStorageBytes < 0 {
+		WriteError(w, errInvalidQuota)
+		return
+	}
+
+	// update quota
+	if err = s.store.SetWorkspaceQuota(storage.WithWorkspace(r.Context(), workspace.Id), workspace.Id, *req); err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			WriteError(w, errWorkspaceNotFound)
+			return
+		}
+		WriteError(w, errInternal)
+		s.logf(r, "error: set workspace quota failed: %v", err)
+		return
+	}
+	s.quotas.forget(workspace.Id)
+	s.audit(r, types.AuditWorkspaceQuota, 0, map[string]any{"workspaceId": workspace.Id, "quota": req})
+
+	// response
+	WriteJSON(w, http.StatusOK, req)
+}
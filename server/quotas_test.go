@@ -0,0 +1,110 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"example/gochat/storage"
+	"example/gochat/types"
+)
+
+// testWorkspace creates a workspace with the quota and a user with a chat
+// in it, the context is scoped to the workspace
+func testWorkspace(t *testing.T, s *Server, quota types.WorkspaceQuotaJSON) (context.Context, *types.User, *types.Chat) {
+	t.Helper()
+	// workspaces are created by operators, who see every workspace
+	ctx := storage.Unscoped(context.Background())
+	ws, err := s.store.CreateWorkspace(ctx, "Acme", "acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.store.SetWorkspaceQuota(ctx, ws.Id, quota); err != nil {
+		t.Fatal(err)
+	}
+	ctx = storage.WithWorkspace(context.Background(), ws.Id)
+	user, err := s.store.CreateUser(ctx, "alice", "alice@example.com", "hash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	chat, err := s.store.CreateChat(ctx, types.Chat{Name: "room", Visibility: types.VisibilityPublic}, *user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ctx, user, chat
+}
+
+func TestCreateBotQuota(t *testing.T) {
+	s := testServer(t, `{}`)
+	ctx, _, _ := testWorkspace(t, s, types.WorkspaceQuotaJSON{MaxMembers: 2})
+
+	for i, want := range []int{http.StatusCreated, http.StatusForbidden} {
+		r := httptest.NewRequest("POST", "/api/admin/bots", strings.NewReader(`{"username": "helper`+string(rune('a'+i))+`"}`)).WithContext(ctx)
+		w := httptest.NewRecorder()
+		s.handleAdminBots(w, r)
+		if w.Code != want {
+			t.Fatalf("bot %d: got %d %s, want %d", i+1, w.Code, w.Body, want)
+		}
+	}
+}
+
+func TestCreateSCIMUserQuota(t *testing.T) {
+	token := strings.Repeat("s", 32)
+	s := testServer(t, `{}`, WithSCIM(token, "acme"))
+	testWorkspace(t, s, types.WorkspaceQuotaJSON{MaxMembers: 2})
+
+	for i, want := range []int{http.StatusCreated, http.StatusForbidden} {
+		name := "bobby" + string(rune('a'+i))
+		body := `{"schemas": ["urn:ietf:params:scim:schemas:core:2.0:User"], "userName": "` + name + `", "emails": [{"value": "` + name + `@example.com"}]}`
+		r := httptest.NewRequest("POST", "/scim/v2/Users", strings.NewReader(body))
+		r.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		s.scimMiddleware(s.handleSCIMUsers)(w, r)
+		if w.Code != want {
+			t.Fatalf("user %d: got %d %s, want %d", i+1, w.Code, w.Body, want)
+		}
+	}
+}
+
+func TestRespondQuota(t *testing.T) {
+	s := testServer(t, `{}`)
+	ctx, user, chat := testWorkspace(t, s, types.WorkspaceQuotaJSON{MaxMessages: 2})
+	bot, err := s.createBot(ctx, "helper")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.store.AddMember(ctx, chat.Id, bot.Id); err != nil {
+		t.Fatal(err)
+	}
+	if chat, err = s.store.GetChatById(ctx, chat.Id); err != nil {
+		t.Fatal(err)
+	}
+
+	// the trigger and the first response fit in the quota, the second
+	// response doesn't
+	message, err := s.sendMessage(ctx, user, chat, "help")
+	if err != nil {
+		t.Fatal(err)
+	}
+	event := MessageEvent{User: user, Chat: chat, Message: message}
+	for id := 1; id <= 2; id++ {
+		s.responders.respond(ctx, types.ResponderJSON{Id: id, ChatId: chat.Id, BotId: bot.Id, Trigger: "help", Response: "hi {{.User}}"}, event)
+	}
+
+	got, err := s.store.GetChatById(ctx, chat.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Messages) != 2 {
+		t.Errorf("got %d messages, want the trigger and one response", len(got.Messages))
+	}
+	usage, err := s.quotas.get(ctx, user.WorkspaceId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usage.Messages != 2 {
+		t.Errorf("counted %d messages", usage.Messages)
+	}
+}
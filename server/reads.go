@@ -0,0 +1,117 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+
+	"example/gochat/storage"
+	"example/gochat/types"
+)
+
+// handleReadMarker shows or sets the last message of the chat the caller
+// has read, where clients draw the "new messages" divider. Setting it may
+// move it back, to mark messages unread again
+func (s *Server) handleReadMarker(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "PUT" {
+		WriteError(w, errMethodNotAllowed(r.Method))
+		return
+	}
+
+	// get chat id
+	id, err := getChatId(r)
+	if err != nil {
+		WriteError(w, errChatNotFound)
+		return
+	}
+
+	// get user from req context
+	user, ok := r.Context().Value(userContextKey).(*types.User)
+	if !ok {
+		WriteError(w, errNotAuthorized)
+		return
+	}
+	if !slices.Contains(user.Chats, id) {
+		WriteError(w, errChatNotFound)
+		return
+	}
+
+	// show marker
+	if r.Method == "GET" {
+		messageId, err := s.store.GetReadMarker(r.Context(), user.Id, id)
+		if err != nil {
+			if errors.Is(err, storage.ErrNotFound) {
+				WriteError(w, errChatNotFound)
+				return
+			}
+			WriteError(w, errInternal)
+			s.logf(r, "error: get read marker failed: %v", err)
+			return
+		}
+		WriteJSON(w, http.StatusOK, types.ReadMarkerJSON{ChatId: id, MessageId: messageId})
+		return
+	}
+
+	// get message id from front
+	req := new(types.ReadMarkerJSON)
+	json.NewDecoder(r.Body).Decode(req)
+	marker := types.ReadMarkerJSON{ChatId: id, MessageId: req.MessageId}
+
+	// update marker
+	if err = s.store.SetReadMarker(r.Context(), user.Id, id, marker.MessageId); err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			WriteError(w, errMessageNotFound)
+			return
+		}
+		WriteError(w, errInternal)
+		s.logf(r, "error: set read marker failed: %v", err)
+		return
+	}
+
+	// tell the other devices
+	s.hub.SendToUsers([]int{user.Id}, types.EventJSON{Type: "read_marker", Data: marker})
+
+	// response
+	WriteJSON(w, http.StatusOK, marker)
+}
+
+// handleReadAll marks the listed chats of the caller, or all of them, read
+// up to their last message
+func (s *Server) handleReadAll(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		WriteError(w, errMethodNotAllowed(r.Method))
+		return
+	}
+
+	// get user from req context
+	user, ok := r.Context().Value(userContextKey).(*types.User)
+	if !ok {
+		WriteError(w, errNotAuthorized)
+		return
+	}
+
+	// get chat ids from front
+	req := new(types.ReadAllRequest)
+	json.NewDecoder(r.Body).Decode(req)
+	if len(req.ChatIds) > 100 {
+		WriteError(w, errTooManyChats)
+		return
+	}
+
+	// update markers
+	markers, err := s.store.MarkAllRead(r.Context(), user.Id, req.ChatIds)
+	if err != nil {
+		WriteError(w, errInternal)
+		s.logf(r, "error: mark all read failed: %v", err)
+		return
+	}
+
+	// tell the other devices
+	for _, marker := range markers {
+		s.hub.SendToUsers([]int{user.Id}, types.EventJSON{Type: "read_marker", Data: marker})
+	}
+
+	// response, the markers that moved
+	WriteJSON(w, http.StatusOK, types.ListJSON[types.ReadMarkerJSON]{Data: markers, Total: len(markers)})
+}
@@ -0,0 +1,640 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"example/gochat/storage"
+	"example/gochat/types"
+)
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+	Subprotocols:    []string{SubprotocolProtobuf, SubprotocolJSON},
+}
+
+// a write that takes longer means the connection is dead
+const writeWait = 10 * time.Second
+
+type Client struct {
+	hub  *Hub
+	conn *websocket.Conn
+	user *types.User
+	send chan outbound
+
+	connectedAt time.Time
+	ping        time.Duration
+	idle        time.Duration
+	// messages of at least this many bytes are compressed, 0 when the
+	// connection doesn't use compression
+	compressAbove int
+	// binary events instead of json
+	protobuf bool
+	// set by the hub when a newer connection of the user took its place
+	evicted bool
+	// the chats whose events it gets, guarded by the hub's mu
+	chats map[int]bool
+
+	// set for clients that identify their device
+	device    string
+	ack       func(int64)
+	heartbeat func()
+	// marks an announcement seen once it was written to the connection
+	announced func(int)
+	// reads the chats of the user again as the client registers, nil uses
+	// the ones loaded with the user
+	memberships func() ([]int, error)
+	receipt     func(int64, string)
+	skipUntil   int64
+}
+
+type outbound struct {
+	id   int64
+	data []byte
+	// the event for protobuf clients, encoded once for all of them
+	binary []byte
+	// set for announcements, which are marked seen once written
+	announcement int
+}
+
+// encode returns the event in the client's format
+func (c *Client) encode(event types.EventJSON) ([]byte, error) {
+	if c.protobuf {
+		return encodeProtobuf(event)
+	}
+	return json.Marshal(event)
+}
+
+// Hub tracks the realtime clients of this instance and fans chat events out
+// to them. Handlers publish through it instead of writing to connections,
+// so every transport and, through the broker, every instance sees the same
+// events
+type Hub struct {
+	mu      sync.RWMutex
+	clients map[*Client]bool
+	// the connections of each user here, so sending to a few users doesn't
+	// go through every client
+	users map[int]map[*Client]bool
+	// the connections of each chat's members here, kept up to date as they
+	// join and leave, so chat events need no member list
+	chats  map[int]map[*Client]bool
+	logger *log.Logger
+
+	// serializes joins and leaves with reading the chats of a registering
+	// client, so none happens in between. Taken before replayMu
+	membersMu sync.Mutex
+
+	// taken before mu
+	replayMu sync.Mutex
+	replay   replayBuffer
+
+	compression compressionStats
+
+	// shares events with the other instances, nil when there are none
+	broker Broker
+	origin string
+	// the other instances by origin, from their status events
+	nodesMu sync.Mutex
+	nodes   map[string]nodeStatus
+}
+
+func NewHub(logger *log.Logger) *Hub {
+	return &Hub{
+		clients: make(map[*Client]bool),
+		users:   make(map[int]map[*Client]bool),
+		chats:   make(map[int]map[*Client]bool),
+		logger:  logger,
+		origin:  newOrigin(),
+		nodes:   make(map[string]nodeStatus),
+	}
+}
+
+// register adds a client, when its user already has max connections the
+// oldest are closed to make room, 0 means no limit. Connections dropped
+// by a flaky network linger until their idle timeout, so a reconnecting
+// client replaces them rather than being refused
+func (h *Hub) register(c *Client, max int) {
+	h.membersMu.Lock()
+	defer h.membersMu.Unlock()
+	h.add(c, max, h.memberships(c))
+}
+
+// memberships returns the chats of c's user, h.membersMu must be held until
+// c is subscribed to them
+func (h *Hub) memberships(c *Client) []int {
+	if c.memberships == nil {
+		return c.user.Chats
+	}
+	chats, err := c.memberships()
+	if err != nil {
+		h.logger.Printf("error: read memberships of user %d failed: %v", c.user.Id, err)
+		return c.user.Chats
+	}
+	return chats
+}
+
+func (h *Hub) add(c *Client, max int, chats []int) {
+	h.mu.Lock()
+	evicted := []*Client{}
+	if max > 0 {
+		own := []*Client{}
+		for other := range h.users[c.user.Id] {
+			if !other.evicted {
+				own = append(own, other)
+			}
+		}
+		sort.Slice(own, func(i, j int) bool { return own[i].connectedAt.Before(own[j].connectedAt) })
+		for ; len(own) >= max; own = own[1:] {
+			own[0].evicted = true
+			evicted = append(evicted, own[0])
+		}
+	}
+	h.clients[c] = true
+	if h.users[c.user.Id] == nil {
+		h.users[c.user.Id] = map[*Client]bool{}
+	}
+	h.users[c.user.Id][c] = true
+	c.chats = map[int]bool{}
+	for _, chatId := range chats {
+		h.subscribe(c, chatId)
+	}
+	h.mu.Unlock()
+
+	// their pumps unregister them
+	for _, other := range evicted {
+		h.logger.Printf("hub: closed oldest connection of user %d", other.user.Id)
+		other.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "too many connections"), time.Now().Add(time.Second))
+		other.conn.Close()
+	}
+}
+
+func (h *Hub) unregister(c *Client) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.clients[c]; ok {
+		delete(h.clients, c)
+		delete(h.users[c.user.Id], c)
+		if len(h.users[c.user.Id]) == 0 {
+			delete(h.users, c.user.Id)
+		}
+		for chatId := range c.chats {
+			h.unsubscribe(c, chatId)
+		}
+		close(c.send)
+	}
+}
+
+// subscribe sends the events of a chat to c, h.mu must be held
+func (h *Hub) subscribe(c *Client, chatId int) {
+	if h.chats[chatId] == nil {
+		h.chats[chatId] = map[*Client]bool{}
+	}
+	h.chats[chatId][c] = true
+	c.chats[chatId] = true
+}
+
+// unsubscribe stops the events of a chat to c, h.mu must be held
+func (h *Hub) unsubscribe(c *Client, chatId int) {
+	delete(h.chats[chatId], c)
+	if len(h.chats[chatId]) == 0 {
+		delete(h.chats, chatId)
+	}
+	delete(c.chats, chatId)
+}
+
+// Join sends the events of a chat to the connections of a user who just
+// became a member, on every instance
+func (h *Hub) Join(userId int, chatId int) {
+	h.updateMembership(hubMembership{ChatId: chatId, UserId: userId, Joined: true})
+	h.relayMembership(hubMembership{ChatId: chatId, UserId: userId, Joined: true})
+}
+
+// Leave stops the events of a chat to a user who left or was removed, on
+// every instance
+func (h *Hub) Leave(userId int, chatId int) {
+	h.updateMembership(hubMembership{ChatId: chatId, UserId: userId})
+	h.relayMembership(hubMembership{ChatId: chatId, UserId: userId})
+}
+
+// RemoveChat forgets the members of a deleted chat on every instance
+func (h *Hub) RemoveChat(chatId int) {
+	h.updateMembership(hubMembership{ChatId: chatId})
+	h.relayMembership(hubMembership{ChatId: chatId})
+}
+
+func (h *Hub) updateMembership(m hubMembership) {
+	h.membersMu.Lock()
+	defer h.membersMu.Unlock()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if m.UserId == 0 {
+		for c := range h.chats[m.ChatId] {
+			h.unsubscribe(c, m.ChatId)
+		}
+		return
+	}
+	for c := range h.users[m.UserId] {
+		if m.Joined {
+			h.subscribe(c, m.ChatId)
+		} else {
+			h.unsubscribe(c, m.ChatId)
+		}
+	}
+}
+
+// Announce sends an announcement to every connected client of a workspace,
+// each marks it seen for its user once it was written. Users it doesn't
+// reach get it on their next login
+func (h *Hub) Announce(workspaceId int, announcement *types.AnnouncementJSON) {
+	event := types.EventJSON{Type: "announcement", Data: announcement}
+	h.send(event, announcement.Id, func(c *Client) bool { return c.user.WorkspaceId == workspaceId })
+	h.publish(hubEvent{All: true, Workspace: workspaceId, Announcement: announcement.Id}, event)
+}
+
+// SendToUsers sends an event to every connection of the given users
+func (h *Hub) SendToUsers(usersId []int, event types.EventJSON) {
+	h.sendToUsers(usersId, event)
+	h.publish(hubEvent{UserIds: usersId}, event)
+}
+
+func (h *Hub) sendToUsers(usersId []int, event types.EventJSON) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	recipients := []*Client{}
+	for _, id := range usersId {
+		for c := range h.users[id] {
+			recipients = append(recipients, c)
+		}
+	}
+	h.deliver(event, 0, recipients)
+}
+
+// sendToChat sends an event to the connections of a chat's members here
+func (h *Hub) sendToChat(chatId int, event types.EventJSON) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	recipients := []*Client{}
+	for c := range h.chats[chatId] {
+		recipients = append(recipients, c)
+	}
+	h.deliver(event, 0, recipients)
+}
+
+func (h *Hub) send(event types.EventJSON, announcement int, match func(*Client) bool) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	recipients := []*Client{}
+	for c := range h.clients {
+		if match(c) {
+			recipients = append(recipients, c)
+		}
+	}
+	h.deliver(event, announcement, recipients)
+}
+
+// deliver queues the event for the clients, h.mu must be held.
+// announcement is the id of the announcement the event carries, if any
+func (h *Hub) deliver(event types.EventJSON, announcement int, recipients []*Client) {
+	if len(recipients) == 0 {
+		return
+	}
+	data, err := json.Marshal(event)
+	if err != nil {
+		h.logger.Printf("error: hub json encoding failed: %v", err)
+		return
+	}
+
+	out := outbound{id: event.Id, data: data, announcement: announcement}
+	for _, c := range recipients {
+		if c.protobuf && out.binary == nil {
+			if out.binary, err = encodeProtobuf(event); err != nil {
+				h.logger.Printf("error: hub protobuf encoding failed: %v", err)
+				return
+			}
+		}
+		select {
+		case c.send <- out:
+		default:
+			// slow client, drop the event
+			h.logger.Printf("hub: dropped event for user %d", c.user.Id)
+		}
+	}
+}
+
+// Close closes every connection, the pumps unregister the clients
+func (h *Hub) Close() {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	for c := range h.clients {
+		c.conn.Close()
+	}
+}
+
+// Disconnect closes the connections of the user on every instance, when
+// they are disabled or their tokens revoked
+func (h *Hub) Disconnect(userId int) {
+	h.disconnect(userId)
+	if h.broker == nil {
+		return
+	}
+	if err := h.relay(hubEvent{Disconnect: userId}); err != nil {
+		h.logger.Printf("error: publish disconnect failed: %v", err)
+	}
+}
+
+func (h *Hub) disconnect(userId int) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	for c := range h.users[userId] {
+		c.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "signed out"), time.Now().Add(time.Second))
+		c.conn.Close()
+	}
+}
+
+// Count returns the number of open connections
+func (h *Hub) Count() int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return len(h.clients)
+}
+
+// UserIds returns the ids of the users connected here or, as far as their
+// last status tells, to another instance
+func (h *Hub) UserIds() []int {
+	seen := map[int]bool{}
+	ids := []int{}
+	for _, id := range h.localUserIds() {
+		seen[id] = true
+		ids = append(ids, id)
+	}
+	for _, node := range h.liveNodes() {
+		for _, id := range node.UserIds {
+			if !seen[id] {
+				seen[id] = true
+				ids = append(ids, id)
+			}
+		}
+	}
+	return ids
+}
+
+func (h *Hub) localUserIds() []int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	ids := make([]int, 0, len(h.users))
+	for id := range h.users {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+func (c *Client) readPump() {
+	defer func() {
+		c.hub.unregister(c)
+		c.conn.Close()
+	}()
+
+	// any message or pong shows the connection is alive
+	alive := func() {
+		if c.idle > 0 {
+			c.conn.SetReadDeadline(time.Now().Add(c.idle))
+		}
+	}
+	alive()
+	c.conn.SetPongHandler(func(string) error {
+		alive()
+		return nil
+	})
+	for {
+		_, data, err := c.conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		alive()
+
+		// acks advance the device delivery cursor
+		event := types.ClientEventJSON{}
+		if err := json.Unmarshal(data, &event); err != nil {
+			continue
+		}
+		if event.Type == "ack" && c.ack != nil {
+			c.ack(event.Id)
+		}
+		if event.Type == "heartbeat" && c.heartbeat != nil {
+			c.heartbeat()
+		}
+		if (event.Type == types.ReceiptDelivered || event.Type == types.ReceiptRead) && c.receipt != nil {
+			c.receipt(event.MessageId, event.Type)
+		}
+	}
+}
+
+func (c *Client) writePump() {
+	defer c.conn.Close()
+	var pings <-chan time.Time
+	if c.ping > 0 {
+		ticker := time.NewTicker(c.ping)
+		defer ticker.Stop()
+		pings = ticker.C
+	}
+	for {
+		select {
+		case out, ok := <-c.send:
+			if !ok {
+				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
+				return
+			}
+			// already sent during replay
+			if out.id != 0 && out.id <= c.skipUntil {
+				continue
+			}
+			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			data := out.data
+			if c.protobuf {
+				data = out.binary
+			}
+			if err := c.write(data); err != nil {
+				return
+			}
+			if out.announcement != 0 && c.announced != nil {
+				c.announced(out.announcement)
+			}
+		case <-pings:
+			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (s *Server) handleWebsocket(w http.ResponseWriter, r *http.Request) {
+	// get user from req context
+	user, ok := r.Context().Value(userContextKey).(*types.User)
+	if !ok {
+		WriteError(w, errNotAuthorized)
+		return
+	}
+
+	// get delivery cursor of the device
+	device := r.URL.Query().Get("device")
+	if len(device) > 64 {
+		WriteError(w, errInvalidDevice)
+		return
+	}
+	// last message per chat of a client resuming its stream, the header
+	// is for clients that can set one
+	resume := r.URL.Query().Get("resume")
+	if resume == "" {
+		resume = r.Header.Get("Last-Event-ID")
+	}
+	positions, err := parseResume(resume)
+	if err != nil {
+		WriteError(w, errInvalidResume)
+		return
+	}
+
+	cursor := int64(0)
+	if device != "" {
+		var err error
+		if cursor, err = s.store.GetDeviceCursor(r.Context(), user.Id, device); err != nil {
+			WriteError(w, errInternal)
+			s.logf(r, "error: get device cursor failed: %v", err)
+			return
+		}
+	}
+
+	// a full instance sends the client to another one
+	ws := s.config.Get().Websocket
+	if ws.MaxConnections > 0 && s.hub.Count() >= ws.MaxConnections {
+		w.Header().Set("Retry-After", "5")
+		WriteError(w, errServerFull)
+		return
+	}
+
+	// upgrade connection, compressed ones count their bytes
+	compress := ws.CompressionThreshold > 0 && offersDeflate(r)
+	var conn *websocket.Conn
+	if compress {
+		u := upgrader
+		u.EnableCompression = true
+		conn, err = u.Upgrade(countingWriter{ResponseWriter: w, stats: &s.hub.compression}, r, nil)
+	} else {
+		conn, err = upgrader.Upgrade(w, r, nil)
+	}
+	if err != nil {
+		s.logf(r, "error: websocket upgrade failed: %v", err)
+		return
+	}
+
+	// register client, live events queue up in send while replaying
+	client := &Client{
+		hub: s.hub, conn: conn, user: user, send: make(chan outbound, 256), device: device, connectedAt: time.Now(),
+		ping: time.Duration(ws.PingSeconds) * time.Second, idle: time.Duration(ws.IdleSeconds) * time.Second,
+	}
+	if compress {
+		client.compressAbove = ws.CompressionThreshold
+	}
+	client.protobuf = conn.Subprotocol() == SubprotocolProtobuf
+	// the request context is done once the handler returns, the callbacks
+	// stay in the user's workspace
+	ctx := storage.WithWorkspace(context.Background(), user.WorkspaceId)
+	client.heartbeat = func() { s.touchLastSeen(ctx, user.Id) }
+	client.memberships = func() ([]int, error) {
+		u, err := s.store.GetUserById(ctx, user.Id)
+		if err != nil {
+			return nil, err
+		}
+		return u.Chats, nil
+	}
+	client.announced = func(id int) {
+		if err := s.store.MarkAnnouncementSeen(ctx, []int{user.Id}, id); err != nil {
+			s.logf(r, "error: mark announcement failed: %v", err)
+		}
+	}
+	client.receipt = func(messageId int64, status string) {
+		s.updateReceipt(ctx, user.Id, messageId, status)
+		if status == types.ReceiptRead {
+			if err := s.store.MarkRead(ctx, user.Id, messageId); err != nil {
+				s.logf(r, "error: mark read failed: %v", err)
+			}
+			s.hub.SendToUsers([]int{user.Id}, types.EventJSON{Type: "read_marker", Data: map[string]any{"messageId": messageId}})
+		}
+	}
+	if device != "" {
+		client.ack = func(id int64) {
+			if err := s.store.UpdateDeviceCursor(ctx, user.Id, device, id); err != nil {
+				s.logf(r, "error: update device cursor failed: %v", err)
+			}
+		}
+	}
+
+	// a resuming client gets the replay buffer instead of the device cursor
+	if len(positions) > 0 {
+		client.heartbeat()
+		if err = s.resume(client, positions, ws.MaxConnectionsPerUser); err != nil {
+			s.logf(r, "error: resume failed: %v", err)
+			s.hub.unregister(client)
+			conn.Close()
+			return
+		}
+		go client.writePump()
+		go client.readPump()
+		return
+	}
+
+	s.hub.register(client, ws.MaxConnectionsPerUser)
+	client.heartbeat()
+
+	if device != "" {
+		if client.skipUntil, err = s.replayMessages(r.Context(), client, cursor); err != nil {
+			s.logf(r, "error: replay for device %s failed: %v", device, err)
+			s.hub.unregister(client)
+			conn.Close()
+			return
+		}
+	}
+
+	go client.writePump()
+	go client.readPump()
+}
+
+// replayMessages writes the messages a device missed since its cursor
+// straight to the connection and returns the last change id it read
+func (s *Server) replayMessages(ctx context.Context, c *Client, cursor int64) (int64, error) {
+	for {
+		changes, err := s.store.GetChanges(ctx, c.user.Id, c.user.Chats, cursor, syncPageSize)
+		if err != nil {
+			return cursor, err
+		}
+
+		for _, change := range changes {
+			cursor = change.Id
+			eventType := change.Type
+			if change.Type == ChangeMessageCreated {
+				eventType = "message"
+			} else if !ownChanges[change.Type] {
+				continue
+			}
+			data, err := c.encode(types.EventJSON{Id: change.Id, Type: eventType, Data: change.Data})
+			if err != nil {
+				return cursor, err
+			}
+			if err = c.write(data); err != nil {
+				return cursor, err
+			}
+		}
+
+		if len(changes) < syncPageSize {
+			return cursor, nil
+		}
+	}
+}
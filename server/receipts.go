@@ -0,0 +1,74 @@
+package server
+
+import (
+	"context"
+	"errors"
+
+	"example/gochat/storage"
+	"example/gochat/types"
+)
+
+// delivery status is only tracked in chats up to this size, it costs a
+// row per recipient for every message
+const maxReceiptMembers = 10
+
+// createReceipts marks a new message as sent to the other members of a
+// small chat, failures are only logged
+func (s *Server) createReceipts(ctx context.Context, message *types.MessageJSON, usersId []int) {
+	if len(usersId) > maxReceiptMembers {
+		return
+	}
+	recipients := []int{}
+	for _, id := range usersId {
+		if id != message.Author.Id {
+			recipients = append(recipients, id)
+		}
+	}
+	if len(recipients) == 0 {
+		return
+	}
+	if err := s.store.CreateReceipts(ctx, *message, recipients); err != nil {
+		s.logger.Printf("[%s] error: create receipts failed: %v", requestId(ctx), err)
+		return
+	}
+	for _, id := range recipients {
+		message.Receipts = append(message.Receipts, types.ReceiptJSON{MessageId: message.Id, UserId: id, Status: types.ReceiptSent})
+	}
+}
+
+// updateReceipt records a delivered or read ack from a recipient and tells
+// the author, acks for untracked messages are ignored
+func (s *Server) updateReceipt(ctx context.Context, userId int, messageId int64, status string) {
+	authorId, err := s.store.UpdateReceipt(ctx, messageId, userId, status)
+	if errors.Is(err, storage.ErrNotFound) {
+		return
+	}
+	if err != nil {
+		s.errorf("error: update receipt failed: %v", err)
+		return
+	}
+	receipt := types.ReceiptJSON{MessageId: messageId, UserId: userId, Status: status}
+	s.hub.SendToUsers([]int{authorId}, types.EventJSON{Type: "receipt", Data: receipt})
+}
+
+// attachReceipts adds the delivery status to the messages of a small chat
+func (s *Server) attachReceipts(ctx context.Context, members int, messages []types.MessageJSON) {
+	if members > maxReceiptMembers || len(messages) == 0 {
+		return
+	}
+	messagesId := []int64{}
+	index := map[int64]int{}
+	for i, m := range messages {
+		messagesId = append(messagesId, m.Id)
+		index[m.Id] = i
+	}
+	receipts, err := s.store.GetReceipts(ctx, messagesId)
+	if err != nil {
+		s.logger.Printf("[%s] error: get receipts failed: %v", requestId(ctx), err)
+		return
+	}
+	for _, receipt := range receipts {
+		i := index[receipt.MessageId]
+		messages[i].Receipts = append(messages[i].Receipts, receipt)
+	}
+}
@@ -0,0 +1,148 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"time"
+
+	"example/gochat/types"
+)
+
+// the hooks a remote plugin can take
+const (
+	HookMessageCreate = "message.create"
+	HookUserJoin      = "user.join"
+	HookLogin         = "login"
+)
+
+// remote plugins answer within this or count as failed, they hold up the
+// request that called them
+const remotePluginTimeout = 2 * time.Second
+
+// remoteHook is posted to a remote plugin
+type remoteHook struct {
+	Hook    string             `json:"hook"`
+	User    types.AuthorJSON   `json:"user"`
+	Chat    *remoteChat        `json:"chat,omitempty"`
+	Message *types.MessageJSON `json:"message,omitempty"`
+}
+
+type remoteChat struct {
+	Id   int    `json:"id"`
+	Name string `json:"name"`
+}
+
+// remoteAnswer is what a remote plugin answers, an empty body allows
+type remoteAnswer struct {
+	Allow   *bool  `json:"allow"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// remotePlugins calls the plugins of the runtime config over http, so
+// operators can extend the server without building it
+type remotePlugins struct {
+	s      *Server
+	client *http.Client
+}
+
+func newRemotePlugins(s *Server) remotePlugins {
+	return remotePlugins{s: s, client: &http.Client{Timeout: remotePluginTimeout}}
+}
+
+func (p remotePlugins) Name() string {
+	return "remote"
+}
+
+func (p remotePlugins) OnMessageCreate(ctx context.Context, event MessageEvent) error {
+	return p.call(ctx, remoteHook{Hook: HookMessageCreate, User: author(event.User), Chat: &remoteChat{Id: event.Chat.Id, Name: event.Chat.Name}, Message: &event.Message})
+}
+
+func (p remotePlugins) OnUserJoin(ctx context.Context, event JoinEvent) error {
+	return p.call(ctx, remoteHook{Hook: HookUserJoin, User: author(event.User), Chat: &remoteChat{Id: event.Chat.Id, Name: event.Chat.Name}})
+}
+
+func (p remotePlugins) OnLogin(ctx context.Context, user *types.User) error {
+	return p.call(ctx, remoteHook{Hook: HookLogin, User: author(user)})
+}
+
+// call posts the hook to each plugin that takes it, in config order, until
+// one vetoes. A plugin that fails vetoes only when it is required
+func (p remotePlugins) call(ctx context.Context, hook remoteHook) error {
+	for _, plugin := range p.s.config.Get().Plugins {
+		if !slices.Contains(plugin.Hooks, hook.Hook) {
+			continue
+		}
+		answer, err := p.post(ctx, plugin, hook)
+		if err != nil {
+			p.s.errorf("error: plugin %s failed on %s: %v", plugin.Name, hook.Hook, err)
+			if plugin.Required {
+				return errPluginUnavailable
+			}
+			continue
+		}
+		if answer.Allow != nil && !*answer.Allow {
+			apiErr := *errRejected
+			if answer.Code != "" {
+				apiErr.Code = answer.Code
+			}
+			if answer.Message != "" {
+				apiErr.Message = answer.Message
+			}
+			return fmt.Errorf("%s: %w", plugin.Name, &apiErr)
+		}
+	}
+	return nil
+}
+
+func (p remotePlugins) post(ctx context.Context, plugin PluginConfig, hook remoteHook) (*remoteAnswer, error) {
+	body, err := json.Marshal(hook)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", plugin.Url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Gochat-Hook", hook.Hook)
+	if plugin.Secret != "" {
+		mac := hmac.New(sha256.New, []byte(plugin.Secret))
+		mac.Write(body)
+		req.Header.Set("X-Gochat-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	res, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		io.Copy(io.Discard, res.Body)
+		return nil, fmt.Errorf("status %d", res.StatusCode)
+	}
+	data, err := io.ReadAll(io.LimitReader(res.Body, 64<<10))
+	if err != nil {
+		return nil, err
+	}
+	answer := &remoteAnswer{}
+	if len(bytes.TrimSpace(data)) == 0 {
+		return answer, nil
+	}
+	if err = json.Unmarshal(data, answer); err != nil {
+		return nil, fmt.Errorf("invalid answer: %w", err)
+	}
+	return answer, nil
+}
+
+func author(user *types.User) types.AuthorJSON {
+	return types.AuthorJSON{Id: user.Id, Username: user.Username, DisplayName: user.DisplayName}
+}
@@ -0,0 +1,167 @@
+package server
+
+import (
+	"errors"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"example/gochat/types"
+)
+
+// the replay buffer keeps the recent events of every chat in memory, so a
+// client that lost its connection for a moment can present the last
+// message it got in each chat and receive exactly what came after
+const (
+	replayWindow  = 5 * time.Minute
+	replayPerChat = 500
+	maxResume     = 100
+)
+
+type bufferedEvent struct {
+	// set on new messages, which are the positions clients resume from
+	messageId int64
+	at        time.Time
+	event     types.EventJSON
+}
+
+type replayBuffer struct {
+	chats map[int][]bufferedEvent
+	swept time.Time
+}
+
+func (b *replayBuffer) add(chatId int, messageId int64, event types.EventJSON, now time.Time) {
+	if b.chats == nil {
+		b.chats = map[int][]bufferedEvent{}
+	}
+	b.chats[chatId] = append(b.chats[chatId], bufferedEvent{messageId: messageId, at: now, event: event})
+
+	// trim this chat, and the quiet ones once per window
+	b.trim(chatId, now)
+	if now.Sub(b.swept) > replayWindow {
+		for id := range b.chats {
+			b.trim(id, now)
+		}
+		b.swept = now
+	}
+}
+
+func (b *replayBuffer) trim(chatId int, now time.Time) {
+	events := b.chats[chatId]
+	drop := max(len(events)-replayPerChat, 0)
+	for drop < len(events) && now.Sub(events[drop].at) > replayWindow {
+		drop++
+	}
+	if drop == len(events) {
+		delete(b.chats, chatId)
+		return
+	}
+	b.chats[chatId] = slices.Clone(events[drop:])
+}
+
+// since returns the events of a chat after the message, false when the
+// message is no longer in the buffer
+func (b *replayBuffer) since(chatId int, messageId int64, now time.Time) ([]types.EventJSON, bool) {
+	events := b.chats[chatId]
+	for i, e := range events {
+		if e.messageId == messageId && now.Sub(e.at) <= replayWindow {
+			missed := []types.EventJSON{}
+			for _, later := range events[i+1:] {
+				missed = append(missed, later.event)
+			}
+			return missed, true
+		}
+	}
+	return nil, false
+}
+
+// SendToChat sends an event of a chat to its members on every instance and
+// keeps it for resuming clients, messageId is set for new messages. Every
+// chat event goes through here whatever the transport it came from
+func (h *Hub) SendToChat(chatId int, messageId int64, event types.EventJSON) {
+	h.replayMu.Lock()
+	h.replay.add(chatId, messageId, event, time.Now())
+	h.sendToChat(chatId, event)
+	h.replayMu.Unlock()
+	h.publish(hubEvent{ChatId: chatId, MessageId: messageId}, event)
+}
+
+// registerResumed registers c and returns what it missed since the given
+// message of each chat, and the chats it has to reload because their
+// message is no longer buffered. Nothing sent in between is lost or sent
+// twice, as events are buffered and sent under the same lock
+func (h *Hub) registerResumed(c *Client, maxConnections int, positions map[int]int64) ([]types.EventJSON, []int) {
+	h.membersMu.Lock()
+	defer h.membersMu.Unlock()
+	chats := h.memberships(c)
+	// only chats the user is in
+	for chatId := range positions {
+		if !slices.Contains(chats, chatId) {
+			delete(positions, chatId)
+		}
+	}
+
+	h.replayMu.Lock()
+	defer h.replayMu.Unlock()
+	h.add(c, maxConnections, chats)
+
+	missed, stale := []types.EventJSON{}, []int{}
+	now := time.Now()
+	for chatId, messageId := range positions {
+		events, ok := h.replay.since(chatId, messageId, now)
+		if !ok {
+			stale = append(stale, chatId)
+			continue
+		}
+		missed = append(missed, events...)
+	}
+	return missed, stale
+}
+
+// parseResume reads positions sent as "chatId:messageId,..."
+func parseResume(value string) (map[int]int64, error) {
+	positions := map[int]int64{}
+	if value == "" {
+		return positions, nil
+	}
+	pairs := strings.Split(value, ",")
+	if len(pairs) > maxResume {
+		return nil, errors.New("too many chats")
+	}
+	for _, pair := range pairs {
+		chat, message, ok := strings.Cut(strings.TrimSpace(pair), ":")
+		if !ok {
+			return nil, errors.New("expected chatId:messageId")
+		}
+		chatId, err := strconv.Atoi(chat)
+		if err != nil {
+			return nil, err
+		}
+		messageId, err := strconv.ParseInt(message, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		positions[chatId] = messageId
+	}
+	return positions, nil
+}
+
+// resume writes what a client missed straight to the connection, then a
+// resync event for every chat it has to reload over the rest api
+func (s *Server) resume(c *Client, positions map[int]int64, maxConnections int) error {
+	missed, stale := s.hub.registerResumed(c, maxConnections, positions)
+	for _, chatId := range stale {
+		missed = append(missed, types.EventJSON{Type: "resync", Data: map[string]int{"chatId": chatId}})
+	}
+	for _, event := range missed {
+		data, err := c.encode(event)
+		if err != nil {
+			return err
+		}
+		if err = c.write(data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,293 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+
+	"example/gochat/storage"
+	"example/gochat/types"
+)
+
+const (
+	// chats' responders are reused this long, changes made through another
+	// instance show up after at most this
+	respondersTTL = 30 * time.Second
+	// cooldown of responders created without one
+	defaultResponderCooldown = 60
+	maxResponderCooldown     = 24 * 60 * 60
+)
+
+// responderData is what response templates see, e.g. "hi {{.User}}"
+type responderData struct {
+	User        string
+	DisplayName string
+	Chat        string
+	Text        string
+}
+
+// responders answers messages with the auto-responders of their chat, each
+// at most once per cooldown. Cooldowns are kept per instance
+type responders struct {
+	s *Server
+
+	mu    sync.Mutex
+	chats map[int]cachedResponders
+	// responder id -> when it may fire again
+	next map[int]time.Time
+}
+
+type cachedResponders struct {
+	responders []types.ResponderJSON
+	expires    time.Time
+}
+
+func newResponders(s *Server) *responders {
+	return &responders{s: s, chats: map[int]cachedResponders{}, next: map[int]time.Time{}}
+}
+
+func (p *responders) Name() string {
+	return "responders"
+}
+
+// OnMessageCreated posts the responses of the triggered responders of the
+// chat in the background, responses don't trigger responders themselves
+func (p *responders) OnMessageCreated(ctx context.Context, event MessageEvent) {
+	if isResponse(ctx) {
+		return
+	}
+	list, err := p.get(ctx, event.Chat.Id)
+	if err != nil {
+		p.s.errorf("error: get responders failed: %v", err)
+		return
+	}
+	text := strings.ToLower(event.Message.Text)
+	for _, responder := range list {
+		if responder.BotId == event.User.Id || !strings.Contains(text, strings.ToLower(responder.Trigger)) || !p.fire(responder) {
+			continue
+		}
+		go p.respond(context.WithoutCancel(ctx), responder, event)
+	}
+}
+
+// withResponse marks the context of sending a response
+func withResponse(ctx context.Context) context.Context {
+	return context.WithValue(ctx, responseContextKey, true)
+}
+
+// isResponse reports whether the message of the context is a response
+func isResponse(ctx context.Context) bool {
+	response, _ := ctx.Value(responseContextKey).(bool)
+	return response
+}
+
+// get returns the responders of a chat, from the cache while it is fresh
+func (p *responders) get(ctx context.Context, chatId int) ([]types.ResponderJSON, error) {
+	p.mu.Lock()
+	cached, ok := p.chats[chatId]
+	p.mu.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		return cached.responders, nil
+	}
+
+	list, err := p.s.store.GetResponders(ctx, chatId)
+	if err != nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	p.chats[chatId] = cachedResponders{responders: list, expires: time.Now().Add(respondersTTL)}
+	p.mu.Unlock()
+	return list, nil
+}
+
+// forget drops the cached responders of a chat that changed
+func (p *responders) forget(chatId int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.chats, chatId)
+}
+
+// fire reports whether the responder is out of its cooldown and starts the
+// next one
+func (p *responders) fire(responder types.ResponderJSON) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	if now.Before(p.next[responder.Id]) {
+		return false
+	}
+	for id, next := range p.next {
+		if now.After(next) {
+			delete(p.next, id)
+		}
+	}
+	p.next[responder.Id] = now.Add(time.Duration(responder.CooldownSeconds) * time.Second)
+	return true
+}
+
+// respond posts the response of a responder as its bot, which has to still
+// be in the chat
+func (p *responders) respond(ctx context.Context, responder types.ResponderJSON, event MessageEvent) {
+	if !slices.ContainsFunc(event.Chat.Users, func(a types.AuthorJSON) bool { return a.Id == responder.BotId }) {
+		return
+	}
+	bot, err := p.s.store.GetUserById(ctx, responder.BotId)
+	if err != nil {
+		p.s.errorf("error: responder %d: get bot failed: %v", responder.Id, err)
+		return
+	}
+	if bot.Disabled {
+		return
+	}
+
+	// fill the template
+	tmpl, err := template.New("response").Parse(responder.Response)
+	if err != nil {
+		p.s.errorf("error: responder %d: invalid template: %v", responder.Id, err)
+		return
+	}
+	var b bytes.Buffer
+	data := responderData{User: event.User.Username, DisplayName: event.User.DisplayName, Chat: event.Chat.Name, Text: event.Message.Text}
+	if err = tmpl.Execute(&b, data); err != nil {
+		p.s.errorf("error: responder %d: template failed: %v", responder.Id, err)
+		return
+	}
+	text := strings.TrimSpace(b.String())
+	if text == "" || len(text) > 2000 {
+		return
+	}
+
+	// send it like any message of the bot, the hooks may veto it
+	_, err = p.s.sendMessage(withResponse(ctx), bot, event.Chat, text)
+	var veto *vetoError
+	if errors.As(err, &veto) {
+		p.s.logger.Printf("responder %d: response vetoed: %v", responder.Id, err)
+		return
+	}
+	if err != nil && !errors.Is(err, storage.ErrNotFound) {
+		p.s.errorf("error: responder %d: add message failed: %v", responder.Id, err)
+	}
+}
+
+// handleAdminResponders lists the auto-responders of a chat or adds one,
+// answered by a bot that is a member of the chat
+func (s *Server) handleAdminResponders(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "POST" {
+		WriteError(w, errMethodNotAllowed(r.Method))
+		return
+	}
+
+	// get chat id
+	id, err := getChatId(r)
+	if err != nil {
+		WriteError(w, errChatNotFound)
+		return
+	}
+
+	// list responders
+	if r.Method == "GET" {
+		list, err := s.store.GetResponders(r.Context(), id)
+		if err != nil {
+			WriteError(w, errInternal)
+			s.logf(r, "error: get responders failed: %v", err)
+			return
+		}
+		WriteJSON(w, http.StatusOK, types.ListJSON[types.ResponderJSON]{Data: list, Total: len(list)})
+		return
+	}
+
+	// get req
+	req := new(types.CreateResponderRequest)
+	json.NewDecoder(r.Body).Decode(req)
+	req.Trigger = strings.TrimSpace(req.Trigger)
+	if req.CooldownSeconds == 0 {
+		req.CooldownSeconds = defaultResponderCooldown
+	}
+	if req.Trigger == "" || utf8.RuneCountInString(req.Trigger) > 100 || strings.TrimSpace(req.Response) == "" || utf8.RuneCountInString(req.Response) > 2000 || req.CooldownSeconds < 0 || req.CooldownSeconds > maxResponderCooldown {
+		WriteError(w, errInvalidResponder)
+		return
+	}
+	if _, err = template.New("response").Parse(req.Response); err != nil {
+		WriteError(w, errInvalidResponder)
+		return
+	}
+
+	// the bot has to be in the chat
+	bot, err := s.store.GetUserById(r.Context(), req.BotId)
+	if err != nil && !errors.Is(err, storage.ErrNotFound) {
+		WriteError(w, errInternal)
+		s.logf(r, "error: get user failed: %v", err)
+		return
+	}
+	if err != nil || !bot.Bot {
+		WriteError(w, errBotNotFound)
+		return
+	}
+	if !slices.Contains(bot.Chats, id) {
+		WriteError(w, errBotNotMember)
+		return
+	}
+
+	// add responder
+	responder, err := s.store.CreateResponder(r.Context(), types.ResponderJSON{ChatId: id, BotId: bot.Id, Trigger: req.Trigger, Response: req.Response, CooldownSeconds: req.CooldownSeconds})
+	if err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			WriteError(w, errChatNotFound)
+			return
+		}
+		WriteError(w, errInternal)
+		s.logf(r, "error: create responder failed: %v", err)
+		return
+	}
+	s.responders.forget(id)
+	s.audit(r, types.AuditResponderAdded, id, map[string]any{"responderId": responder.Id, "botId": bot.Id, "trigger": responder.Trigger})
+
+	// response
+	WriteJSON(w, http.StatusCreated, responder)
+}
+
+func (s *Server) handleAdminDeleteResponder(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "DELETE" {
+		WriteError(w, errMethodNotAllowed(r.Method))
+		return
+	}
+
+	// get chat and responder id
+	id, err := getChatId(r)
+	if err != nil {
+		WriteError(w, errResponderNotFound)
+		return
+	}
+	responderId, err := strconv.Atoi(mux.Vars(r)["responderId"])
+	if err != nil {
+		WriteError(w, errResponderNotFound)
+		return
+	}
+
+	// delete responder
+	if err = s.store.DeleteResponder(r.Context(), id, responderId); err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			WriteError(w, errResponderNotFound)
+			return
+		}
+		WriteError(w, errInternal)
+		s.logf(r, "error: delete responder failed: %v", err)
+		return
+	}
+	s.responders.forget(id)
+	s.audit(r, types.AuditResponderRemoved, id, map[string]any{"responderId": responderId})
+
+	// response
+	w.WriteHeader(http.StatusNoContent)
+}
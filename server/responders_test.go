@@ -0,0 +1,39 @@
+package server
+
+import (
+	"testing"
+
+	"example/gochat/types"
+)
+
+// responses are sent through the message hooks, the word filter refuses a
+// response with a filtered word
+func TestRespondRunsHooks(t *testing.T) {
+	s := testServer(t, `{"wordFilter": ["darn"]}`)
+	ctx, user, chat := testChat(t, s)
+	bot, err := s.store.CreateBot(ctx, "helper")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.store.AddMember(ctx, chat.Id, bot.Id); err != nil {
+		t.Fatal(err)
+	}
+	if chat, err = s.store.GetChatById(ctx, chat.Id); err != nil {
+		t.Fatal(err)
+	}
+	event := MessageEvent{User: user, Chat: chat, Message: types.MessageJSON{ChatId: chat.Id, Text: "help"}}
+
+	s.responders.respond(ctx, types.ResponderJSON{Id: 1, ChatId: chat.Id, BotId: bot.Id, Trigger: "help", Response: "darn it {{.User}}"}, event)
+	s.responders.respond(ctx, types.ResponderJSON{Id: 2, ChatId: chat.Id, BotId: bot.Id, Trigger: "help", Response: "hi {{.User}}"}, event)
+
+	got, err := s.store.GetChatById(ctx, chat.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Messages) != 1 {
+		t.Fatalf("got %d messages, want only the response without a filtered word", len(got.Messages))
+	}
+	if m := got.Messages[0]; m.Text != "hi alice" || m.Author.Id != bot.Id {
+		t.Errorf("got %q by %d", m.Text, m.Author.Id)
+	}
+}
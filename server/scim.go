@@ -0,0 +1,429 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"example/gochat/storage"
+	"example/gochat/types"
+)
+
+const (
+	scimUserSchema  = "urn:ietf:params:scim:schemas:core:2.0:User"
+	scimListSchema  = "urn:ietf:params:scim:api:messages:2.0:ListResponse"
+	scimErrorSchema = "urn:ietf:params:scim:api:messages:2.0:Error"
+	// users are searched and listed this many at a time
+	scimPageSize = 100
+)
+
+// scimFilterPattern is the only kind of filter identity providers send
+// before provisioning, e.g. userName eq "jane"
+var scimFilterPattern = regexp.MustCompile(`(?i)^\s*(userName|emails(?:\.value)?)\s+eq\s+"([^"]*)"\s*$`)
+
+// WithSCIM lets identity providers provision users at /scim/v2 with the
+// bearer token, in the workspace with the slug or the default workspace
+// when it is empty
+func WithSCIM(token string, workspace string) Option {
+	return func(s *Server) {
+		sum := sha256.Sum256([]byte(token))
+		s.scimToken = sum[:]
+		s.scimWorkspace = workspace
+	}
+}
+
+// writeSCIM writes a scim response, which has its own media type
+func writeSCIM(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/scim+json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("error: json encoding failed: %v", err)
+	}
+}
+
+func writeSCIMError(w http.ResponseWriter, status int, scimType string, detail string) {
+	writeSCIM(w, status, types.SCIMErrorJSON{Schemas: []string{scimErrorSchema}, Status: strconv.Itoa(status), ScimType: scimType, Detail: detail})
+}
+
+// scimMiddleware lets through requests with the scim token, which isn't a
+// user's and can't call the rest of the api. They only see the token's
+// workspace
+func (s *Server) scimMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.scimToken == nil {
+			writeSCIMError(w, http.StatusNotFound, "", "scim provisioning is not enabled")
+			return
+		}
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		sum := sha256.Sum256([]byte(token))
+		if !ok || subtle.ConstantTimeCompare(sum[:], s.scimToken) != 1 {
+			writeSCIMError(w, http.StatusUnauthorized, "", "invalid scim token")
+			return
+		}
+		ctx, err := s.providerWorkspace(r.Context(), s.scimWorkspace)
+		if err != nil {
+			writeSCIMError(w, http.StatusInternalServerError, "", "internal server error")
+			s.logf(r, "error: scim: %v", err)
+			return
+		}
+		next(w, r.WithContext(ctx))
+	}
+}
+
+// scimUser returns the scim resource of a user
+func scimUser(user *types.User) types.SCIMUserJSON {
+	active := !user.Disabled
+	id := strconv.Itoa(user.Id)
+	res := types.SCIMUserJSON{
+		Schemas:     []string{scimUserSchema},
+		Id:          id,
+		UserName:    user.Username,
+		DisplayName: user.DisplayName,
+		Emails:      []types.SCIMEmail{{Value: user.Email, Primary: true}},
+		Active:      &active,
+		Meta:        &types.SCIMMetaJSON{ResourceType: "User", Location: "/scim/v2/Users/" + id},
+	}
+	if user.DisplayName != "" {
+		res.Name = &types.SCIMName{Formatted: user.DisplayName}
+	}
+	return res
+}
+
+// scimEmail is the primary email of the resource, or its first one
+func scimEmail(req *types.SCIMUserJSON) string {
+	for _, e := range req.Emails {
+		if e.Primary {
+			return normalizeEmail(e.Value)
+		}
+	}
+	if len(req.Emails) > 0 {
+		return normalizeEmail(req.Emails[0].Value)
+	}
+	return ""
+}
+
+// scimDisplayName is the display name of the resource, or its formatted name
+func scimDisplayName(req *types.SCIMUserJSON) string {
+	if req.DisplayName == "" && req.Name != nil {
+		return req.Name.Formatted
+	}
+	return req.DisplayName
+}
+
+// getSCIMUser returns the user of the request path, bots aren't provisioned
+func (s *Server) getSCIMUser(w http.ResponseWriter, r *http.Request) (*types.User, bool) {
+	id, err := getUserId(r)
+	if err != nil {
+		writeSCIMError(w, http.StatusNotFound, "", "user not found")
+		return nil, false
+	}
+	user, err := s.store.GetUserById(r.Context(), id)
+	if err != nil && !errors.Is(err, storage.ErrNotFound) {
+		writeSCIMError(w, http.StatusInternalServerError, "", "internal server error")
+		s.logf(r, "error: get user failed: %v", err)
+		return nil, false
+	}
+	if err != nil || user.Bot {
+		writeSCIMError(w, http.StatusNotFound, "", "user not found")
+		return nil, false
+	}
+	return user, true
+}
+
+// findUsers returns the users, without bots, matching q that match is true
+// for, in id order
+func (s *Server) findUsers(ctx context.Context, q string, match func(*types.User) bool) ([]types.User, error) {
+	found := []types.User{}
+	after := 0
+	for {
+		users, _, err := s.store.ListUsers(ctx, q, after, scimPageSize)
+		if err != nil {
+			return nil, err
+		}
+		for i := range users {
+			if !users[i].Bot && match(&users[i]) {
+				found = append(found, users[i])
+			}
+		}
+		if len(users) < scimPageSize {
+			return found, nil
+		}
+		after = users[len(users)-1].Id
+	}
+}
+
+// handleSCIMUsers searches the users or provisions one
+func (s *Server) handleSCIMUsers(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		s.listSCIMUsers(w, r)
+	case "POST":
+		s.createSCIMUser(w, r)
+	default:
+		writeSCIMError(w, http.StatusMethodNotAllowed, "", fmt.Sprintf("method %s not allowed", r.Method))
+	}
+}
+
+func (s *Server) listSCIMUsers(w http.ResponseWriter, r *http.Request) {
+	// get filter and page
+	query := r.URL.Query()
+	q, match := "", func(*types.User) bool { return true }
+	if filter := query.Get("filter"); filter != "" {
+		m := scimFilterPattern.FindStringSubmatch(filter)
+		if m == nil {
+			writeSCIMError(w, http.StatusBadRequest, "invalidFilter", `only userName eq "..." and emails eq "..." filters are supported`)
+			return
+		}
+		q = m[2]
+		if strings.EqualFold(m[1], "userName") {
+			match = func(u *types.User) bool { return strings.EqualFold(u.Username, m[2]) }
+		} else {
+			match = func(u *types.User) bool { return u.Email == normalizeEmail(m[2]) }
+		}
+	}
+	start, count := 1, scimPageSize
+	if v := query.Get("startIndex"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			writeSCIMError(w, http.StatusBadRequest, "invalidValue", "startIndex must be a number")
+			return
+		}
+		start = max(n, 1)
+	}
+	if v := query.Get("count"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			writeSCIMError(w, http.StatusBadRequest, "invalidValue", "count must be a number")
+			return
+		}
+		count = min(max(n, 0), scimPageSize)
+	}
+
+	// get users
+	users, err := s.findUsers(r.Context(), q, match)
+	if err != nil {
+		writeSCIMError(w, http.StatusInternalServerError, "", "internal server error")
+		s.logf(r, "error: list users failed: %v", err)
+		return
+	}
+
+	// response
+	res := types.SCIMListJSON{Schemas: []string{scimListSchema}, TotalResults: len(users), StartIndex: start, Resources: []types.SCIMUserJSON{}}
+	for i := start - 1; i < len(users) && len(res.Resources) < count; i++ {
+		res.Resources = append(res.Resources, scimUser(&users[i]))
+	}
+	res.ItemsPerPage = len(res.Resources)
+	writeSCIM(w, http.StatusOK, res)
+}
+
+func (s *Server) createSCIMUser(w http.ResponseWriter, r *http.Request) {
+	// get req
+	req := new(types.SCIMUserJSON)
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		writeSCIMError(w, http.StatusBadRequest, "invalidSyntax", "invalid json")
+		return
+	}
+	email := scimEmail(req)
+	if apiErr := checkUsername(req.UserName); apiErr != nil {
+		writeSCIMError(w, http.StatusBadRequest, "invalidValue", "userName: "+apiErr.Message)
+		return
+	}
+	if s.config.Get().HasFilteredWord(req.UserName) {
+		writeSCIMError(w, http.StatusBadRequest, "invalidValue", "userName: "+errUsernameNotAllowed.Message)
+		return
+	}
+	if email == "" || len(email) > 50 {
+		writeSCIMError(w, http.StatusBadRequest, "invalidValue", "emails: an email of up to 50 characters is required")
+		return
+	}
+	profile := types.ProfileRequest{DisplayName: scimDisplayName(req)}
+	if apiErr := s.checkProfile(&profile); apiErr != nil {
+		writeSCIMError(w, http.StatusBadRequest, "invalidValue", "displayName: "+apiErr.Message)
+		return
+	}
+
+	// create user, they sign in with single sign-on or the directory
+	user, err := s.createUser(r.Context(), req.UserName, email, "")
+	if err != nil {
+		var apiErr *ApiError
+		if errors.As(err, &apiErr) {
+			writeSCIMError(w, apiErr.Status, "", apiErr.Message)
+			return
+		}
+		if errors.Is(err, storage.ErrConflict) {
+			writeSCIMError(w, http.StatusConflict, "uniqueness", errUserExists.Message)
+			return
+		}
+		writeSCIMError(w, http.StatusInternalServerError, "", "internal server error")
+		s.logf(r, "error: create user failed: %v", err)
+		return
+	}
+	if profile.DisplayName != "" {
+		if err = s.store.SetProfile(r.Context(), user.Id, profile); err != nil {
+			s.logf(r, "error: set profile failed: %v", err)
+		} else {
+			user.DisplayName = profile.DisplayName
+		}
+	}
+	if req.Active != nil && !*req.Active {
+		if err = s.store.SetUserDisabled(r.Context(), user.Id, true); err != nil {
+			s.logf(r, "error: set user disabled failed: %v", err)
+		} else {
+			user.Disabled = true
+		}
+	}
+
+	// response
+	res := scimUser(user)
+	w.Header().Set("Location", res.Meta.Location)
+	writeSCIM(w, http.StatusCreated, res)
+}
+
+// handleSCIMUser shows, replaces, patches or deletes a user. Deactivated
+// users are signed out and can't log in until they are active again
+func (s *Server) handleSCIMUser(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "PUT" && r.Method != "PATCH" && r.Method != "DELETE" {
+		writeSCIMError(w, http.StatusMethodNotAllowed, "", fmt.Sprintf("method %s not allowed", r.Method))
+		return
+	}
+
+	// get user
+	user, ok := s.getSCIMUser(w, r)
+	if !ok {
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		writeSCIM(w, http.StatusOK, scimUser(user))
+	case "PUT":
+		s.replaceSCIMUser(w, r, user)
+	case "PATCH":
+		s.patchSCIMUser(w, r, user)
+	case "DELETE":
+		if err := s.deleteUser(r.Context(), user); err != nil {
+			if errors.Is(err, storage.ErrNotFound) {
+				writeSCIMError(w, http.StatusNotFound, "", "user not found")
+				return
+			}
+			writeSCIMError(w, http.StatusInternalServerError, "", "internal server error")
+			s.logf(r, "error: delete user failed: %v", err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// replaceSCIMUser sets the display name and active flag, usernames and
+// emails can't be changed
+func (s *Server) replaceSCIMUser(w http.ResponseWriter, r *http.Request, user *types.User) {
+	// get req
+	req := new(types.SCIMUserJSON)
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		writeSCIMError(w, http.StatusBadRequest, "invalidSyntax", "invalid json")
+		return
+	}
+	if !strings.EqualFold(req.UserName, user.Username) {
+		writeSCIMError(w, http.StatusBadRequest, "mutability", "userName can't be changed")
+		return
+	}
+	if email := scimEmail(req); email != "" && email != user.Email {
+		writeSCIMError(w, http.StatusBadRequest, "mutability", "emails can't be changed")
+		return
+	}
+	active := req.Active == nil || *req.Active
+	s.updateSCIMUser(w, r, user, scimDisplayName(req), active)
+}
+
+// patchSCIMUser applies the replace and add operations on active,
+// displayName and name.formatted, other attributes aren't stored and their
+// operations are ignored
+func (s *Server) patchSCIMUser(w http.ResponseWriter, r *http.Request, user *types.User) {
+	// get req
+	req := new(types.SCIMPatchRequest)
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		writeSCIMError(w, http.StatusBadRequest, "invalidSyntax", "invalid json")
+		return
+	}
+
+	// apply operations to the current values
+	displayName, active := user.DisplayName, !user.Disabled
+	for _, op := range req.Operations {
+		if !strings.EqualFold(op.Op, "replace") && !strings.EqualFold(op.Op, "add") {
+			continue
+		}
+		values := map[string]json.RawMessage{}
+		if op.Path != "" {
+			values[op.Path] = op.Value
+		} else if err := json.Unmarshal(op.Value, &values); err != nil {
+			writeSCIMError(w, http.StatusBadRequest, "invalidValue", "operations without a path need an object value")
+			return
+		}
+		for path, value := range values {
+			switch strings.ToLower(path) {
+			case "active":
+				// some providers send "False" as a string
+				v, err := strconv.ParseBool(strings.Trim(string(value), `"`))
+				if err != nil {
+					writeSCIMError(w, http.StatusBadRequest, "invalidValue", "active must be true or false")
+					return
+				}
+				active = v
+			case "displayname", "name.formatted":
+				if err := json.Unmarshal(value, &displayName); err != nil {
+					writeSCIMError(w, http.StatusBadRequest, "invalidValue", path+" must be a string")
+					return
+				}
+			}
+		}
+	}
+	s.updateSCIMUser(w, r, user, displayName, active)
+}
+
+// updateSCIMUser stores the changed display name and active flag of a user
+func (s *Server) updateSCIMUser(w http.ResponseWriter, r *http.Request, user *types.User, displayName string, active bool) {
+	// update display name, keeping the rest of the profile
+	if displayName != user.DisplayName {
+		current, err := s.store.GetProfile(r.Context(), user.Id)
+		if err != nil {
+			writeSCIMError(w, http.StatusInternalServerError, "", "internal server error")
+			s.logf(r, "error: get profile failed: %v", err)
+			return
+		}
+		profile := types.ProfileRequest{DisplayName: displayName, Bio: current.Bio, Pronouns: current.Pronouns, Link: current.Link}
+		if apiErr := s.checkProfile(&profile); apiErr != nil {
+			writeSCIMError(w, http.StatusBadRequest, "invalidValue", "displayName: "+apiErr.Message)
+			return
+		}
+		if err = s.store.SetProfile(r.Context(), user.Id, profile); err != nil {
+			writeSCIMError(w, http.StatusInternalServerError, "", "internal server error")
+			s.logf(r, "error: set profile failed: %v", err)
+			return
+		}
+		user.DisplayName = profile.DisplayName
+	}
+
+	// activate or deactivate
+	if active == user.Disabled {
+		if err := s.store.SetUserDisabled(r.Context(), user.Id, !active); err != nil {
+			writeSCIMError(w, http.StatusInternalServerError, "", "internal server error")
+			s.logf(r, "error: set user disabled failed: %v", err)
+			return
+		}
+		user.Disabled = !active
+		if user.Disabled {
+			s.hub.Disconnect(user.Id)
+		}
+	}
+
+	// response
+	writeSCIM(w, http.StatusOK, scimUser(user))
+}
@@ -0,0 +1,75 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"regexp"
+
+	"example/gochat/storage"
+	"example/gochat/types"
+)
+
+// settings are opaque to the server, clients pick the keys
+const (
+	maxSettings     = 100
+	maxSettingValue = 4096
+)
+
+var settingKeyPattern = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,64}$`)
+
+// handleSettings returns the caller's settings on GET and merges the
+// object sent on PATCH into them, keys set to null are removed
+func (s *Server) handleSettings(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "PATCH" {
+		WriteError(w, errMethodNotAllowed(r.Method))
+		return
+	}
+
+	// get user from req context
+	user, ok := r.Context().Value(userContextKey).(*types.User)
+	if !ok {
+		WriteError(w, errNotAuthorized)
+		return
+	}
+
+	if r.Method == "GET" {
+		settings, err := s.store.GetSettings(r.Context(), user.Id)
+		if err != nil {
+			WriteError(w, errInternal)
+			s.logf(r, "error: get settings failed: %v", err)
+			return
+		}
+		WriteJSON(w, http.StatusOK, settings)
+		return
+	}
+
+	// get settings from front
+	patch := map[string]json.RawMessage{}
+	if err := json.NewDecoder(r.Body).Decode(&patch); err != nil || len(patch) > maxSettings {
+		WriteError(w, errInvalidUserSettings)
+		return
+	}
+	for key, value := range patch {
+		if !settingKeyPattern.MatchString(key) || len(value) > maxSettingValue {
+			WriteError(w, errInvalidUserSettings)
+			return
+		}
+	}
+
+	// update settings
+	settings, err := s.store.UpdateSettings(r.Context(), user.Id, patch, maxSettings)
+	if err != nil {
+		if errors.Is(err, storage.ErrLimit) {
+			WriteError(w, errTooManySettings)
+			return
+		}
+		WriteError(w, errInternal)
+		s.logf(r, "error: update settings failed: %v", err)
+		return
+	}
+	s.syncOwnState(r.Context(), user.Id, ChangeSettingsUpdated, settings)
+
+	// response
+	WriteJSON(w, http.StatusOK, settings)
+}
@@ -0,0 +1,236 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"example/gochat/types"
+)
+
+// the outbox cursor of the event stream
+const streamConsumer = "stream"
+
+// EventStream publishes the outbox events to a message broker for
+// analytics and other downstream systems
+type EventStream interface {
+	// Publish sends the events in order and returns the id of the last one
+	// the broker took
+	Publish(context.Context, []types.OutboxEventJSON) (int64, error)
+}
+
+// WithEventStream publishes every chat event to stream
+func WithEventStream(stream EventStream) Option {
+	return func(s *Server) {
+		s.stream = stream
+	}
+}
+
+// NATSStream publishes each event to <subject>.<type>, for example
+// gochat.events.message.created, over the plain nats protocol. Tls
+// connections aren't supported
+type NATSStream struct {
+	addr    string
+	subject string
+	// sent with CONNECT
+	options map[string]any
+
+	mu   sync.Mutex
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// NewNATSStream takes a nats://[user:password@]host[:port] url, a user
+// without password is sent as a token
+func NewNATSStream(rawUrl string, subject string) (*NATSStream, error) {
+	u, err := url.Parse(rawUrl)
+	if err != nil || u.Scheme != "nats" || u.Hostname() == "" {
+		return nil, fmt.Errorf("nats: invalid url, expected nats://host:4222")
+	}
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), "4222")
+	}
+	options := map[string]any{"verbose": false, "pedantic": false, "name": "gochat", "lang": "go"}
+	if password, ok := u.User.Password(); ok {
+		options["user"], options["pass"] = u.User.Username(), password
+	} else if u.User != nil {
+		options["auth_token"] = u.User.Username()
+	}
+	return &NATSStream{addr: addr, subject: subject, options: options}, nil
+}
+
+func (n *NATSStream) connect(ctx context.Context) error {
+	dialer := net.Dialer{Timeout: 5 * time.Second}
+	conn, err := dialer.DialContext(ctx, "tcp", n.addr)
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	r := bufio.NewReader(conn)
+
+	// the server starts with INFO
+	line, err := r.ReadString('\n')
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	if !strings.HasPrefix(line, "INFO ") {
+		conn.Close()
+		return fmt.Errorf("nats: unexpected greeting %q", strings.TrimSpace(line))
+	}
+	info := struct {
+		TLSRequired bool `json:"tls_required"`
+	}{}
+	json.Unmarshal([]byte(strings.TrimPrefix(line, "INFO ")), &info)
+	if info.TLSRequired {
+		conn.Close()
+		return errors.New("nats: the server requires tls")
+	}
+
+	options, err := json.Marshal(n.options)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	if _, err = fmt.Fprintf(conn, "CONNECT %s\r\n", options); err != nil {
+		conn.Close()
+		return err
+	}
+	n.conn, n.r = conn, r
+	return nil
+}
+
+// Publish sends the events and a PING, the PONG tells they were taken.
+// The connection is dropped on any error and opened again next time
+func (n *NATSStream) Publish(ctx context.Context, events []types.OutboxEventJSON) (int64, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.conn == nil {
+		if err := n.connect(ctx); err != nil {
+			return 0, err
+		}
+	}
+	if err := n.publish(events); err != nil {
+		n.conn.Close()
+		n.conn, n.r = nil, nil
+		return 0, err
+	}
+	return events[len(events)-1].Id, nil
+}
+
+func (n *NATSStream) publish(events []types.OutboxEventJSON) error {
+	buf := bytes.Buffer{}
+	for _, event := range events {
+		data, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(&buf, "PUB %s.%s %d\r\n", n.subject, event.Type, len(data))
+		buf.Write(data)
+		buf.WriteString("\r\n")
+	}
+	buf.WriteString("PING\r\n")
+
+	n.conn.SetDeadline(time.Now().Add(10 * time.Second))
+	if _, err := n.conn.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	for {
+		line, err := n.r.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "PONG":
+			return nil
+		case line == "PING":
+			if _, err = io.WriteString(n.conn, "PONG\r\n"); err != nil {
+				return err
+			}
+		case strings.HasPrefix(line, "-ERR"):
+			return fmt.Errorf("nats: %s", strings.TrimSpace(strings.TrimPrefix(line, "-ERR")))
+		}
+	}
+}
+
+// KafkaRestStream produces the events to a kafka topic through a REST
+// Proxy speaking the v2 api, keyed by chat so each chat keeps its order
+type KafkaRestStream struct {
+	url    string
+	topic  string
+	client *http.Client
+}
+
+func NewKafkaRestStream(proxyUrl string, topic string) (*KafkaRestStream, error) {
+	u, err := url.Parse(proxyUrl)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("kafka: invalid rest proxy url, expected http://host:8082")
+	}
+	return &KafkaRestStream{url: strings.TrimRight(proxyUrl, "/"), topic: topic, client: &http.Client{Timeout: 10 * time.Second}}, nil
+}
+
+func (k *KafkaRestStream) Publish(ctx context.Context, events []types.OutboxEventJSON) (int64, error) {
+	type record struct {
+		Key   string                `json:"key"`
+		Value types.OutboxEventJSON `json:"value"`
+	}
+	records := []record{}
+	for _, event := range events {
+		records = append(records, record{Key: strconv.Itoa(event.ChatId), Value: event})
+	}
+	body, err := json.Marshal(map[string]any{"records": records})
+	if err != nil {
+		return 0, err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", k.url+"/topics/"+url.PathEscape(k.topic), bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/vnd.kafka.json.v2+json")
+	req.Header.Set("Accept", "application/vnd.kafka.v2+json")
+
+	res, err := k.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		io.Copy(io.Discard, res.Body)
+		return 0, fmt.Errorf("kafka: status %d", res.StatusCode)
+	}
+
+	// records are answered in order, stop at the first that failed
+	result := struct {
+		Offsets []struct {
+			ErrorCode *int   `json:"error_code"`
+			Error     string `json:"error"`
+		} `json:"offsets"`
+	}{}
+	if err = json.NewDecoder(res.Body).Decode(&result); err != nil {
+		return 0, err
+	}
+	last := int64(0)
+	for i, offset := range result.Offsets {
+		if i >= len(events) {
+			break
+		}
+		if offset.ErrorCode != nil {
+			return last, fmt.Errorf("kafka: %s", offset.Error)
+		}
+		last = events[i].Id
+	}
+	return last, nil
+}
@@ -0,0 +1,89 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+
+	"example/gochat/types"
+)
+
+const (
+	ChangeChatCreated    = "chat_created"
+	ChangeMessageCreated = "message_created"
+	ChangeMessageEdited  = "message_edited"
+	ChangeMemberJoined   = "member_joined"
+	ChangeMemberLeft     = "member_left"
+
+	// changes to the user's own state, made on one device and sent to
+	// the others
+	ChangeProfileUpdated     = "profile_updated"
+	ChangePreferencesUpdated = "preferences_updated"
+	ChangeSettingsUpdated    = "settings_updated"
+)
+
+// ownChanges are replayed to reconnecting devices next to the messages
+var ownChanges = map[string]bool{ChangeProfileUpdated: true, ChangePreferencesUpdated: true, ChangeSettingsUpdated: true}
+
+const syncPageSize = 500
+
+// recordChange appends to the change log read by /api/sync and returns the
+// change id, failures are only logged since the change itself already happened
+func (s *Server) recordChange(ctx context.Context, chatId int, userId int, changeType string, data any) int64 {
+	id, err := s.store.CreateChange(ctx, chatId, userId, changeType, data)
+	if err != nil {
+		s.logger.Printf("[%s] error: record change %s failed: %v", requestId(ctx), changeType, err)
+	}
+	return id
+}
+
+// syncOwnState records a change to the user's own state and sends it to
+// every connection of the user, so their other devices can update
+func (s *Server) syncOwnState(ctx context.Context, userId int, changeType string, data any) {
+	id := s.recordChange(ctx, 0, userId, changeType, data)
+	s.hub.SendToUsers([]int{userId}, types.EventJSON{Id: id, Type: changeType, Data: data})
+}
+
+func (s *Server) handleSync(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		WriteError(w, errMethodNotAllowed(r.Method))
+		return
+	}
+
+	// get cursor
+	since := int64(0)
+	if cursor := r.URL.Query().Get("since"); cursor != "" {
+		var err error
+		since, err = strconv.ParseInt(cursor, 10, 64)
+		if err != nil || since < 0 {
+			WriteError(w, errInvalidCursor)
+			return
+		}
+	}
+
+	// get user from req context
+	user, ok := r.Context().Value(userContextKey).(*types.User)
+	if !ok {
+		WriteError(w, errNotAuthorized)
+		return
+	}
+
+	// get one extra change to know if there are more
+	changes, err := s.store.GetChanges(r.Context(), user.Id, user.Chats, since, syncPageSize+1)
+	if err != nil {
+		WriteError(w, errInternal)
+		s.logf(r, "error: get changes failed: %v", err)
+		return
+	}
+	res := types.SyncJSON{Changes: changes, Cursor: strconv.FormatInt(since, 10)}
+	if len(changes) > syncPageSize {
+		res.Changes = changes[:syncPageSize]
+		res.HasMore = true
+	}
+	if len(res.Changes) > 0 {
+		res.Cursor = strconv.FormatInt(res.Changes[len(res.Changes)-1].Id, 10)
+	}
+
+	// response
+	WriteJSON(w, http.StatusOK, res)
+}
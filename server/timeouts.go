@@ -0,0 +1,117 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// request headers have to arrive within this whatever the other timeouts
+const readHeaderTimeout = 10 * time.Second
+
+// Timeouts limit how long connections and requests may take, zero turns
+// one off
+type Timeouts struct {
+	// reading a request, body included
+	Read time.Duration
+	// from the end of the request headers until the response is written
+	Write time.Duration
+	// keep-alive connections waiting for their next request
+	Idle time.Duration
+	// handlers, after it their context is cancelled and the request
+	// answered with a 504
+	Handler time.Duration
+}
+
+func DefaultTimeouts() Timeouts {
+	return Timeouts{Read: 30 * time.Second, Write: time.Minute, Idle: 2 * time.Minute, Handler: 30 * time.Second}
+}
+
+// WithTimeouts replaces the default timeouts
+func WithTimeouts(timeouts Timeouts) Option {
+	return func(s *Server) {
+		s.timeouts = timeouts
+	}
+}
+
+// routeTimeouts are the handler timeouts of routes that need another one,
+// by path template, 0 for none
+var routeTimeouts = map[string]time.Duration{
+	// the connection outlives the handler once upgraded
+	"/api/ws": 0,
+	// streamed and as long as the chat
+	"/api/admin/chats/{chatId}/export": 0,
+	// deletes in batches until done
+	"/api/admin/chats/{chatId}/purge": 10 * time.Minute,
+	// run for ?seconds=, the cpu profile 30 by default
+	"/debug/pprof/profile": 0,
+	"/debug/pprof/trace":   0,
+}
+
+// timeoutMiddleware cancels the context of requests that run past their
+// handler timeout, so slow queries stop, and answers them with a 504 unless
+// the handler already answered
+func (s *Server) timeoutMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		timeout := s.timeouts.Handler
+		if route := mux.CurrentRoute(r); route != nil {
+			if template, err := route.GetPathTemplate(); err == nil {
+				if d, ok := routeTimeouts[template]; ok {
+					timeout = d
+				}
+			}
+		}
+		if timeout <= 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		tw := &timeoutWriter{ResponseWriter: w, ctx: ctx}
+		next.ServeHTTP(tw, r.WithContext(ctx))
+		if !tw.wrote && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			WriteError(w, errTimeout)
+		}
+	})
+}
+
+// timeoutWriter answers a 504 in place of the error a handler writes
+// after its deadline passed, the failure is the timeout's
+type timeoutWriter struct {
+	http.ResponseWriter
+	ctx      context.Context
+	wrote    bool
+	timedOut bool
+}
+
+func (w *timeoutWriter) WriteHeader(status int) {
+	if w.wrote {
+		return
+	}
+	w.wrote = true
+	if status >= 500 && errors.Is(w.ctx.Err(), context.DeadlineExceeded) {
+		w.timedOut = true
+		WriteError(w.ResponseWriter, errTimeout)
+		return
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *timeoutWriter) Write(b []byte) (int, error) {
+	if !w.wrote {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.timedOut {
+		return len(b), nil
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController reach the connection
+func (w *timeoutWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,69 @@
+package server
+
+import (
+	"crypto/tls"
+	"log"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// CertReloader serves a certificate that is reloaded when its files change
+type CertReloader struct {
+	certFile string
+	keyFile  string
+	cert     atomic.Pointer[tls.Certificate]
+	modTime  time.Time
+}
+
+func NewCertReloader(certFile, keyFile string) (*CertReloader, error) {
+	c := &CertReloader{certFile: certFile, keyFile: keyFile}
+	if err := c.reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *CertReloader) reload() error {
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+	c.cert.Store(&cert)
+	c.modTime = c.lastModified()
+	return nil
+}
+
+// lastModified returns the newest mod time of the cert and key files
+func (c *CertReloader) lastModified() time.Time {
+	latest := time.Time{}
+	for _, path := range []string{c.certFile, c.keyFile} {
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest
+}
+
+// Watch polls the files and reloads the certificate when they change,
+// a broken pair keeps the current certificate and is retried on the next tick
+func (c *CertReloader) Watch(interval time.Duration) {
+	for range time.Tick(interval) {
+		if !c.lastModified().After(c.modTime) {
+			continue
+		}
+		if err := c.reload(); err != nil {
+			log.Printf("error: tls certificate reload failed: %v", err)
+			continue
+		}
+		log.Println("tls certificate reloaded")
+	}
+}
+
+func (c *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return c.cert.Load(), nil
+}
@@ -0,0 +1,52 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"example/gochat/types"
+)
+
+const (
+	trendingInterval = 5 * time.Minute
+	trendingWindow   = 24 * time.Hour
+	trendingLimit    = 20
+)
+
+// refreshTrending recomputes the chat activity scores every
+// trendingInterval until ctx is done
+func (s *Server) refreshTrending(ctx context.Context) {
+	ticker := time.NewTicker(trendingInterval)
+	defer ticker.Stop()
+	for {
+		if err := s.store.UpdateChatActivity(ctx, time.Now().Add(-trendingWindow)); err != nil && ctx.Err() == nil {
+			s.errorf("error: update chat activity failed: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// handleTrending lists the public chats with the most activity in the
+// last day, busiest first
+func (s *Server) handleTrending(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		WriteError(w, errMethodNotAllowed(r.Method))
+		return
+	}
+
+	// get chats
+	chats, err := s.store.GetTrendingChats(r.Context(), trendingLimit)
+	if err != nil {
+		WriteError(w, errInternal)
+		s.logf(r, "error: get trending chats failed: %v", err)
+		return
+	}
+
+	// response
+	WriteJSON(w, http.StatusOK, types.ListJSON[types.TrendingChatJSON]{Data: chats, Total: len(chats)})
+}
@@ -0,0 +1,141 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+
+	"example/gochat/storage"
+	"example/gochat/types"
+)
+
+var workspaceSlugPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{1,29}$`)
+
+// operatorMiddleware lets through the admins of the default workspace, who
+// run the instance. Admins of other workspaces only manage their own
+func (s *Server) operatorMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return s.adminMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		if workspace, _ := storage.WorkspaceFrom(r.Context()); workspace != storage.DefaultWorkspace {
+			WriteError(w, errForbidden)
+			return
+		}
+		next(w, r)
+	})
+}
+
+// providerWorkspace scopes ctx to the workspace an identity provider is
+// configured for by slug, the default workspace when it has none
+func (s *Server) providerWorkspace(ctx context.Context, slug string) (context.Context, error) {
+	if slug == "" {
+		return storage.WithWorkspace(ctx, storage.DefaultWorkspace), nil
+	}
+	workspace, err := s.store.GetWorkspaceBySlug(ctx, slug)
+	if err != nil {
+		return nil, fmt.Errorf("get workspace %q failed: %w", slug, err)
+	}
+	return storage.WithWorkspace(ctx, workspace.Id), nil
+}
+
+// handleAdminWorkspaces lists the workspaces or creates one, users join it
+// by registering with its slug
+func (s *Server) handleAdminWorkspaces(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "POST" {
+		WriteError(w, errMethodNotAllowed(r.Method))
+		return
+	}
+
+	// list workspaces
+	if r.Method == "GET" {
+		list, err := s.store.GetWorkspaces(r.Context())
+		if err != nil {
+			WriteError(w, errInternal)
+			s.logf(r, "error: get workspaces failed: %v", err)
+			return
+		}
+		WriteJSON(w, http.StatusOK, types.ListJSON[types.WorkspaceJSON]{Data: list, Total: len(list)})
+		return
+	}
+
+	// get req
+	req := new(types.CreateWorkspaceRequest)
+	json.NewDecoder(r.Body).Decode(req)
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" || utf8.RuneCountInString(req.Name) > 100 || !workspaceSlugPattern.MatchString(req.Slug) {
+		WriteError(w, errInvalidWorkspace)
+		return
+	}
+
+	// create workspace
+	workspace, err := s.store.CreateWorkspace(r.Context(), req.Name, req.Slug)
+	if err != nil {
+		if errors.Is(err, storage.ErrConflict) {
+			WriteError(w, errWorkspaceExists)
+			return
+		}
+		WriteError(w, errInternal)
+		s.logf(r, "error: create workspace failed: %v", err)
+		return
+	}
+	s.audit(r, types.AuditWorkspaceCreated, 0, map[string]any{"workspaceId": workspace.Id, "slug": workspace.Slug})
+
+	// response
+	WriteJSON(w, http.StatusCreated, workspace)
+}
+
+// handleAdminWorkspaceAdmins makes a user of a workspace its admin, who
+// takes it from there
+func (s *Server) handleAdminWorkspaceAdmins(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		WriteError(w, errMethodNotAllowed(r.Method))
+		return
+	}
+
+	// get workspace
+	workspace, err := s.store.GetWorkspaceBySlug(r.Context(), mux.Vars(r)["slug"])
+	if err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			WriteError(w, errWorkspaceNotFound)
+			return
+		}
+		WriteError(w, errInternal)
+		s.logf(r, "error: get workspace failed: %v", err)
+		return
+	}
+
+	// get user, only those of the workspace are found in its scope
+	req := new(types.WorkspaceAdminRequest)
+	json.NewDecoder(r.Body).Decode(req)
+	ctx := storage.WithWorkspace(r.Context(), workspace.Id)
+	user, err := s.store.GetUserByEmail(ctx, normalizeEmail(req.Email))
+	if err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			WriteError(w, errUserNotFound)
+			return
+		}
+		WriteError(w, errInternal)
+		s.logf(r, "error: get user failed: %v", err)
+		return
+	}
+
+	// update role
+	if err = s.store.UpdateUserRole(ctx, user.Id, types.RoleAdmin); err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			WriteError(w, errUserNotFound)
+			return
+		}
+		WriteError(w, errInternal)
+		s.logf(r, "error: update user role failed: %v", err)
+		return
+	}
+	s.audit(r, types.AuditWorkspaceAdmin, 0, map[string]any{"workspaceId": workspace.Id, "userId": user.Id})
+
+	// response
+	WriteJSON(w, http.StatusOK, types.RoleRequest{Role: types.RoleAdmin})
+}
@@ -0,0 +1,81 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+
+	"github.com/lib/pq"
+
+	"example/gochat/types"
+)
+
+// the activity feed keeps what happened to a user, unlike notifications
+// there is nothing to mark read
+
+func (s *PostgresStore) createActivityTable(ctx context.Context) error {
+	query := `create table if not exists user_activity (
+		id bigserial primary key,
+		user_id integer not null references users (id) on delete cascade,
+		type varchar(20) not null,
+		chat_id integer not null default 0,
+		data json,
+		created_at timestamp not null default now()
+	);
+	create index if not exists user_activity_user_id_idx on user_activity (user_id, id)`
+
+	_, err := s.db.ExecContext(ctx, query)
+	return err
+}
+
+// AddActivity adds the same entry to the activity feed of every user
+func (s *PostgresStore) AddActivity(ctx context.Context, usersId []int, activityType string, chatId int, data any) error {
+	// encode data
+	djs, err := json.Marshal(data)
+	if err != nil {
+		log.Println("addActivity json error")
+		return err
+	}
+
+	// exec query
+	query := `insert into user_activity (user_id, type, chat_id, data)
+	select unnest($1::integer[]), $2, $3, $4`
+	if _, err = s.db.ExecContext(ctx, query, pq.Array(usersId), activityType, chatId, djs); err != nil {
+		log.Println("addActivity error")
+		return err
+	}
+	return nil
+}
+
+// GetActivity returns a page of the user's activity newest first with ids
+// below before
+func (s *PostgresStore) GetActivity(ctx context.Context, userId int, before int64, limit int) ([]types.ActivityJSON, error) {
+	// exec query
+	query := `select id, type, chat_id, data, created_at from user_activity
+	where user_id = $1 and ($2 = 0 or id < $2)
+	order by id desc
+	limit $3`
+	rows, err := s.db.QueryContext(ctx, query, userId, before, limit)
+	if err != nil {
+		log.Println("getActivity query error")
+		return nil, err
+	}
+	defer rows.Close()
+
+	// iterate rows
+	result := []types.ActivityJSON{}
+	for rows.Next() {
+		activity := types.ActivityJSON{}
+		if err := rows.Scan(&activity.Id, &activity.Type, &activity.ChatId, &activity.Data, &activity.CreatedAt); err != nil {
+			log.Println("getActivity scan error")
+			return nil, err
+		}
+		activity.CreatedAt = activity.CreatedAt.UTC()
+		result = append(result, activity)
+	}
+	if err = rows.Err(); err != nil {
+		log.Println("getActivity err error")
+		return nil, err
+	}
+	return result, nil
+}
@@ -0,0 +1,77 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+
+	"example/gochat/types"
+)
+
+// the audit log keeps what admins did, it has no foreign keys so entries
+// outlive the users and chats they are about
+
+func (s *PostgresStore) createAuditTable(ctx context.Context) error {
+	query := `create table if not exists audit_log (
+		id bigserial primary key,
+		action varchar(50) not null,
+		actor_id integer not null,
+		actor_name varchar(20) not null,
+		chat_id integer not null default 0,
+		data json,
+		created_at timestamp not null default now()
+	)`
+
+	_, err := s.db.ExecContext(ctx, query)
+	return err
+}
+
+func (s *PostgresStore) AddAuditEntry(ctx context.Context, actor types.AuthorJSON, action string, chatId int, data any) error {
+	// encode data
+	djs, err := json.Marshal(data)
+	if err != nil {
+		log.Println("addAuditEntry json error")
+		return err
+	}
+
+	// exec query
+	query := `insert into audit_log (action, actor_id, actor_name, chat_id, data, workspace_id) values ($1, $2, $3, $4, $5, $6)`
+	if _, err = s.db.ExecContext(ctx, query, action, actor.Id, actor.Username, chatId, djs, workspaceOf(ctx)); err != nil {
+		log.Println("addAuditEntry error")
+		return err
+	}
+	return nil
+}
+
+// GetAuditLog returns a page of the audit log newest first with ids below
+// before
+func (s *PostgresStore) GetAuditLog(ctx context.Context, before int64, limit int) ([]types.AuditEntryJSON, error) {
+	// exec query
+	query := `select id, action, actor_id, actor_name, chat_id, data, created_at from audit_log
+	where ($1 = 0 or id < $1) and ($3 < 0 or workspace_id = $3)
+	order by id desc
+	limit $2`
+	rows, err := s.db.QueryContext(ctx, query, before, limit, workspaceScope(ctx))
+	if err != nil {
+		log.Println("getAuditLog query error")
+		return nil, err
+	}
+	defer rows.Close()
+
+	// iterate rows
+	result := []types.AuditEntryJSON{}
+	for rows.Next() {
+		entry := types.AuditEntryJSON{}
+		if err := rows.Scan(&entry.Id, &entry.Action, &entry.Actor.Id, &entry.Actor.Username, &entry.ChatId, &entry.Data, &entry.CreatedAt); err != nil {
+			log.Println("getAuditLog scan error")
+			return nil, err
+		}
+		entry.CreatedAt = entry.CreatedAt.UTC()
+		result = append(result, entry)
+	}
+	if err = rows.Err(); err != nil {
+		log.Println("getAuditLog err error")
+		return nil, err
+	}
+	return result, nil
+}
@@ -0,0 +1,85 @@
+package storage
+
+import (
+	"sync"
+	"time"
+
+	"example/gochat/types"
+)
+
+const (
+	// how long a looked up author is reused, other instances' changes
+	// show up after at most this
+	authorTTL = 30 * time.Second
+	// authors kept at most, the cache is emptied when it fills up with
+	// live entries
+	maxCachedAuthors = 10000
+)
+
+// authorCache keeps the authors of member lists, which are looked up with
+// every chat
+type authorCache struct {
+	mu      sync.Mutex
+	entries map[int]cachedAuthor
+}
+
+type cachedAuthor struct {
+	author  types.AuthorJSON
+	expires time.Time
+}
+
+func newAuthorCache() *authorCache {
+	return &authorCache{entries: map[int]cachedAuthor{}}
+}
+
+// get returns the cached authors of ids and the ids that missed
+func (c *authorCache) get(ids []int) (map[int]types.AuthorJSON, []int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	found := map[int]types.AuthorJSON{}
+	missing := []int{}
+	for _, id := range ids {
+		if entry, ok := c.entries[id]; ok && now.Before(entry.expires) {
+			found[id] = entry.author
+			continue
+		}
+		missing = append(missing, id)
+	}
+	return found, missing
+}
+
+func (c *authorCache) put(authors map[int]types.AuthorJSON) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	if len(c.entries)+len(authors) > maxCachedAuthors {
+		for id, entry := range c.entries {
+			if !now.Before(entry.expires) {
+				delete(c.entries, id)
+			}
+		}
+		if len(c.entries)+len(authors) > maxCachedAuthors {
+			c.entries = map[int]cachedAuthor{}
+		}
+	}
+	for id, author := range authors {
+		c.entries[id] = cachedAuthor{author: author, expires: now.Add(authorTTL)}
+	}
+}
+
+// forget drops a user whose name or last seen changed
+func (c *authorCache) forget(id int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, id)
+}
+
+// authorList returns the authors of ids in their order
+func authorList(authors map[int]types.AuthorJSON, ids []int) []types.AuthorJSON {
+	result := []types.AuthorJSON{}
+	for _, id := range ids {
+		result = append(result, authors[id])
+	}
+	return result
+}
@@ -0,0 +1,2663 @@
+package storage
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-webauthn/webauthn/webauthn"
+	bolt "go.etcd.io/bbolt"
+
+	"example/gochat/types"
+)
+
+// BoltStore keeps everything in a single bbolt file, for single node
+// deployments without a database server. Records are json and lookups
+// other than by id scan the bucket, which is fine at that scale
+type BoltStore struct {
+	db *bolt.DB
+}
+
+var (
+	bucketUsers         = []byte("users")
+	bucketEmails        = []byte("emails")
+	bucketUsernames     = []byte("usernames")
+	bucketChats         = []byte("chats")
+	bucketMemberRoles   = []byte("member_roles")
+	bucketMessageIds    = []byte("message_ids")
+	bucketMessageEdits  = []byte("message_edits")
+	bucketReactions     = []byte("reactions")
+	bucketBookmarks     = []byte("bookmarks")
+	bucketReceipts      = []byte("receipts")
+	bucketAnnouncements = []byte("announcements")
+	bucketChanges       = []byte("changes")
+	bucketDeviceCursors = []byte("device_cursors")
+	bucketPushTokens    = []byte("push_tokens")
+	bucketChatMutes     = []byte("chat_mutes")
+	bucketPreferences   = []byte("preferences")
+	bucketNotifications = []byte("notifications")
+	bucketPasskeys      = []byte("passkeys")
+	bucketSettings      = []byte("settings")
+	bucketLastRead      = []byte("last_read")
+	bucketJoinedAt      = []byte("joined_at")
+	bucketUserActivity  = []byte("user_activity")
+	bucketChatImages    = []byte("chat_images")
+	// outbox events by id, and the cursor of each consumer by name
+	bucketOutbox          = []byte("outbox")
+	bucketOutboxConsumers = []byte("outbox_consumers")
+	bucketAudit           = []byte("audit")
+	bucketAPITokens       = []byte("api_tokens")
+	bucketResponders      = []byte("responders")
+	bucketWorkspaces      = []byte("workspaces")
+	bucketWorkspaceUsage  = []byte("workspace_usage")
+	bucketIdentities      = []byte("identities")
+	bucketMeta            = []byte("meta")
+)
+
+var keyActivity = []byte("activity")
+
+// keyUserIndex holds the version of the email and username indexes
+var keyUserIndex = []byte("user_index")
+
+const userIndexVersion = "2"
+
+type boltUser struct {
+	Id               int        `json:"id"`
+	Username         string     `json:"username"`
+	Email            string     `json:"email"`
+	Password         string     `json:"password"`
+	Chats            []int      `json:"chats"`
+	Role             string     `json:"role"`
+	TimeZone         string     `json:"timeZone"`
+	LastAnnouncement int        `json:"lastAnnouncement"`
+	LastSeen         *time.Time `json:"lastSeen"`
+	HideLastSeen     bool       `json:"hideLastSeen"`
+	DisplayName      string     `json:"displayName"`
+	Bio              string     `json:"bio"`
+	Pronouns         string     `json:"pronouns"`
+	Link             string     `json:"link"`
+	Disabled         bool       `json:"disabled"`
+	TokenVersion     int        `json:"tokenVersion"`
+	Bot              bool       `json:"bot"`
+	WorkspaceId      int        `json:"workspaceId"`
+}
+
+func (u *boltUser) user() *types.User {
+	return &types.User{Id: u.Id, Username: u.Username, Email: u.Email, Password: u.Password, Chats: u.Chats, Role: u.Role, TimeZone: u.TimeZone, DisplayName: u.DisplayName, Disabled: u.Disabled, TokenVersion: u.TokenVersion, Bot: u.Bot, WorkspaceId: u.WorkspaceId}
+}
+
+type boltChat struct {
+	Id           int                 `json:"id"`
+	Name         string              `json:"name"`
+	Topic        string              `json:"topic"`
+	Password     string              `json:"password"`
+	Messages     []types.MessageJSON `json:"messages"`
+	Users        []int               `json:"users"`
+	Visibility   string              `json:"visibility"`
+	Category     string              `json:"category"`
+	Tags         []string            `json:"tags"`
+	Welcome      string              `json:"welcome"`
+	Announcement bool                `json:"announcement"`
+	Images       map[string]int64    `json:"images"`
+	WorkspaceId  int                 `json:"workspaceId"`
+}
+
+func (c *boltChat) info() types.ChatInfoJSON {
+	return types.ChatInfoJSON{Id: c.Id, Name: c.Name, Topic: c.Topic, Visibility: c.Visibility, Category: c.Category, Tags: c.Tags, MemberCount: len(c.Users)}
+}
+
+type boltActivity struct {
+	ChatId   int `json:"chatId"`
+	Messages int `json:"messages"`
+	Members  int `json:"members"`
+	Score    int `json:"score"`
+}
+
+type boltEdit struct {
+	ChatId int `json:"chatId"`
+	types.MessageEditJSON
+}
+
+type boltReaction struct {
+	ChatId    int       `json:"chatId"`
+	UserId    int       `json:"userId"`
+	Emoji     string    `json:"emoji"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+type boltBookmark struct {
+	Id        int64     `json:"id"`
+	UserId    int       `json:"userId"`
+	ChatId    int       `json:"chatId"`
+	MessageId int64     `json:"messageId"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+type boltReceipts struct {
+	AuthorId int            `json:"authorId"`
+	Statuses map[int]string `json:"statuses"`
+}
+
+// boltAnnouncement and boltAuditEntry keep the workspace they were made in
+type boltAnnouncement struct {
+	WorkspaceId int `json:"workspaceId"`
+	types.AnnouncementJSON
+}
+
+type boltAuditEntry struct {
+	WorkspaceId int `json:"workspaceId"`
+	types.AuditEntryJSON
+}
+
+type boltNotification struct {
+	UserId int `json:"userId"`
+	types.NotificationJSON
+}
+
+type boltUserActivity struct {
+	UserId int `json:"userId"`
+	types.ActivityJSON
+}
+
+type boltImage struct {
+	Data      []byte    `json:"data"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+type boltPreferences struct {
+	Notify     string                 `json:"notify"`
+	Email      bool                   `json:"email"`
+	QuietHours []types.QuietHoursJSON `json:"quietHours"`
+}
+
+type boltPasskey struct {
+	UserId     int                 `json:"userId"`
+	Credential webauthn.Credential `json:"credential"`
+}
+
+// NewBoltStore opens or creates the database file at path
+func NewBoltStore(path string) (*BoltStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return &BoltStore{db: db}, nil
+}
+
+func (s *BoltStore) Close() error {
+	return s.db.Close()
+}
+
+// Ping checks that the file can still be read
+func (s *BoltStore) Ping(ctx context.Context) error {
+	return s.db.View(func(tx *bolt.Tx) error { return nil })
+}
+
+// Init creates the buckets
+func (s *BoltStore) Init(ctx context.Context) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{
+			bucketUsers, bucketEmails, bucketChats, bucketMemberRoles, bucketMessageIds,
+			bucketMessageEdits, bucketReactions, bucketBookmarks, bucketReceipts,
+			bucketAnnouncements, bucketChanges, bucketDeviceCursors, bucketPushTokens,
+			bucketChatMutes, bucketPreferences, bucketNotifications, bucketPasskeys, bucketSettings, bucketLastRead, bucketJoinedAt, bucketUserActivity, bucketChatImages, bucketOutbox, bucketOutboxConsumers, bucketAudit, bucketAPITokens, bucketResponders, bucketWorkspaces, bucketWorkspaceUsage, bucketIdentities, bucketMeta,
+		} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+
+		// rebuild the email and username indexes of files from before
+		// they were unique and case insensitive, a value taken twice stays
+		// with the older user
+		meta := tx.Bucket(bucketMeta)
+		if string(meta.Get(keyUserIndex)) == userIndexVersion {
+			return nil
+		}
+		for _, name := range [][]byte{bucketEmails, bucketUsernames} {
+			if err := tx.DeleteBucket(name); err != nil && !errors.Is(err, bolt.ErrBucketNotFound) {
+				return err
+			}
+		}
+		emails, err := tx.CreateBucket(bucketEmails)
+		if err != nil {
+			return err
+		}
+		usernames, err := tx.CreateBucket(bucketUsernames)
+		if err != nil {
+			return err
+		}
+		err = tx.Bucket(bucketUsers).ForEach(func(k, v []byte) error {
+			u := boltUser{}
+			if err := json.Unmarshal(v, &u); err != nil {
+				return err
+			}
+			if emails.Get(fold(u.Email)) == nil {
+				if err := emails.Put(fold(u.Email), k); err != nil {
+					return err
+				}
+			}
+			if usernames.Get(fold(u.Username)) == nil {
+				return usernames.Put(fold(u.Username), k)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		return meta.Put(keyUserIndex, []byte(userIndexVersion))
+	})
+}
+
+// fold is the key of an email or username in their indexes
+func fold(s string) []byte {
+	return []byte(strings.ToLower(s))
+}
+
+// view and update log failures like the postgres store, not found and
+// conflicts are expected and only returned
+func (s *BoltStore) view(name string, fn func(*bolt.Tx) error) error {
+	return logged(name, s.db.View(fn))
+}
+
+func (s *BoltStore) update(name string, fn func(*bolt.Tx) error) error {
+	return logged(name, s.db.Update(fn))
+}
+
+func logged(name string, err error) error {
+	if err != nil && !errors.Is(err, ErrNotFound) && !errors.Is(err, ErrConflict) && !errors.Is(err, ErrLimit) {
+		log.Println(name + " error")
+	}
+	return err
+}
+
+func itob(id int64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(id))
+	return key
+}
+
+func btoi(key []byte) int64 {
+	return int64(binary.BigEndian.Uint64(key))
+}
+
+func pairKey(a, b any) []byte {
+	return []byte(fmt.Sprintf("%v:%v", a, b))
+}
+
+func put(b *bolt.Bucket, key []byte, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return b.Put(key, data)
+}
+
+// get decodes the record at key into v, ErrNotFound when there is none
+func get(b *bolt.Bucket, key []byte, v any) error {
+	data := b.Get(key)
+	if data == nil {
+		return ErrNotFound
+	}
+	return json.Unmarshal(data, v)
+}
+
+// seekBefore moves the cursor to the last key below key
+func seekBefore(cur *bolt.Cursor, key []byte) ([]byte, []byte) {
+	if k, _ := cur.Seek(key); k == nil {
+		return cur.Last()
+	}
+	return cur.Prev()
+}
+
+// deleteMatching deletes the records match returns true for, keys are
+// collected first since buckets can't be written while iterating
+func deleteMatching(b *bolt.Bucket, match func(k, v []byte) (bool, error)) error {
+	keys := [][]byte{}
+	err := b.ForEach(func(k, v []byte) error {
+		ok, err := match(k, v)
+		if ok {
+			keys = append(keys, slices.Clone(k))
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	for _, k := range keys {
+		if err = b.Delete(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func nextId(b *bolt.Bucket) (int64, error) {
+	id, err := b.NextSequence()
+	return int64(id), err
+}
+
+func getUser(tx *bolt.Tx, id int) (*boltUser, error) {
+	u := &boltUser{}
+	if err := get(tx.Bucket(bucketUsers), itob(int64(id)), u); err != nil {
+		return nil, err
+	}
+	if u.Chats == nil {
+		u.Chats = []int{}
+	}
+	return u, nil
+}
+
+func getChat(tx *bolt.Tx, id int) (*boltChat, error) {
+	c := &boltChat{}
+	if err := get(tx.Bucket(bucketChats), itob(int64(id)), c); err != nil {
+		return nil, err
+	}
+	if c.Messages == nil {
+		c.Messages = []types.MessageJSON{}
+	}
+	if c.Users == nil {
+		c.Users = []int{}
+	}
+	if c.Tags == nil {
+		c.Tags = []string{}
+	}
+	return c, nil
+}
+
+func putChat(tx *bolt.Tx, c *boltChat) error {
+	return put(tx.Bucket(bucketChats), itob(int64(c.Id)), c)
+}
+
+// authors returns the users in the order of ids, deleted ones as
+// types.DeletedUser
+func authors(tx *bolt.Tx, ids []int) ([]types.AuthorJSON, error) {
+	result := []types.AuthorJSON{}
+	for _, id := range ids {
+		u, err := getUser(tx, id)
+		if errors.Is(err, ErrNotFound) {
+			result = append(result, types.DeletedUser)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		author := types.AuthorJSON{Id: u.Id, Username: u.Username, DisplayName: u.DisplayName}
+		if !u.HideLastSeen && u.LastSeen != nil {
+			t := u.LastSeen.UTC()
+			author.LastSeen = &t
+		}
+		result = append(result, author)
+	}
+	return result, nil
+}
+
+func chatFromRecord(tx *bolt.Tx, c *boltChat) (*types.Chat, error) {
+	users, err := authors(tx, c.Users)
+	if err != nil {
+		return nil, err
+	}
+	names := map[int]string{}
+	for i := range c.Messages {
+		author := &c.Messages[i].Author
+		if _, ok := names[author.Id]; !ok {
+			names[author.Id] = displayName(tx, author.Id)
+		}
+		author.DisplayName = names[author.Id]
+	}
+	return &types.Chat{Id: c.Id, Name: c.Name, Topic: c.Topic, Password: c.Password, Messages: c.Messages, Users: users, Visibility: c.Visibility, Category: c.Category, Tags: c.Tags, Welcome: c.Welcome, Announcement: c.Announcement, Images: c.Images}, nil
+}
+
+// displayName is the current display name of a message author, messages
+// keep the one from when they were sent
+func displayName(tx *bolt.Tx, id int) string {
+	u, err := getUser(tx, id)
+	if err != nil {
+		return ""
+	}
+	return u.DisplayName
+}
+
+func hasMessage(c *boltChat, messageId int64) bool {
+	for _, m := range c.Messages {
+		if m.Id == messageId {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *BoltStore) CreateUser(ctx context.Context, username string, email string, password string) (*types.User, error) {
+	var user *types.User
+	err := s.update("createUser", func(tx *bolt.Tx) error {
+		emails, usernames := tx.Bucket(bucketEmails), tx.Bucket(bucketUsernames)
+		if emails.Get(fold(email)) != nil || usernames.Get(fold(username)) != nil {
+			return ErrConflict
+		}
+		users := tx.Bucket(bucketUsers)
+		id, err := nextId(users)
+		if err != nil {
+			return err
+		}
+
+		// new users don't see older announcements
+		last := 0
+		if k, _ := tx.Bucket(bucketAnnouncements).Cursor().Last(); k != nil {
+			last = int(btoi(k))
+		}
+		u := &boltUser{Id: int(id), Username: username, Email: email, Password: password, Chats: []int{}, Role: types.RoleUser, TimeZone: "UTC", LastAnnouncement: last, WorkspaceId: workspaceOf(ctx)}
+		if err = put(users, itob(id), u); err != nil {
+			return err
+		}
+		user = u.user()
+		if err = usernames.Put(fold(username), itob(id)); err != nil {
+			return err
+		}
+		return emails.Put(fold(email), itob(id))
+	})
+	return user, err
+}
+
+func (s *BoltStore) GetUserById(ctx context.Context, id int) (*types.User, error) {
+	var user *types.User
+	err := s.view("getUserById", func(tx *bolt.Tx) error {
+		u, err := getUser(tx, id)
+		if err != nil {
+			return err
+		}
+		user = u.user()
+		return nil
+	})
+	return user, err
+}
+
+func (s *BoltStore) GetUserByEmail(ctx context.Context, email string) (*types.User, error) {
+	var user *types.User
+	err := s.view("getUserByEmail", func(tx *bolt.Tx) error {
+		id := tx.Bucket(bucketEmails).Get(fold(email))
+		if id == nil {
+			return ErrNotFound
+		}
+		u, err := getUser(tx, int(btoi(id)))
+		if err != nil {
+			return err
+		}
+		user = u.user()
+		return nil
+	})
+	return user, err
+}
+
+func (s *BoltStore) GetUsers(ctx context.Context, arr []int) ([]types.User, error) {
+	users := []types.User{}
+	err := s.view("getUsers", func(tx *bolt.Tx) error {
+		for _, id := range arr {
+			u, err := getUser(tx, id)
+			if errors.Is(err, ErrNotFound) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			users = append(users, *u.user())
+		}
+		return nil
+	})
+	return users, err
+}
+
+func (s *BoltStore) GetAuthors(ctx context.Context, arr []int) (map[int]types.AuthorJSON, error) {
+	result := map[int]types.AuthorJSON{}
+	err := s.view("getAuthors", func(tx *bolt.Tx) error {
+		list, err := authors(tx, arr)
+		if err != nil {
+			return err
+		}
+		for i, id := range arr {
+			result[id] = list[i]
+		}
+		return nil
+	})
+	return result, err
+}
+
+// updateUser applies fn to the stored user
+func (s *BoltStore) updateUser(name string, id int, fn func(*boltUser)) error {
+	return s.update(name, func(tx *bolt.Tx) error {
+		u, err := getUser(tx, id)
+		if err != nil {
+			return err
+		}
+		fn(u)
+		return put(tx.Bucket(bucketUsers), itob(int64(id)), u)
+	})
+}
+
+func (s *BoltStore) TouchLastSeen(ctx context.Context, id int, at time.Time) error {
+	at = at.UTC()
+	return s.updateUser("touchLastSeen", id, func(u *boltUser) { u.LastSeen = &at })
+}
+
+func (s *BoltStore) SetShowLastSeen(ctx context.Context, id int, show bool) error {
+	return s.updateUser("setShowLastSeen", id, func(u *boltUser) { u.HideLastSeen = !show })
+}
+
+func (s *BoltStore) GetProfile(ctx context.Context, id int) (*types.ProfileJSON, error) {
+	var profile *types.ProfileJSON
+	err := s.view("getProfile", func(tx *bolt.Tx) error {
+		u, err := getUser(tx, id)
+		if err != nil {
+			return err
+		}
+		profile = &types.ProfileJSON{Id: u.Id, Username: u.Username, DisplayName: u.DisplayName, Bio: u.Bio, Pronouns: u.Pronouns, Link: u.Link}
+		if !u.HideLastSeen && u.LastSeen != nil {
+			t := u.LastSeen.UTC()
+			profile.LastSeen = &t
+		}
+		return nil
+	})
+	return profile, err
+}
+
+func (s *BoltStore) SetProfile(ctx context.Context, id int, profile types.ProfileRequest) error {
+	return s.updateUser("setProfile", id, func(u *boltUser) {
+		u.DisplayName, u.Bio, u.Pronouns, u.Link = profile.DisplayName, profile.Bio, profile.Pronouns, profile.Link
+	})
+}
+
+func (s *BoltStore) UpdateUserRole(ctx context.Context, id int, role string) error {
+	return s.updateUser("updateUserRole", id, func(u *boltUser) { u.Role = role })
+}
+
+func (s *BoltStore) SetRoleByEmail(ctx context.Context, emails []string, role string) error {
+	return s.update("setRoleByEmail", func(tx *bolt.Tx) error {
+		for _, email := range emails {
+			id := tx.Bucket(bucketEmails).Get(fold(email))
+			if id == nil {
+				continue
+			}
+			u, err := getUser(tx, int(btoi(id)))
+			if err != nil {
+				return err
+			}
+			u.Role = role
+			if err = put(tx.Bucket(bucketUsers), id, u); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// ListUsers goes through every user when q is set, to count the matches
+func (s *BoltStore) ListUsers(ctx context.Context, q string, after int, limit int) ([]types.User, int, error) {
+	users := []types.User{}
+	total := 0
+	q = strings.ToLower(q)
+	workspace := workspaceScope(ctx)
+	// the total of a search or a workspace takes a scan
+	scan := q != "" || workspace >= 0
+	err := s.view("listUsers", func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketUsers)
+		if !scan {
+			total = b.Stats().KeyN
+		}
+		cur := b.Cursor()
+		k, v := cur.Seek(itob(int64(after + 1)))
+		if scan {
+			k, v = cur.First()
+		}
+		for ; k != nil && (scan || len(users) < limit); k, v = cur.Next() {
+			u := &boltUser{}
+			if err := json.Unmarshal(v, u); err != nil {
+				return err
+			}
+			if scan {
+				if workspace >= 0 && u.WorkspaceId != workspace {
+					continue
+				}
+				if q != "" && !strings.Contains(strings.ToLower(u.Username), q) && !strings.Contains(strings.ToLower(u.Email), q) && !strings.Contains(strings.ToLower(u.DisplayName), q) {
+					continue
+				}
+				total++
+				if u.Id <= after || len(users) == limit {
+					continue
+				}
+			}
+			if u.Chats == nil {
+				u.Chats = []int{}
+			}
+			users = append(users, *u.user())
+		}
+		return nil
+	})
+	return users, total, err
+}
+
+func (s *BoltStore) SetUserDisabled(ctx context.Context, id int, disabled bool) error {
+	return s.updateUser("setUserDisabled", id, func(u *boltUser) {
+		u.Disabled = disabled
+		if disabled {
+			u.TokenVersion++
+		}
+	})
+}
+
+func (s *BoltStore) SetPassword(ctx context.Context, id int, password string) error {
+	return s.updateUser("setPassword", id, func(u *boltUser) {
+		u.Password = password
+		u.TokenVersion++
+	})
+}
+
+// DeleteUser deletes a user with their memberships and personal data, their
+// messages stay as types.DeletedUser's, reactions and receipts stay as they
+// are
+func (s *BoltStore) DeleteUser(ctx context.Context, id int) error {
+	return s.update("deleteUser", func(tx *bolt.Tx) error {
+		u, err := getUser(tx, id)
+		if err != nil {
+			return err
+		}
+
+		// leave the chats
+		for _, chatId := range u.Chats {
+			c, err := getChat(tx, chatId)
+			if errors.Is(err, ErrNotFound) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			left := types.MemberEventJSON{ChatId: chatId, User: types.AuthorJSON{Id: u.Id, Username: u.Username, DisplayName: u.DisplayName}}
+			if err = putOutboxEvent(tx, types.OutboxMemberLeft, chatId, left); err != nil {
+				return err
+			}
+			c.Users = slices.DeleteFunc(c.Users, func(userId int) bool { return userId == id })
+			if err = putChat(tx, c); err != nil {
+				return err
+			}
+		}
+
+		// anonymize their messages in every chat, left ones included,
+		// written after the scan since bolt can't change what it iterates
+		chats := []*boltChat{}
+		err = tx.Bucket(bucketChats).ForEach(func(k, v []byte) error {
+			c := &boltChat{}
+			if err := json.Unmarshal(v, c); err != nil {
+				return err
+			}
+			changed := false
+			for i := range c.Messages {
+				if c.Messages[i].Author.Id == id {
+					c.Messages[i].Author = types.DeletedUser
+					changed = true
+				}
+			}
+			if changed {
+				chats = append(chats, c)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, c := range chats {
+			if err = putChat(tx, c); err != nil {
+				return err
+			}
+		}
+		receipts := map[string]boltReceipts{}
+		err = tx.Bucket(bucketReceipts).ForEach(func(k, v []byte) error {
+			r := boltReceipts{}
+			if err := json.Unmarshal(v, &r); err != nil || r.AuthorId != id {
+				return err
+			}
+			r.AuthorId = types.DeletedUser.Id
+			receipts[string(k)] = r
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for k, r := range receipts {
+			if err = put(tx.Bucket(bucketReceipts), []byte(k), r); err != nil {
+				return err
+			}
+		}
+
+		// drop everything that belongs to the user
+		byUser := func(k, v []byte) (bool, error) {
+			record := struct {
+				UserId int `json:"userId"`
+			}{}
+			err := json.Unmarshal(v, &record)
+			return record.UserId == id, err
+		}
+		byUserPrefix := func(k, v []byte) (bool, error) { return bytes.HasPrefix(k, []byte(fmt.Sprintf("%d:", id))), nil }
+		byUserSuffix := func(k, v []byte) (bool, error) { return bytes.HasSuffix(k, []byte(fmt.Sprintf(":%d", id))), nil }
+		matches := map[*bolt.Bucket]func(k, v []byte) (bool, error){
+			tx.Bucket(bucketBookmarks):     byUser,
+			tx.Bucket(bucketNotifications): byUser,
+			tx.Bucket(bucketUserActivity):  byUser,
+			tx.Bucket(bucketPasskeys):      byUser,
+			tx.Bucket(bucketAPITokens):     byUser,
+			tx.Bucket(bucketResponders):    byUser,
+			tx.Bucket(bucketPushTokens):    byUser,
+			tx.Bucket(bucketIdentities):    byUser,
+			tx.Bucket(bucketDeviceCursors): byUserPrefix,
+			tx.Bucket(bucketChatMutes):     byUserPrefix,
+			tx.Bucket(bucketLastRead):      byUserPrefix,
+			tx.Bucket(bucketMemberRoles):   byUserSuffix,
+			tx.Bucket(bucketJoinedAt):      byUserSuffix,
+		}
+		for b, match := range matches {
+			if err = deleteMatching(b, match); err != nil {
+				return err
+			}
+		}
+		for _, b := range [][]byte{bucketSettings, bucketPreferences, bucketUsers} {
+			if err = tx.Bucket(b).Delete(itob(int64(id))); err != nil {
+				return err
+			}
+		}
+		if err = tx.Bucket(bucketEmails).Delete(fold(u.Email)); err != nil {
+			return err
+		}
+		return tx.Bucket(bucketUsernames).Delete(fold(u.Username))
+	})
+}
+
+func (s *BoltStore) CreateChat(ctx context.Context, newChat types.Chat, user types.User) (*types.Chat, error) {
+	var chat *types.Chat
+	err := s.update("createChat", func(tx *bolt.Tx) error {
+		id, err := nextId(tx.Bucket(bucketChats))
+		if err != nil {
+			return err
+		}
+		c := &boltChat{Id: int(id), Name: newChat.Name, Topic: newChat.Topic, Password: newChat.Password, Messages: []types.MessageJSON{}, Users: []int{user.Id}, Visibility: newChat.Visibility, Tags: []string{}, WorkspaceId: workspaceOf(ctx)}
+		if err = putChat(tx, c); err != nil {
+			return err
+		}
+
+		// the creator is the first member and an admin
+		if err = put(tx.Bucket(bucketJoinedAt), pairKey(c.Id, user.Id), time.Now().UTC()); err != nil {
+			return err
+		}
+		if err = tx.Bucket(bucketMemberRoles).Put(pairKey(c.Id, user.Id), []byte(types.MemberRoleAdmin)); err != nil {
+			return err
+		}
+		u, err := getUser(tx, user.Id)
+		if err != nil {
+			return err
+		}
+		u.Chats = append(u.Chats, c.Id)
+		if err = put(tx.Bucket(bucketUsers), itob(int64(u.Id)), u); err != nil {
+			return err
+		}
+		chat = &types.Chat{Id: c.Id, Name: c.Name, Topic: c.Topic, Password: c.Password, Messages: c.Messages, Users: []types.AuthorJSON{{Id: user.Id, Username: user.Username, DisplayName: user.DisplayName}}, Visibility: c.Visibility, Tags: c.Tags}
+		created := types.ChatCreatedJSON{Id: c.Id, Name: c.Name, Topic: c.Topic, Visibility: c.Visibility, Creator: chat.Users[0]}
+		return putOutboxEvent(tx, types.OutboxChatCreated, c.Id, created)
+	})
+	return chat, err
+}
+
+func (s *BoltStore) GetChatById(ctx context.Context, id int) (*types.Chat, error) {
+	var chat *types.Chat
+	err := s.view("getChatById", func(tx *bolt.Tx) error {
+		c, err := getChat(tx, id)
+		if err != nil {
+			return err
+		}
+		chat, err = chatFromRecord(tx, c)
+		return err
+	})
+	return chat, err
+}
+
+func (s *BoltStore) GetChats(ctx context.Context, arr []int) ([]types.Chat, error) {
+	chats := []types.Chat{}
+	err := s.view("getChats", func(tx *bolt.Tx) error {
+		for _, id := range arr {
+			c, err := getChat(tx, id)
+			if errors.Is(err, ErrNotFound) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			c.Messages = c.Messages[max(0, len(c.Messages)-chatListMessages):]
+			chat, err := chatFromRecord(tx, c)
+			if err != nil {
+				return err
+			}
+			chats = append(chats, *chat)
+		}
+		return nil
+	})
+	return chats, err
+}
+
+func (s *BoltStore) GetChatSummaries(ctx context.Context, userId int, arr []int) ([]types.ChatSummaryJSON, error) {
+	result := []types.ChatSummaryJSON{}
+	ids := slices.Clone(arr)
+	slices.Sort(ids)
+	ids = slices.Compact(ids)
+	err := s.view("getChatSummaries", func(tx *bolt.Tx) error {
+		var err error
+		result, err = getChatSummaries(tx, userId, ids)
+		return err
+	})
+	return result, err
+}
+
+// GetUserChats pages through the chats of the user, with the latest
+// message or by name first. Chats without messages come last when
+// sorting by activity, there is no join time to go by
+func (s *BoltStore) GetUserChats(ctx context.Context, userId int, sort string, offset int, limit int) ([]types.ChatSummaryJSON, error) {
+	result := []types.ChatSummaryJSON{}
+	err := s.view("getUserChats", func(tx *bolt.Tx) error {
+		u, err := getUser(tx, userId)
+		if err != nil {
+			return err
+		}
+		if result, err = getChatSummaries(tx, userId, u.Chats); err != nil {
+			return err
+		}
+		slices.SortFunc(result, func(a, b types.ChatSummaryJSON) int {
+			if sort == ChatsByName {
+				if c := cmp.Compare(strings.ToLower(a.Name), strings.ToLower(b.Name)); c != 0 {
+					return c
+				}
+				return cmp.Compare(a.Id, b.Id)
+			}
+			var at, bt time.Time
+			if a.LastMessage != nil {
+				at = a.LastMessage.CreatedAt
+			}
+			if b.LastMessage != nil {
+				bt = b.LastMessage.CreatedAt
+			}
+			if c := bt.Compare(at); c != 0 {
+				return c
+			}
+			return cmp.Compare(b.Id, a.Id)
+		})
+		result = result[min(offset, len(result)):]
+		result = result[:min(limit, len(result))]
+		return nil
+	})
+	return result, err
+}
+
+func getChatSummaries(tx *bolt.Tx, userId int, ids []int) ([]types.ChatSummaryJSON, error) {
+	result := []types.ChatSummaryJSON{}
+	for _, id := range ids {
+		c, err := getChat(tx, id)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		summary := types.ChatSummaryJSON{Id: c.Id, Name: c.Name, MemberCount: len(c.Users), MessageCount: len(c.Messages)}
+		if len(c.Messages) > 0 {
+			last := c.Messages[len(c.Messages)-1]
+			last.Author.DisplayName = displayName(tx, last.Author.Id)
+			summary.LastMessage = &last
+			summary.Preview = last.Preview()
+		}
+
+		// count back from the newest message
+		if slices.Contains(c.Users, userId) {
+			lastRead := lastRead(tx, userId, c.Id)
+			for i := len(c.Messages) - 1; i >= 0 && c.Messages[i].Id > lastRead && summary.Unread < types.MaxUnread; i-- {
+				if c.Messages[i].Author.Id != userId {
+					summary.Unread++
+				}
+			}
+		}
+		result = append(result, summary)
+	}
+	return result, nil
+}
+
+func lastRead(tx *bolt.Tx, userId int, chatId int) int64 {
+	var id int64
+	get(tx.Bucket(bucketLastRead), pairKey(userId, chatId), &id)
+	return id
+}
+
+func (s *BoltStore) GetReadMarker(ctx context.Context, userId int, chatId int) (int64, error) {
+	var id int64
+	err := s.view("getReadMarker", func(tx *bolt.Tx) error {
+		c, err := getChat(tx, chatId)
+		if err != nil {
+			return err
+		}
+		if !slices.Contains(c.Users, userId) {
+			return ErrNotFound
+		}
+		id = lastRead(tx, userId, chatId)
+		return nil
+	})
+	return id, err
+}
+
+func (s *BoltStore) SetReadMarker(ctx context.Context, userId int, chatId int, messageId int64) error {
+	return s.update("setReadMarker", func(tx *bolt.Tx) error {
+		c, err := getChat(tx, chatId)
+		if err != nil {
+			return err
+		}
+		if !slices.Contains(c.Users, userId) || (messageId != 0 && !hasMessage(c, messageId)) {
+			return ErrNotFound
+		}
+		return put(tx.Bucket(bucketLastRead), pairKey(userId, chatId), messageId)
+	})
+}
+
+// MarkAllRead moves the read position of the user to the last message of
+// each of the chats, or of all their chats when none are given
+func (s *BoltStore) MarkAllRead(ctx context.Context, userId int, chatIds []int) ([]types.ReadMarkerJSON, error) {
+	result := []types.ReadMarkerJSON{}
+	err := s.update("markAllRead", func(tx *bolt.Tx) error {
+		u, err := getUser(tx, userId)
+		if err != nil {
+			return err
+		}
+		for _, chatId := range u.Chats {
+			if len(chatIds) > 0 && !slices.Contains(chatIds, chatId) {
+				continue
+			}
+			c, err := getChat(tx, chatId)
+			if errors.Is(err, ErrNotFound) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			if len(c.Messages) == 0 {
+				continue
+			}
+			last := c.Messages[len(c.Messages)-1].Id
+			if lastRead(tx, userId, chatId) >= last {
+				continue
+			}
+			if err = put(tx.Bucket(bucketLastRead), pairKey(userId, chatId), last); err != nil {
+				return err
+			}
+			result = append(result, types.ReadMarkerJSON{ChatId: chatId, MessageId: last})
+		}
+		return nil
+	})
+	return result, err
+}
+
+// MarkRead moves the read position of the user in the chat of the message
+// forward to it, reading an older message changes nothing
+func (s *BoltStore) MarkRead(ctx context.Context, userId int, messageId int64) error {
+	return s.update("markRead", func(tx *bolt.Tx) error {
+		u, err := getUser(tx, userId)
+		if err != nil {
+			return err
+		}
+		for _, chatId := range u.Chats {
+			c, err := getChat(tx, chatId)
+			if errors.Is(err, ErrNotFound) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			if !hasMessage(c, messageId) {
+				continue
+			}
+			if lastRead(tx, userId, chatId) >= messageId {
+				return nil
+			}
+			return put(tx.Bucket(bucketLastRead), pairKey(userId, chatId), messageId)
+		}
+		return nil
+	})
+}
+
+// updateChat applies fn to the stored chat
+func (s *BoltStore) updateChat(name string, id int, fn func(*boltChat) error) error {
+	return s.update(name, func(tx *bolt.Tx) error {
+		c, err := getChat(tx, id)
+		if err != nil {
+			return err
+		}
+		if err = fn(c); err != nil {
+			return err
+		}
+		return putChat(tx, c)
+	})
+}
+
+// AddMember and RemoveMember change the member list of the chat and the
+// chats of the user in the same transaction
+func (s *BoltStore) AddMember(ctx context.Context, chatId int, userId int) error {
+	return s.updateMembership("addMember", chatId, userId, func(tx *bolt.Tx, c *boltChat, u *boltUser) error {
+		if slices.Contains(c.Users, userId) && slices.Contains(u.Chats, chatId) {
+			return ErrConflict
+		}
+		if !slices.Contains(c.Users, userId) {
+			c.Users = append(c.Users, userId)
+
+			// new members have read everything sent before
+			lastRead := int64(0)
+			if len(c.Messages) > 0 {
+				lastRead = c.Messages[len(c.Messages)-1].Id
+			}
+			if err := put(tx.Bucket(bucketLastRead), pairKey(userId, chatId), lastRead); err != nil {
+				return err
+			}
+			if err := put(tx.Bucket(bucketJoinedAt), pairKey(chatId, userId), time.Now().UTC()); err != nil {
+				return err
+			}
+			joined := types.MemberEventJSON{ChatId: chatId, User: types.AuthorJSON{Id: u.Id, Username: u.Username, DisplayName: u.DisplayName}}
+			if err := putOutboxEvent(tx, types.OutboxMemberJoined, chatId, joined); err != nil {
+				return err
+			}
+		}
+		if !slices.Contains(u.Chats, chatId) {
+			u.Chats = append(u.Chats, chatId)
+		}
+		return nil
+	})
+}
+
+func (s *BoltStore) RemoveMember(ctx context.Context, chatId int, userId int) error {
+	return s.updateMembership("removeMember", chatId, userId, func(tx *bolt.Tx, c *boltChat, u *boltUser) error {
+		if slices.Contains(c.Users, userId) {
+			left := types.MemberEventJSON{ChatId: chatId, User: types.AuthorJSON{Id: u.Id, Username: u.Username, DisplayName: u.DisplayName}}
+			if err := putOutboxEvent(tx, types.OutboxMemberLeft, chatId, left); err != nil {
+				return err
+			}
+		}
+		c.Users = slices.DeleteFunc(c.Users, func(id int) bool { return id == userId })
+		u.Chats = slices.DeleteFunc(u.Chats, func(id int) bool { return id == chatId })
+		if err := tx.Bucket(bucketJoinedAt).Delete(pairKey(chatId, userId)); err != nil {
+			return err
+		}
+		return tx.Bucket(bucketLastRead).Delete(pairKey(userId, chatId))
+	})
+}
+
+func (s *BoltStore) updateMembership(name string, chatId int, userId int, fn func(*bolt.Tx, *boltChat, *boltUser) error) error {
+	return s.update(name, func(tx *bolt.Tx) error {
+		c, err := getChat(tx, chatId)
+		if err != nil {
+			return err
+		}
+		u, err := getUser(tx, userId)
+		if err != nil {
+			return err
+		}
+		if err = fn(tx, c, u); err != nil {
+			return err
+		}
+		if err = putChat(tx, c); err != nil {
+			return err
+		}
+		return put(tx.Bucket(bucketUsers), itob(int64(userId)), u)
+	})
+}
+
+func (s *BoltStore) SetChatVisibility(ctx context.Context, id int, visibility string) error {
+	return s.updateChat("setChatVisibility", id, func(c *boltChat) error {
+		c.Visibility = visibility
+		return nil
+	})
+}
+
+func (s *BoltStore) SetChatInfo(ctx context.Context, id int, name string, topic string) error {
+	return s.updateChat("setChatInfo", id, func(c *boltChat) error {
+		c.Name, c.Topic = name, topic
+		return nil
+	})
+}
+
+func (s *BoltStore) SetChatWelcome(ctx context.Context, id int, text string) error {
+	return s.updateChat("setChatWelcome", id, func(c *boltChat) error {
+		c.Welcome = text
+		return nil
+	})
+}
+
+func (s *BoltStore) SetChatAnnouncement(ctx context.Context, id int, announcement bool) error {
+	return s.updateChat("setChatAnnouncement", id, func(c *boltChat) error {
+		c.Announcement = announcement
+		return nil
+	})
+}
+
+// SetChatImage stores the image next to the chat and its version in it
+func (s *BoltStore) SetChatImage(ctx context.Context, chatId int, kind string, data []byte, at time.Time) error {
+	return s.update("setChatImage", func(tx *bolt.Tx) error {
+		c, err := getChat(tx, chatId)
+		if err != nil {
+			return err
+		}
+		at = at.UTC()
+		if c.Images == nil {
+			c.Images = map[string]int64{}
+		}
+		c.Images[kind] = at.Unix()
+		if err = putChat(tx, c); err != nil {
+			return err
+		}
+		return put(tx.Bucket(bucketChatImages), pairKey(chatId, kind), boltImage{Data: data, UpdatedAt: at})
+	})
+}
+
+func (s *BoltStore) GetChatImage(ctx context.Context, chatId int, kind string) ([]byte, time.Time, error) {
+	image := boltImage{}
+	err := s.view("getChatImage", func(tx *bolt.Tx) error {
+		return get(tx.Bucket(bucketChatImages), pairKey(chatId, kind), &image)
+	})
+	return image.Data, image.UpdatedAt, err
+}
+
+func (s *BoltStore) DeleteChatImage(ctx context.Context, chatId int, kind string) error {
+	return s.update("deleteChatImage", func(tx *bolt.Tx) error {
+		c, err := getChat(tx, chatId)
+		if err != nil {
+			return err
+		}
+		if _, ok := c.Images[kind]; !ok {
+			return ErrNotFound
+		}
+		delete(c.Images, kind)
+		if err = putChat(tx, c); err != nil {
+			return err
+		}
+		return tx.Bucket(bucketChatImages).Delete(pairKey(chatId, kind))
+	})
+}
+
+// DeleteChat deletes a chat with its messages and takes it out of the
+// chats of its members
+func (s *BoltStore) DeleteChat(ctx context.Context, id int) error {
+	return s.update("deleteChat", func(tx *bolt.Tx) error {
+		c, err := getChat(tx, id)
+		if err != nil {
+			return err
+		}
+		for _, userId := range c.Users {
+			u, err := getUser(tx, userId)
+			if errors.Is(err, ErrNotFound) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			u.Chats = slices.DeleteFunc(u.Chats, func(chatId int) bool { return chatId == id })
+			if err = put(tx.Bucket(bucketUsers), itob(int64(userId)), u); err != nil {
+				return err
+			}
+		}
+
+		// drop everything that points at the chat or its messages
+		messages := map[int64]bool{}
+		for _, m := range c.Messages {
+			messages[m.Id] = true
+		}
+		byMessage := func(k, v []byte) (bool, error) { return messages[btoi(k[:8])], nil }
+		byChat := func(k, v []byte) (bool, error) {
+			record := struct {
+				ChatId int `json:"chatId"`
+			}{}
+			err := json.Unmarshal(v, &record)
+			return record.ChatId == id, err
+		}
+		byChatPrefix := func(k, v []byte) (bool, error) { return bytes.HasPrefix(k, []byte(fmt.Sprintf("%d:", id))), nil }
+		byChatSuffix := func(k, v []byte) (bool, error) { return bytes.HasSuffix(k, []byte(fmt.Sprintf(":%d", id))), nil }
+		matches := map[*bolt.Bucket]func(k, v []byte) (bool, error){
+			tx.Bucket(bucketMessageEdits): byMessage,
+			tx.Bucket(bucketReactions):    byMessage,
+			tx.Bucket(bucketBookmarks):    byChat,
+			tx.Bucket(bucketResponders):   byChat,
+			tx.Bucket(bucketMemberRoles):  byChatPrefix,
+			tx.Bucket(bucketJoinedAt):     byChatPrefix,
+			tx.Bucket(bucketChatImages):   byChatPrefix,
+			tx.Bucket(bucketChatMutes):    byChatSuffix,
+			tx.Bucket(bucketLastRead):     byChatSuffix,
+		}
+		for b, match := range matches {
+			if err = deleteMatching(b, match); err != nil {
+				return err
+			}
+		}
+		if err = putOutboxEvent(tx, types.OutboxChatDeleted, id, map[string]int{"chatId": id}); err != nil {
+			return err
+		}
+		return tx.Bucket(bucketChats).Delete(itob(int64(id)))
+	})
+}
+
+// SearchMessages goes through the messages of the chats newest first, there
+// are no indexes to help
+func (s *BoltStore) SearchMessages(ctx context.Context, search MessageSearch) ([]types.MessageJSON, error) {
+	result := []types.MessageJSON{}
+	text := strings.ToLower(search.Text)
+	err := s.view("searchMessages", func(tx *bolt.Tx) error {
+		authorId := 0
+		if search.Author != "" {
+			v := tx.Bucket(bucketUsernames).Get(fold(search.Author))
+			if v == nil {
+				return nil
+			}
+			authorId = int(btoi(v))
+		}
+		for _, chatId := range search.ChatIds {
+			c, err := getChat(tx, chatId)
+			if errors.Is(err, ErrNotFound) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			for _, m := range c.Messages {
+				switch {
+				case search.BeforeId != 0 && m.Id >= search.BeforeId:
+				case authorId != 0 && m.Author.Id != authorId:
+				case !search.After.IsZero() && !m.CreatedAt.After(search.After):
+				case !search.Before.IsZero() && !m.CreatedAt.Before(search.Before):
+				case text != "" && !strings.Contains(strings.ToLower(m.Text), text):
+				case search.HasLink && !linkRegexp.MatchString(m.Text):
+				default:
+					m.Author.DisplayName = displayName(tx, m.Author.Id)
+					result = append(result, m)
+				}
+			}
+		}
+		return nil
+	})
+
+	// newest first across chats
+	slices.SortFunc(result, func(a, b types.MessageJSON) int { return cmp.Compare(b.Id, a.Id) })
+	return result[:min(search.Limit, len(result))], err
+}
+
+// SearchChats matches q case-insensitively inside names and topics, there
+// is no fuzzy matching without pg_trgm, newest chats first
+func (s *BoltStore) SearchChats(ctx context.Context, q string, chats []int, limit int) ([]types.ChatInfoJSON, error) {
+	result := []types.ChatInfoJSON{}
+	q = strings.ToLower(q)
+	workspace := workspaceScope(ctx)
+	err := s.view("searchChats", func(tx *bolt.Tx) error {
+		cur := tx.Bucket(bucketChats).Cursor()
+		for k, v := cur.Last(); k != nil && len(result) < limit; k, v = cur.Prev() {
+			c := &boltChat{}
+			if err := json.Unmarshal(v, c); err != nil {
+				return err
+			}
+			if c.Visibility != types.VisibilityPublic && !slices.Contains(chats, c.Id) {
+				continue
+			}
+			if workspace >= 0 && c.WorkspaceId != workspace {
+				continue
+			}
+			if strings.Contains(strings.ToLower(c.Name), q) || strings.Contains(strings.ToLower(c.Topic), q) {
+				result = append(result, c.info())
+			}
+		}
+		return nil
+	})
+	return result, err
+}
+
+func (s *BoltStore) UpdateChatActivity(ctx context.Context, since time.Time) error {
+	return s.update("updateChatActivity", func(tx *bolt.Tx) error {
+		// walk the change log back to since
+		counts := map[int]*boltActivity{}
+		senders := map[int]map[int]bool{}
+		cur := tx.Bucket(bucketChanges).Cursor()
+		for k, v := cur.Last(); k != nil; k, v = cur.Prev() {
+			change := types.ChangeJSON{}
+			if err := json.Unmarshal(v, &change); err != nil {
+				return err
+			}
+			if !change.CreatedAt.After(since) {
+				break
+			}
+			if change.Type != "message_created" {
+				continue
+			}
+			if counts[change.ChatId] == nil {
+				counts[change.ChatId] = &boltActivity{ChatId: change.ChatId}
+				senders[change.ChatId] = map[int]bool{}
+			}
+			counts[change.ChatId].Messages++
+			senders[change.ChatId][change.UserId] = true
+		}
+
+		activity := []boltActivity{}
+		for id, a := range counts {
+			a.Members = len(senders[id])
+			a.Score = a.Messages + 5*a.Members
+			activity = append(activity, *a)
+		}
+		return put(tx.Bucket(bucketMeta), keyActivity, activity)
+	})
+}
+
+func (s *BoltStore) GetTrendingChats(ctx context.Context, limit int) ([]types.TrendingChatJSON, error) {
+	result := []types.TrendingChatJSON{}
+	workspace := workspaceScope(ctx)
+	err := s.view("getTrendingChats", func(tx *bolt.Tx) error {
+		activity := []boltActivity{}
+		if err := get(tx.Bucket(bucketMeta), keyActivity, &activity); err != nil && !errors.Is(err, ErrNotFound) {
+			return err
+		}
+		sort.Slice(activity, func(i, j int) bool {
+			if activity[i].Score != activity[j].Score {
+				return activity[i].Score > activity[j].Score
+			}
+			return activity[i].ChatId > activity[j].ChatId
+		})
+		for _, a := range activity {
+			if len(result) == limit {
+				break
+			}
+			c, err := getChat(tx, a.ChatId)
+			if errors.Is(err, ErrNotFound) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			if c.Visibility != types.VisibilityPublic || (workspace >= 0 && c.WorkspaceId != workspace) {
+				continue
+			}
+			result = append(result, types.TrendingChatJSON{ChatInfoJSON: c.info(), Score: a.Score, RecentMessages: a.Messages, ActiveMembers: a.Members})
+		}
+		return nil
+	})
+	return result, err
+}
+
+func (s *BoltStore) SetChatTags(ctx context.Context, id int, category string, tags []string) error {
+	return s.updateChat("setChatTags", id, func(c *boltChat) error {
+		c.Category = category
+		c.Tags = slices.Clone(tags)
+		slices.Sort(c.Tags)
+		c.Tags = slices.Compact(c.Tags)
+		return nil
+	})
+}
+
+func (s *BoltStore) GetPublicChats(ctx context.Context, tag string, category string, before int, limit int) ([]types.ChatInfoJSON, int, error) {
+	result := []types.ChatInfoJSON{}
+	total := 0
+	workspace := workspaceScope(ctx)
+	err := s.view("getPublicChats", func(tx *bolt.Tx) error {
+		cur := tx.Bucket(bucketChats).Cursor()
+		for k, v := cur.Last(); k != nil; k, v = cur.Prev() {
+			c := &boltChat{}
+			if err := json.Unmarshal(v, c); err != nil {
+				return err
+			}
+			if c.Visibility != types.VisibilityPublic || (workspace >= 0 && c.WorkspaceId != workspace) {
+				continue
+			}
+			if tag != "" && !slices.Contains(c.Tags, tag) {
+				continue
+			}
+			if category != "" && c.Category != category {
+				continue
+			}
+			total++
+			if (before == 0 || c.Id < before) && len(result) < limit {
+				if c.Tags == nil {
+					c.Tags = []string{}
+				}
+				result = append(result, c.info())
+			}
+		}
+		return nil
+	})
+	return result, total, err
+}
+
+func (s *BoltStore) GetMemberRole(ctx context.Context, chatId int, userId int) (string, error) {
+	role := types.MemberRoleMember
+	err := s.view("getMemberRole", func(tx *bolt.Tx) error {
+		if v := tx.Bucket(bucketMemberRoles).Get(pairKey(chatId, userId)); v != nil {
+			role = string(v)
+		}
+		return nil
+	})
+	return role, err
+}
+
+func (s *BoltStore) GetMembers(ctx context.Context, chatId int, after int, limit int) ([]types.MemberJSON, int, error) {
+	members := []types.MemberJSON{}
+	total := 0
+	err := s.view("getMembers", func(tx *bolt.Tx) error {
+		c, err := getChat(tx, chatId)
+		if err != nil {
+			return err
+		}
+		total = len(c.Users)
+		ids := slices.Clone(c.Users)
+		slices.Sort(ids)
+		for _, id := range ids {
+			if id <= after {
+				continue
+			}
+			if len(members) == limit {
+				break
+			}
+			u, err := getUser(tx, id)
+			if errors.Is(err, ErrNotFound) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			member := types.MemberJSON{Id: u.Id, Username: u.Username, DisplayName: u.DisplayName, Role: types.MemberRoleMember}
+			if v := tx.Bucket(bucketMemberRoles).Get(pairKey(chatId, id)); v != nil {
+				member.Role = string(v)
+			}
+			get(tx.Bucket(bucketJoinedAt), pairKey(chatId, id), &member.JoinedAt)
+			if !u.HideLastSeen && u.LastSeen != nil {
+				t := u.LastSeen.UTC()
+				member.LastSeen = &t
+			}
+			members = append(members, member)
+		}
+		return nil
+	})
+	return members, total, err
+}
+
+func (s *BoltStore) SetMemberRole(ctx context.Context, chatId int, userId int, role string) error {
+	return s.update("setMemberRole", func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketMemberRoles)
+		if role == types.MemberRoleMember {
+			return b.Delete(pairKey(chatId, userId))
+		}
+		return b.Put(pairKey(chatId, userId), []byte(role))
+	})
+}
+
+func (s *BoltStore) AddMessage(ctx context.Context, message types.MessageJSON) (int64, error) {
+	var id int64
+	err := s.update("addMessage", func(tx *bolt.Tx) error {
+		c, err := getChat(tx, message.ChatId)
+		if err != nil {
+			return err
+		}
+		if id, err = nextId(tx.Bucket(bucketMessageIds)); err != nil {
+			return err
+		}
+		message.Id = id
+		c.Messages = append(c.Messages, message)
+		if err = countBoltWorkspaceMessage(tx, c.WorkspaceId, message.CreatedAt); err != nil {
+			return err
+		}
+		if err = putOutboxEvent(tx, types.OutboxMessageCreated, c.Id, message); err != nil {
+			return err
+		}
+		return putChat(tx, c)
+	})
+	return id, err
+}
+
+// EditMessage replaces the text of a message written by authorId and
+// keeps the previous text in the edit history
+func (s *BoltStore) EditMessage(ctx context.Context, chatId int, messageId int64, authorId int, text string, at time.Time) (*types.MessageJSON, error) {
+	var edited *types.MessageJSON
+	err := s.update("editMessage", func(tx *bolt.Tx) error {
+		c, err := getChat(tx, chatId)
+		if err != nil {
+			return err
+		}
+		var message *types.MessageJSON
+		for i := range c.Messages {
+			if c.Messages[i].Id == messageId && c.Messages[i].Author.Id == authorId {
+				message = &c.Messages[i]
+				break
+			}
+		}
+		if message == nil {
+			return ErrNotFound
+		}
+
+		// keep previous text
+		edits := tx.Bucket(bucketMessageEdits)
+		seq, err := nextId(edits)
+		if err != nil {
+			return err
+		}
+		key := append(itob(messageId), itob(seq)...)
+		if err = put(edits, key, boltEdit{ChatId: chatId, MessageEditJSON: types.MessageEditJSON{Text: message.Text, EditedAt: at.UTC()}}); err != nil {
+			return err
+		}
+
+		editedAt := at.UTC()
+		message.Text, message.EditedAt = text, &editedAt
+		m := *message
+		edited = &m
+		if err = putOutboxEvent(tx, types.OutboxMessageEdited, chatId, m); err != nil {
+			return err
+		}
+		return putChat(tx, c)
+	})
+	return edited, err
+}
+
+// GetMessageHistory returns the previous versions of a message, oldest first
+func (s *BoltStore) GetMessageHistory(ctx context.Context, chatId int, messageId int64) ([]types.MessageEditJSON, error) {
+	result := []types.MessageEditJSON{}
+	err := s.view("getMessageHistory", func(tx *bolt.Tx) error {
+		c, err := getChat(tx, chatId)
+		if err != nil {
+			return err
+		}
+		if !hasMessage(c, messageId) {
+			return ErrNotFound
+		}
+		prefix := itob(messageId)
+		cur := tx.Bucket(bucketMessageEdits).Cursor()
+		for k, v := cur.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = cur.Next() {
+			edit := boltEdit{}
+			if err := json.Unmarshal(v, &edit); err != nil {
+				return err
+			}
+			if edit.ChatId == chatId {
+				result = append(result, edit.MessageEditJSON)
+			}
+		}
+		return nil
+	})
+	return result, err
+}
+
+func reactionKey(messageId int64, userId int, emoji string) []byte {
+	return append(append(itob(messageId), itob(int64(userId))...), emoji...)
+}
+
+// reactions returns the reactions on a message of the chat, oldest first
+func reactions(tx *bolt.Tx, chatId int, messageId int64) ([]boltReaction, error) {
+	result := []boltReaction{}
+	prefix := itob(messageId)
+	cur := tx.Bucket(bucketReactions).Cursor()
+	for k, v := cur.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = cur.Next() {
+		r := boltReaction{}
+		if err := json.Unmarshal(v, &r); err != nil {
+			return nil, err
+		}
+		if r.ChatId == chatId {
+			result = append(result, r)
+		}
+	}
+	sort.SliceStable(result, func(i, j int) bool { return result[i].CreatedAt.Before(result[j].CreatedAt) })
+	return result, nil
+}
+
+// AddReaction reacts to a message of the chat, reacting twice with the
+// same emoji is a no-op
+func (s *BoltStore) AddReaction(ctx context.Context, chatId int, messageId int64, userId int, emoji string) error {
+	return s.update("addReaction", func(tx *bolt.Tx) error {
+		c, err := getChat(tx, chatId)
+		if err != nil {
+			return err
+		}
+		if !hasMessage(c, messageId) {
+			return ErrNotFound
+		}
+		b := tx.Bucket(bucketReactions)
+		key := reactionKey(messageId, userId, emoji)
+		if b.Get(key) != nil {
+			return nil
+		}
+		return put(b, key, boltReaction{ChatId: chatId, UserId: userId, Emoji: emoji, CreatedAt: time.Now().UTC()})
+	})
+}
+
+func (s *BoltStore) RemoveReaction(ctx context.Context, chatId int, messageId int64, userId int, emoji string) error {
+	return s.update("removeReaction", func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketReactions)
+		key := reactionKey(messageId, userId, emoji)
+		r := boltReaction{}
+		if err := get(b, key, &r); err != nil {
+			return err
+		}
+		if r.ChatId != chatId {
+			return ErrNotFound
+		}
+		return b.Delete(key)
+	})
+}
+
+// GetReactionSummary counts the reactions on a message per emoji, most
+// used first, and marks the ones userId made
+func (s *BoltStore) GetReactionSummary(ctx context.Context, chatId int, messageId int64, userId int) ([]types.ReactionJSON, error) {
+	result := []types.ReactionJSON{}
+	err := s.view("getReactionSummary", func(tx *bolt.Tx) error {
+		all, err := reactions(tx, chatId, messageId)
+		if err != nil {
+			return err
+		}
+
+		// group by emoji, in order of first use
+		index := map[string]int{}
+		for _, r := range all {
+			i, ok := index[r.Emoji]
+			if !ok {
+				i = len(result)
+				index[r.Emoji] = i
+				result = append(result, types.ReactionJSON{Emoji: r.Emoji})
+			}
+			result[i].Count++
+			result[i].Reacted = result[i].Reacted || r.UserId == userId
+		}
+		sort.SliceStable(result, func(i, j int) bool { return result[i].Count > result[j].Count })
+		return nil
+	})
+	return result, err
+}
+
+// GetReactionUsers returns a page of the users who reacted with emoji,
+// ordered by id and starting after the given user id
+func (s *BoltStore) GetReactionUsers(ctx context.Context, chatId int, messageId int64, emoji string, after int, limit int) ([]types.AuthorJSON, error) {
+	result := []types.AuthorJSON{}
+	err := s.view("getReactionUsers", func(tx *bolt.Tx) error {
+		all, err := reactions(tx, chatId, messageId)
+		if err != nil {
+			return err
+		}
+		ids := []int{}
+		for _, r := range all {
+			if r.Emoji == emoji && r.UserId > after {
+				ids = append(ids, r.UserId)
+			}
+		}
+		slices.Sort(ids)
+		if len(ids) > limit {
+			ids = ids[:limit]
+		}
+		for _, id := range ids {
+			u, err := getUser(tx, id)
+			if errors.Is(err, ErrNotFound) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			result = append(result, types.AuthorJSON{Id: u.Id, Username: u.Username, DisplayName: u.DisplayName})
+		}
+		return nil
+	})
+	return result, err
+}
+
+// findBookmark returns the key of the user's bookmark on the message
+func findBookmark(tx *bolt.Tx, userId int, messageId int64) ([]byte, error) {
+	cur := tx.Bucket(bucketBookmarks).Cursor()
+	for k, v := cur.First(); k != nil; k, v = cur.Next() {
+		b := boltBookmark{}
+		if err := json.Unmarshal(v, &b); err != nil {
+			return nil, err
+		}
+		if b.UserId == userId && b.MessageId == messageId {
+			return k, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+// CreateBookmark bookmarks a message of the chat, bookmarking it twice
+// is a no-op
+func (s *BoltStore) CreateBookmark(ctx context.Context, userId int, chatId int, messageId int64) error {
+	return s.update("createBookmark", func(tx *bolt.Tx) error {
+		c, err := getChat(tx, chatId)
+		if err != nil {
+			return err
+		}
+		if !hasMessage(c, messageId) {
+			return ErrNotFound
+		}
+		if _, err = findBookmark(tx, userId, messageId); !errors.Is(err, ErrNotFound) {
+			return err
+		}
+		b := tx.Bucket(bucketBookmarks)
+		id, err := nextId(b)
+		if err != nil {
+			return err
+		}
+		return put(b, itob(id), boltBookmark{Id: id, UserId: userId, ChatId: chatId, MessageId: messageId, CreatedAt: time.Now().UTC()})
+	})
+}
+
+func (s *BoltStore) DeleteBookmark(ctx context.Context, userId int, messageId int64) error {
+	return s.update("deleteBookmark", func(tx *bolt.Tx) error {
+		key, err := findBookmark(tx, userId, messageId)
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(bucketBookmarks).Delete(key)
+	})
+}
+
+// GetBookmarks returns a page of the user's bookmarks in the given chats,
+// newest first with ids below before
+func (s *BoltStore) GetBookmarks(ctx context.Context, userId int, chats []int, before int64, limit int) ([]types.BookmarkJSON, error) {
+	result := []types.BookmarkJSON{}
+	err := s.view("getBookmarks", func(tx *bolt.Tx) error {
+		cur := tx.Bucket(bucketBookmarks).Cursor()
+		k, v := cur.Last()
+		if before != 0 {
+			k, v = seekBefore(cur, itob(before))
+		}
+		for ; k != nil && len(result) < limit; k, v = cur.Prev() {
+			b := boltBookmark{}
+			if err := json.Unmarshal(v, &b); err != nil {
+				return err
+			}
+			if b.UserId != userId || !slices.Contains(chats, b.ChatId) {
+				continue
+			}
+			c, err := getChat(tx, b.ChatId)
+			if errors.Is(err, ErrNotFound) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			for _, m := range c.Messages {
+				if m.Id == b.MessageId {
+					m.Author.DisplayName = displayName(tx, m.Author.Id)
+					result = append(result, types.BookmarkJSON{Id: b.Id, Message: m, CreatedAt: b.CreatedAt})
+					break
+				}
+			}
+		}
+		return nil
+	})
+	return result, err
+}
+
+// receiptRank orders the receipt statuses, they only move forward
+var receiptRank = map[string]int{types.ReceiptSent: 1, types.ReceiptDelivered: 2, types.ReceiptRead: 3}
+
+// CreateReceipts marks the message as sent to each of the recipients
+func (s *BoltStore) CreateReceipts(ctx context.Context, message types.MessageJSON, usersId []int) error {
+	return s.update("createReceipts", func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketReceipts)
+		r := boltReceipts{AuthorId: message.Author.Id, Statuses: map[int]string{}}
+		if err := get(b, itob(message.Id), &r); err != nil && !errors.Is(err, ErrNotFound) {
+			return err
+		}
+		for _, id := range usersId {
+			if _, ok := r.Statuses[id]; !ok {
+				r.Statuses[id] = types.ReceiptSent
+			}
+		}
+		return put(b, itob(message.Id), r)
+	})
+}
+
+// UpdateReceipt moves the status of the message for the user forward and
+// returns the author to notify, going back from read to delivered is ignored
+func (s *BoltStore) UpdateReceipt(ctx context.Context, messageId int64, userId int, status string) (int, error) {
+	var authorId int
+	err := s.update("updateReceipt", func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketReceipts)
+		r := boltReceipts{}
+		if err := get(b, itob(messageId), &r); err != nil {
+			return err
+		}
+		current, ok := r.Statuses[userId]
+		if !ok || receiptRank[current] >= receiptRank[status] {
+			return ErrNotFound
+		}
+		r.Statuses[userId] = status
+		authorId = r.AuthorId
+		return put(b, itob(messageId), r)
+	})
+	return authorId, err
+}
+
+// ExportMessages calls fn with every message of the chat in the order they
+// were sent. Bolt keeps a chat in one record so it is read whole, fn is
+// called after the transaction so a slow reader doesn't hold it open
+func (s *BoltStore) ExportMessages(ctx context.Context, chatId int, fn func(types.MessageJSON) error) error {
+	var messages []types.MessageJSON
+	err := s.view("exportMessages", func(tx *bolt.Tx) error {
+		c, err := getChat(tx, chatId)
+		if err != nil {
+			return err
+		}
+		chat, err := chatFromRecord(tx, c)
+		if err != nil {
+			return err
+		}
+		messages = chat.Messages
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, m := range messages {
+		if err = fn(m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *BoltStore) GetReceipts(ctx context.Context, messagesId []int64) ([]types.ReceiptJSON, error) {
+	result := []types.ReceiptJSON{}
+	ids := slices.Clone(messagesId)
+	slices.Sort(ids)
+	ids = slices.Compact(ids)
+	err := s.view("getReceipts", func(tx *bolt.Tx) error {
+		for _, id := range ids {
+			r := boltReceipts{}
+			if err := get(tx.Bucket(bucketReceipts), itob(id), &r); errors.Is(err, ErrNotFound) {
+				continue
+			} else if err != nil {
+				return err
+			}
+			users := []int{}
+			for userId := range r.Statuses {
+				users = append(users, userId)
+			}
+			slices.Sort(users)
+			for _, userId := range users {
+				result = append(result, types.ReceiptJSON{MessageId: id, UserId: userId, Status: r.Statuses[userId]})
+			}
+		}
+		return nil
+	})
+	return result, err
+}
+
+// PurgeMessages deletes up to limit of the oldest messages of the chat sent
+// before the time, all of them when it is zero
+func (s *BoltStore) PurgeMessages(ctx context.Context, chatId int, before time.Time, limit int) (int, error) {
+	deleted := 0
+	err := s.update("purgeMessages", func(tx *bolt.Tx) error {
+		c, err := getChat(tx, chatId)
+		if err != nil {
+			return err
+		}
+		purged := map[int64]bool{}
+		kept := []types.MessageJSON{}
+		for _, m := range c.Messages {
+			if len(purged) < limit && (before.IsZero() || m.CreatedAt.Before(before)) {
+				purged[m.Id] = true
+			} else {
+				kept = append(kept, m)
+			}
+		}
+		if len(purged) == 0 {
+			return nil
+		}
+		c.Messages = kept
+		if err = putChat(tx, c); err != nil {
+			return err
+		}
+
+		// drop what points at the deleted messages
+		byKey := func(k, v []byte) (bool, error) { return purged[btoi(k[:8])], nil }
+		byRecord := func(k, v []byte) (bool, error) {
+			b := boltBookmark{}
+			err := json.Unmarshal(v, &b)
+			return purged[b.MessageId], err
+		}
+		matches := map[*bolt.Bucket]func(k, v []byte) (bool, error){
+			tx.Bucket(bucketMessageEdits): byKey,
+			tx.Bucket(bucketReactions):    byKey,
+			tx.Bucket(bucketReceipts):     byKey,
+			tx.Bucket(bucketBookmarks):    byRecord,
+		}
+		for b, match := range matches {
+			if err = deleteMatching(b, match); err != nil {
+				return err
+			}
+		}
+		deleted = len(purged)
+		return nil
+	})
+	return deleted, err
+}
+
+// MaintainMessages deletes the messages older than retention with their
+// reactions, edits, receipts and bookmarks, bolt has no partitions
+func (s *BoltStore) MaintainMessages(ctx context.Context, now time.Time, retention time.Duration) error {
+	if retention <= 0 {
+		return nil
+	}
+	return s.update("maintainMessages", func(tx *bolt.Tx) error {
+		_, err := expireMessages(tx, now.Add(-retention))
+		return err
+	})
+}
+
+// expireMessages deletes the messages sent before cutoff and what points
+// at them, and returns how many
+func expireMessages(tx *bolt.Tx, cutoff time.Time) (int, error) {
+	expired := map[int64]bool{}
+	chats := []*boltChat{}
+	err := tx.Bucket(bucketChats).ForEach(func(k, v []byte) error {
+		c := &boltChat{}
+		if err := json.Unmarshal(v, c); err != nil {
+			return err
+		}
+		kept := []types.MessageJSON{}
+		for _, m := range c.Messages {
+			if m.CreatedAt.Before(cutoff) {
+				expired[m.Id] = true
+			} else {
+				kept = append(kept, m)
+			}
+		}
+		if len(kept) < len(c.Messages) {
+			c.Messages = kept
+			chats = append(chats, c)
+		}
+		return nil
+	})
+	if err != nil || len(expired) == 0 {
+		return 0, err
+	}
+	for _, c := range chats {
+		if err = putChat(tx, c); err != nil {
+			return 0, err
+		}
+	}
+
+	// drop what points at the deleted messages
+	byKey := func(k, v []byte) (bool, error) { return expired[btoi(k[:8])], nil }
+	byRecord := func(k, v []byte) (bool, error) {
+		b := boltBookmark{}
+		err := json.Unmarshal(v, &b)
+		return expired[b.MessageId], err
+	}
+	matches := map[*bolt.Bucket]func(k, v []byte) (bool, error){
+		tx.Bucket(bucketMessageEdits): byKey,
+		tx.Bucket(bucketReactions):    byKey,
+		tx.Bucket(bucketReceipts):     byKey,
+		tx.Bucket(bucketBookmarks):    byRecord,
+	}
+	for b, match := range matches {
+		if err = deleteMatching(b, match); err != nil {
+			return 0, err
+		}
+	}
+	return len(expired), nil
+}
+
+func (s *BoltStore) GetStats(ctx context.Context) (*types.StatsJSON, error) {
+	stats := &types.StatsJSON{}
+	workspace, since := workspaceScope(ctx), statsSince(time.Now())
+	counts := map[string]int{}
+	err := s.view("getStats", func(tx *bolt.Tx) error {
+		// the file size is only shown outside of workspaces
+		if workspace <= 0 {
+			stats.StorageBytes = tx.Size()
+		}
+		if workspace < 0 {
+			stats.Users = tx.Bucket(bucketUsers).Stats().KeyN
+		} else {
+			err := tx.Bucket(bucketUsers).ForEach(func(k, v []byte) error {
+				u := &boltUser{}
+				if err := json.Unmarshal(v, u); err != nil {
+					return err
+				}
+				if u.WorkspaceId == workspace {
+					stats.Users++
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return tx.Bucket(bucketChats).ForEach(func(k, v []byte) error {
+			c := &boltChat{}
+			if err := json.Unmarshal(v, c); err != nil {
+				return err
+			}
+			if workspace >= 0 && c.WorkspaceId != workspace {
+				return nil
+			}
+			stats.Chats++
+			active := false
+			for _, m := range c.Messages {
+				if m.CreatedAt.Before(since) {
+					continue
+				}
+				active = true
+				counts[m.CreatedAt.UTC().Format(time.DateOnly)]++
+			}
+			if active {
+				stats.ActiveChats++
+			}
+			stats.Messages += len(c.Messages)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	stats.MessagesPerDay = messagesPerDay(since, counts)
+	return stats, nil
+}
+
+func (s *BoltStore) CreateAnnouncement(ctx context.Context, text string) (*types.AnnouncementJSON, error) {
+	var a *types.AnnouncementJSON
+	err := s.update("createAnnouncement", func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketAnnouncements)
+		id, err := nextId(b)
+		if err != nil {
+			return err
+		}
+		a = &types.AnnouncementJSON{Id: int(id), Text: text, CreatedAt: time.Now().UTC()}
+		return put(b, itob(id), boltAnnouncement{WorkspaceId: workspaceOf(ctx), AnnouncementJSON: *a})
+	})
+	return a, err
+}
+
+func (s *BoltStore) GetUnseenAnnouncements(ctx context.Context, userId int) ([]types.AnnouncementJSON, error) {
+	result := []types.AnnouncementJSON{}
+	err := s.view("getUnseenAnnouncements", func(tx *bolt.Tx) error {
+		u, err := getUser(tx, userId)
+		if errors.Is(err, ErrNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		cur := tx.Bucket(bucketAnnouncements).Cursor()
+		for k, v := cur.Seek(itob(int64(u.LastAnnouncement + 1))); k != nil; k, v = cur.Next() {
+			a := boltAnnouncement{}
+			if err := json.Unmarshal(v, &a); err != nil {
+				return err
+			}
+			if a.WorkspaceId == u.WorkspaceId {
+				result = append(result, a.AnnouncementJSON)
+			}
+		}
+		return nil
+	})
+	return result, err
+}
+
+func (s *BoltStore) MarkAnnouncementSeen(ctx context.Context, usersId []int, id int) error {
+	return s.update("markAnnouncementSeen", func(tx *bolt.Tx) error {
+		for _, userId := range usersId {
+			u, err := getUser(tx, userId)
+			if errors.Is(err, ErrNotFound) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			if u.LastAnnouncement < id {
+				u.LastAnnouncement = id
+				if err = put(tx.Bucket(bucketUsers), itob(int64(userId)), u); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+func (s *BoltStore) CreateChange(ctx context.Context, chatId int, userId int, changeType string, data any) (int64, error) {
+	djs, err := json.Marshal(data)
+	if err != nil {
+		log.Println("createChange json error")
+		return 0, err
+	}
+	var id int64
+	err = s.update("createChange", func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketChanges)
+		if id, err = nextId(b); err != nil {
+			return err
+		}
+		return put(b, itob(id), types.ChangeJSON{Id: id, ChatId: chatId, UserId: userId, Type: changeType, Data: djs, CreatedAt: time.Now().UTC()})
+	})
+	return id, err
+}
+
+func (s *BoltStore) GetChanges(ctx context.Context, userId int, chats []int, since int64, limit int) ([]types.ChangeJSON, error) {
+	result := []types.ChangeJSON{}
+	err := s.view("getChanges", func(tx *bolt.Tx) error {
+		cur := tx.Bucket(bucketChanges).Cursor()
+		for k, v := cur.Seek(itob(since + 1)); k != nil && len(result) < limit; k, v = cur.Next() {
+			change := types.ChangeJSON{}
+			if err := json.Unmarshal(v, &change); err != nil {
+				return err
+			}
+			if slices.Contains(chats, change.ChatId) || change.UserId == userId {
+				result = append(result, change)
+			}
+		}
+		return nil
+	})
+	return result, err
+}
+
+func (s *BoltStore) GetDeviceCursor(ctx context.Context, userId int, device string) (int64, error) {
+	cursor := int64(0)
+	err := s.view("getDeviceCursor", func(tx *bolt.Tx) error {
+		// new devices start at the latest change
+		if v := tx.Bucket(bucketDeviceCursors).Get(pairKey(userId, device)); v != nil {
+			cursor = btoi(v)
+		} else if k, _ := tx.Bucket(bucketChanges).Cursor().Last(); k != nil {
+			cursor = btoi(k)
+		}
+		return nil
+	})
+	return cursor, err
+}
+
+func (s *BoltStore) UpdateDeviceCursor(ctx context.Context, userId int, device string, cursor int64) error {
+	return s.update("updateDeviceCursor", func(tx *bolt.Tx) error {
+		// cursors never move back
+		b := tx.Bucket(bucketDeviceCursors)
+		if v := b.Get(pairKey(userId, device)); v != nil && btoi(v) >= cursor {
+			return nil
+		}
+		return b.Put(pairKey(userId, device), itob(cursor))
+	})
+}
+
+func (s *BoltStore) CreatePushToken(ctx context.Context, userId int, token string, platform string) error {
+	return s.update("createPushToken", func(tx *bolt.Tx) error {
+		// a token moves to the user who registered it last
+		return put(tx.Bucket(bucketPushTokens), []byte(token), types.PushToken{UserId: userId, Token: token, Platform: platform})
+	})
+}
+
+func (s *BoltStore) DeletePushToken(ctx context.Context, userId int, token string) error {
+	return s.update("deletePushToken", func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketPushTokens)
+		t := types.PushToken{}
+		if err := get(b, []byte(token), &t); err != nil || t.UserId != userId {
+			return nil
+		}
+		return b.Delete([]byte(token))
+	})
+}
+
+func (s *BoltStore) GetPushTokens(ctx context.Context, usersId []int, chatId int) ([]types.PushToken, error) {
+	result := []types.PushToken{}
+	err := s.view("getPushTokens", func(tx *bolt.Tx) error {
+		// users that muted the chat are skipped
+		mutes := tx.Bucket(bucketChatMutes)
+		return tx.Bucket(bucketPushTokens).ForEach(func(k, v []byte) error {
+			t := types.PushToken{}
+			if err := json.Unmarshal(v, &t); err != nil {
+				return err
+			}
+			if slices.Contains(usersId, t.UserId) && mutes.Get(pairKey(t.UserId, chatId)) == nil {
+				result = append(result, t)
+			}
+			return nil
+		})
+	})
+	return result, err
+}
+
+func (s *BoltStore) SetChatMuted(ctx context.Context, userId int, chatId int, muted bool) error {
+	return s.update("setChatMuted", func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketChatMutes)
+		if muted {
+			return b.Put(pairKey(userId, chatId), []byte{})
+		}
+		return b.Delete(pairKey(userId, chatId))
+	})
+}
+
+// GetPreferences returns the preferences of the users, with the defaults
+// for users that never set them
+func (s *BoltStore) GetPreferences(ctx context.Context, usersId []int) (map[int]types.PreferencesJSON, error) {
+	result := map[int]types.PreferencesJSON{}
+	err := s.view("getPreferences", func(tx *bolt.Tx) error {
+		for _, id := range usersId {
+			p := types.DefaultPreferences()
+			u, err := getUser(tx, id)
+			if errors.Is(err, ErrNotFound) {
+				result[id] = p
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			stored := boltPreferences{}
+			if err := get(tx.Bucket(bucketPreferences), itob(int64(id)), &stored); err == nil {
+				p.Notify, p.Email = stored.Notify, stored.Email
+				if stored.QuietHours != nil {
+					p.QuietHours = stored.QuietHours
+				}
+			} else if !errors.Is(err, ErrNotFound) {
+				return err
+			}
+			p.TimeZone = u.TimeZone
+			result[id] = p
+		}
+		return nil
+	})
+	return result, err
+}
+
+func (s *BoltStore) SetPreferences(ctx context.Context, userId int, p types.PreferencesJSON) error {
+	return s.update("setPreferences", func(tx *bolt.Tx) error {
+		// the time zone belongs to the user
+		u, err := getUser(tx, userId)
+		if err != nil {
+			return err
+		}
+		u.TimeZone = p.TimeZone
+		if err = put(tx.Bucket(bucketUsers), itob(int64(userId)), u); err != nil {
+			return err
+		}
+		return put(tx.Bucket(bucketPreferences), itob(int64(userId)), boltPreferences{Notify: p.Notify, Email: p.Email, QuietHours: p.QuietHours})
+	})
+}
+
+// GetSettings returns the settings of a user, empty when none were set
+func (s *BoltStore) GetSettings(ctx context.Context, userId int) (map[string]json.RawMessage, error) {
+	settings := map[string]json.RawMessage{}
+	err := s.view("getSettings", func(tx *bolt.Tx) error {
+		err := get(tx.Bucket(bucketSettings), itob(int64(userId)), &settings)
+		if errors.Is(err, ErrNotFound) {
+			return nil
+		}
+		return err
+	})
+	return settings, err
+}
+
+// UpdateSettings merges patch into the settings of a user and returns the
+// result, see mergeSettings
+func (s *BoltStore) UpdateSettings(ctx context.Context, userId int, patch map[string]json.RawMessage, maxKeys int) (map[string]json.RawMessage, error) {
+	settings := map[string]json.RawMessage{}
+	err := s.update("updateSettings", func(tx *bolt.Tx) error {
+		if _, err := getUser(tx, userId); err != nil {
+			return err
+		}
+		b := tx.Bucket(bucketSettings)
+		if err := get(b, itob(int64(userId)), &settings); err != nil && !errors.Is(err, ErrNotFound) {
+			return err
+		}
+		if err := mergeSettings(settings, patch, maxKeys); err != nil {
+			return err
+		}
+		return put(b, itob(int64(userId)), settings)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return settings, nil
+}
+
+// CreateNotifications adds the same notification to the inbox of every user
+func (s *BoltStore) CreateNotifications(ctx context.Context, usersId []int, notificationType string, chatId int, data any) error {
+	djs, err := json.Marshal(data)
+	if err != nil {
+		log.Println("createNotifications json error")
+		return err
+	}
+	return s.update("createNotifications", func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketNotifications)
+		now := time.Now().UTC()
+		for _, userId := range usersId {
+			id, err := nextId(b)
+			if err != nil {
+				return err
+			}
+			n := boltNotification{UserId: userId, NotificationJSON: types.NotificationJSON{Id: id, Type: notificationType, ChatId: chatId, Data: djs, CreatedAt: now}}
+			if err = put(b, itob(id), n); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// GetNotifications returns a page of the user's notifications newest first
+// with ids below before
+func (s *BoltStore) GetNotifications(ctx context.Context, userId int, unreadOnly bool, before int64, limit int) ([]types.NotificationJSON, error) {
+	result := []types.NotificationJSON{}
+	err := s.view("getNotifications", func(tx *bolt.Tx) error {
+		cur := tx.Bucket(bucketNotifications).Cursor()
+		k, v := cur.Last()
+		if before != 0 {
+			k, v = seekBefore(cur, itob(before))
+		}
+		for ; k != nil && len(result) < limit; k, v = cur.Prev() {
+			n := boltNotification{}
+			if err := json.Unmarshal(v, &n); err != nil {
+				return err
+			}
+			if n.UserId == userId && !(unreadOnly && n.Read) {
+				result = append(result, n.NotificationJSON)
+			}
+		}
+		return nil
+	})
+	return result, err
+}
+
+// AddActivity adds the same entry to the activity feed of every user
+func (s *BoltStore) AddActivity(ctx context.Context, usersId []int, activityType string, chatId int, data any) error {
+	djs, err := json.Marshal(data)
+	if err != nil {
+		log.Println("addActivity json error")
+		return err
+	}
+	return s.update("addActivity", func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketUserActivity)
+		now := time.Now().UTC()
+		for _, userId := range usersId {
+			id, err := nextId(b)
+			if err != nil {
+				return err
+			}
+			a := boltUserActivity{UserId: userId, ActivityJSON: types.ActivityJSON{Id: id, Type: activityType, ChatId: chatId, Data: djs, CreatedAt: now}}
+			if err = put(b, itob(id), a); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *BoltStore) AddAuditEntry(ctx context.Context, actor types.AuthorJSON, action string, chatId int, data any) error {
+	djs, err := json.Marshal(data)
+	if err != nil {
+		log.Println("addAuditEntry json error")
+		return err
+	}
+	return s.update("addAuditEntry", func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketAudit)
+		id, err := nextId(b)
+		if err != nil {
+			return err
+		}
+		actor = types.AuthorJSON{Id: actor.Id, Username: actor.Username}
+		entry := types.AuditEntryJSON{Id: id, Action: action, Actor: actor, ChatId: chatId, Data: djs, CreatedAt: time.Now().UTC()}
+		return put(b, itob(id), boltAuditEntry{WorkspaceId: workspaceOf(ctx), AuditEntryJSON: entry})
+	})
+}
+
+// GetAuditLog returns a page of the audit log newest first with ids below
+// before
+func (s *BoltStore) GetAuditLog(ctx context.Context, before int64, limit int) ([]types.AuditEntryJSON, error) {
+	result := []types.AuditEntryJSON{}
+	workspace := workspaceScope(ctx)
+	err := s.view("getAuditLog", func(tx *bolt.Tx) error {
+		cur := tx.Bucket(bucketAudit).Cursor()
+		k, v := cur.Last()
+		if before != 0 {
+			k, v = seekBefore(cur, itob(before))
+		}
+		for ; k != nil && len(result) < limit; k, v = cur.Prev() {
+			entry := boltAuditEntry{}
+			if err := json.Unmarshal(v, &entry); err != nil {
+				return err
+			}
+			if workspace < 0 || entry.WorkspaceId == workspace {
+				result = append(result, entry.AuditEntryJSON)
+			}
+		}
+		return nil
+	})
+	return result, err
+}
+
+// GetActivity returns a page of the user's activity newest first with ids
+// below before
+func (s *BoltStore) GetActivity(ctx context.Context, userId int, before int64, limit int) ([]types.ActivityJSON, error) {
+	result := []types.ActivityJSON{}
+	err := s.view("getActivity", func(tx *bolt.Tx) error {
+		cur := tx.Bucket(bucketUserActivity).Cursor()
+		k, v := cur.Last()
+		if before != 0 {
+			k, v = seekBefore(cur, itob(before))
+		}
+		for ; k != nil && len(result) < limit; k, v = cur.Prev() {
+			a := boltUserActivity{}
+			if err := json.Unmarshal(v, &a); err != nil {
+				return err
+			}
+			if a.UserId == userId {
+				result = append(result, a.ActivityJSON)
+			}
+		}
+		return nil
+	})
+	return result, err
+}
+
+// MarkNotificationsRead marks the given notifications of the user read,
+// all of them when ids is empty
+func (s *BoltStore) MarkNotificationsRead(ctx context.Context, userId int, ids []int64) error {
+	return s.update("markNotificationsRead", func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketNotifications)
+		read := map[string][]byte{}
+		err := b.ForEach(func(k, v []byte) error {
+			n := boltNotification{}
+			if err := json.Unmarshal(v, &n); err != nil {
+				return err
+			}
+			if n.UserId != userId || n.Read || (len(ids) > 0 && !slices.Contains(ids, n.Id)) {
+				return nil
+			}
+			n.Read = true
+			data, err := json.Marshal(n)
+			if err != nil {
+				return err
+			}
+			read[string(k)] = data
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		// buckets can't be written while iterating
+		for k, v := range read {
+			if err = b.Put([]byte(k), v); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *BoltStore) CreatePasskey(ctx context.Context, userId int, credential webauthn.Credential) error {
+	return s.update("createPasskey", func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketPasskeys)
+		if b.Get(credential.ID) != nil {
+			return ErrConflict
+		}
+		return put(b, credential.ID, boltPasskey{UserId: userId, Credential: credential})
+	})
+}
+
+func (s *BoltStore) GetPasskeys(ctx context.Context, userId int) ([]webauthn.Credential, error) {
+	result := []webauthn.Credential{}
+	err := s.view("getPasskeys", func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketPasskeys).ForEach(func(k, v []byte) error {
+			p := boltPasskey{}
+			if err := json.Unmarshal(v, &p); err != nil {
+				return err
+			}
+			if p.UserId == userId {
+				result = append(result, p.Credential)
+			}
+			return nil
+		})
+	})
+	return result, err
+}
+
+func (s *BoltStore) UpdatePasskey(ctx context.Context, credential webauthn.Credential) error {
+	return s.update("updatePasskey", func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketPasskeys)
+		p := boltPasskey{}
+		if err := get(b, credential.ID, &p); err != nil {
+			return err
+		}
+		p.Credential = credential
+		return put(b, credential.ID, p)
+	})
+}
+
+func putOutboxEvent(tx *bolt.Tx, eventType string, chatId int, data any) error {
+	djs, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	b := tx.Bucket(bucketOutbox)
+	id, err := nextId(b)
+	if err != nil {
+		return err
+	}
+	return put(b, itob(id), types.OutboxEventJSON{Id: id, Type: eventType, ChatId: chatId, Data: djs, CreatedAt: time.Now().UTC()})
+}
+
+func (s *BoltStore) AddOutboxEvent(ctx context.Context, eventType string, chatId int, data any) error {
+	return s.update("addOutboxEvent", func(tx *bolt.Tx) error {
+		return putOutboxEvent(tx, eventType, chatId, data)
+	})
+}
+
+// DispatchOutbox gives up to limit events after the cursor of the consumer
+// to deliver, oldest first, and moves the cursor to the id it returns. A
+// new consumer starts after the latest event
+func (s *BoltStore) DispatchOutbox(ctx context.Context, consumer string, limit int, deliver func([]types.OutboxEventJSON) int64) error {
+	var cursor int64
+	events := []types.OutboxEventJSON{}
+	err := s.update("dispatchOutbox", func(tx *bolt.Tx) error {
+		consumers := tx.Bucket(bucketOutboxConsumers)
+		err := get(consumers, []byte(consumer), &cursor)
+		if errors.Is(err, ErrNotFound) {
+			if k, _ := tx.Bucket(bucketOutbox).Cursor().Last(); k != nil {
+				cursor = btoi(k)
+			}
+			return put(consumers, []byte(consumer), cursor)
+		}
+		if err != nil {
+			return err
+		}
+		cur := tx.Bucket(bucketOutbox).Cursor()
+		for k, v := cur.Seek(itob(cursor + 1)); k != nil && len(events) < limit; k, v = cur.Next() {
+			event := types.OutboxEventJSON{}
+			if err := json.Unmarshal(v, &event); err != nil {
+				return err
+			}
+			events = append(events, event)
+		}
+		return nil
+	})
+	if err != nil || len(events) == 0 {
+		return err
+	}
+
+	// move cursor past what was delivered
+	last := deliver(events)
+	if last <= cursor {
+		return nil
+	}
+	return s.update("dispatchOutbox", func(tx *bolt.Tx) error {
+		return put(tx.Bucket(bucketOutboxConsumers), []byte(consumer), last)
+	})
+}
+
+// PruneOutbox deletes the events created before the time, delivered or not
+func (s *BoltStore) PruneOutbox(ctx context.Context, before time.Time) error {
+	return s.update("pruneOutbox", func(tx *bolt.Tx) error {
+		_, err := pruneOutbox(tx, before)
+		return err
+	})
+}
+
+func pruneOutbox(tx *bolt.Tx, before time.Time) (int, error) {
+	b := tx.Bucket(bucketOutbox)
+	expired := [][]byte{}
+	cur := b.Cursor()
+	for k, v := cur.First(); k != nil; k, v = cur.Next() {
+		event := types.OutboxEventJSON{}
+		if err := json.Unmarshal(v, &event); err != nil {
+			return 0, err
+		}
+		if !event.CreatedAt.Before(before) {
+			break
+		}
+		expired = append(expired, k)
+	}
+	for _, k := range expired {
+		if err := b.Delete(k); err != nil {
+			return 0, err
+		}
+	}
+	return len(expired), nil
+}
+
+// returned to roll back the transaction of a dry run
+var errDryRun = errors.New("dry run")
+
+// Cleanup deletes what expired under the rules and the images of deleted
+// chats, a dry run does the same and rolls it back
+func (s *BoltStore) Cleanup(ctx context.Context, rules Retention, dryRun bool) (CleanupReport, error) {
+	report := CleanupReport{}
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		var err error
+		if !rules.MessagesBefore.IsZero() {
+			if report.Messages, err = expireMessages(tx, rules.MessagesBefore); err != nil {
+				return err
+			}
+		}
+		if !rules.OutboxBefore.IsZero() {
+			if report.OutboxEvents, err = pruneOutbox(tx, rules.OutboxBefore); err != nil {
+				return err
+			}
+		}
+
+		// images are keyed chat id:kind
+		chats := tx.Bucket(bucketChats)
+		orphaned := func(k, v []byte) (bool, error) {
+			id, _, _ := bytes.Cut(k, []byte(":"))
+			chatId, err := strconv.ParseInt(string(id), 10, 64)
+			if err != nil || chats.Get(itob(chatId)) != nil {
+				return false, nil
+			}
+			report.ChatImages++
+			return true, nil
+		}
+		if err = deleteMatching(tx.Bucket(bucketChatImages), orphaned); err != nil {
+			return err
+		}
+		if dryRun {
+			return errDryRun
+		}
+		return nil
+	})
+	if errors.Is(err, errDryRun) {
+		err = nil
+	}
+	return report, logged("cleanup", err)
+}
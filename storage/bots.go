@@ -0,0 +1,250 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"slices"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"example/gochat/types"
+)
+
+// botEmail fills the email of bots, which have none, the reserved .invalid
+// domain can't receive mail or be registered
+func botEmail(username string) string {
+	return strings.ToLower(username) + "@bots.invalid"
+}
+
+func (s *PostgresStore) createBotTables(ctx context.Context) error {
+	query := `alter table users add column if not exists bot boolean not null default false;
+	create table if not exists api_tokens (
+		id serial primary key,
+		user_id integer not null references users (id) on delete cascade,
+		name varchar(50) not null,
+		scope varchar(20) not null,
+		hash bytea not null unique,
+		created_at timestamp not null default now()
+	);
+	create index if not exists api_tokens_user_idx on api_tokens (user_id)`
+
+	_, err := s.db.ExecContext(ctx, query)
+	return err
+}
+
+// CreateBot creates a bot user, ErrConflict when the username is taken
+func (s *PostgresStore) CreateBot(ctx context.Context, username string) (*types.User, error) {
+	// exec query
+	query := `insert into users
+	(username, email, password, bot, last_announcement, workspace_id)
+	values ($1, $2, '', true, (select coalesce(max(id), 0) from announcements), $3)
+	on conflict do nothing
+	returning id, username, email, role, time_zone, display_name, workspace_id`
+	row := s.db.QueryRowContext(ctx, query, username, botEmail(username), workspaceOf(ctx))
+
+	// scan row, no row means a conflict
+	user := &types.User{Chats: []int{}, Bot: true}
+	if err := row.Scan(&user.Id, &user.Username, &user.Email, &user.Role, &user.TimeZone, &user.DisplayName, &user.WorkspaceId); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrConflict
+		}
+		log.Println("createBot error")
+		return nil, storageError(err)
+	}
+	return user, nil
+}
+
+// CreateAPIToken stores a token of a bot by the sha256 of its secret,
+// ErrNotFound when the user isn't a bot
+func (s *PostgresStore) CreateAPIToken(ctx context.Context, userId int, name string, scope string, hash []byte) (*types.APITokenJSON, error) {
+	// exec query
+	query := `insert into api_tokens (user_id, name, scope, hash)
+	select id, $2, $3, $4 from users where id = $1 and bot
+	returning id, name, scope, created_at`
+	token := &types.APITokenJSON{}
+	if err := s.db.QueryRowContext(ctx, query, userId, name, scope, hash).Scan(&token.Id, &token.Name, &token.Scope, &token.CreatedAt); err != nil {
+		if err = storageError(err); !errors.Is(err, ErrNotFound) {
+			log.Println("createAPIToken error")
+		}
+		return nil, err
+	}
+	token.CreatedAt = token.CreatedAt.UTC()
+	return token, nil
+}
+
+// GetAPITokens returns the tokens of a bot, oldest first
+func (s *PostgresStore) GetAPITokens(ctx context.Context, userId int) ([]types.APITokenJSON, error) {
+	// exec query
+	query := `select id, name, scope, created_at from api_tokens where user_id = $1 order by id`
+	rows, err := s.db.QueryContext(ctx, query, userId)
+	if err != nil {
+		log.Println("getAPITokens query error")
+		return nil, err
+	}
+	defer rows.Close()
+
+	// iterate rows
+	tokens := []types.APITokenJSON{}
+	for rows.Next() {
+		token := types.APITokenJSON{}
+		if err := rows.Scan(&token.Id, &token.Name, &token.Scope, &token.CreatedAt); err != nil {
+			log.Println("getAPITokens scan error")
+			return nil, err
+		}
+		token.CreatedAt = token.CreatedAt.UTC()
+		tokens = append(tokens, token)
+	}
+	if err = rows.Err(); err != nil {
+		log.Println("getAPITokens err error")
+		return nil, err
+	}
+	return tokens, nil
+}
+
+// GetAPIToken returns the user and scope of the token with the hash
+func (s *PostgresStore) GetAPIToken(ctx context.Context, hash []byte) (int, string, error) {
+	// exec query
+	var userId int
+	var scope string
+	query := `select user_id, scope from api_tokens where hash = $1`
+	if err := s.db.QueryRowContext(ctx, query, hash).Scan(&userId, &scope); err != nil {
+		if err = storageError(err); !errors.Is(err, ErrNotFound) {
+			log.Println("getAPIToken error")
+		}
+		return 0, "", err
+	}
+	return userId, scope, nil
+}
+
+// DeleteAPIToken revokes a token of the user
+func (s *PostgresStore) DeleteAPIToken(ctx context.Context, userId int, id int) error {
+	// exec query
+	res, err := s.db.ExecContext(ctx, `delete from api_tokens where id = $1 and user_id = $2`, id, userId)
+	if err != nil {
+		log.Println("deleteAPIToken error")
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// boltAPIToken is kept under the hash of its secret
+type boltAPIToken struct {
+	Id        int       `json:"id"`
+	UserId    int       `json:"userId"`
+	Name      string    `json:"name"`
+	Scope     string    `json:"scope"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+func (t boltAPIToken) toJSON() types.APITokenJSON {
+	return types.APITokenJSON{Id: t.Id, Name: t.Name, Scope: t.Scope, CreatedAt: t.CreatedAt}
+}
+
+func (s *BoltStore) CreateBot(ctx context.Context, username string) (*types.User, error) {
+	var user *types.User
+	err := s.update("createBot", func(tx *bolt.Tx) error {
+		email := botEmail(username)
+		emails, usernames := tx.Bucket(bucketEmails), tx.Bucket(bucketUsernames)
+		if emails.Get(fold(email)) != nil || usernames.Get(fold(username)) != nil {
+			return ErrConflict
+		}
+		users := tx.Bucket(bucketUsers)
+		id, err := nextId(users)
+		if err != nil {
+			return err
+		}
+
+		// like new users, bots don't see older announcements
+		last := 0
+		if k, _ := tx.Bucket(bucketAnnouncements).Cursor().Last(); k != nil {
+			last = int(btoi(k))
+		}
+		u := &boltUser{Id: int(id), Username: username, Email: email, Chats: []int{}, Role: types.RoleUser, TimeZone: "UTC", LastAnnouncement: last, Bot: true, WorkspaceId: workspaceOf(ctx)}
+		if err = put(users, itob(id), u); err != nil {
+			return err
+		}
+		user = u.user()
+		if err = usernames.Put(fold(username), itob(id)); err != nil {
+			return err
+		}
+		return emails.Put(fold(email), itob(id))
+	})
+	return user, err
+}
+
+func (s *BoltStore) CreateAPIToken(ctx context.Context, userId int, name string, scope string, hash []byte) (*types.APITokenJSON, error) {
+	var token types.APITokenJSON
+	err := s.update("createAPIToken", func(tx *bolt.Tx) error {
+		u, err := getUser(tx, userId)
+		if err != nil {
+			return err
+		}
+		if !u.Bot {
+			return ErrNotFound
+		}
+		b := tx.Bucket(bucketAPITokens)
+		id, err := nextId(b)
+		if err != nil {
+			return err
+		}
+		t := boltAPIToken{Id: int(id), UserId: userId, Name: name, Scope: scope, CreatedAt: time.Now().UTC()}
+		token = t.toJSON()
+		return put(b, hash, t)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &token, nil
+}
+
+func (s *BoltStore) GetAPITokens(ctx context.Context, userId int) ([]types.APITokenJSON, error) {
+	tokens := []types.APITokenJSON{}
+	err := s.view("getAPITokens", func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketAPITokens).ForEach(func(k, v []byte) error {
+			t := boltAPIToken{}
+			if err := json.Unmarshal(v, &t); err != nil {
+				return err
+			}
+			if t.UserId == userId {
+				tokens = append(tokens, t.toJSON())
+			}
+			return nil
+		})
+	})
+	// keys are hashes, ids give the order
+	slices.SortFunc(tokens, func(a, b types.APITokenJSON) int { return a.Id - b.Id })
+	return tokens, err
+}
+
+func (s *BoltStore) GetAPIToken(ctx context.Context, hash []byte) (int, string, error) {
+	t := boltAPIToken{}
+	err := s.view("getAPIToken", func(tx *bolt.Tx) error {
+		return get(tx.Bucket(bucketAPITokens), hash, &t)
+	})
+	return t.UserId, t.Scope, err
+}
+
+func (s *BoltStore) DeleteAPIToken(ctx context.Context, userId int, id int) error {
+	return s.update("deleteAPIToken", func(tx *bolt.Tx) error {
+		found := false
+		err := deleteMatching(tx.Bucket(bucketAPITokens), func(k, v []byte) (bool, error) {
+			t := boltAPIToken{}
+			err := json.Unmarshal(v, &t)
+			match := t.Id == id && t.UserId == userId
+			found = found || match
+			return match, err
+		})
+		if err == nil && !found {
+			return ErrNotFound
+		}
+		return err
+	})
+}
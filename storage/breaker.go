@@ -0,0 +1,601 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/go-webauthn/webauthn/webauthn"
+
+	"example/gochat/types"
+)
+
+var ErrCircuitOpen = errors.New("storage unavailable: circuit open")
+
+// Breaker stops calling the database after repeated failures and probes
+// it in the background until it answers again
+type Breaker struct {
+	mu        sync.Mutex
+	failures  int
+	threshold int
+	open      bool
+	interval  time.Duration
+	probe     func(context.Context) error
+}
+
+func NewBreaker(threshold int, interval time.Duration, probe func(context.Context) error) *Breaker {
+	return &Breaker{
+		threshold: threshold,
+		interval:  interval,
+		probe:     probe,
+	}
+}
+
+// Interval is how often the database is probed while the circuit is open
+func (b *Breaker) Interval() time.Duration {
+	return b.interval
+}
+
+// Open reports whether calls are currently being rejected
+func (b *Breaker) Open() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.open
+}
+
+func (b *Breaker) do(f func() error) error {
+	if b.Open() {
+		return ErrCircuitOpen
+	}
+	err := f()
+	b.record(err)
+	return err
+}
+
+func call[T any](b *Breaker, f func() (T, error)) (T, error) {
+	var result T
+	err := b.do(func() error {
+		var err error
+		result, err = f()
+		return err
+	})
+	return result, err
+}
+
+// record counts consecutive failures, lookups that find nothing and
+// requests cancelled by the client don't count
+func (b *Breaker) record(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if err == nil || errors.Is(err, ErrNotFound) || errors.Is(err, ErrConflict) || errors.Is(err, ErrLimit) || errors.Is(err, context.Canceled) {
+		b.failures = 0
+		return
+	}
+
+	b.failures++
+	if b.failures >= b.threshold && !b.open {
+		b.open = true
+		log.Printf("storage circuit open after %d failures: %v", b.failures, err)
+		go b.probeUntilClosed()
+	}
+}
+
+func (b *Breaker) probeUntilClosed() {
+	ticker := time.NewTicker(b.interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		ctx, cancel := context.WithTimeout(context.Background(), b.interval)
+		err := b.probe(ctx)
+		cancel()
+		if err != nil {
+			continue
+		}
+
+		b.mu.Lock()
+		b.open = false
+		b.failures = 0
+		b.mu.Unlock()
+		log.Println("storage circuit closed")
+		return
+	}
+}
+
+// BreakerStore guards every Storage call with a Breaker
+type BreakerStore struct {
+	Storage
+	breaker *Breaker
+}
+
+func NewBreakerStore(store Storage, breaker *Breaker) *BreakerStore {
+	return &BreakerStore{
+		Storage: store,
+		breaker: breaker,
+	}
+}
+
+func (s *BreakerStore) Breaker() *Breaker {
+	return s.breaker
+}
+
+func (s *BreakerStore) CreateUser(ctx context.Context, username string, email string, password string) (*types.User, error) {
+	return call(s.breaker, func() (*types.User, error) { return s.Storage.CreateUser(ctx, username, email, password) })
+}
+
+func (s *BreakerStore) GetUserById(ctx context.Context, id int) (*types.User, error) {
+	return call(s.breaker, func() (*types.User, error) { return s.Storage.GetUserById(ctx, id) })
+}
+
+func (s *BreakerStore) GetUserByEmail(ctx context.Context, email string) (*types.User, error) {
+	return call(s.breaker, func() (*types.User, error) { return s.Storage.GetUserByEmail(ctx, email) })
+}
+
+func (s *BreakerStore) GetUsers(ctx context.Context, arr []int) ([]types.User, error) {
+	return call(s.breaker, func() ([]types.User, error) { return s.Storage.GetUsers(ctx, arr) })
+}
+
+func (s *BreakerStore) GetAuthors(ctx context.Context, arr []int) (map[int]types.AuthorJSON, error) {
+	return call(s.breaker, func() (map[int]types.AuthorJSON, error) { return s.Storage.GetAuthors(ctx, arr) })
+}
+
+func (s *BreakerStore) TouchLastSeen(ctx context.Context, id int, at time.Time) error {
+	return s.breaker.do(func() error { return s.Storage.TouchLastSeen(ctx, id, at) })
+}
+
+func (s *BreakerStore) SetShowLastSeen(ctx context.Context, id int, show bool) error {
+	return s.breaker.do(func() error { return s.Storage.SetShowLastSeen(ctx, id, show) })
+}
+
+func (s *BreakerStore) GetProfile(ctx context.Context, id int) (*types.ProfileJSON, error) {
+	return call(s.breaker, func() (*types.ProfileJSON, error) { return s.Storage.GetProfile(ctx, id) })
+}
+
+func (s *BreakerStore) SetProfile(ctx context.Context, id int, profile types.ProfileRequest) error {
+	return s.breaker.do(func() error { return s.Storage.SetProfile(ctx, id, profile) })
+}
+
+func (s *BreakerStore) UpdateUserRole(ctx context.Context, id int, role string) error {
+	return s.breaker.do(func() error { return s.Storage.UpdateUserRole(ctx, id, role) })
+}
+
+func (s *BreakerStore) SetRoleByEmail(ctx context.Context, emails []string, role string) error {
+	return s.breaker.do(func() error { return s.Storage.SetRoleByEmail(ctx, emails, role) })
+}
+
+func (s *BreakerStore) ListUsers(ctx context.Context, q string, after int, limit int) ([]types.User, int, error) {
+	var total int
+	users, err := call(s.breaker, func() ([]types.User, error) {
+		users, n, err := s.Storage.ListUsers(ctx, q, after, limit)
+		total = n
+		return users, err
+	})
+	return users, total, err
+}
+
+func (s *BreakerStore) SetUserDisabled(ctx context.Context, id int, disabled bool) error {
+	return s.breaker.do(func() error { return s.Storage.SetUserDisabled(ctx, id, disabled) })
+}
+
+func (s *BreakerStore) SetPassword(ctx context.Context, id int, password string) error {
+	return s.breaker.do(func() error { return s.Storage.SetPassword(ctx, id, password) })
+}
+
+func (s *BreakerStore) DeleteUser(ctx context.Context, id int) error {
+	return s.breaker.do(func() error { return s.Storage.DeleteUser(ctx, id) })
+}
+
+func (s *BreakerStore) CreateChat(ctx context.Context, newChat types.Chat, user types.User) (*types.Chat, error) {
+	return call(s.breaker, func() (*types.Chat, error) { return s.Storage.CreateChat(ctx, newChat, user) })
+}
+
+func (s *BreakerStore) GetChatById(ctx context.Context, id int) (*types.Chat, error) {
+	return call(s.breaker, func() (*types.Chat, error) { return s.Storage.GetChatById(ctx, id) })
+}
+
+func (s *BreakerStore) GetChats(ctx context.Context, arr []int) ([]types.Chat, error) {
+	return call(s.breaker, func() ([]types.Chat, error) { return s.Storage.GetChats(ctx, arr) })
+}
+
+func (s *BreakerStore) GetChatSummaries(ctx context.Context, userId int, arr []int) ([]types.ChatSummaryJSON, error) {
+	return call(s.breaker, func() ([]types.ChatSummaryJSON, error) { return s.Storage.GetChatSummaries(ctx, userId, arr) })
+}
+
+func (s *BreakerStore) GetUserChats(ctx context.Context, userId int, sort string, offset int, limit int) ([]types.ChatSummaryJSON, error) {
+	return call(s.breaker, func() ([]types.ChatSummaryJSON, error) {
+		return s.Storage.GetUserChats(ctx, userId, sort, offset, limit)
+	})
+}
+
+func (s *BreakerStore) GetReadMarker(ctx context.Context, userId int, chatId int) (int64, error) {
+	return call(s.breaker, func() (int64, error) { return s.Storage.GetReadMarker(ctx, userId, chatId) })
+}
+
+func (s *BreakerStore) SetReadMarker(ctx context.Context, userId int, chatId int, messageId int64) error {
+	return s.breaker.do(func() error { return s.Storage.SetReadMarker(ctx, userId, chatId, messageId) })
+}
+
+func (s *BreakerStore) DispatchOutbox(ctx context.Context, consumer string, limit int, deliver func([]types.OutboxEventJSON) int64) error {
+	return s.breaker.do(func() error { return s.Storage.DispatchOutbox(ctx, consumer, limit, deliver) })
+}
+
+// errors of fn are the caller's and don't count as failures
+func (s *BreakerStore) ExportMessages(ctx context.Context, chatId int, fn func(types.MessageJSON) error) error {
+	var fnErr error
+	err := s.breaker.do(func() error {
+		err := s.Storage.ExportMessages(ctx, chatId, func(m types.MessageJSON) error {
+			fnErr = fn(m)
+			return fnErr
+		})
+		if fnErr != nil {
+			return nil
+		}
+		return err
+	})
+	if fnErr != nil {
+		return fnErr
+	}
+	return err
+}
+
+func (s *BreakerStore) PruneOutbox(ctx context.Context, before time.Time) error {
+	return s.breaker.do(func() error { return s.Storage.PruneOutbox(ctx, before) })
+}
+
+func (s *BreakerStore) MarkAllRead(ctx context.Context, userId int, chatIds []int) ([]types.ReadMarkerJSON, error) {
+	return call(s.breaker, func() ([]types.ReadMarkerJSON, error) { return s.Storage.MarkAllRead(ctx, userId, chatIds) })
+}
+
+func (s *BreakerStore) MarkRead(ctx context.Context, userId int, messageId int64) error {
+	return s.breaker.do(func() error { return s.Storage.MarkRead(ctx, userId, messageId) })
+}
+
+func (s *BreakerStore) AddMember(ctx context.Context, chatId int, userId int) error {
+	return s.breaker.do(func() error { return s.Storage.AddMember(ctx, chatId, userId) })
+}
+
+func (s *BreakerStore) RemoveMember(ctx context.Context, chatId int, userId int) error {
+	return s.breaker.do(func() error { return s.Storage.RemoveMember(ctx, chatId, userId) })
+}
+
+func (s *BreakerStore) SetChatInfo(ctx context.Context, id int, name string, topic string) error {
+	return s.breaker.do(func() error { return s.Storage.SetChatInfo(ctx, id, name, topic) })
+}
+
+func (s *BreakerStore) SetChatImage(ctx context.Context, chatId int, kind string, data []byte, at time.Time) error {
+	return s.breaker.do(func() error { return s.Storage.SetChatImage(ctx, chatId, kind, data, at) })
+}
+
+func (s *BreakerStore) GetChatImage(ctx context.Context, chatId int, kind string) ([]byte, time.Time, error) {
+	var updatedAt time.Time
+	data, err := call(s.breaker, func() ([]byte, error) {
+		data, t, err := s.Storage.GetChatImage(ctx, chatId, kind)
+		updatedAt = t
+		return data, err
+	})
+	return data, updatedAt, err
+}
+
+func (s *BreakerStore) DeleteChatImage(ctx context.Context, chatId int, kind string) error {
+	return s.breaker.do(func() error { return s.Storage.DeleteChatImage(ctx, chatId, kind) })
+}
+
+func (s *BreakerStore) SearchMessages(ctx context.Context, search MessageSearch) ([]types.MessageJSON, error) {
+	return call(s.breaker, func() ([]types.MessageJSON, error) { return s.Storage.SearchMessages(ctx, search) })
+}
+
+func (s *BreakerStore) SetChatWelcome(ctx context.Context, id int, text string) error {
+	return s.breaker.do(func() error { return s.Storage.SetChatWelcome(ctx, id, text) })
+}
+
+func (s *BreakerStore) DeleteChat(ctx context.Context, id int) error {
+	return s.breaker.do(func() error { return s.Storage.DeleteChat(ctx, id) })
+}
+
+func (s *BreakerStore) SearchChats(ctx context.Context, q string, chats []int, limit int) ([]types.ChatInfoJSON, error) {
+	return call(s.breaker, func() ([]types.ChatInfoJSON, error) { return s.Storage.SearchChats(ctx, q, chats, limit) })
+}
+
+func (s *BreakerStore) UpdateChatActivity(ctx context.Context, since time.Time) error {
+	return s.breaker.do(func() error { return s.Storage.UpdateChatActivity(ctx, since) })
+}
+
+func (s *BreakerStore) GetTrendingChats(ctx context.Context, limit int) ([]types.TrendingChatJSON, error) {
+	return call(s.breaker, func() ([]types.TrendingChatJSON, error) { return s.Storage.GetTrendingChats(ctx, limit) })
+}
+
+func (s *BreakerStore) SetChatTags(ctx context.Context, id int, category string, tags []string) error {
+	return s.breaker.do(func() error { return s.Storage.SetChatTags(ctx, id, category, tags) })
+}
+
+func (s *BreakerStore) GetPublicChats(ctx context.Context, tag string, category string, before int, limit int) ([]types.ChatInfoJSON, int, error) {
+	var total int
+	chats, err := call(s.breaker, func() ([]types.ChatInfoJSON, error) {
+		chats, n, err := s.Storage.GetPublicChats(ctx, tag, category, before, limit)
+		total = n
+		return chats, err
+	})
+	return chats, total, err
+}
+
+func (s *BreakerStore) GetMemberRole(ctx context.Context, chatId int, userId int) (string, error) {
+	return call(s.breaker, func() (string, error) { return s.Storage.GetMemberRole(ctx, chatId, userId) })
+}
+
+func (s *BreakerStore) GetMembers(ctx context.Context, chatId int, after int, limit int) ([]types.MemberJSON, int, error) {
+	var total int
+	members, err := call(s.breaker, func() ([]types.MemberJSON, error) {
+		members, n, err := s.Storage.GetMembers(ctx, chatId, after, limit)
+		total = n
+		return members, err
+	})
+	return members, total, err
+}
+
+func (s *BreakerStore) SetMemberRole(ctx context.Context, chatId int, userId int, role string) error {
+	return s.breaker.do(func() error { return s.Storage.SetMemberRole(ctx, chatId, userId, role) })
+}
+
+func (s *BreakerStore) SetChatAnnouncement(ctx context.Context, id int, announcement bool) error {
+	return s.breaker.do(func() error { return s.Storage.SetChatAnnouncement(ctx, id, announcement) })
+}
+
+func (s *BreakerStore) SetChatVisibility(ctx context.Context, id int, visibility string) error {
+	return s.breaker.do(func() error { return s.Storage.SetChatVisibility(ctx, id, visibility) })
+}
+
+func (s *BreakerStore) AddMessage(ctx context.Context, message types.MessageJSON) (int64, error) {
+	return call(s.breaker, func() (int64, error) { return s.Storage.AddMessage(ctx, message) })
+}
+
+func (s *BreakerStore) EditMessage(ctx context.Context, chatId int, messageId int64, authorId int, text string, at time.Time) (*types.MessageJSON, error) {
+	return call(s.breaker, func() (*types.MessageJSON, error) {
+		return s.Storage.EditMessage(ctx, chatId, messageId, authorId, text, at)
+	})
+}
+
+func (s *BreakerStore) GetMessageHistory(ctx context.Context, chatId int, messageId int64) ([]types.MessageEditJSON, error) {
+	return call(s.breaker, func() ([]types.MessageEditJSON, error) { return s.Storage.GetMessageHistory(ctx, chatId, messageId) })
+}
+
+func (s *BreakerStore) AddReaction(ctx context.Context, chatId int, messageId int64, userId int, emoji string) error {
+	return s.breaker.do(func() error { return s.Storage.AddReaction(ctx, chatId, messageId, userId, emoji) })
+}
+
+func (s *BreakerStore) RemoveReaction(ctx context.Context, chatId int, messageId int64, userId int, emoji string) error {
+	return s.breaker.do(func() error { return s.Storage.RemoveReaction(ctx, chatId, messageId, userId, emoji) })
+}
+
+func (s *BreakerStore) GetReactionSummary(ctx context.Context, chatId int, messageId int64, userId int) ([]types.ReactionJSON, error) {
+	return call(s.breaker, func() ([]types.ReactionJSON, error) {
+		return s.Storage.GetReactionSummary(ctx, chatId, messageId, userId)
+	})
+}
+
+func (s *BreakerStore) GetReactionUsers(ctx context.Context, chatId int, messageId int64, emoji string, after int, limit int) ([]types.AuthorJSON, error) {
+	return call(s.breaker, func() ([]types.AuthorJSON, error) {
+		return s.Storage.GetReactionUsers(ctx, chatId, messageId, emoji, after, limit)
+	})
+}
+
+func (s *BreakerStore) CreateBookmark(ctx context.Context, userId int, chatId int, messageId int64) error {
+	return s.breaker.do(func() error { return s.Storage.CreateBookmark(ctx, userId, chatId, messageId) })
+}
+
+func (s *BreakerStore) DeleteBookmark(ctx context.Context, userId int, messageId int64) error {
+	return s.breaker.do(func() error { return s.Storage.DeleteBookmark(ctx, userId, messageId) })
+}
+
+func (s *BreakerStore) GetBookmarks(ctx context.Context, userId int, chats []int, before int64, limit int) ([]types.BookmarkJSON, error) {
+	return call(s.breaker, func() ([]types.BookmarkJSON, error) {
+		return s.Storage.GetBookmarks(ctx, userId, chats, before, limit)
+	})
+}
+
+func (s *BreakerStore) CreateReceipts(ctx context.Context, message types.MessageJSON, usersId []int) error {
+	return s.breaker.do(func() error { return s.Storage.CreateReceipts(ctx, message, usersId) })
+}
+
+func (s *BreakerStore) UpdateReceipt(ctx context.Context, messageId int64, userId int, status string) (int, error) {
+	return call(s.breaker, func() (int, error) { return s.Storage.UpdateReceipt(ctx, messageId, userId, status) })
+}
+
+func (s *BreakerStore) GetReceipts(ctx context.Context, messagesId []int64) ([]types.ReceiptJSON, error) {
+	return call(s.breaker, func() ([]types.ReceiptJSON, error) { return s.Storage.GetReceipts(ctx, messagesId) })
+}
+
+func (s *BreakerStore) MaintainMessages(ctx context.Context, now time.Time, retention time.Duration) error {
+	return s.breaker.do(func() error { return s.Storage.MaintainMessages(ctx, now, retention) })
+}
+
+func (s *BreakerStore) PurgeMessages(ctx context.Context, chatId int, before time.Time, limit int) (int, error) {
+	return call(s.breaker, func() (int, error) { return s.Storage.PurgeMessages(ctx, chatId, before, limit) })
+}
+
+func (s *BreakerStore) GetStats(ctx context.Context) (*types.StatsJSON, error) {
+	return call(s.breaker, func() (*types.StatsJSON, error) { return s.Storage.GetStats(ctx) })
+}
+
+func (s *BreakerStore) CreateAnnouncement(ctx context.Context, text string) (*types.AnnouncementJSON, error) {
+	return call(s.breaker, func() (*types.AnnouncementJSON, error) { return s.Storage.CreateAnnouncement(ctx, text) })
+}
+
+func (s *BreakerStore) GetUnseenAnnouncements(ctx context.Context, userId int) ([]types.AnnouncementJSON, error) {
+	return call(s.breaker, func() ([]types.AnnouncementJSON, error) { return s.Storage.GetUnseenAnnouncements(ctx, userId) })
+}
+
+func (s *BreakerStore) MarkAnnouncementSeen(ctx context.Context, usersId []int, id int) error {
+	return s.breaker.do(func() error { return s.Storage.MarkAnnouncementSeen(ctx, usersId, id) })
+}
+
+func (s *BreakerStore) CreateChange(ctx context.Context, chatId int, userId int, changeType string, data any) (int64, error) {
+	return call(s.breaker, func() (int64, error) { return s.Storage.CreateChange(ctx, chatId, userId, changeType, data) })
+}
+
+func (s *BreakerStore) GetChanges(ctx context.Context, userId int, chats []int, since int64, limit int) ([]types.ChangeJSON, error) {
+	return call(s.breaker, func() ([]types.ChangeJSON, error) { return s.Storage.GetChanges(ctx, userId, chats, since, limit) })
+}
+
+func (s *BreakerStore) GetDeviceCursor(ctx context.Context, userId int, device string) (int64, error) {
+	return call(s.breaker, func() (int64, error) { return s.Storage.GetDeviceCursor(ctx, userId, device) })
+}
+
+func (s *BreakerStore) UpdateDeviceCursor(ctx context.Context, userId int, device string, cursor int64) error {
+	return s.breaker.do(func() error { return s.Storage.UpdateDeviceCursor(ctx, userId, device, cursor) })
+}
+
+func (s *BreakerStore) CreatePushToken(ctx context.Context, userId int, token string, platform string) error {
+	return s.breaker.do(func() error { return s.Storage.CreatePushToken(ctx, userId, token, platform) })
+}
+
+func (s *BreakerStore) DeletePushToken(ctx context.Context, userId int, token string) error {
+	return s.breaker.do(func() error { return s.Storage.DeletePushToken(ctx, userId, token) })
+}
+
+func (s *BreakerStore) GetPushTokens(ctx context.Context, usersId []int, chatId int) ([]types.PushToken, error) {
+	return call(s.breaker, func() ([]types.PushToken, error) { return s.Storage.GetPushTokens(ctx, usersId, chatId) })
+}
+
+func (s *BreakerStore) SetChatMuted(ctx context.Context, userId int, chatId int, muted bool) error {
+	return s.breaker.do(func() error { return s.Storage.SetChatMuted(ctx, userId, chatId, muted) })
+}
+
+func (s *BreakerStore) GetPreferences(ctx context.Context, usersId []int) (map[int]types.PreferencesJSON, error) {
+	return call(s.breaker, func() (map[int]types.PreferencesJSON, error) { return s.Storage.GetPreferences(ctx, usersId) })
+}
+
+func (s *BreakerStore) SetPreferences(ctx context.Context, userId int, p types.PreferencesJSON) error {
+	return s.breaker.do(func() error { return s.Storage.SetPreferences(ctx, userId, p) })
+}
+
+func (s *BreakerStore) GetSettings(ctx context.Context, userId int) (map[string]json.RawMessage, error) {
+	return call(s.breaker, func() (map[string]json.RawMessage, error) { return s.Storage.GetSettings(ctx, userId) })
+}
+
+func (s *BreakerStore) UpdateSettings(ctx context.Context, userId int, patch map[string]json.RawMessage, maxKeys int) (map[string]json.RawMessage, error) {
+	return call(s.breaker, func() (map[string]json.RawMessage, error) {
+		return s.Storage.UpdateSettings(ctx, userId, patch, maxKeys)
+	})
+}
+
+func (s *BreakerStore) CreateNotifications(ctx context.Context, usersId []int, notificationType string, chatId int, data any) error {
+	return s.breaker.do(func() error { return s.Storage.CreateNotifications(ctx, usersId, notificationType, chatId, data) })
+}
+
+func (s *BreakerStore) AddActivity(ctx context.Context, usersId []int, activityType string, chatId int, data any) error {
+	return s.breaker.do(func() error { return s.Storage.AddActivity(ctx, usersId, activityType, chatId, data) })
+}
+
+func (s *BreakerStore) GetActivity(ctx context.Context, userId int, before int64, limit int) ([]types.ActivityJSON, error) {
+	return call(s.breaker, func() ([]types.ActivityJSON, error) { return s.Storage.GetActivity(ctx, userId, before, limit) })
+}
+
+func (s *BreakerStore) AddAuditEntry(ctx context.Context, actor types.AuthorJSON, action string, chatId int, data any) error {
+	return s.breaker.do(func() error { return s.Storage.AddAuditEntry(ctx, actor, action, chatId, data) })
+}
+
+func (s *BreakerStore) GetAuditLog(ctx context.Context, before int64, limit int) ([]types.AuditEntryJSON, error) {
+	return call(s.breaker, func() ([]types.AuditEntryJSON, error) { return s.Storage.GetAuditLog(ctx, before, limit) })
+}
+
+func (s *BreakerStore) GetNotifications(ctx context.Context, userId int, unreadOnly bool, before int64, limit int) ([]types.NotificationJSON, error) {
+	return call(s.breaker, func() ([]types.NotificationJSON, error) {
+		return s.Storage.GetNotifications(ctx, userId, unreadOnly, before, limit)
+	})
+}
+
+func (s *BreakerStore) MarkNotificationsRead(ctx context.Context, userId int, ids []int64) error {
+	return s.breaker.do(func() error { return s.Storage.MarkNotificationsRead(ctx, userId, ids) })
+}
+
+func (s *BreakerStore) CreatePasskey(ctx context.Context, userId int, credential webauthn.Credential) error {
+	return s.breaker.do(func() error { return s.Storage.CreatePasskey(ctx, userId, credential) })
+}
+
+func (s *BreakerStore) GetPasskeys(ctx context.Context, userId int) ([]webauthn.Credential, error) {
+	return call(s.breaker, func() ([]webauthn.Credential, error) { return s.Storage.GetPasskeys(ctx, userId) })
+}
+
+func (s *BreakerStore) UpdatePasskey(ctx context.Context, credential webauthn.Credential) error {
+	return s.breaker.do(func() error { return s.Storage.UpdatePasskey(ctx, credential) })
+}
+
+func (s *BreakerStore) GetIdentityUser(ctx context.Context, issuer string, subject string) (int, error) {
+	return call(s.breaker, func() (int, error) { return s.Storage.GetIdentityUser(ctx, issuer, subject) })
+}
+
+func (s *BreakerStore) LinkIdentity(ctx context.Context, issuer string, subject string, userId int) error {
+	return s.breaker.do(func() error { return s.Storage.LinkIdentity(ctx, issuer, subject, userId) })
+}
+
+func (s *BreakerStore) CreateBot(ctx context.Context, username string) (*types.User, error) {
+	return call(s.breaker, func() (*types.User, error) { return s.Storage.CreateBot(ctx, username) })
+}
+
+func (s *BreakerStore) CreateAPIToken(ctx context.Context, userId int, name string, scope string, hash []byte) (*types.APITokenJSON, error) {
+	return call(s.breaker, func() (*types.APITokenJSON, error) { return s.Storage.CreateAPIToken(ctx, userId, name, scope, hash) })
+}
+
+func (s *BreakerStore) GetAPITokens(ctx context.Context, userId int) ([]types.APITokenJSON, error) {
+	return call(s.breaker, func() ([]types.APITokenJSON, error) { return s.Storage.GetAPITokens(ctx, userId) })
+}
+
+func (s *BreakerStore) GetAPIToken(ctx context.Context, hash []byte) (int, string, error) {
+	var scope string
+	userId, err := call(s.breaker, func() (int, error) {
+		userId, sc, err := s.Storage.GetAPIToken(ctx, hash)
+		scope = sc
+		return userId, err
+	})
+	return userId, scope, err
+}
+
+func (s *BreakerStore) DeleteAPIToken(ctx context.Context, userId int, id int) error {
+	return s.breaker.do(func() error { return s.Storage.DeleteAPIToken(ctx, userId, id) })
+}
+
+func (s *BreakerStore) CreateResponder(ctx context.Context, responder types.ResponderJSON) (*types.ResponderJSON, error) {
+	return call(s.breaker, func() (*types.ResponderJSON, error) { return s.Storage.CreateResponder(ctx, responder) })
+}
+
+func (s *BreakerStore) GetResponders(ctx context.Context, chatId int) ([]types.ResponderJSON, error) {
+	return call(s.breaker, func() ([]types.ResponderJSON, error) { return s.Storage.GetResponders(ctx, chatId) })
+}
+
+func (s *BreakerStore) DeleteResponder(ctx context.Context, chatId int, id int) error {
+	return s.breaker.do(func() error { return s.Storage.DeleteResponder(ctx, chatId, id) })
+}
+
+func (s *BreakerStore) CreateWorkspace(ctx context.Context, name string, slug string) (*types.WorkspaceJSON, error) {
+	return call(s.breaker, func() (*types.WorkspaceJSON, error) { return s.Storage.CreateWorkspace(ctx, name, slug) })
+}
+
+func (s *BreakerStore) GetWorkspaces(ctx context.Context) ([]types.WorkspaceJSON, error) {
+	return call(s.breaker, func() ([]types.WorkspaceJSON, error) { return s.Storage.GetWorkspaces(ctx) })
+}
+
+func (s *BreakerStore) GetWorkspaceBySlug(ctx context.Context, slug string) (*types.WorkspaceJSON, error) {
+	return call(s.breaker, func() (*types.WorkspaceJSON, error) { return s.Storage.GetWorkspaceBySlug(ctx, slug) })
+}
+
+func (s *BreakerStore) GetUserWorkspace(ctx context.Context, userId int) (int, error) {
+	return call(s.breaker, func() (int, error) { return s.Storage.GetUserWorkspace(ctx, userId) })
+}
+
+func (s *BreakerStore) GetChatWorkspace(ctx context.Context, chatId int) (int, error) {
+	return call(s.breaker, func() (int, error) { return s.Storage.GetChatWorkspace(ctx, chatId) })
+}
+
+func (s *BreakerStore) SetWorkspaceQuota(ctx context.Context, id int, quota types.WorkspaceQuotaJSON) error {
+	return s.breaker.do(func() error { return s.Storage.SetWorkspaceQuota(ctx, id, quota) })
+}
+
+func (s *BreakerStore) GetWorkspaceUsage(ctx context.Context, id int, month time.Time) (*types.WorkspaceUsageJSON, error) {
+	return call(s.breaker, func() (*types.WorkspaceUsageJSON, error) { return s.Storage.GetWorkspaceUsage(ctx, id, month) })
+}
+
+func (s *BreakerStore) AddOutboxEvent(ctx context.Context, eventType string, chatId int, data any) error {
+	return s.breaker.do(func() error { return s.Storage.AddOutboxEvent(ctx, eventType, chatId, data) })
+}
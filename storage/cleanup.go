@@ -0,0 +1,92 @@
+package storage
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// Retention tells Cleanup what expired, a zero time keeps everything of
+// that kind
+type Retention struct {
+	// messages sent before, with their reactions, edits, receipts and
+	// bookmarks
+	MessagesBefore time.Time
+	// outbox events created before, delivered or not
+	OutboxBefore time.Time
+}
+
+// CleanupReport counts what Cleanup deleted, or would delete on a dry run
+type CleanupReport struct {
+	Messages     int
+	OutboxEvents int
+	// images left behind by chats that no longer exist
+	ChatImages int
+}
+
+// Cleanup deletes what expired under the rules and the images of deleted
+// chats in one transaction, a dry run only counts them. Messages are
+// deleted one by one, unlike the monthly partitions MaintainMessages drops
+func (s *PostgresStore) Cleanup(ctx context.Context, rules Retention, dryRun bool) (CleanupReport, error) {
+	report := CleanupReport{}
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		log.Println("cleanup begin error")
+		return report, err
+	}
+	defer tx.Rollback()
+
+	// count the rows of the condition, or delete them
+	run := func(n *int, table string, where string, args ...any) error {
+		if dryRun {
+			return tx.QueryRowContext(ctx, `select count(*) from `+table+` where `+where, args...).Scan(n)
+		}
+		res, err := tx.ExecContext(ctx, `delete from `+table+` where `+where, args...)
+		if err != nil {
+			return err
+		}
+		affected, err := res.RowsAffected()
+		*n = int(affected)
+		return err
+	}
+
+	// messages
+	if !rules.MessagesBefore.IsZero() {
+		before := rules.MessagesBefore.UTC()
+		if !dryRun {
+			for _, table := range []string{"message_edits", "message_reactions", "message_receipts", "bookmarks"} {
+				query := `delete from ` + table + ` where message_id in (select id from messages where created_at < $1)`
+				if _, err = tx.ExecContext(ctx, query, before); err != nil {
+					log.Println("cleanup messages error")
+					return report, err
+				}
+			}
+			if err = uncountMessages(ctx, tx, "messages", "created_at < $1", before); err != nil {
+				log.Println("cleanup messages error")
+				return report, err
+			}
+		}
+		if err = run(&report.Messages, "messages", "created_at < $1", before); err != nil {
+			log.Println("cleanup messages error")
+			return report, err
+		}
+	}
+
+	// outbox
+	if !rules.OutboxBefore.IsZero() {
+		if err = run(&report.OutboxEvents, "outbox", "created_at < $1", rules.OutboxBefore.UTC()); err != nil {
+			log.Println("cleanup outbox error")
+			return report, err
+		}
+	}
+
+	// images, the foreign key should leave none
+	if err = run(&report.ChatImages, "chat_images", "not exists (select 1 from chat where chat.id = chat_images.chat_id)"); err != nil {
+		log.Println("cleanup images error")
+		return report, err
+	}
+	if dryRun {
+		return report, nil
+	}
+	return report, tx.Commit()
+}
@@ -0,0 +1,74 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"strconv"
+
+	"example/gochat/types"
+)
+
+// addChatCounterColumns keeps the message count and the time of the last
+// message on the chat, so chat lists and stats don't count messages
+func (s *PostgresStore) addChatCounterColumns(ctx context.Context) error {
+	query := `alter table chat add column if not exists message_count integer;
+	alter table chat add column if not exists last_message_at timestamp;
+	update chat c set message_count = (select count(*) from messages where chat_id = c.id),
+		last_message_at = (select max(created_at) from messages where chat_id = c.id)
+	where message_count is null;
+	alter table chat alter column message_count set default 0, alter column message_count set not null`
+
+	_, err := s.db.ExecContext(ctx, query)
+	return err
+}
+
+// excerpt is types.Excerpt of the text column
+var excerpt = `case when char_length(btrim(regexp_replace(text, '\s+', ' ', 'g'))) > ` + strconv.Itoa(types.MaxExcerpt) + `
+	then rtrim(left(btrim(regexp_replace(text, '\s+', ' ', 'g')), ` + strconv.Itoa(types.MaxExcerpt-1) + `)) || '…'
+	else btrim(regexp_replace(text, '\s+', ' ', 'g')) end`
+
+// addChatPreviewColumns keeps the last message of the chat shortened for
+// chat lists, last_message_at is its time
+func (s *PostgresStore) addChatPreviewColumns(ctx context.Context) error {
+	query := `alter table chat add column if not exists last_message_id bigint,
+		add column if not exists last_author_id integer,
+		add column if not exists last_author_name varchar(20),
+		add column if not exists last_excerpt varchar(` + strconv.Itoa(types.MaxExcerpt) + `);
+	update chat c set last_message_id = l.id, last_author_id = l.author_id, last_author_name = l.author_name, last_excerpt = l.excerpt
+	from chat c2 cross join lateral (
+		select id, author_id, author_name, ` + excerpt + ` as excerpt from messages
+		where chat_id = c2.id order by created_at desc, id desc limit 1
+	) l
+	where c.id = c2.id and c.last_message_id is null and c.message_count > 0`
+
+	_, err := s.db.ExecContext(ctx, query)
+	return err
+}
+
+// countMessage adds a new message to the counters and preview of its chat
+func countMessage(ctx context.Context, tx *sql.Tx, message types.MessageJSON) error {
+	query := `update chat set message_count = message_count + 1 where id = $1`
+	if _, err := tx.ExecContext(ctx, query, message.ChatId); err != nil {
+		return err
+	}
+	query = `update chat set last_message_at = $2, last_message_id = $3, last_author_id = $4, last_author_name = $5, last_excerpt = $6
+	where id = $1 and (last_message_at is null or last_message_at <= $2)`
+	_, err := tx.ExecContext(ctx, query, message.ChatId, message.CreatedAt.UTC(), message.Id, message.Author.Id, message.Author.Username, types.Excerpt(message.Text))
+	return err
+}
+
+// uncountMessages takes the messages of from matching where off the
+// counters of their chats, before they are deleted. Messages are always
+// deleted oldest first, so the preview only goes with the last one
+func uncountMessages(ctx context.Context, tx *sql.Tx, from string, where string, args ...any) error {
+	query := `update chat c set message_count = c.message_count - d.n,
+		last_message_at = case when c.message_count = d.n then null else c.last_message_at end,
+		last_message_id = case when c.message_count = d.n then null else c.last_message_id end,
+		last_author_id = case when c.message_count = d.n then null else c.last_author_id end,
+		last_author_name = case when c.message_count = d.n then null else c.last_author_name end,
+		last_excerpt = case when c.message_count = d.n then null else c.last_excerpt end
+	from (select chat_id, count(*) n from ` + from + ` where ` + where + ` group by chat_id) d
+	where c.id = d.chat_id`
+	_, err := tx.ExecContext(ctx, query, args...)
+	return err
+}
@@ -0,0 +1,100 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// identities link single sign-on accounts, by the issuer and subject of
+// their id tokens, to local users. Once linked a user is found by them, not
+// by the email the provider sends
+
+func (s *PostgresStore) createIdentityTable(ctx context.Context) error {
+	query := `create table if not exists user_identities (
+		issuer varchar(255) not null,
+		subject varchar(255) not null,
+		user_id integer not null references users (id) on delete cascade,
+		created_at timestamp not null default now(),
+		primary key (issuer, subject),
+		unique (issuer, user_id)
+	)`
+
+	_, err := s.db.ExecContext(ctx, query)
+	return err
+}
+
+// GetIdentityUser returns the id of the user an identity is linked to
+func (s *PostgresStore) GetIdentityUser(ctx context.Context, issuer string, subject string) (int, error) {
+	// exec query
+	query := `select user_id from user_identities where issuer = $1 and subject = $2`
+	var userId int
+	if err := s.db.QueryRowContext(ctx, query, issuer, subject).Scan(&userId); err != nil {
+		if err = storageError(err); !errors.Is(err, ErrNotFound) {
+			log.Println("getIdentityUser error")
+		}
+		return 0, err
+	}
+	return userId, nil
+}
+
+// LinkIdentity returns ErrConflict when the identity or the user is already
+// linked for the issuer
+func (s *PostgresStore) LinkIdentity(ctx context.Context, issuer string, subject string, userId int) error {
+	// exec query
+	query := `insert into user_identities (issuer, subject, user_id) values ($1, $2, $3)`
+	if _, err := s.db.ExecContext(ctx, query, issuer, subject, userId); err != nil {
+		if err = storageError(err); !errors.Is(err, ErrConflict) && !errors.Is(err, ErrNotFound) {
+			log.Println("linkIdentity error")
+		}
+		return err
+	}
+	return nil
+}
+
+type boltIdentity struct {
+	Issuer  string `json:"issuer"`
+	Subject string `json:"subject"`
+	UserId  int    `json:"userId"`
+}
+
+func (s *BoltStore) GetIdentityUser(ctx context.Context, issuer string, subject string) (int, error) {
+	identity := boltIdentity{}
+	err := s.view("getIdentityUser", func(tx *bolt.Tx) error {
+		return get(tx.Bucket(bucketIdentities), pairKey(issuer, subject), &identity)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return identity.UserId, nil
+}
+
+func (s *BoltStore) LinkIdentity(ctx context.Context, issuer string, subject string, userId int) error {
+	return s.update("linkIdentity", func(tx *bolt.Tx) error {
+		if _, err := getUser(tx, userId); err != nil {
+			return err
+		}
+		b := tx.Bucket(bucketIdentities)
+		key := pairKey(issuer, subject)
+		if b.Get(key) != nil {
+			return ErrConflict
+		}
+		err := b.ForEach(func(k, v []byte) error {
+			identity := boltIdentity{}
+			if err := json.Unmarshal(v, &identity); err != nil {
+				return err
+			}
+			if identity.Issuer == issuer && identity.UserId == userId {
+				return ErrConflict
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		return put(b, key, boltIdentity{Issuer: issuer, Subject: subject, UserId: userId})
+	})
+}
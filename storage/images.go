@@ -0,0 +1,76 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+)
+
+// chat images are kept apart from the chat row so loading a chat doesn't
+// read them, chats only carry when each one was last set
+
+// chatImages selects the versions of the images of chat as a json object
+const chatImages = `coalesce((select json_object_agg(kind, floor(extract(epoch from updated_at))::bigint) from chat_images where chat_id = chat.id), '{}')`
+
+func (s *PostgresStore) createChatImageTable(ctx context.Context) error {
+	query := `create table if not exists chat_images (
+		chat_id integer not null references chat (id) on delete cascade,
+		kind varchar(10) not null,
+		data bytea not null,
+		updated_at timestamp not null default now(),
+		primary key (chat_id, kind)
+	)`
+
+	_, err := s.db.ExecContext(ctx, query)
+	return err
+}
+
+// SetChatImage replaces the image of the given kind of the chat, the
+// time it was set becomes its version
+func (s *PostgresStore) SetChatImage(ctx context.Context, chatId int, kind string, data []byte, at time.Time) error {
+	// exec query
+	query := `insert into chat_images (chat_id, kind, data, updated_at)
+	select id, $2, $3, $4 from chat where id = $1
+	on conflict (chat_id, kind) do update set data = excluded.data, updated_at = excluded.updated_at`
+	res, err := s.db.ExecContext(ctx, query, chatId, kind, data, at.UTC())
+	if err != nil {
+		log.Println("setChatImage error")
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// GetChatImage returns the image of the given kind of the chat and when
+// it was set
+func (s *PostgresStore) GetChatImage(ctx context.Context, chatId int, kind string) ([]byte, time.Time, error) {
+	// exec query
+	var data []byte
+	var updatedAt time.Time
+	query := `select data, updated_at from chat_images where chat_id = $1 and kind = $2`
+	if err := s.db.QueryRowContext(ctx, query, chatId, kind).Scan(&data, &updatedAt); err != nil {
+		if err = storageError(err); !errors.Is(err, ErrNotFound) {
+			log.Println("getChatImage error")
+		}
+		return nil, time.Time{}, err
+	}
+	return data, updatedAt.UTC(), nil
+}
+
+// DeleteChatImage removes the image of the given kind of the chat
+func (s *PostgresStore) DeleteChatImage(ctx context.Context, chatId int, kind string) error {
+	// exec query
+	query := `delete from chat_images where chat_id = $1 and kind = $2`
+	res, err := s.db.ExecContext(ctx, query, chatId, kind)
+	if err != nil {
+		log.Println("deleteChatImage error")
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
@@ -0,0 +1,897 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/go-webauthn/webauthn/webauthn"
+
+	"example/gochat/types"
+)
+
+// WorkspaceStore keeps the calls made with a context scoped by
+// WithWorkspace inside that workspace. Users and chats of other workspaces
+// are ErrNotFound when asked for by id and left out of lists by id, the
+// listings that aren't by id (directory, search, stats, audit log) are
+// filtered by the stores. Calls with contexts marked Unscoped pass through,
+// and calls with neither fail with ErrUnscoped
+type WorkspaceStore struct {
+	Storage
+	// id -> workspace, users and chats never move so these aren't evicted
+	users sync.Map
+	chats sync.Map
+}
+
+func NewWorkspaceStore(store Storage) *WorkspaceStore {
+	return &WorkspaceStore{Storage: store}
+}
+
+func (s *WorkspaceStore) GetUserWorkspace(ctx context.Context, userId int) (int, error) {
+	if id, ok := s.users.Load(userId); ok {
+		return id.(int), nil
+	}
+	id, err := s.Storage.GetUserWorkspace(ctx, userId)
+	if err != nil {
+		return 0, err
+	}
+	s.users.Store(userId, id)
+	return id, nil
+}
+
+func (s *WorkspaceStore) GetChatWorkspace(ctx context.Context, chatId int) (int, error) {
+	if id, ok := s.chats.Load(chatId); ok {
+		return id.(int), nil
+	}
+	id, err := s.Storage.GetChatWorkspace(ctx, chatId)
+	if err != nil {
+		return 0, err
+	}
+	s.chats.Store(chatId, id)
+	return id, nil
+}
+
+// checkUser checks that the user is in the workspace of ctx
+func (s *WorkspaceStore) checkUser(ctx context.Context, userId int) error {
+	workspace, ok, err := scope(ctx)
+	if err != nil || !ok {
+		return err
+	}
+	id, err := s.GetUserWorkspace(ctx, userId)
+	if err != nil {
+		return err
+	}
+	if id != workspace {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// checkChat checks that the chat is in the workspace of ctx
+func (s *WorkspaceStore) checkChat(ctx context.Context, chatId int) error {
+	workspace, ok, err := scope(ctx)
+	if err != nil || !ok {
+		return err
+	}
+	id, err := s.GetChatWorkspace(ctx, chatId)
+	if err != nil {
+		return err
+	}
+	if id != workspace {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// keepUsers keeps the users in the workspace of ctx, ids that don't exist
+// are dropped too
+func (s *WorkspaceStore) keepUsers(ctx context.Context, ids []int) ([]int, error) {
+	return s.filter(ctx, ids, s.checkUser)
+}
+
+func (s *WorkspaceStore) keepChats(ctx context.Context, ids []int) ([]int, error) {
+	return s.filter(ctx, ids, s.checkChat)
+}
+
+func (s *WorkspaceStore) filter(ctx context.Context, ids []int, in func(context.Context, int) error) ([]int, error) {
+	if _, ok, err := scope(ctx); err != nil || !ok {
+		return ids, err
+	}
+	kept := make([]int, 0, len(ids))
+	for _, id := range ids {
+		err := in(ctx, id)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		kept = append(kept, id)
+	}
+	return kept, nil
+}
+
+// checkMember checks a chat and a user, for calls about a member
+func (s *WorkspaceStore) checkMember(ctx context.Context, chatId int, userId int) error {
+	if err := s.checkChat(ctx, chatId); err != nil {
+		return err
+	}
+	return s.checkUser(ctx, userId)
+}
+
+// checkCreate checks that ctx is scoped, users, bots, chats and
+// announcements are created in the workspace of ctx and there is none to
+// pick for an unscoped one
+func checkCreate(ctx context.Context) error {
+	if _, ok := WorkspaceFrom(ctx); !ok {
+		return ErrUnscoped
+	}
+	return nil
+}
+
+func (s *WorkspaceStore) CreateUser(ctx context.Context, username string, email string, password string) (*types.User, error) {
+	if err := checkCreate(ctx); err != nil {
+		return nil, err
+	}
+	return s.Storage.CreateUser(ctx, username, email, password)
+}
+
+func (s *WorkspaceStore) CreateBot(ctx context.Context, username string) (*types.User, error) {
+	if err := checkCreate(ctx); err != nil {
+		return nil, err
+	}
+	return s.Storage.CreateBot(ctx, username)
+}
+
+func (s *WorkspaceStore) CreateAnnouncement(ctx context.Context, text string) (*types.AnnouncementJSON, error) {
+	if err := checkCreate(ctx); err != nil {
+		return nil, err
+	}
+	return s.Storage.CreateAnnouncement(ctx, text)
+}
+
+func (s *WorkspaceStore) ListUsers(ctx context.Context, q string, after int, limit int) ([]types.User, int, error) {
+	if err := checkScope(ctx); err != nil {
+		return nil, 0, err
+	}
+	return s.Storage.ListUsers(ctx, q, after, limit)
+}
+
+func (s *WorkspaceStore) GetTrendingChats(ctx context.Context, limit int) ([]types.TrendingChatJSON, error) {
+	if err := checkScope(ctx); err != nil {
+		return nil, err
+	}
+	return s.Storage.GetTrendingChats(ctx, limit)
+}
+
+func (s *WorkspaceStore) GetPublicChats(ctx context.Context, tag string, category string, before int, limit int) ([]types.ChatInfoJSON, int, error) {
+	if err := checkScope(ctx); err != nil {
+		return nil, 0, err
+	}
+	return s.Storage.GetPublicChats(ctx, tag, category, before, limit)
+}
+
+func (s *WorkspaceStore) GetStats(ctx context.Context) (*types.StatsJSON, error) {
+	if err := checkScope(ctx); err != nil {
+		return nil, err
+	}
+	return s.Storage.GetStats(ctx)
+}
+
+func (s *WorkspaceStore) AddAuditEntry(ctx context.Context, actor types.AuthorJSON, action string, chatId int, data any) error {
+	if err := checkScope(ctx); err != nil {
+		return err
+	}
+	return s.Storage.AddAuditEntry(ctx, actor, action, chatId, data)
+}
+
+func (s *WorkspaceStore) GetAuditLog(ctx context.Context, before int64, limit int) ([]types.AuditEntryJSON, error) {
+	if err := checkScope(ctx); err != nil {
+		return nil, err
+	}
+	return s.Storage.GetAuditLog(ctx, before, limit)
+}
+
+func (s *WorkspaceStore) GetUserById(ctx context.Context, id int) (*types.User, error) {
+	if err := s.checkUser(ctx, id); err != nil {
+		return nil, err
+	}
+	return s.Storage.GetUserById(ctx, id)
+}
+
+func (s *WorkspaceStore) GetUserByEmail(ctx context.Context, email string) (*types.User, error) {
+	workspace, ok, err := scope(ctx)
+	if err != nil {
+		return nil, err
+	}
+	user, err := s.Storage.GetUserByEmail(ctx, email)
+	if err != nil {
+		return nil, err
+	}
+	if ok && user.WorkspaceId != workspace {
+		return nil, ErrNotFound
+	}
+	return user, nil
+}
+
+func (s *WorkspaceStore) GetUsers(ctx context.Context, arr []int) ([]types.User, error) {
+	arr, err := s.keepUsers(ctx, arr)
+	if err != nil {
+		return nil, err
+	}
+	return s.Storage.GetUsers(ctx, arr)
+}
+
+func (s *WorkspaceStore) GetAuthors(ctx context.Context, arr []int) (map[int]types.AuthorJSON, error) {
+	authors, err := s.Storage.GetAuthors(ctx, arr)
+	if err != nil {
+		return nil, err
+	}
+	// deleted users stay as types.DeletedUser
+	for id, author := range authors {
+		err := s.checkUser(ctx, id)
+		if errors.Is(err, ErrNotFound) && author != types.DeletedUser {
+			delete(authors, id)
+			continue
+		}
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			return nil, err
+		}
+	}
+	return authors, nil
+}
+
+func (s *WorkspaceStore) TouchLastSeen(ctx context.Context, id int, at time.Time) error {
+	if err := s.checkUser(ctx, id); err != nil {
+		return err
+	}
+	return s.Storage.TouchLastSeen(ctx, id, at)
+}
+
+func (s *WorkspaceStore) SetShowLastSeen(ctx context.Context, id int, show bool) error {
+	if err := s.checkUser(ctx, id); err != nil {
+		return err
+	}
+	return s.Storage.SetShowLastSeen(ctx, id, show)
+}
+
+func (s *WorkspaceStore) GetProfile(ctx context.Context, id int) (*types.ProfileJSON, error) {
+	if err := s.checkUser(ctx, id); err != nil {
+		return nil, err
+	}
+	return s.Storage.GetProfile(ctx, id)
+}
+
+func (s *WorkspaceStore) SetProfile(ctx context.Context, id int, profile types.ProfileRequest) error {
+	if err := s.checkUser(ctx, id); err != nil {
+		return err
+	}
+	return s.Storage.SetProfile(ctx, id, profile)
+}
+
+func (s *WorkspaceStore) UpdateUserRole(ctx context.Context, id int, role string) error {
+	if err := s.checkUser(ctx, id); err != nil {
+		return err
+	}
+	return s.Storage.UpdateUserRole(ctx, id, role)
+}
+
+func (s *WorkspaceStore) SetRoleByEmail(ctx context.Context, emails []string, role string) error {
+	_, ok, err := scope(ctx)
+	if err != nil {
+		return err
+	}
+	if ok {
+		kept := []string{}
+		for _, email := range emails {
+			_, err := s.GetUserByEmail(ctx, email)
+			if errors.Is(err, ErrNotFound) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			kept = append(kept, email)
+		}
+		emails = kept
+	}
+	return s.Storage.SetRoleByEmail(ctx, emails, role)
+}
+
+func (s *WorkspaceStore) SetUserDisabled(ctx context.Context, id int, disabled bool) error {
+	if err := s.checkUser(ctx, id); err != nil {
+		return err
+	}
+	return s.Storage.SetUserDisabled(ctx, id, disabled)
+}
+
+func (s *WorkspaceStore) SetPassword(ctx context.Context, id int, password string) error {
+	if err := s.checkUser(ctx, id); err != nil {
+		return err
+	}
+	return s.Storage.SetPassword(ctx, id, password)
+}
+
+func (s *WorkspaceStore) DeleteUser(ctx context.Context, id int) error {
+	if err := s.checkUser(ctx, id); err != nil {
+		return err
+	}
+	return s.Storage.DeleteUser(ctx, id)
+}
+
+func (s *WorkspaceStore) CreateChat(ctx context.Context, newChat types.Chat, user types.User) (*types.Chat, error) {
+	if err := checkCreate(ctx); err != nil {
+		return nil, err
+	}
+	if err := s.checkUser(ctx, user.Id); err != nil {
+		return nil, err
+	}
+	return s.Storage.CreateChat(ctx, newChat, user)
+}
+
+func (s *WorkspaceStore) GetChatById(ctx context.Context, id int) (*types.Chat, error) {
+	if err := s.checkChat(ctx, id); err != nil {
+		return nil, err
+	}
+	return s.Storage.GetChatById(ctx, id)
+}
+
+func (s *WorkspaceStore) GetChats(ctx context.Context, arr []int) ([]types.Chat, error) {
+	arr, err := s.keepChats(ctx, arr)
+	if err != nil {
+		return nil, err
+	}
+	return s.Storage.GetChats(ctx, arr)
+}
+
+func (s *WorkspaceStore) GetChatSummaries(ctx context.Context, userId int, arr []int) ([]types.ChatSummaryJSON, error) {
+	if err := s.checkUser(ctx, userId); err != nil {
+		return nil, err
+	}
+	arr, err := s.keepChats(ctx, arr)
+	if err != nil {
+		return nil, err
+	}
+	return s.Storage.GetChatSummaries(ctx, userId, arr)
+}
+
+func (s *WorkspaceStore) GetUserChats(ctx context.Context, userId int, q string, after int, limit int) ([]types.ChatSummaryJSON, error) {
+	if err := s.checkUser(ctx, userId); err != nil {
+		return nil, err
+	}
+	return s.Storage.GetUserChats(ctx, userId, q, after, limit)
+}
+
+func (s *WorkspaceStore) MarkRead(ctx context.Context, userId int, messageId int64) error {
+	if err := s.checkUser(ctx, userId); err != nil {
+		return err
+	}
+	return s.Storage.MarkRead(ctx, userId, messageId)
+}
+
+func (s *WorkspaceStore) GetReadMarker(ctx context.Context, userId int, chatId int) (int64, error) {
+	if err := s.checkMember(ctx, chatId, userId); err != nil {
+		return 0, err
+	}
+	return s.Storage.GetReadMarker(ctx, userId, chatId)
+}
+
+func (s *WorkspaceStore) SetReadMarker(ctx context.Context, userId int, chatId int, messageId int64) error {
+	if err := s.checkMember(ctx, chatId, userId); err != nil {
+		return err
+	}
+	return s.Storage.SetReadMarker(ctx, userId, chatId, messageId)
+}
+
+func (s *WorkspaceStore) MarkAllRead(ctx context.Context, userId int, chats []int) ([]types.ReadMarkerJSON, error) {
+	if err := s.checkUser(ctx, userId); err != nil {
+		return nil, err
+	}
+	chats, err := s.keepChats(ctx, chats)
+	if err != nil {
+		return nil, err
+	}
+	return s.Storage.MarkAllRead(ctx, userId, chats)
+}
+
+func (s *WorkspaceStore) AddMember(ctx context.Context, chatId int, userId int) error {
+	if err := s.checkMember(ctx, chatId, userId); err != nil {
+		return err
+	}
+	return s.Storage.AddMember(ctx, chatId, userId)
+}
+
+func (s *WorkspaceStore) RemoveMember(ctx context.Context, chatId int, userId int) error {
+	if err := s.checkMember(ctx, chatId, userId); err != nil {
+		return err
+	}
+	return s.Storage.RemoveMember(ctx, chatId, userId)
+}
+
+func (s *WorkspaceStore) SetChatVisibility(ctx context.Context, id int, visibility string) error {
+	if err := s.checkChat(ctx, id); err != nil {
+		return err
+	}
+	return s.Storage.SetChatVisibility(ctx, id, visibility)
+}
+
+func (s *WorkspaceStore) SetChatInfo(ctx context.Context, id int, name string, topic string) error {
+	if err := s.checkChat(ctx, id); err != nil {
+		return err
+	}
+	return s.Storage.SetChatInfo(ctx, id, name, topic)
+}
+
+func (s *WorkspaceStore) SetChatWelcome(ctx context.Context, id int, welcome string) error {
+	if err := s.checkChat(ctx, id); err != nil {
+		return err
+	}
+	return s.Storage.SetChatWelcome(ctx, id, welcome)
+}
+
+func (s *WorkspaceStore) SetChatAnnouncement(ctx context.Context, id int, announcement bool) error {
+	if err := s.checkChat(ctx, id); err != nil {
+		return err
+	}
+	return s.Storage.SetChatAnnouncement(ctx, id, announcement)
+}
+
+func (s *WorkspaceStore) SetChatImage(ctx context.Context, id int, kind string, data []byte, at time.Time) error {
+	if err := s.checkChat(ctx, id); err != nil {
+		return err
+	}
+	return s.Storage.SetChatImage(ctx, id, kind, data, at)
+}
+
+func (s *WorkspaceStore) GetChatImage(ctx context.Context, id int, kind string) ([]byte, time.Time, error) {
+	if err := s.checkChat(ctx, id); err != nil {
+		return nil, time.Time{}, err
+	}
+	return s.Storage.GetChatImage(ctx, id, kind)
+}
+
+func (s *WorkspaceStore) DeleteChatImage(ctx context.Context, id int, kind string) error {
+	if err := s.checkChat(ctx, id); err != nil {
+		return err
+	}
+	return s.Storage.DeleteChatImage(ctx, id, kind)
+}
+
+func (s *WorkspaceStore) DeleteChat(ctx context.Context, id int) error {
+	if err := s.checkChat(ctx, id); err != nil {
+		return err
+	}
+	return s.Storage.DeleteChat(ctx, id)
+}
+
+func (s *WorkspaceStore) SearchChats(ctx context.Context, q string, chats []int, limit int) ([]types.ChatInfoJSON, error) {
+	chats, err := s.keepChats(ctx, chats)
+	if err != nil {
+		return nil, err
+	}
+	return s.Storage.SearchChats(ctx, q, chats, limit)
+}
+
+func (s *WorkspaceStore) SetChatTags(ctx context.Context, id int, category string, tags []string) error {
+	if err := s.checkChat(ctx, id); err != nil {
+		return err
+	}
+	return s.Storage.SetChatTags(ctx, id, category, tags)
+}
+
+func (s *WorkspaceStore) GetMemberRole(ctx context.Context, chatId int, userId int) (string, error) {
+	if err := s.checkMember(ctx, chatId, userId); err != nil {
+		return "", err
+	}
+	return s.Storage.GetMemberRole(ctx, chatId, userId)
+}
+
+func (s *WorkspaceStore) GetMembers(ctx context.Context, chatId int, after int, limit int) ([]types.MemberJSON, int, error) {
+	if err := s.checkChat(ctx, chatId); err != nil {
+		return nil, 0, err
+	}
+	return s.Storage.GetMembers(ctx, chatId, after, limit)
+}
+
+func (s *WorkspaceStore) SetMemberRole(ctx context.Context, chatId int, userId int, role string) error {
+	if err := s.checkMember(ctx, chatId, userId); err != nil {
+		return err
+	}
+	return s.Storage.SetMemberRole(ctx, chatId, userId, role)
+}
+
+func (s *WorkspaceStore) AddMessage(ctx context.Context, message types.MessageJSON) (int64, error) {
+	if err := s.checkChat(ctx, message.ChatId); err != nil {
+		return 0, err
+	}
+	return s.Storage.AddMessage(ctx, message)
+}
+
+func (s *WorkspaceStore) EditMessage(ctx context.Context, chatId int, messageId int64, authorId int, text string, at time.Time) (*types.MessageJSON, error) {
+	if err := s.checkChat(ctx, chatId); err != nil {
+		return nil, err
+	}
+	return s.Storage.EditMessage(ctx, chatId, messageId, authorId, text, at)
+}
+
+func (s *WorkspaceStore) GetMessageHistory(ctx context.Context, chatId int, messageId int64) ([]types.MessageEditJSON, error) {
+	if err := s.checkChat(ctx, chatId); err != nil {
+		return nil, err
+	}
+	return s.Storage.GetMessageHistory(ctx, chatId, messageId)
+}
+
+func (s *WorkspaceStore) SearchMessages(ctx context.Context, search MessageSearch) ([]types.MessageJSON, error) {
+	chats, err := s.keepChats(ctx, search.ChatIds)
+	if err != nil {
+		return nil, err
+	}
+	search.ChatIds = chats
+	return s.Storage.SearchMessages(ctx, search)
+}
+
+func (s *WorkspaceStore) AddReaction(ctx context.Context, chatId int, messageId int64, userId int, emoji string) error {
+	if err := s.checkMember(ctx, chatId, userId); err != nil {
+		return err
+	}
+	return s.Storage.AddReaction(ctx, chatId, messageId, userId, emoji)
+}
+
+func (s *WorkspaceStore) RemoveReaction(ctx context.Context, chatId int, messageId int64, userId int, emoji string) error {
+	if err := s.checkMember(ctx, chatId, userId); err != nil {
+		return err
+	}
+	return s.Storage.RemoveReaction(ctx, chatId, messageId, userId, emoji)
+}
+
+func (s *WorkspaceStore) GetReactionSummary(ctx context.Context, chatId int, messageId int64, userId int) ([]types.ReactionJSON, error) {
+	if err := s.checkChat(ctx, chatId); err != nil {
+		return nil, err
+	}
+	return s.Storage.GetReactionSummary(ctx, chatId, messageId, userId)
+}
+
+func (s *WorkspaceStore) GetReactionUsers(ctx context.Context, chatId int, messageId int64, emoji string, after int, limit int) ([]types.AuthorJSON, error) {
+	if err := s.checkChat(ctx, chatId); err != nil {
+		return nil, err
+	}
+	return s.Storage.GetReactionUsers(ctx, chatId, messageId, emoji, after, limit)
+}
+
+func (s *WorkspaceStore) CreateBookmark(ctx context.Context, userId int, chatId int, messageId int64) error {
+	if err := s.checkMember(ctx, chatId, userId); err != nil {
+		return err
+	}
+	return s.Storage.CreateBookmark(ctx, userId, chatId, messageId)
+}
+
+func (s *WorkspaceStore) DeleteBookmark(ctx context.Context, userId int, messageId int64) error {
+	if err := s.checkUser(ctx, userId); err != nil {
+		return err
+	}
+	return s.Storage.DeleteBookmark(ctx, userId, messageId)
+}
+
+func (s *WorkspaceStore) GetBookmarks(ctx context.Context, userId int, chats []int, before int64, limit int) ([]types.BookmarkJSON, error) {
+	if err := s.checkUser(ctx, userId); err != nil {
+		return nil, err
+	}
+	chats, err := s.keepChats(ctx, chats)
+	if err != nil {
+		return nil, err
+	}
+	return s.Storage.GetBookmarks(ctx, userId, chats, before, limit)
+}
+
+func (s *WorkspaceStore) CreateReceipts(ctx context.Context, message types.MessageJSON, usersId []int) error {
+	if err := s.checkChat(ctx, message.ChatId); err != nil {
+		return err
+	}
+	usersId, err := s.keepUsers(ctx, usersId)
+	if err != nil {
+		return err
+	}
+	return s.Storage.CreateReceipts(ctx, message, usersId)
+}
+
+func (s *WorkspaceStore) UpdateReceipt(ctx context.Context, messageId int64, userId int, status string) (int, error) {
+	if err := s.checkUser(ctx, userId); err != nil {
+		return 0, err
+	}
+	return s.Storage.UpdateReceipt(ctx, messageId, userId, status)
+}
+
+func (s *WorkspaceStore) GetReceipts(ctx context.Context, messagesId []int64) ([]types.ReceiptJSON, error) {
+	receipts, err := s.Storage.GetReceipts(ctx, messagesId)
+	if err != nil {
+		return nil, err
+	}
+	// receipts are kept by message id only, the recipients give away the
+	// workspace
+	kept := receipts[:0]
+	for _, receipt := range receipts {
+		err := s.checkUser(ctx, receipt.UserId)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		kept = append(kept, receipt)
+	}
+	return kept, nil
+}
+
+func (s *WorkspaceStore) ExportMessages(ctx context.Context, chatId int, fn func(types.MessageJSON) error) error {
+	if err := s.checkChat(ctx, chatId); err != nil {
+		return err
+	}
+	return s.Storage.ExportMessages(ctx, chatId, fn)
+}
+
+func (s *WorkspaceStore) PurgeMessages(ctx context.Context, chatId int, before time.Time, limit int) (int, error) {
+	if err := s.checkChat(ctx, chatId); err != nil {
+		return 0, err
+	}
+	return s.Storage.PurgeMessages(ctx, chatId, before, limit)
+}
+
+func (s *WorkspaceStore) GetUnseenAnnouncements(ctx context.Context, userId int) ([]types.AnnouncementJSON, error) {
+	if err := s.checkUser(ctx, userId); err != nil {
+		return nil, err
+	}
+	return s.Storage.GetUnseenAnnouncements(ctx, userId)
+}
+
+func (s *WorkspaceStore) MarkAnnouncementSeen(ctx context.Context, usersId []int, id int) error {
+	usersId, err := s.keepUsers(ctx, usersId)
+	if err != nil {
+		return err
+	}
+	return s.Storage.MarkAnnouncementSeen(ctx, usersId, id)
+}
+
+// CreateChange takes 0 for changes of a user outside of chats and for
+// changes of a chat that aren't about a user
+func (s *WorkspaceStore) CreateChange(ctx context.Context, chatId int, userId int, changeType string, data any) (int64, error) {
+	if chatId != 0 {
+		if err := s.checkChat(ctx, chatId); err != nil {
+			return 0, err
+		}
+	}
+	if userId != 0 {
+		if err := s.checkUser(ctx, userId); err != nil {
+			return 0, err
+		}
+	}
+	return s.Storage.CreateChange(ctx, chatId, userId, changeType, data)
+}
+
+func (s *WorkspaceStore) GetChanges(ctx context.Context, userId int, chats []int, since int64, limit int) ([]types.ChangeJSON, error) {
+	if err := s.checkUser(ctx, userId); err != nil {
+		return nil, err
+	}
+	chats, err := s.keepChats(ctx, chats)
+	if err != nil {
+		return nil, err
+	}
+	return s.Storage.GetChanges(ctx, userId, chats, since, limit)
+}
+
+func (s *WorkspaceStore) GetDeviceCursor(ctx context.Context, userId int, device string) (int64, error) {
+	if err := s.checkUser(ctx, userId); err != nil {
+		return 0, err
+	}
+	return s.Storage.GetDeviceCursor(ctx, userId, device)
+}
+
+func (s *WorkspaceStore) UpdateDeviceCursor(ctx context.Context, userId int, device string, cursor int64) error {
+	if err := s.checkUser(ctx, userId); err != nil {
+		return err
+	}
+	return s.Storage.UpdateDeviceCursor(ctx, userId, device, cursor)
+}
+
+func (s *WorkspaceStore) CreatePushToken(ctx context.Context, userId int, platform string, token string) error {
+	if err := s.checkUser(ctx, userId); err != nil {
+		return err
+	}
+	return s.Storage.CreatePushToken(ctx, userId, platform, token)
+}
+
+func (s *WorkspaceStore) DeletePushToken(ctx context.Context, userId int, token string) error {
+	if err := s.checkUser(ctx, userId); err != nil {
+		return err
+	}
+	return s.Storage.DeletePushToken(ctx, userId, token)
+}
+
+func (s *WorkspaceStore) GetPushTokens(ctx context.Context, usersId []int, chatId int) ([]types.PushToken, error) {
+	usersId, err := s.keepUsers(ctx, usersId)
+	if err != nil {
+		return nil, err
+	}
+	return s.Storage.GetPushTokens(ctx, usersId, chatId)
+}
+
+func (s *WorkspaceStore) SetChatMuted(ctx context.Context, userId int, chatId int, muted bool) error {
+	if err := s.checkMember(ctx, chatId, userId); err != nil {
+		return err
+	}
+	return s.Storage.SetChatMuted(ctx, userId, chatId, muted)
+}
+
+func (s *WorkspaceStore) GetPreferences(ctx context.Context, usersId []int) (map[int]types.PreferencesJSON, error) {
+	usersId, err := s.keepUsers(ctx, usersId)
+	if err != nil {
+		return nil, err
+	}
+	return s.Storage.GetPreferences(ctx, usersId)
+}
+
+func (s *WorkspaceStore) CreateNotifications(ctx context.Context, usersId []int, notificationType string, chatId int, data any) error {
+	usersId, err := s.keepUsers(ctx, usersId)
+	if err != nil {
+		return err
+	}
+	return s.Storage.CreateNotifications(ctx, usersId, notificationType, chatId, data)
+}
+
+func (s *WorkspaceStore) GetNotifications(ctx context.Context, userId int, unread bool, before int64, limit int) ([]types.NotificationJSON, error) {
+	if err := s.checkUser(ctx, userId); err != nil {
+		return nil, err
+	}
+	return s.Storage.GetNotifications(ctx, userId, unread, before, limit)
+}
+
+func (s *WorkspaceStore) MarkNotificationsRead(ctx context.Context, userId int, ids []int64) error {
+	if err := s.checkUser(ctx, userId); err != nil {
+		return err
+	}
+	return s.Storage.MarkNotificationsRead(ctx, userId, ids)
+}
+
+func (s *WorkspaceStore) AddActivity(ctx context.Context, usersId []int, activityType string, chatId int, data any) error {
+	usersId, err := s.keepUsers(ctx, usersId)
+	if err != nil {
+		return err
+	}
+	return s.Storage.AddActivity(ctx, usersId, activityType, chatId, data)
+}
+
+func (s *WorkspaceStore) GetActivity(ctx context.Context, userId int, before int64, limit int) ([]types.ActivityJSON, error) {
+	if err := s.checkUser(ctx, userId); err != nil {
+		return nil, err
+	}
+	return s.Storage.GetActivity(ctx, userId, before, limit)
+}
+
+func (s *WorkspaceStore) SetPreferences(ctx context.Context, userId int, preferences types.PreferencesJSON) error {
+	if err := s.checkUser(ctx, userId); err != nil {
+		return err
+	}
+	return s.Storage.SetPreferences(ctx, userId, preferences)
+}
+
+func (s *WorkspaceStore) GetSettings(ctx context.Context, userId int) (map[string]json.RawMessage, error) {
+	if err := s.checkUser(ctx, userId); err != nil {
+		return nil, err
+	}
+	return s.Storage.GetSettings(ctx, userId)
+}
+
+func (s *WorkspaceStore) UpdateSettings(ctx context.Context, userId int, settings map[string]json.RawMessage, version int) (map[string]json.RawMessage, error) {
+	if err := s.checkUser(ctx, userId); err != nil {
+		return nil, err
+	}
+	return s.Storage.UpdateSettings(ctx, userId, settings, version)
+}
+
+func (s *WorkspaceStore) CreatePasskey(ctx context.Context, userId int, credential webauthn.Credential) error {
+	if err := s.checkUser(ctx, userId); err != nil {
+		return err
+	}
+	return s.Storage.CreatePasskey(ctx, userId, credential)
+}
+
+func (s *WorkspaceStore) GetPasskeys(ctx context.Context, userId int) ([]webauthn.Credential, error) {
+	if err := s.checkUser(ctx, userId); err != nil {
+		return nil, err
+	}
+	return s.Storage.GetPasskeys(ctx, userId)
+}
+
+func (s *WorkspaceStore) LinkIdentity(ctx context.Context, issuer string, subject string, userId int) error {
+	if err := s.checkUser(ctx, userId); err != nil {
+		return err
+	}
+	return s.Storage.LinkIdentity(ctx, issuer, subject, userId)
+}
+
+func (s *WorkspaceStore) CreateAPIToken(ctx context.Context, userId int, name string, scope string, hash []byte) (*types.APITokenJSON, error) {
+	if err := s.checkUser(ctx, userId); err != nil {
+		return nil, err
+	}
+	return s.Storage.CreateAPIToken(ctx, userId, name, scope, hash)
+}
+
+func (s *WorkspaceStore) GetAPITokens(ctx context.Context, userId int) ([]types.APITokenJSON, error) {
+	if err := s.checkUser(ctx, userId); err != nil {
+		return nil, err
+	}
+	return s.Storage.GetAPITokens(ctx, userId)
+}
+
+func (s *WorkspaceStore) GetAPIToken(ctx context.Context, hash []byte) (int, string, error) {
+	userId, scope, err := s.Storage.GetAPIToken(ctx, hash)
+	if err != nil {
+		return 0, "", err
+	}
+	if err = s.checkUser(ctx, userId); err != nil {
+		return 0, "", err
+	}
+	return userId, scope, nil
+}
+
+func (s *WorkspaceStore) DeleteAPIToken(ctx context.Context, userId int, id int) error {
+	if err := s.checkUser(ctx, userId); err != nil {
+		return err
+	}
+	return s.Storage.DeleteAPIToken(ctx, userId, id)
+}
+
+func (s *WorkspaceStore) CreateResponder(ctx context.Context, responder types.ResponderJSON) (*types.ResponderJSON, error) {
+	if err := s.checkMember(ctx, responder.ChatId, responder.BotId); err != nil {
+		return nil, err
+	}
+	return s.Storage.CreateResponder(ctx, responder)
+}
+
+func (s *WorkspaceStore) GetResponders(ctx context.Context, chatId int) ([]types.ResponderJSON, error) {
+	if err := s.checkChat(ctx, chatId); err != nil {
+		return nil, err
+	}
+	return s.Storage.GetResponders(ctx, chatId)
+}
+
+func (s *WorkspaceStore) DeleteResponder(ctx context.Context, chatId int, id int) error {
+	if err := s.checkChat(ctx, chatId); err != nil {
+		return err
+	}
+	return s.Storage.DeleteResponder(ctx, chatId, id)
+}
+
+// checkWorkspace checks that id is the workspace of ctx
+func checkWorkspace(ctx context.Context, id int) error {
+	workspace, ok, err := scope(ctx)
+	if err != nil {
+		return err
+	}
+	if ok && workspace != id {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// checkScope checks that ctx is scoped or marked Unscoped, for the calls
+// the stores filter or create in the workspace of ctx themselves
+func checkScope(ctx context.Context) error {
+	_, _, err := scope(ctx)
+	return err
+}
+
+func (s *WorkspaceStore) SetWorkspaceQuota(ctx context.Context, id int, quota types.WorkspaceQuotaJSON) error {
+	if err := checkWorkspace(ctx, id); err != nil {
+		return err
+	}
+	return s.Storage.SetWorkspaceQuota(ctx, id, quota)
+}
+
+func (s *WorkspaceStore) GetWorkspaceUsage(ctx context.Context, id int, month time.Time) (*types.WorkspaceUsageJSON, error) {
+	if err := checkWorkspace(ctx, id); err != nil {
+		return nil, err
+	}
+	return s.Storage.GetWorkspaceUsage(ctx, id, month)
+}
@@ -0,0 +1,53 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"example/gochat/types"
+)
+
+// calls without a workspace fail unless they are marked Unscoped, scoped
+// calls don't see other workspaces
+func TestWorkspaceStoreScope(t *testing.T) {
+	s := NewWorkspaceStore(testBolt(t))
+	ctx := WithWorkspace(context.Background(), DefaultWorkspace)
+	user, err := s.CreateUser(ctx, "alice", "alice@example.com", "hash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	chat, err := s.CreateChat(ctx, types.Chat{Name: "room", Visibility: types.VisibilityPublic}, *user)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	unscoped := context.Background()
+	if _, err = s.GetUserById(unscoped, user.Id); !errors.Is(err, ErrUnscoped) {
+		t.Errorf("get user: got %v", err)
+	}
+	if _, err = s.GetUserByEmail(unscoped, user.Email); !errors.Is(err, ErrUnscoped) {
+		t.Errorf("get user by email: got %v", err)
+	}
+	if _, err = s.GetChats(unscoped, []int{chat.Id}); !errors.Is(err, ErrUnscoped) {
+		t.Errorf("get chats: got %v", err)
+	}
+	if _, err = s.CreateUser(unscoped, "bobby", "bobby@example.com", "hash"); !errors.Is(err, ErrUnscoped) {
+		t.Errorf("create user: got %v", err)
+	}
+	if _, err = s.CreateUser(Unscoped(unscoped), "bobby", "bobby@example.com", "hash"); !errors.Is(err, ErrUnscoped) {
+		t.Errorf("create user without a workspace to create it in: got %v", err)
+	}
+
+	if _, err = s.GetUserById(Unscoped(unscoped), user.Id); err != nil {
+		t.Errorf("get user unscoped: got %v", err)
+	}
+	other := WithWorkspace(context.Background(), DefaultWorkspace+1)
+	if _, err = s.GetUserById(other, user.Id); !errors.Is(err, ErrNotFound) {
+		t.Errorf("get user of another workspace: got %v", err)
+	}
+	chats, err := s.GetChats(other, []int{chat.Id})
+	if err != nil || len(chats) != 0 {
+		t.Errorf("get chats of another workspace: got %d, %v", len(chats), err)
+	}
+}
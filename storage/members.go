@@ -0,0 +1,190 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+
+	"example/gochat/types"
+)
+
+// chats and users used to list each other in integer arrays that were
+// written separately and could disagree, chat_members is the one place
+// membership is kept now. chat_member_roles only keeps the roles of
+// members who left, so a viewer who leaves and joins again stays a viewer
+
+// memberIds and chatIds select the members of chat and the chats of
+// users as integer arrays, in the order they were joined
+const (
+	memberIds = `array(select user_id from chat_members where chat_id = chat.id order by joined_at, user_id)`
+	chatIds   = `array(select chat_id from chat_members where user_id = users.id order by joined_at, chat_id)`
+)
+
+// createMemberTable creates chat_members and moves the membership arrays
+// and member roles into it
+func (s *PostgresStore) createMemberTable(ctx context.Context) error {
+	query := `create table if not exists chat_members (
+		chat_id integer not null references chat (id) on delete cascade,
+		user_id integer not null references users (id) on delete cascade,
+		role varchar(20) not null default 'member',
+		joined_at timestamp not null default now(),
+		primary key (chat_id, user_id)
+	);
+	create index if not exists chat_members_user_idx on chat_members (user_id, joined_at)`
+	if _, err := s.db.ExecContext(ctx, query); err != nil {
+		return err
+	}
+
+	// migrate arrays
+	var legacy bool
+	query = `select exists (select 1 from information_schema.columns where table_name = 'chat' and column_name = 'users')`
+	if err := s.db.QueryRowContext(ctx, query).Scan(&legacy); err != nil || !legacy {
+		return err
+	}
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// whichever side lists a membership counts, ids of deleted rows don't
+	query = `insert into chat_members (chat_id, user_id, role)
+	select m.chat_id, m.user_id, coalesce(r.role, 'member')
+	from (
+		select id as chat_id, unnest(users) as user_id from chat
+		union
+		select unnest(chats), id from users
+	) m
+	join chat c on c.id = m.chat_id
+	join users u on u.id = m.user_id
+	left join chat_member_roles r on r.chat_id = m.chat_id and r.user_id = m.user_id
+	on conflict do nothing;
+	delete from chat_member_roles r using chat_members m where m.chat_id = r.chat_id and m.user_id = r.user_id;
+	alter table chat drop column users;
+	alter table users drop column if exists chats;
+	alter table chat drop column if exists version;
+	alter table users drop column if exists version`
+	if _, err = tx.ExecContext(ctx, query); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// AddMember makes the user a member of the chat with the role they had
+// when they left, if any. Adding a member again changes nothing and returns
+// ErrConflict, so of two racing joins only the one that added the row
+// records the join
+func (s *PostgresStore) AddMember(ctx context.Context, chatId int, userId int) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		log.Println("addMember begin error")
+		return err
+	}
+	defer tx.Rollback()
+
+	// exec queries, new members have read everything sent before
+	query := `insert into chat_members (chat_id, user_id, role, last_read)
+	values ($1, $2, coalesce((select role from chat_member_roles where chat_id = $1 and user_id = $2), $3),
+	coalesce((select max(id) from messages where chat_id = $1), 0))
+	on conflict do nothing`
+	res, err := tx.ExecContext(ctx, query, chatId, userId, types.MemberRoleMember)
+	if err != nil {
+		log.Println("addMember insert error")
+		return storageError(err)
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrConflict
+	}
+	if _, err = tx.ExecContext(ctx, `delete from chat_member_roles where chat_id = $1 and user_id = $2`, chatId, userId); err != nil {
+		log.Println("addMember roles error")
+		return err
+	}
+	if err = addMemberEvent(ctx, tx, types.OutboxMemberJoined, chatId, userId); err != nil {
+		log.Println("addMember outbox error")
+		return err
+	}
+	return tx.Commit()
+}
+
+// RemoveMember takes the user out of the chat, a role other than member
+// is kept for when they join again
+func (s *PostgresStore) RemoveMember(ctx context.Context, chatId int, userId int) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		log.Println("removeMember begin error")
+		return err
+	}
+	defer tx.Rollback()
+
+	// exec queries
+	role := ""
+	query := `delete from chat_members where chat_id = $1 and user_id = $2 returning role`
+	if err = tx.QueryRowContext(ctx, query, chatId, userId).Scan(&role); err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			log.Println("removeMember delete error")
+		}
+		return storageError(err)
+	}
+	if role != types.MemberRoleMember {
+		query = `insert into chat_member_roles (chat_id, user_id, role) values ($1, $2, $3)
+		on conflict (chat_id, user_id) do update set role = excluded.role`
+		if _, err = tx.ExecContext(ctx, query, chatId, userId, role); err != nil {
+			log.Println("removeMember roles error")
+			return err
+		}
+	}
+	if err = addMemberEvent(ctx, tx, types.OutboxMemberLeft, chatId, userId); err != nil {
+		log.Println("removeMember outbox error")
+		return err
+	}
+	return tx.Commit()
+}
+
+// GetMembers pages through the members of the chat by user id, after the
+// given one, and counts them all
+func (s *PostgresStore) GetMembers(ctx context.Context, chatId int, after int, limit int) ([]types.MemberJSON, int, error) {
+	// count members
+	total := 0
+	query := `select count(*) from chat_members where chat_id = $1`
+	if err := s.db.QueryRowContext(ctx, query, chatId).Scan(&total); err != nil {
+		log.Println("getMembers count error")
+		return nil, 0, err
+	}
+
+	// exec query
+	query = `select u.id, u.username, u.display_name, m.role, m.joined_at, case when u.show_last_seen then u.last_seen end
+	from chat_members m
+	join users u on u.id = m.user_id
+	where m.chat_id = $1 and m.user_id > $2
+	order by m.user_id
+	limit $3`
+	rows, err := s.db.QueryContext(ctx, query, chatId, after, limit)
+	if err != nil {
+		log.Println("getMembers query error")
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	// iterate rows
+	members := []types.MemberJSON{}
+	for rows.Next() {
+		member := types.MemberJSON{}
+		var lastSeen sql.NullTime
+		if err := rows.Scan(&member.Id, &member.Username, &member.DisplayName, &member.Role, &member.JoinedAt, &lastSeen); err != nil {
+			log.Println("getMembers scan error")
+			return nil, 0, err
+		}
+		member.JoinedAt = member.JoinedAt.UTC()
+		if lastSeen.Valid {
+			t := lastSeen.Time.UTC()
+			member.LastSeen = &t
+		}
+		members = append(members, member)
+	}
+	if err = rows.Err(); err != nil {
+		log.Println("getMembers err error")
+		return nil, 0, err
+	}
+	return members, total, nil
+}
@@ -0,0 +1,123 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const (
+	// channel the server instances notify each other on
+	notifyChannel = "gochat_events"
+	// notify payloads are limited to 8000 bytes, longer ones are stored in
+	// broker_events, read right away and deleted after a minute, and only
+	// their id is sent
+	maxNotifyPayload = 7900
+	// the listener connection is checked when it was quiet this long
+	listenerPing = 90 * time.Second
+)
+
+// PostgresBroker relays events between server instances sharing a
+// database with LISTEN/NOTIFY, so running two of them needs nothing else
+type PostgresBroker struct {
+	db  *sql.DB
+	dsn string
+}
+
+func NewPostgresBroker(dsn string) (*PostgresBroker, error) {
+	db, err := openPostgres(dsn)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	query := `create table if not exists broker_events (
+		id bigserial primary key,
+		payload text not null,
+		created_at timestamp not null default now()
+	)`
+	if _, err = db.ExecContext(ctx, query); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &PostgresBroker{db: db, dsn: dsn}, nil
+}
+
+// Publish notifies every listening instance, the sender included
+func (b *PostgresBroker) Publish(ctx context.Context, payload []byte) error {
+	if len(payload) < maxNotifyPayload {
+		_, err := b.db.ExecContext(ctx, `select pg_notify($1, $2)`, notifyChannel, string(payload))
+		return err
+	}
+
+	// store it and send the id, the listeners fetch it
+	query := `with expired as (delete from broker_events where created_at < now() - interval '1 minute')
+	insert into broker_events (payload) values ($1) returning id`
+	var id int64
+	if err := b.db.QueryRowContext(ctx, query, string(payload)).Scan(&id); err != nil {
+		log.Println("publish insert error")
+		return err
+	}
+	_, err := b.db.ExecContext(ctx, `select pg_notify($1, $2)`, notifyChannel, "#"+strconv.FormatInt(id, 10))
+	return err
+}
+
+// Listen calls deliver with every published payload until ctx is done. The
+// connection is reopened when it drops, what was published meanwhile is
+// lost
+func (b *PostgresBroker) Listen(ctx context.Context, deliver func([]byte)) error {
+	listener := pq.NewListener(b.dsn, time.Second, time.Minute, func(event pq.ListenerEventType, err error) {
+		if err != nil {
+			log.Println("broker listener error:", err)
+		}
+	})
+	defer listener.Close()
+	if err := listener.Listen(notifyChannel); err != nil {
+		return err
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case n := <-listener.Notify:
+			// nil after a reconnect
+			if n == nil {
+				log.Println("broker listener reconnected, events may have been lost")
+				continue
+			}
+			payload := []byte(n.Extra)
+			if ref, ok := strings.CutPrefix(n.Extra, "#"); ok {
+				var err error
+				if payload, err = b.stored(ctx, ref); err != nil {
+					log.Println("broker fetch error:", err)
+					continue
+				}
+			}
+			deliver(payload)
+		case <-time.After(listenerPing):
+			go listener.Ping()
+		}
+	}
+}
+
+func (b *PostgresBroker) stored(ctx context.Context, ref string) ([]byte, error) {
+	id, err := strconv.ParseInt(ref, 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	var payload string
+	if err = b.db.QueryRowContext(ctx, `select payload from broker_events where id = $1`, id).Scan(&payload); err != nil {
+		return nil, storageError(err)
+	}
+	return []byte(payload), nil
+}
+
+func (b *PostgresBroker) Close() error {
+	return b.db.Close()
+}
@@ -0,0 +1,146 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"time"
+
+	"example/gochat/types"
+)
+
+// the outbox keeps integration events, written in the transaction of the
+// change they describe, until every consumer has been given them. Each
+// consumer has a cursor that only moves past what it was delivered
+
+// createOutboxTables needs postgres 13 for xid8. The transaction id of an
+// event tells whether transactions that started before it are still
+// running, ids are taken when a transaction inserts and not when it
+// commits, so reading by id alone could skip an event committed late
+func (s *PostgresStore) createOutboxTables(ctx context.Context) error {
+	query := `create table if not exists outbox (
+		id bigserial primary key,
+		type varchar(50) not null,
+		chat_id integer not null,
+		data jsonb not null,
+		tx_id xid8 not null default pg_current_xact_id(),
+		created_at timestamp not null default now()
+	);
+	create table if not exists outbox_consumers (
+		name varchar(100) primary key,
+		last_id bigint not null
+	)`
+
+	_, err := s.db.ExecContext(ctx, query)
+	return err
+}
+
+func addOutboxEvent(ctx context.Context, tx execer, eventType string, chatId int, data any) error {
+	djs, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	query := `insert into outbox (type, chat_id, data) values ($1, $2, $3)`
+	_, err = tx.ExecContext(ctx, query, eventType, chatId, djs)
+	return err
+}
+
+func (s *PostgresStore) AddOutboxEvent(ctx context.Context, eventType string, chatId int, data any) error {
+	if err := addOutboxEvent(ctx, s.db, eventType, chatId, data); err != nil {
+		log.Println("addOutboxEvent error")
+		return err
+	}
+	return nil
+}
+
+// addMemberEvent adds a member.joined or member.left event for the user
+func addMemberEvent(ctx context.Context, tx *sql.Tx, eventType string, chatId int, userId int) error {
+	event := types.MemberEventJSON{ChatId: chatId}
+	query := `select id, username, display_name from users where id = $1`
+	if err := tx.QueryRowContext(ctx, query, userId).Scan(&event.User.Id, &event.User.Username, &event.User.DisplayName); err != nil {
+		return storageError(err)
+	}
+	return addOutboxEvent(ctx, tx, eventType, chatId, event)
+}
+
+// DispatchOutbox gives up to limit events after the cursor of the consumer
+// to deliver, oldest first, and moves the cursor to the id it returns. A
+// new consumer starts after the latest event. Another server dispatching
+// to the same consumer holds its cursor, then this does nothing
+func (s *PostgresStore) DispatchOutbox(ctx context.Context, consumer string, limit int, deliver func([]types.OutboxEventJSON) int64) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		log.Println("dispatchOutbox begin error")
+		return err
+	}
+	defer tx.Rollback()
+
+	// lock cursor
+	query := `insert into outbox_consumers (name, last_id) values ($1, (select coalesce(max(id), 0) from outbox))
+	on conflict do nothing`
+	if _, err = tx.ExecContext(ctx, query, consumer); err != nil {
+		log.Println("dispatchOutbox consumer error")
+		return err
+	}
+	var cursor int64
+	query = `select last_id from outbox_consumers where name = $1 for update skip locked`
+	if err = tx.QueryRowContext(ctx, query, consumer).Scan(&cursor); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil
+		}
+		log.Println("dispatchOutbox cursor error")
+		return err
+	}
+
+	// events of finished transactions, up to the first still running
+	query = `select id, type, chat_id, data, created_at from outbox
+	where id > $1 and tx_id < pg_snapshot_xmin(pg_current_snapshot())
+	order by id
+	limit $2`
+	rows, err := tx.QueryContext(ctx, query, cursor, limit)
+	if err != nil {
+		log.Println("dispatchOutbox query error")
+		return err
+	}
+	events := []types.OutboxEventJSON{}
+	for rows.Next() {
+		event := types.OutboxEventJSON{}
+		if err := rows.Scan(&event.Id, &event.Type, &event.ChatId, &event.Data, &event.CreatedAt); err != nil {
+			rows.Close()
+			log.Println("dispatchOutbox scan error")
+			return err
+		}
+		event.CreatedAt = event.CreatedAt.UTC()
+		events = append(events, event)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		log.Println("dispatchOutbox err error")
+		return err
+	}
+	if len(events) == 0 {
+		return nil
+	}
+
+	// move cursor past what was delivered
+	last := deliver(events)
+	if last <= cursor {
+		return nil
+	}
+	if _, err = tx.ExecContext(ctx, `update outbox_consumers set last_id = $1 where name = $2`, last, consumer); err != nil {
+		log.Println("dispatchOutbox update error")
+		return err
+	}
+	return tx.Commit()
+}
+
+// PruneOutbox deletes the events created before the time, delivered or not
+func (s *PostgresStore) PruneOutbox(ctx context.Context, before time.Time) error {
+	if _, err := s.db.ExecContext(ctx, `delete from outbox where created_at < $1`, before.UTC()); err != nil {
+		log.Println("pruneOutbox error")
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,253 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// messages live in a table partitioned by month of created_at, so old
+// months can be dropped whole and each partition keeps small indexes
+
+// messagePartition returns the name and bounds of the partition holding t
+func messagePartition(t time.Time) (string, time.Time, time.Time) {
+	start := time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+	return fmt.Sprintf("messages_p%04d%02d", start.Year(), start.Month()), start, start.AddDate(0, 1, 0)
+}
+
+type execer interface {
+	ExecContext(context.Context, string, ...any) (sql.Result, error)
+}
+
+func createMessagePartition(ctx context.Context, db execer, month time.Time) error {
+	name, from, to := messagePartition(month)
+	query := fmt.Sprintf(`create table if not exists %s partition of messages for values from ('%s') to ('%s')`,
+		name, from.Format(time.DateTime), to.Format(time.DateTime))
+	_, err := db.ExecContext(ctx, query)
+	return err
+}
+
+// createMessageTable creates the partitioned messages table and moves
+// the messages out of the json column chats used to keep them in
+func (s *PostgresStore) createMessageTable(ctx context.Context) error {
+	query := `create table if not exists messages (
+		id bigint not null default nextval('message_id_seq'),
+		chat_id integer not null,
+		author_id integer not null,
+		author_name varchar(20) not null default '',
+		text varchar(2000) not null,
+		created_at timestamp not null default now(),
+		edited_at timestamp,
+		primary key (chat_id, id, created_at)
+	) partition by range (created_at);
+	create index if not exists messages_id_idx on messages (id);
+	create index if not exists messages_chat_created_idx on messages (chat_id, created_at)`
+	if _, err := s.db.ExecContext(ctx, query); err != nil {
+		return err
+	}
+
+	// this month and the next always exist
+	now := time.Now().UTC()
+	for _, month := range []time.Time{now, now.AddDate(0, 1, 0)} {
+		if err := createMessagePartition(ctx, s.db, month); err != nil {
+			return err
+		}
+	}
+
+	// migrate json messages
+	var legacy bool
+	query = `select exists (select 1 from information_schema.columns where table_name = 'chat' and column_name = 'messages')`
+	if err := s.db.QueryRowContext(ctx, query).Scan(&legacy); err != nil || !legacy {
+		return err
+	}
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// every month with messages needs its partition first, messages from
+	// before createdAt existed end up in year 1
+	rows, err := tx.QueryContext(ctx, `select distinct date_trunc('month', coalesce((m->>'createdAt')::timestamptz at time zone 'UTC', now()))
+	from chat, jsonb_array_elements(coalesce(messages::jsonb, '[]')) m`)
+	if err != nil {
+		return err
+	}
+	months := []time.Time{}
+	for rows.Next() {
+		var month time.Time
+		if err := rows.Scan(&month); err != nil {
+			rows.Close()
+			return err
+		}
+		months = append(months, month)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	for _, month := range months {
+		if err = createMessagePartition(ctx, tx, month); err != nil {
+			return err
+		}
+	}
+
+	query = `insert into messages (id, chat_id, author_id, author_name, text, created_at, edited_at)
+	select (m->>'id')::bigint, c.id, (m->'author'->>'id')::integer, coalesce(m->'author'->>'username', ''), m->>'text',
+	coalesce((m->>'createdAt')::timestamptz at time zone 'UTC', now()), (m->>'editedAt')::timestamptz at time zone 'UTC'
+	from chat c, jsonb_array_elements(coalesce(c.messages::jsonb, '[]')) m;
+	alter table chat drop column messages`
+	if _, err = tx.ExecContext(ctx, query); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// MaintainMessages creates the partitions for this month and the next and,
+// when retention is set, drops the months that ended more than retention
+// ago together with the reactions, edits, receipts and bookmarks of their
+// messages. Pruning goes a month at a time, so up to a month more than
+// retention is kept
+func (s *PostgresStore) MaintainMessages(ctx context.Context, now time.Time, retention time.Duration) error {
+	now = now.UTC()
+	for _, month := range []time.Time{now, now.AddDate(0, 1, 0)} {
+		if err := createMessagePartition(ctx, s.db, month); err != nil {
+			log.Println("maintainMessages create error")
+			return err
+		}
+	}
+	if retention <= 0 {
+		return nil
+	}
+
+	// find expired partitions, by name since they are all ours
+	query := `select c.relname from pg_inherits i
+	join pg_class c on c.oid = i.inhrelid
+	join pg_class p on p.oid = i.inhparent
+	where p.relname = 'messages'
+	order by c.relname`
+	rows, err := s.db.QueryContext(ctx, query)
+	if err != nil {
+		log.Println("maintainMessages query error")
+		return err
+	}
+	expired := []string{}
+	cutoff := now.Add(-retention)
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			log.Println("maintainMessages scan error")
+			return err
+		}
+		month, err := time.Parse("messages_p200601", name)
+		if err != nil {
+			continue
+		}
+		if _, _, end := messagePartition(month); !end.After(cutoff) {
+			expired = append(expired, name)
+		}
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		log.Println("maintainMessages err error")
+		return err
+	}
+
+	// drop one month per transaction
+	for _, name := range expired {
+		if err = s.dropMessagePartition(ctx, name); err != nil {
+			log.Println("maintainMessages drop error")
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *PostgresStore) dropMessagePartition(ctx context.Context, name string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, table := range []string{"message_edits", "message_reactions", "message_receipts", "bookmarks"} {
+		query := fmt.Sprintf(`delete from %s where message_id in (select id from %s)`, table, name)
+		if _, err = tx.ExecContext(ctx, query); err != nil {
+			return err
+		}
+	}
+	if err = uncountMessages(ctx, tx, name, "true"); err != nil {
+		return err
+	}
+	if _, err = tx.ExecContext(ctx, fmt.Sprintf(`drop table %s`, name)); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// PurgeMessages deletes up to limit of the oldest messages of the chat sent
+// before the time, all of them when it is zero, in one transaction and
+// returns how many it deleted. Callers repeat it until it deletes fewer
+func (s *PostgresStore) PurgeMessages(ctx context.Context, chatId int, before time.Time, limit int) (int, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		log.Println("purgeMessages begin error")
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	// pick the batch
+	query := `select id from messages
+	where chat_id = $1 and ($2::timestamp is null or created_at < $2)
+	order by id
+	limit $3`
+	var cutoff *time.Time
+	if !before.IsZero() {
+		utc := before.UTC()
+		cutoff = &utc
+	}
+	rows, err := tx.QueryContext(ctx, query, chatId, cutoff, limit)
+	if err != nil {
+		log.Println("purgeMessages query error")
+		return 0, err
+	}
+	ids := []int64{}
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			log.Println("purgeMessages scan error")
+			return 0, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		log.Println("purgeMessages err error")
+		return 0, err
+	}
+	if len(ids) == 0 {
+		return 0, nil
+	}
+
+	// delete them with what points at them
+	for _, table := range []string{"message_edits", "message_reactions", "message_receipts", "bookmarks"} {
+		if _, err = tx.ExecContext(ctx, `delete from `+table+` where message_id = any($1)`, pq.Array(ids)); err != nil {
+			log.Println("purgeMessages cleanup error")
+			return 0, err
+		}
+	}
+	if err = uncountMessages(ctx, tx, "messages", "chat_id = $1 and id = any($2)", chatId, pq.Array(ids)); err != nil {
+		log.Println("purgeMessages count error")
+		return 0, err
+	}
+	if _, err = tx.ExecContext(ctx, `delete from messages where chat_id = $1 and id = any($2)`, chatId, pq.Array(ids)); err != nil {
+		log.Println("purgeMessages delete error")
+		return 0, err
+	}
+	return len(ids), tx.Commit()
+}
@@ -0,0 +1,172 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"example/gochat/types"
+)
+
+// MonthFormat is how usage months are written, e.g. 2024-01
+const MonthFormat = "2006-01"
+
+// createQuotaTables keeps the quotas on the workspace and counts the
+// messages sent in each workspace by month, deleting messages doesn't
+// uncount them
+func (s *PostgresStore) createQuotaTables(ctx context.Context) error {
+	query := `alter table workspaces add column if not exists max_members integer not null default 0,
+		add column if not exists max_messages integer not null default 0,
+		add column if not exists max_storage_bytes bigint not null default 0;
+	create table if not exists workspace_usage (
+		workspace_id integer not null,
+		month date not null,
+		messages integer not null default 0,
+		primary key (workspace_id, month)
+	)`
+
+	_, err := s.db.ExecContext(ctx, query)
+	return err
+}
+
+// quotaColumns are scanned into types.WorkspaceQuotaJSON
+const quotaColumns = `max_members, max_messages, max_storage_bytes`
+
+// countWorkspaceMessage adds a new message to the usage of its chat's
+// workspace
+func countWorkspaceMessage(ctx context.Context, tx *sql.Tx, message types.MessageJSON) error {
+	query := `insert into workspace_usage (workspace_id, month, messages)
+	select workspace_id, date_trunc('month', $2::timestamp)::date, 1 from chat where id = $1
+	on conflict (workspace_id, month) do update set messages = workspace_usage.messages + 1`
+	_, err := tx.ExecContext(ctx, query, message.ChatId, message.CreatedAt.UTC())
+	return err
+}
+
+// SetWorkspaceQuota returns ErrNotFound for the default workspace, which
+// has no quota
+func (s *PostgresStore) SetWorkspaceQuota(ctx context.Context, id int, quota types.WorkspaceQuotaJSON) error {
+	// exec query
+	query := `update workspaces set max_members = $2, max_messages = $3, max_storage_bytes = $4 where id = $1`
+	res, err := s.db.ExecContext(ctx, query, id, quota.MaxMembers, quota.MaxMessages, quota.MaxStorageBytes)
+	if err != nil {
+		log.Println("setWorkspaceQuota error")
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *PostgresStore) GetWorkspaceUsage(ctx context.Context, id int, month time.Time) (*types.WorkspaceUsageJSON, error) {
+	usage := &types.WorkspaceUsageJSON{WorkspaceId: id, Month: month.UTC().Format(MonthFormat)}
+
+	// get quota
+	if id != DefaultWorkspace {
+		query := `select ` + quotaColumns + ` from workspaces where id = $1`
+		if err := s.db.QueryRowContext(ctx, query, id).Scan(&usage.Quota.MaxMembers, &usage.Quota.MaxMessages, &usage.Quota.MaxStorageBytes); err != nil {
+			if err = storageError(err); !errors.Is(err, ErrNotFound) {
+				log.Println("getWorkspaceUsage quota error")
+			}
+			return nil, err
+		}
+	}
+
+	// exec query
+	query := `select
+		(select count(*) from users where workspace_id = $1),
+		coalesce((select messages from workspace_usage where workspace_id = $1 and month = date_trunc('month', $2::timestamp)::date), 0),
+		(select coalesce(sum(octet_length(m.text)), 0) from messages m join chat c on c.id = m.chat_id where c.workspace_id = $1)
+		+ (select coalesce(sum(octet_length(i.data)), 0) from chat_images i join chat c on c.id = i.chat_id where c.workspace_id = $1)`
+	if err := s.db.QueryRowContext(ctx, query, id, month.UTC()).Scan(&usage.Members, &usage.Messages, &usage.StorageBytes); err != nil {
+		log.Println("getWorkspaceUsage error")
+		return nil, err
+	}
+	return usage, nil
+}
+
+// countBoltWorkspaceMessage adds a new message to the usage of the workspace
+func countBoltWorkspaceMessage(tx *bolt.Tx, workspaceId int, at time.Time) error {
+	b := tx.Bucket(bucketWorkspaceUsage)
+	key := pairKey(workspaceId, at.UTC().Format(MonthFormat))
+	count := 0
+	if err := get(b, key, &count); err != nil && !errors.Is(err, ErrNotFound) {
+		return err
+	}
+	return put(b, key, count+1)
+}
+
+func (s *BoltStore) SetWorkspaceQuota(ctx context.Context, id int, quota types.WorkspaceQuotaJSON) error {
+	return s.update("setWorkspaceQuota", func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketWorkspaces)
+		w := types.WorkspaceJSON{}
+		if err := get(b, itob(int64(id)), &w); err != nil {
+			return err
+		}
+		w.Quota = quota
+		return put(b, itob(int64(id)), w)
+	})
+}
+
+func (s *BoltStore) GetWorkspaceUsage(ctx context.Context, id int, month time.Time) (*types.WorkspaceUsageJSON, error) {
+	usage := &types.WorkspaceUsageJSON{WorkspaceId: id, Month: month.UTC().Format(MonthFormat)}
+	err := s.view("getWorkspaceUsage", func(tx *bolt.Tx) error {
+		// get quota
+		if id != DefaultWorkspace {
+			w := types.WorkspaceJSON{}
+			if err := get(tx.Bucket(bucketWorkspaces), itob(int64(id)), &w); err != nil {
+				return err
+			}
+			usage.Quota = w.Quota
+		}
+		if err := get(tx.Bucket(bucketWorkspaceUsage), pairKey(id, usage.Month), &usage.Messages); err != nil && !errors.Is(err, ErrNotFound) {
+			return err
+		}
+
+		// count members
+		err := tx.Bucket(bucketUsers).ForEach(func(k, v []byte) error {
+			u := &boltUser{}
+			if err := json.Unmarshal(v, u); err != nil {
+				return err
+			}
+			if u.WorkspaceId == id {
+				usage.Members++
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		// add up message texts and images
+		images := tx.Bucket(bucketChatImages)
+		return tx.Bucket(bucketChats).ForEach(func(k, v []byte) error {
+			c := &boltChat{}
+			if err := json.Unmarshal(v, c); err != nil {
+				return err
+			}
+			if c.WorkspaceId != id {
+				return nil
+			}
+			for _, m := range c.Messages {
+				usage.StorageBytes += int64(len(m.Text))
+			}
+			for kind := range c.Images {
+				image := boltImage{}
+				if err := get(images, pairKey(c.Id, kind), &image); err == nil {
+					usage.StorageBytes += int64(len(image.Data))
+				}
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return usage, nil
+}
@@ -0,0 +1,110 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"log"
+
+	"github.com/lib/pq"
+
+	"example/gochat/types"
+)
+
+// chat_members.last_read is the id of the last message each member read,
+// unread counts are the messages from others after it
+
+// orders of GetUserChats
+const (
+	ChatsByActivity = "activity"
+	ChatsByName     = "name"
+)
+
+// addLastReadColumn adds the read position of members, existing members
+// start with everything read
+func (s *PostgresStore) addLastReadColumn(ctx context.Context) error {
+	query := `alter table chat_members add column if not exists last_read bigint;
+	update chat_members m set last_read = coalesce((select max(id) from messages where chat_id = m.chat_id), 0) where last_read is null;
+	alter table chat_members alter column last_read set default 0, alter column last_read set not null`
+
+	_, err := s.db.ExecContext(ctx, query)
+	return err
+}
+
+// MarkRead moves the read position of the user in the chat of the message
+// forward to it, reading an older message changes nothing
+func (s *PostgresStore) MarkRead(ctx context.Context, userId int, messageId int64) error {
+	// exec query
+	query := `update chat_members set last_read = $2
+	where user_id = $1 and chat_id = (select chat_id from messages where id = $2) and last_read < $2`
+	if _, err := s.db.ExecContext(ctx, query, userId, messageId); err != nil {
+		log.Println("markRead error")
+		return err
+	}
+	return nil
+}
+
+// GetReadMarker returns the read position of a member, ErrNotFound when
+// the user isn't one
+func (s *PostgresStore) GetReadMarker(ctx context.Context, userId int, chatId int) (int64, error) {
+	// exec query
+	var lastRead int64
+	query := `select last_read from chat_members where chat_id = $1 and user_id = $2`
+	if err := s.db.QueryRowContext(ctx, query, chatId, userId).Scan(&lastRead); err != nil {
+		if err = storageError(err); !errors.Is(err, ErrNotFound) {
+			log.Println("getReadMarker error")
+		}
+		return 0, err
+	}
+	return lastRead, nil
+}
+
+// SetReadMarker puts the read position of a member on a message of the
+// chat, also backwards, 0 marks the whole chat unread. ErrNotFound when
+// the user isn't a member or the message isn't in the chat
+func (s *PostgresStore) SetReadMarker(ctx context.Context, userId int, chatId int, messageId int64) error {
+	// exec query
+	query := `update chat_members set last_read = $3
+	where chat_id = $1 and user_id = $2 and ($3 = 0 or exists (select 1 from messages where chat_id = $1 and id = $3))`
+	res, err := s.db.ExecContext(ctx, query, chatId, userId, messageId)
+	if err != nil {
+		log.Println("setReadMarker error")
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// MarkAllRead moves the read position of the user to the last message of
+// each of the chats, or of all their chats when none are given, in one
+// statement. It returns the positions that moved
+func (s *PostgresStore) MarkAllRead(ctx context.Context, userId int, chatIds []int) ([]types.ReadMarkerJSON, error) {
+	// exec query
+	query := `update chat_members m set last_read = l.id
+	from (select c.chat_id, (select max(id) from messages where chat_id = c.chat_id) as id from chat_members c where c.user_id = $1) l
+	where m.user_id = $1 and m.chat_id = l.chat_id and m.last_read < l.id and (cardinality($2::integer[]) = 0 or m.chat_id = any($2))
+	returning m.chat_id, m.last_read`
+	rows, err := s.db.QueryContext(ctx, query, userId, pq.Array(chatIds))
+	if err != nil {
+		log.Println("markAllRead query error")
+		return nil, err
+	}
+	defer rows.Close()
+
+	// iterate rows
+	result := []types.ReadMarkerJSON{}
+	for rows.Next() {
+		marker := types.ReadMarkerJSON{}
+		if err := rows.Scan(&marker.ChatId, &marker.MessageId); err != nil {
+			log.Println("markAllRead scan error")
+			return nil, err
+		}
+		result = append(result, marker)
+	}
+	if err = rows.Err(); err != nil {
+		log.Println("markAllRead err error")
+		return nil, err
+	}
+	return result, nil
+}
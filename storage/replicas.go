@@ -0,0 +1,71 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// a replica that fails is skipped for this long
+const replicaBackoff = 5 * time.Second
+
+// replica is a read only copy of the database, reads on it go through a
+// PostgresStore of its own so the queries are shared with the primary
+type replica struct {
+	store     *PostgresStore
+	downUntil atomic.Int64
+}
+
+func (r *replica) up() bool {
+	return time.Now().UnixNano() >= r.downUntil.Load()
+}
+
+func (r *replica) fail() {
+	r.downUntil.Store(time.Now().Add(replicaBackoff).UnixNano())
+}
+
+// replica picks the next replica that is up, round robin, nil when
+// there is none
+func (s *PostgresStore) replica() *replica {
+	n := len(s.replicas)
+	if n == 0 {
+		return nil
+	}
+	start := int(s.nextReplica.Add(1))
+	for i := 0; i < n; i++ {
+		if r := s.replicas[(start+i)%n]; r.up() {
+			return r
+		}
+	}
+	return nil
+}
+
+// read runs fn on a replica when one is up and on the primary otherwise.
+// Replicas can lag behind, so a read that finds nothing or fails there is
+// retried on the primary, which also covers reading right after a write
+func (s *PostgresStore) read(ctx context.Context, fn func(*PostgresStore) error) error {
+	if ctx.Value(primaryKey{}) != nil {
+		return fn(s)
+	}
+	if r := s.replica(); r != nil {
+		err := fn(r.store)
+		if err == nil || ctx.Err() != nil {
+			return err
+		}
+		if !errors.Is(err, ErrNotFound) {
+			log.Println("replica read error, using primary for", replicaBackoff)
+			r.fail()
+		}
+	}
+	return fn(s)
+}
+
+type primaryKey struct{}
+
+// Primary returns a context whose reads all go to the primary, for reads
+// that must not be stale
+func Primary(ctx context.Context) context.Context {
+	return context.WithValue(ctx, primaryKey{}, true)
+}
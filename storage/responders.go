@@ -0,0 +1,160 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"example/gochat/types"
+)
+
+func (s *PostgresStore) createResponderTable(ctx context.Context) error {
+	query := `create table if not exists chat_responders (
+		id serial primary key,
+		chat_id integer not null references chat (id) on delete cascade,
+		bot_id integer not null references users (id) on delete cascade,
+		trigger varchar(100) not null,
+		response varchar(2000) not null,
+		cooldown_seconds integer not null,
+		created_at timestamp not null default now()
+	);
+	create index if not exists chat_responders_chat_idx on chat_responders (chat_id)`
+
+	_, err := s.db.ExecContext(ctx, query)
+	return err
+}
+
+// CreateResponder adds an auto-responder to a chat, ErrNotFound when the
+// chat or the bot doesn't exist
+func (s *PostgresStore) CreateResponder(ctx context.Context, responder types.ResponderJSON) (*types.ResponderJSON, error) {
+	// exec query
+	query := `insert into chat_responders (chat_id, bot_id, trigger, response, cooldown_seconds)
+	values ($1, $2, $3, $4, $5)
+	returning id, created_at`
+	err := s.db.QueryRowContext(ctx, query, responder.ChatId, responder.BotId, responder.Trigger, responder.Response, responder.CooldownSeconds).Scan(&responder.Id, &responder.CreatedAt)
+	if err != nil {
+		if err = storageError(err); !errors.Is(err, ErrNotFound) {
+			log.Println("createResponder error")
+		}
+		return nil, err
+	}
+	responder.CreatedAt = responder.CreatedAt.UTC()
+	return &responder, nil
+}
+
+// GetResponders returns the auto-responders of a chat, oldest first
+func (s *PostgresStore) GetResponders(ctx context.Context, chatId int) ([]types.ResponderJSON, error) {
+	// exec query
+	query := `select id, chat_id, bot_id, trigger, response, cooldown_seconds, created_at
+	from chat_responders where chat_id = $1 order by id`
+	rows, err := s.db.QueryContext(ctx, query, chatId)
+	if err != nil {
+		log.Println("getResponders query error")
+		return nil, err
+	}
+	defer rows.Close()
+
+	// iterate rows
+	responders := []types.ResponderJSON{}
+	for rows.Next() {
+		r := types.ResponderJSON{}
+		if err := rows.Scan(&r.Id, &r.ChatId, &r.BotId, &r.Trigger, &r.Response, &r.CooldownSeconds, &r.CreatedAt); err != nil {
+			log.Println("getResponders scan error")
+			return nil, err
+		}
+		r.CreatedAt = r.CreatedAt.UTC()
+		responders = append(responders, r)
+	}
+	if err = rows.Err(); err != nil {
+		log.Println("getResponders err error")
+		return nil, err
+	}
+	return responders, nil
+}
+
+// DeleteResponder removes an auto-responder of the chat
+func (s *PostgresStore) DeleteResponder(ctx context.Context, chatId int, id int) error {
+	// exec query
+	res, err := s.db.ExecContext(ctx, `delete from chat_responders where id = $1 and chat_id = $2`, id, chatId)
+	if err != nil {
+		log.Println("deleteResponder error")
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// boltResponder keeps the bot as userId so deleting the bot drops it
+type boltResponder struct {
+	Id              int       `json:"id"`
+	ChatId          int       `json:"chatId"`
+	UserId          int       `json:"userId"`
+	Trigger         string    `json:"trigger"`
+	Response        string    `json:"response"`
+	CooldownSeconds int       `json:"cooldownSeconds"`
+	CreatedAt       time.Time `json:"createdAt"`
+}
+
+func (r boltResponder) toJSON() types.ResponderJSON {
+	return types.ResponderJSON{Id: r.Id, ChatId: r.ChatId, BotId: r.UserId, Trigger: r.Trigger, Response: r.Response, CooldownSeconds: r.CooldownSeconds, CreatedAt: r.CreatedAt}
+}
+
+func (s *BoltStore) CreateResponder(ctx context.Context, responder types.ResponderJSON) (*types.ResponderJSON, error) {
+	err := s.update("createResponder", func(tx *bolt.Tx) error {
+		if tx.Bucket(bucketChats).Get(itob(int64(responder.ChatId))) == nil {
+			return ErrNotFound
+		}
+		if _, err := getUser(tx, responder.BotId); err != nil {
+			return err
+		}
+		b := tx.Bucket(bucketResponders)
+		id, err := nextId(b)
+		if err != nil {
+			return err
+		}
+		r := boltResponder{Id: int(id), ChatId: responder.ChatId, UserId: responder.BotId, Trigger: responder.Trigger, Response: responder.Response, CooldownSeconds: responder.CooldownSeconds, CreatedAt: time.Now().UTC()}
+		responder = r.toJSON()
+		return put(b, itob(id), r)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &responder, nil
+}
+
+func (s *BoltStore) GetResponders(ctx context.Context, chatId int) ([]types.ResponderJSON, error) {
+	responders := []types.ResponderJSON{}
+	err := s.view("getResponders", func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketResponders).ForEach(func(k, v []byte) error {
+			r := boltResponder{}
+			if err := json.Unmarshal(v, &r); err != nil {
+				return err
+			}
+			if r.ChatId == chatId {
+				responders = append(responders, r.toJSON())
+			}
+			return nil
+		})
+	})
+	return responders, err
+}
+
+func (s *BoltStore) DeleteResponder(ctx context.Context, chatId int, id int) error {
+	return s.update("deleteResponder", func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketResponders)
+		r := boltResponder{}
+		if err := get(b, itob(int64(id)), &r); err != nil {
+			return err
+		}
+		if r.ChatId != chatId {
+			return ErrNotFound
+		}
+		return b.Delete(itob(int64(id)))
+	})
+}
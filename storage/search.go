@@ -0,0 +1,109 @@
+package storage
+
+import (
+	"context"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+
+	"example/gochat/types"
+)
+
+// MessageSearch filters messages, fields left zero don't filter
+type MessageSearch struct {
+	// chats to search in, nothing is found without any
+	ChatIds []int
+	// contained in the text, ignoring case
+	Text string
+	// username of the author, ignoring case
+	Author string
+	After  time.Time
+	Before time.Time
+	// only messages with an http(s) url
+	HasLink bool
+	// only messages with ids below, to page through the results
+	BeforeId int64
+	Limit    int
+}
+
+// linkPattern matches the start of a url, in postgres and go regexp syntax
+const linkPattern = `https?://`
+
+var linkRegexp = regexp.MustCompile(`(?i)` + linkPattern)
+
+// createMessageSearchIndexes lets text and link filters use trigrams and
+// author filters skip to the author's messages
+func (s *PostgresStore) createMessageSearchIndexes(ctx context.Context) error {
+	query := `create extension if not exists pg_trgm;
+	create index if not exists messages_text_trgm_idx on messages using gin (text gin_trgm_ops);
+	create index if not exists messages_author_created_idx on messages (author_id, created_at)`
+
+	_, err := s.db.ExecContext(ctx, query)
+	return err
+}
+
+// SearchMessages returns the messages matching every filter, newest first
+func (s *PostgresStore) SearchMessages(ctx context.Context, search MessageSearch) ([]types.MessageJSON, error) {
+	// only the filters that are set end up in the query
+	where := []string{`chat_id = any($1)`}
+	args := []any{pq.Array(search.ChatIds)}
+	arg := func(v any) string {
+		args = append(args, v)
+		return "$" + strconv.Itoa(len(args))
+	}
+	if search.Text != "" {
+		where = append(where, `text ilike `+arg("%"+escapeLike(search.Text)+"%"))
+	}
+	if search.Author != "" {
+		where = append(where, `author_id = (select id from users where lower(username) = lower(`+arg(search.Author)+`))`)
+	}
+	if !search.After.IsZero() {
+		where = append(where, `created_at > `+arg(search.After.UTC()))
+	}
+	if !search.Before.IsZero() {
+		where = append(where, `created_at < `+arg(search.Before.UTC()))
+	}
+	if search.HasLink {
+		where = append(where, `text ~* '`+linkPattern+`'`)
+	}
+	if search.BeforeId != 0 {
+		where = append(where, `id < `+arg(search.BeforeId))
+	}
+
+	// exec query
+	query := `select ` + messageColumns + ` from messages
+	where ` + strings.Join(where, " and ") + `
+	order by id desc
+	limit ` + arg(search.Limit)
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		log.Println("searchMessages query error")
+		return nil, err
+	}
+	defer rows.Close()
+
+	// iterate rows
+	result := []types.MessageJSON{}
+	for rows.Next() {
+		m, err := scanMessage(rows)
+		if err != nil {
+			log.Println("searchMessages scan error")
+			return nil, err
+		}
+		result = append(result, m)
+	}
+	if err = rows.Err(); err != nil {
+		log.Println("searchMessages err error")
+		return nil, err
+	}
+	return result, nil
+}
+
+// escapeLike makes s match itself in a like pattern
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
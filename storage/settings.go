@@ -0,0 +1,108 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+)
+
+// settings are free-form client preferences (theme, compact mode, ...)
+// kept as one json object per user so they follow the user across devices
+
+// mergeSettings applies patch to settings, a null value removes the key.
+// ErrLimit when more than maxKeys would be left
+func mergeSettings(settings map[string]json.RawMessage, patch map[string]json.RawMessage, maxKeys int) error {
+	for key, value := range patch {
+		if value == nil || string(value) == "null" {
+			delete(settings, key)
+			continue
+		}
+		settings[key] = value
+	}
+	if len(settings) > maxKeys {
+		return ErrLimit
+	}
+	return nil
+}
+
+func (s *PostgresStore) createSettingTable(ctx context.Context) error {
+	query := `create table if not exists user_settings (
+		user_id integer primary key references users (id) on delete cascade,
+		settings jsonb not null default '{}',
+		updated_at timestamp not null default now()
+	)`
+
+	_, err := s.db.ExecContext(ctx, query)
+	return err
+}
+
+// GetSettings returns the settings of a user, empty when none were set
+func (s *PostgresStore) GetSettings(ctx context.Context, userId int) (map[string]json.RawMessage, error) {
+	// exec query
+	query := `select coalesce((select settings from user_settings where user_id = $1), '{}')`
+	var data []byte
+	if err := s.db.QueryRowContext(ctx, query, userId).Scan(&data); err != nil {
+		log.Println("getSettings scan error")
+		return nil, err
+	}
+
+	settings := map[string]json.RawMessage{}
+	if err := json.Unmarshal(data, &settings); err != nil {
+		log.Println("getSettings json decode error")
+		return nil, err
+	}
+	return settings, nil
+}
+
+// UpdateSettings merges patch into the settings of a user and returns the
+// result, see mergeSettings
+func (s *PostgresStore) UpdateSettings(ctx context.Context, userId int, patch map[string]json.RawMessage, maxKeys int) (map[string]json.RawMessage, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		log.Println("updateSettings begin error")
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// lock the row, creating it first so concurrent patches queue up
+	query := `insert into user_settings (user_id) values ($1) on conflict do nothing`
+	if _, err = tx.ExecContext(ctx, query, userId); err != nil {
+		if err = storageError(err); !errors.Is(err, ErrNotFound) {
+			log.Println("updateSettings insert error")
+		}
+		return nil, err
+	}
+	var data []byte
+	query = `select settings from user_settings where user_id = $1 for update`
+	if err = tx.QueryRowContext(ctx, query, userId).Scan(&data); err != nil {
+		log.Println("updateSettings select error")
+		return nil, err
+	}
+
+	// merge
+	settings := map[string]json.RawMessage{}
+	if err = json.Unmarshal(data, &settings); err != nil {
+		log.Println("updateSettings json decode error")
+		return nil, err
+	}
+	if err = mergeSettings(settings, patch, maxKeys); err != nil {
+		return nil, err
+	}
+	if data, err = json.Marshal(settings); err != nil {
+		log.Println("updateSettings json encode error")
+		return nil, err
+	}
+
+	// exec query
+	query = `update user_settings set settings = $1, updated_at = now() where user_id = $2`
+	if _, err = tx.ExecContext(ctx, query, data, userId); err != nil {
+		log.Println("updateSettings update error")
+		return nil, err
+	}
+	if err = tx.Commit(); err != nil {
+		log.Println("updateSettings commit error")
+		return nil, err
+	}
+	return settings, nil
+}
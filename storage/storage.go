@@ -0,0 +1,2590 @@
+// Package storage persists users, chats and messages
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/lib/pq"
+
+	"example/gochat/types"
+)
+
+// errors returned by every Storage implementation, anything else is
+// an internal error
+var (
+	ErrNotFound = errors.New("not found")
+	ErrConflict = errors.New("already exists")
+	ErrLimit    = errors.New("limit reached")
+	// ErrUnscoped is returned by a WorkspaceStore for a context that is
+	// neither scoped to a workspace nor marked Unscoped
+	ErrUnscoped = errors.New("context has no workspace")
+)
+
+type Storage interface {
+	CreateUser(context.Context, string, string, string) (*types.User, error)
+	GetUserById(context.Context, int) (*types.User, error)
+	GetUserByEmail(context.Context, string) (*types.User, error)
+	GetUsers(context.Context, []int) ([]types.User, error)
+	// GetAuthors returns the authors by id, deleted users as
+	// types.DeletedUser
+	GetAuthors(context.Context, []int) (map[int]types.AuthorJSON, error)
+	TouchLastSeen(context.Context, int, time.Time) error
+	SetShowLastSeen(context.Context, int, bool) error
+	GetProfile(context.Context, int) (*types.ProfileJSON, error)
+	SetProfile(context.Context, int, types.ProfileRequest) error
+	UpdateUserRole(context.Context, int, string) error
+	SetRoleByEmail(context.Context, []string, string) error
+	ListUsers(context.Context, string, int, int) ([]types.User, int, error)
+	SetUserDisabled(context.Context, int, bool) error
+	SetPassword(context.Context, int, string) error
+	DeleteUser(context.Context, int) error
+
+	CreateChat(context.Context, types.Chat, types.User) (*types.Chat, error)
+	GetChatById(context.Context, int) (*types.Chat, error)
+	GetChats(context.Context, []int) ([]types.Chat, error)
+	GetChatSummaries(context.Context, int, []int) ([]types.ChatSummaryJSON, error)
+	GetUserChats(context.Context, int, string, int, int) ([]types.ChatSummaryJSON, error)
+	MarkRead(context.Context, int, int64) error
+	GetReadMarker(context.Context, int, int) (int64, error)
+	SetReadMarker(context.Context, int, int, int64) error
+	MarkAllRead(context.Context, int, []int) ([]types.ReadMarkerJSON, error)
+	AddMember(context.Context, int, int) error
+	RemoveMember(context.Context, int, int) error
+	SetChatVisibility(context.Context, int, string) error
+	SetChatInfo(context.Context, int, string, string) error
+	SetChatWelcome(context.Context, int, string) error
+	SetChatAnnouncement(context.Context, int, bool) error
+	SetChatImage(context.Context, int, string, []byte, time.Time) error
+	GetChatImage(context.Context, int, string) ([]byte, time.Time, error)
+	DeleteChatImage(context.Context, int, string) error
+	DeleteChat(context.Context, int) error
+	SearchChats(context.Context, string, []int, int) ([]types.ChatInfoJSON, error)
+	UpdateChatActivity(context.Context, time.Time) error
+	GetTrendingChats(context.Context, int) ([]types.TrendingChatJSON, error)
+	SetChatTags(context.Context, int, string, []string) error
+	GetPublicChats(context.Context, string, string, int, int) ([]types.ChatInfoJSON, int, error)
+	GetMemberRole(context.Context, int, int) (string, error)
+	GetMembers(context.Context, int, int, int) ([]types.MemberJSON, int, error)
+	SetMemberRole(context.Context, int, int, string) error
+	AddMessage(context.Context, types.MessageJSON) (int64, error)
+	EditMessage(context.Context, int, int64, int, string, time.Time) (*types.MessageJSON, error)
+	GetMessageHistory(context.Context, int, int64) ([]types.MessageEditJSON, error)
+	SearchMessages(context.Context, MessageSearch) ([]types.MessageJSON, error)
+	AddReaction(context.Context, int, int64, int, string) error
+	RemoveReaction(context.Context, int, int64, int, string) error
+	GetReactionSummary(context.Context, int, int64, int) ([]types.ReactionJSON, error)
+	GetReactionUsers(context.Context, int, int64, string, int, int) ([]types.AuthorJSON, error)
+	CreateBookmark(context.Context, int, int, int64) error
+	DeleteBookmark(context.Context, int, int64) error
+	GetBookmarks(context.Context, int, []int, int64, int) ([]types.BookmarkJSON, error)
+	CreateReceipts(context.Context, types.MessageJSON, []int) error
+	UpdateReceipt(context.Context, int64, int, string) (int, error)
+	GetReceipts(context.Context, []int64) ([]types.ReceiptJSON, error)
+	ExportMessages(context.Context, int, func(types.MessageJSON) error) error
+	MaintainMessages(context.Context, time.Time, time.Duration) error
+	PurgeMessages(context.Context, int, time.Time, int) (int, error)
+
+	GetStats(context.Context) (*types.StatsJSON, error)
+
+	CreateAnnouncement(context.Context, string) (*types.AnnouncementJSON, error)
+	GetUnseenAnnouncements(context.Context, int) ([]types.AnnouncementJSON, error)
+	MarkAnnouncementSeen(context.Context, []int, int) error
+
+	CreateChange(context.Context, int, int, string, any) (int64, error)
+	// AddOutboxEvent adds an event that isn't written with a change
+	AddOutboxEvent(context.Context, string, int, any) error
+	DispatchOutbox(context.Context, string, int, func([]types.OutboxEventJSON) int64) error
+	PruneOutbox(context.Context, time.Time) error
+	GetChanges(context.Context, int, []int, int64, int) ([]types.ChangeJSON, error)
+
+	GetDeviceCursor(context.Context, int, string) (int64, error)
+	UpdateDeviceCursor(context.Context, int, string, int64) error
+
+	CreatePushToken(context.Context, int, string, string) error
+	DeletePushToken(context.Context, int, string) error
+	GetPushTokens(context.Context, []int, int) ([]types.PushToken, error)
+	SetChatMuted(context.Context, int, int, bool) error
+	GetPreferences(context.Context, []int) (map[int]types.PreferencesJSON, error)
+	CreateNotifications(context.Context, []int, string, int, any) error
+	GetNotifications(context.Context, int, bool, int64, int) ([]types.NotificationJSON, error)
+	MarkNotificationsRead(context.Context, int, []int64) error
+	AddActivity(context.Context, []int, string, int, any) error
+	GetActivity(context.Context, int, int64, int) ([]types.ActivityJSON, error)
+	AddAuditEntry(context.Context, types.AuthorJSON, string, int, any) error
+	GetAuditLog(context.Context, int64, int) ([]types.AuditEntryJSON, error)
+	SetPreferences(context.Context, int, types.PreferencesJSON) error
+	GetSettings(context.Context, int) (map[string]json.RawMessage, error)
+	UpdateSettings(context.Context, int, map[string]json.RawMessage, int) (map[string]json.RawMessage, error)
+
+	CreatePasskey(context.Context, int, webauthn.Credential) error
+	GetPasskeys(context.Context, int) ([]webauthn.Credential, error)
+	UpdatePasskey(context.Context, webauthn.Credential) error
+	// GetIdentityUser returns the user a single sign-on identity, by issuer
+	// and subject, is linked to
+	GetIdentityUser(context.Context, string, string) (int, error)
+	LinkIdentity(context.Context, string, string, int) error
+
+	CreateBot(context.Context, string) (*types.User, error)
+	CreateAPIToken(context.Context, int, string, string, []byte) (*types.APITokenJSON, error)
+	GetAPITokens(context.Context, int) ([]types.APITokenJSON, error)
+	GetAPIToken(context.Context, []byte) (int, string, error)
+	DeleteAPIToken(context.Context, int, int) error
+	CreateResponder(context.Context, types.ResponderJSON) (*types.ResponderJSON, error)
+	GetResponders(context.Context, int) ([]types.ResponderJSON, error)
+	DeleteResponder(context.Context, int, int) error
+
+	CreateWorkspace(context.Context, string, string) (*types.WorkspaceJSON, error)
+	GetWorkspaces(context.Context) ([]types.WorkspaceJSON, error)
+	GetWorkspaceBySlug(context.Context, string) (*types.WorkspaceJSON, error)
+	GetUserWorkspace(context.Context, int) (int, error)
+	GetChatWorkspace(context.Context, int) (int, error)
+	SetWorkspaceQuota(context.Context, int, types.WorkspaceQuotaJSON) error
+	// GetWorkspaceUsage returns the usage of a workspace, its messages are
+	// those sent in the month of the time
+	GetWorkspaceUsage(context.Context, int, time.Time) (*types.WorkspaceUsageJSON, error)
+}
+
+// Backend is a Storage that can create its schema, be probed by the
+// breaker and be cleaned up offline, implemented by PostgresStore and
+// BoltStore
+type Backend interface {
+	Storage
+	Init(context.Context) error
+	Ping(context.Context) error
+	Cleanup(context.Context, Retention, bool) (CleanupReport, error)
+}
+
+type PostgresStore struct {
+	db *sql.DB
+	// shared with the replicas
+	authors *authorCache
+
+	// read only copies used by read, may be empty
+	replicas    []*replica
+	nextReplica atomic.Uint32
+}
+
+// storageError maps driver errors to the storage errors
+func storageError(err error) error {
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrNotFound
+	}
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+		return ErrConflict
+	}
+	// a foreign key pointing at a deleted row
+	if errors.As(err, &pqErr) && pqErr.Code == "23503" {
+		return ErrNotFound
+	}
+	return err
+}
+
+// DefaultDSN connects to a local postgres with the development password
+const DefaultDSN = "user=postgres dbname=postgres password=gochat sslmode=disable"
+
+// NewPostgresStore connects with dsn, a url or key=value connection string.
+// Some reads are sent to the replicas when given, a replica that can't be
+// reached at startup is skipped until it can
+func NewPostgresStore(dsn string, replicas ...string) (*PostgresStore, error) {
+	db, err := openPostgres(dsn)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err = db.PingContext(ctx); err != nil {
+		db.Close()
+		return nil, err
+	}
+	s := &PostgresStore{
+		db:      db,
+		authors: newAuthorCache(),
+	}
+	for _, replicaDsn := range replicas {
+		replicaDb, err := openPostgres(replicaDsn)
+		if err != nil {
+			db.Close()
+			return nil, err
+		}
+		r := &replica{store: &PostgresStore{db: replicaDb, authors: s.authors}}
+		if err = replicaDb.PingContext(ctx); err != nil {
+			log.Println("replica ping error:", err)
+			r.fail()
+		}
+		s.replicas = append(s.replicas, r)
+	}
+	return s, nil
+}
+
+func openPostgres(dsn string) (*sql.DB, error) {
+	// timestamps are stored and read in utc whatever the server's zone
+	if strings.Contains(dsn, "://") {
+		sep := "?"
+		if strings.Contains(dsn, "?") {
+			sep = "&"
+		}
+		dsn += sep + "timezone=UTC"
+	} else {
+		dsn += " timezone=UTC"
+	}
+	return sql.Open("postgres", dsn)
+}
+
+// Ping checks that the database is reachable
+func (s *PostgresStore) Ping(ctx context.Context) error {
+	return s.db.PingContext(ctx)
+}
+
+func (s *PostgresStore) Init(ctx context.Context) error {
+	if err := s.createUserTable(ctx); err != nil {
+		return err
+	}
+	if err := s.createChatTable(ctx); err != nil {
+		return err
+	}
+	if err := s.addUserRoleColumn(ctx); err != nil {
+		return err
+	}
+	if err := s.addChatVisibilityColumn(ctx); err != nil {
+		return err
+	}
+	if err := s.createAnnouncementTable(ctx); err != nil {
+		return err
+	}
+	if err := s.createChangeTable(ctx); err != nil {
+		return err
+	}
+	if err := s.createDeviceCursorTable(ctx); err != nil {
+		return err
+	}
+	if err := s.createPushTables(ctx); err != nil {
+		return err
+	}
+	if err := s.createPasskeyTable(ctx); err != nil {
+		return err
+	}
+	if err := s.createMemberRoleTable(ctx); err != nil {
+		return err
+	}
+	if err := s.createChatTagTable(ctx); err != nil {
+		return err
+	}
+	if err := s.addChatNameColumns(ctx); err != nil {
+		return err
+	}
+	if err := s.createChatActivityTable(ctx); err != nil {
+		return err
+	}
+	if err := s.addUserLastSeenColumns(ctx); err != nil {
+		return err
+	}
+	if err := s.addMessageIds(ctx); err != nil {
+		return err
+	}
+	if err := s.createMessageEditTable(ctx); err != nil {
+		return err
+	}
+	if err := s.createReceiptTable(ctx); err != nil {
+		return err
+	}
+	if err := s.createReactionTable(ctx); err != nil {
+		return err
+	}
+	if err := s.createBookmarkTable(ctx); err != nil {
+		return err
+	}
+	if err := s.createPreferenceTable(ctx); err != nil {
+		return err
+	}
+	if err := s.createNotificationTable(ctx); err != nil {
+		return err
+	}
+	if err := s.addQuietScheduleColumns(ctx); err != nil {
+		return err
+	}
+	if err := s.addUserTimeZoneColumn(ctx); err != nil {
+		return err
+	}
+	if err := s.createMessageTable(ctx); err != nil {
+		return err
+	}
+	if err := s.createMemberTable(ctx); err != nil {
+		return err
+	}
+	if err := s.addUserUniqueIndexes(ctx); err != nil {
+		return err
+	}
+	if err := s.addProfileColumns(ctx); err != nil {
+		return err
+	}
+	if err := s.createSettingTable(ctx); err != nil {
+		return err
+	}
+	if err := s.addLastReadColumn(ctx); err != nil {
+		return err
+	}
+	if err := s.createActivityTable(ctx); err != nil {
+		return err
+	}
+	if err := s.addChatWelcomeColumn(ctx); err != nil {
+		return err
+	}
+	if err := s.createChatImageTable(ctx); err != nil {
+		return err
+	}
+	if err := s.createMessageSearchIndexes(ctx); err != nil {
+		return err
+	}
+	if err := s.addChatAnnouncementColumn(ctx); err != nil {
+		return err
+	}
+	if err := s.createOutboxTables(ctx); err != nil {
+		return err
+	}
+	if err := s.addUserAccountColumns(ctx); err != nil {
+		return err
+	}
+	if err := s.createAuditTable(ctx); err != nil {
+		return err
+	}
+	if err := s.addChatCounterColumns(ctx); err != nil {
+		return err
+	}
+	if err := s.addChatPreviewColumns(ctx); err != nil {
+		return err
+	}
+	if err := s.createBotTables(ctx); err != nil {
+		return err
+	}
+	if err := s.createResponderTable(ctx); err != nil {
+		return err
+	}
+	if err := s.createWorkspaceTables(ctx); err != nil {
+		return err
+	}
+	if err := s.createQuotaTables(ctx); err != nil {
+		return err
+	}
+	if err := s.createIdentityTable(ctx); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (s *PostgresStore) createUserTable(ctx context.Context) error {
+	query := `create table if not exists users (
+		id serial primary key,
+		username varchar(20),
+		email varchar(50),
+		password varchar(64)
+	)`
+
+	_, err := s.db.ExecContext(ctx, query)
+	return err
+}
+
+func (s *PostgresStore) createChatTable(ctx context.Context) error {
+	query := `create table if not exists chat (
+		id serial primary key,
+		password varchar(64)
+	)`
+
+	_, err := s.db.ExecContext(ctx, query)
+	return err
+}
+
+func (s *PostgresStore) addUserRoleColumn(ctx context.Context) error {
+	query := `alter table users add column if not exists role varchar(20) not null default 'user'`
+
+	_, err := s.db.ExecContext(ctx, query)
+	return err
+}
+
+func (s *PostgresStore) addChatVisibilityColumn(ctx context.Context) error {
+	query := `alter table chat add column if not exists visibility varchar(20) not null default 'private'`
+
+	_, err := s.db.ExecContext(ctx, query)
+	return err
+}
+
+func (s *PostgresStore) createAnnouncementTable(ctx context.Context) error {
+	query := `create table if not exists announcements (
+		id serial primary key,
+		text varchar(1000),
+		created_at timestamp default now()
+	);
+	alter table users add column if not exists last_announcement integer not null default 0`
+
+	_, err := s.db.ExecContext(ctx, query)
+	return err
+}
+
+func (s *PostgresStore) createChangeTable(ctx context.Context) error {
+	query := `create table if not exists changes (
+		id bigserial primary key,
+		chat_id integer not null default 0,
+		user_id integer not null default 0,
+		type varchar(30),
+		data json,
+		created_at timestamp default now()
+	);
+	create index if not exists changes_chat_id_idx on changes (chat_id, id);
+	create index if not exists changes_user_id_idx on changes (user_id, id)`
+
+	_, err := s.db.ExecContext(ctx, query)
+	return err
+}
+
+func (s *PostgresStore) createDeviceCursorTable(ctx context.Context) error {
+	query := `create table if not exists device_cursors (
+		user_id integer,
+		device_id varchar(64),
+		cursor bigint not null default 0,
+		primary key (user_id, device_id)
+	)`
+
+	_, err := s.db.ExecContext(ctx, query)
+	return err
+}
+
+func (s *PostgresStore) createPushTables(ctx context.Context) error {
+	query := `create table if not exists push_tokens (
+		token varchar(512) primary key,
+		user_id integer,
+		platform varchar(10),
+		created_at timestamp default now()
+	);
+	create index if not exists push_tokens_user_id_idx on push_tokens (user_id);
+	create table if not exists chat_mutes (
+		user_id integer,
+		chat_id integer,
+		primary key (user_id, chat_id)
+	)`
+
+	_, err := s.db.ExecContext(ctx, query)
+	return err
+}
+
+func (s *PostgresStore) createPasskeyTable(ctx context.Context) error {
+	query := `create table if not exists passkeys (
+		id bytea primary key,
+		user_id integer,
+		credential json,
+		created_at timestamp default now()
+	);
+	create index if not exists passkeys_user_id_idx on passkeys (user_id)`
+
+	_, err := s.db.ExecContext(ctx, query)
+	return err
+}
+
+// createMemberRoleTable only holds members that don't have the default role
+func (s *PostgresStore) createMemberRoleTable(ctx context.Context) error {
+	query := `create table if not exists chat_member_roles (
+		chat_id integer,
+		user_id integer,
+		role varchar(20) not null,
+		primary key (chat_id, user_id)
+	)`
+
+	_, err := s.db.ExecContext(ctx, query)
+	return err
+}
+
+func (s *PostgresStore) createChatTagTable(ctx context.Context) error {
+	query := `alter table chat add column if not exists category varchar(50) not null default '';
+	create table if not exists chat_tags (
+		chat_id integer,
+		tag varchar(30),
+		primary key (chat_id, tag)
+	);
+	create index if not exists chat_tags_tag_idx on chat_tags (tag)`
+
+	_, err := s.db.ExecContext(ctx, query)
+	return err
+}
+
+// addChatNameColumns adds name and topic with trigram indexes for search
+func (s *PostgresStore) addChatNameColumns(ctx context.Context) error {
+	query := `create extension if not exists pg_trgm;
+	alter table chat add column if not exists name varchar(100) not null default '';
+	alter table chat add column if not exists topic varchar(300) not null default '';
+	create index if not exists chat_name_trgm_idx on chat using gin (name gin_trgm_ops);
+	create index if not exists chat_topic_trgm_idx on chat using gin (topic gin_trgm_ops)`
+
+	_, err := s.db.ExecContext(ctx, query)
+	return err
+}
+
+func (s *PostgresStore) createChatActivityTable(ctx context.Context) error {
+	query := `create table if not exists chat_activity (
+		chat_id integer primary key,
+		messages integer not null default 0,
+		members integer not null default 0,
+		score integer not null default 0,
+		updated_at timestamp default now()
+	);
+	create index if not exists chat_activity_score_idx on chat_activity (score desc);
+	create index if not exists changes_created_at_idx on changes (created_at)`
+
+	_, err := s.db.ExecContext(ctx, query)
+	return err
+}
+
+func (s *PostgresStore) addUserLastSeenColumns(ctx context.Context) error {
+	query := `alter table users add column if not exists last_seen timestamp;
+	alter table users add column if not exists show_last_seen boolean not null default true`
+
+	_, err := s.db.ExecContext(ctx, query)
+	return err
+}
+
+// addMessageIds creates the message id sequence and numbers the
+// messages stored before ids existed
+func (s *PostgresStore) addMessageIds(ctx context.Context) error {
+	query := `create sequence if not exists message_id_seq;
+	do $$ begin
+		if exists (select 1 from information_schema.columns where table_name = 'chat' and column_name = 'messages') then
+			update chat set messages = (
+				select json_agg(case when m ? 'id' and (m->>'id')::bigint > 0 then m
+				else m || jsonb_build_object('id', nextval('message_id_seq')) end order by n)
+				from jsonb_array_elements(messages::jsonb) with ordinality as t(m, n)
+			)
+			where exists (
+				select 1 from jsonb_array_elements(messages::jsonb) m
+				where not m ? 'id' or (m->>'id')::bigint = 0
+			);
+		end if;
+	end $$`
+
+	_, err := s.db.ExecContext(ctx, query)
+	return err
+}
+
+func (s *PostgresStore) createMessageEditTable(ctx context.Context) error {
+	query := `create table if not exists message_edits (
+		id bigserial primary key,
+		chat_id integer not null,
+		message_id bigint not null,
+		text varchar(2000),
+		edited_at timestamp default now()
+	);
+	create index if not exists message_edits_message_id_idx on message_edits (message_id, id)`
+
+	_, err := s.db.ExecContext(ctx, query)
+	return err
+}
+
+func (s *PostgresStore) createReceiptTable(ctx context.Context) error {
+	query := `create table if not exists message_receipts (
+		message_id bigint,
+		user_id integer,
+		author_id integer not null,
+		status varchar(10) not null default 'sent',
+		updated_at timestamp default now(),
+		primary key (message_id, user_id)
+	)`
+
+	_, err := s.db.ExecContext(ctx, query)
+	return err
+}
+
+func (s *PostgresStore) createReactionTable(ctx context.Context) error {
+	query := `create table if not exists message_reactions (
+		chat_id integer not null,
+		message_id bigint,
+		user_id integer,
+		emoji varchar(32),
+		created_at timestamp default now(),
+		primary key (message_id, emoji, user_id)
+	)`
+
+	_, err := s.db.ExecContext(ctx, query)
+	return err
+}
+
+func (s *PostgresStore) createBookmarkTable(ctx context.Context) error {
+	query := `create table if not exists bookmarks (
+		id bigserial primary key,
+		user_id integer not null,
+		chat_id integer not null,
+		message_id bigint not null,
+		created_at timestamp default now(),
+		unique (user_id, message_id)
+	);
+	create index if not exists bookmarks_user_id_idx on bookmarks (user_id, id)`
+
+	_, err := s.db.ExecContext(ctx, query)
+	return err
+}
+
+func (s *PostgresStore) createPreferenceTable(ctx context.Context) error {
+	query := `create table if not exists user_preferences (
+		user_id integer primary key,
+		notify varchar(10) not null default 'all',
+		email boolean not null default true
+	)`
+
+	_, err := s.db.ExecContext(ctx, query)
+	return err
+}
+
+func (s *PostgresStore) createNotificationTable(ctx context.Context) error {
+	query := `create table if not exists notifications (
+		id bigserial primary key,
+		user_id integer not null,
+		type varchar(20) not null,
+		chat_id integer not null default 0,
+		data json,
+		read boolean not null default false,
+		created_at timestamp default now()
+	);
+	create index if not exists notifications_user_id_idx on notifications (user_id, id)`
+
+	_, err := s.db.ExecContext(ctx, query)
+	return err
+}
+
+// addQuietScheduleColumns replaces the single quiet hours window with a
+// list of schedules and adds the time zone they are read in
+func (s *PostgresStore) addQuietScheduleColumns(ctx context.Context) error {
+	query := `alter table user_preferences add column if not exists quiet_hours json not null default '[]';
+	alter table user_preferences add column if not exists time_zone varchar(64) not null default 'UTC';
+	do $$ begin
+		if exists (select 1 from information_schema.columns where table_name = 'user_preferences' and column_name = 'quiet_start') then
+			update user_preferences set quiet_hours = json_build_array(json_build_object('start', quiet_start, 'end', quiet_end))
+			where quiet_start <> '' and quiet_end <> '';
+			alter table user_preferences drop column quiet_start, drop column quiet_end;
+		end if;
+	end $$`
+
+	_, err := s.db.ExecContext(ctx, query)
+	return err
+}
+
+// addUserTimeZoneColumn moves the time zone from the notification
+// preferences to the user
+func (s *PostgresStore) addUserTimeZoneColumn(ctx context.Context) error {
+	query := `alter table users add column if not exists time_zone varchar(64) not null default 'UTC';
+	do $$ begin
+		if exists (select 1 from information_schema.columns where table_name = 'user_preferences' and column_name = 'time_zone') then
+			update users u set time_zone = p.time_zone from user_preferences p where p.user_id = u.id;
+			alter table user_preferences drop column time_zone;
+		end if;
+	end $$`
+
+	_, err := s.db.ExecContext(ctx, query)
+	return err
+}
+
+// addUserUniqueIndexes makes emails and usernames unique ignoring case,
+// accounts that already share one have to be renamed by hand first
+func (s *PostgresStore) addUserUniqueIndexes(ctx context.Context) error {
+	for _, column := range []string{"email", "username"} {
+		query := `create unique index if not exists users_` + column + `_lower_key on users (lower(` + column + `));
+		drop index if exists users_` + column + `_key`
+		_, err := s.db.ExecContext(ctx, query)
+		if !errors.Is(storageError(err), ErrConflict) {
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		// name the duplicates
+		rows, err := s.db.QueryContext(ctx, `select lower(`+column+`) from users group by 1 having count(*) > 1 order by 1 limit 10`)
+		if err != nil {
+			return err
+		}
+		duplicates := []string{}
+		for rows.Next() {
+			var value string
+			if err := rows.Scan(&value); err != nil {
+				rows.Close()
+				return err
+			}
+			duplicates = append(duplicates, value)
+		}
+		rows.Close()
+		return fmt.Errorf("users share the same %s, change all but one of them before restarting: %s", column, strings.Join(duplicates, ", "))
+	}
+	return nil
+}
+
+func (s *PostgresStore) addChatWelcomeColumn(ctx context.Context) error {
+	query := `alter table chat add column if not exists welcome varchar(1000) not null default ''`
+
+	_, err := s.db.ExecContext(ctx, query)
+	return err
+}
+
+func (s *PostgresStore) addChatAnnouncementColumn(ctx context.Context) error {
+	query := `alter table chat add column if not exists announcement boolean not null default false`
+
+	_, err := s.db.ExecContext(ctx, query)
+	return err
+}
+
+func (s *PostgresStore) addProfileColumns(ctx context.Context) error {
+	query := `alter table users add column if not exists display_name varchar(50) not null default '';
+	alter table users add column if not exists bio varchar(300) not null default '';
+	alter table users add column if not exists pronouns varchar(30) not null default '';
+	alter table users add column if not exists link varchar(200) not null default ''`
+
+	_, err := s.db.ExecContext(ctx, query)
+	return err
+}
+
+// CreateUser returns ErrConflict when the email or the username is taken
+func (s *PostgresStore) CreateUser(ctx context.Context, username string, email string, password string) (*types.User, error) {
+	// exec query
+	query := `insert into users 
+	(username, email, password, last_announcement, workspace_id)
+	values ($1, $2, $3, (select coalesce(max(id), 0) from announcements), $4)
+	on conflict do nothing
+	returning id, username, email, password, role, time_zone, display_name, workspace_id`
+	row := s.db.QueryRowContext(ctx, query, username, email, password, workspaceOf(ctx))
+
+	user := &types.User{Chats: []int{}}
+
+	// scan row, no row means a conflict
+	if err := row.Scan(&user.Id, &user.Username, &user.Email, &user.Password, &user.Role, &user.TimeZone, &user.DisplayName, &user.WorkspaceId); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrConflict
+		}
+		log.Println("createUser")
+		return nil, storageError(err)
+	}
+
+	return user, nil
+}
+
+func (s *PostgresStore) GetUserById(ctx context.Context, id int) (*types.User, error) {
+	// exec query
+	query := `select id, username, email, password, ` + chatIds + `, role, time_zone, display_name, disabled, token_version, bot, workspace_id from users where id = $1 limit 1`
+	row := s.db.QueryRowContext(ctx, query, id)
+
+	user := &types.User{Chats: []int{}}
+
+	// scan row
+	nullArray := []sql.NullInt64{}
+	if err := row.Scan(&user.Id, &user.Username, &user.Email, &user.Password, pq.Array(&nullArray), &user.Role, &user.TimeZone, &user.DisplayName, &user.Disabled, &user.TokenVersion, &user.Bot, &user.WorkspaceId); err != nil {
+		log.Println("getUserById")
+		return nil, storageError(err)
+	}
+
+	// decode sql arr
+	for _, id := range nullArray {
+		if id.Valid {
+			user.Chats = append(user.Chats, int(id.Int64))
+		}
+	}
+
+	return user, nil
+}
+
+func (s *PostgresStore) GetUserByEmail(ctx context.Context, email string) (*types.User, error) {
+	// exec query
+	query := `select id, username, email, password, ` + chatIds + `, role, time_zone, display_name, disabled, token_version, bot, workspace_id from users where lower(email) = lower($1) limit 1`
+	row := s.db.QueryRowContext(ctx, query, email)
+
+	user := &types.User{Chats: []int{}}
+
+	// scan row
+	nullArray := []sql.NullInt64{}
+	if err := row.Scan(&user.Id, &user.Username, &user.Email, &user.Password, pq.Array(&nullArray), &user.Role, &user.TimeZone, &user.DisplayName, &user.Disabled, &user.TokenVersion, &user.Bot, &user.WorkspaceId); err != nil {
+		log.Println("getUserByEmail")
+		return nil, storageError(err)
+	}
+
+	// decode sql array
+	for _, id := range nullArray {
+		if id.Valid {
+			user.Chats = append(user.Chats, int(id.Int64))
+		}
+	}
+
+	return user, nil
+}
+
+func (s *PostgresStore) GetUsers(ctx context.Context, arr []int) ([]types.User, error) {
+	var users []types.User
+	err := s.read(ctx, func(db *PostgresStore) (err error) {
+		users, err = db.getUsers(ctx, arr)
+		return err
+	})
+	return users, err
+}
+
+func (s *PostgresStore) getUsers(ctx context.Context, arr []int) ([]types.User, error) {
+	// exec query
+	query := `select id, username, email, password, ` + chatIds + `, role, time_zone, display_name from users where id = any($1)`
+	rows, err := s.db.QueryContext(ctx, query, pq.Array(arr))
+	if err != nil {
+		log.Println("getUsers query error")
+		return nil, err
+	}
+	defer rows.Close()
+
+	// iterate rows
+	users := []types.User{}
+	for rows.Next() {
+
+		user := types.User{Chats: []int{}}
+
+		// scan row
+		nullArray := []sql.NullInt64{}
+		if err := rows.Scan(&user.Id, &user.Username, &user.Email, &user.Password, pq.Array(&nullArray), &user.Role, &user.TimeZone, &user.DisplayName); err != nil {
+			log.Println("getUsers scan error")
+			return nil, err
+		}
+
+		// decode sql array
+		for _, id := range nullArray {
+			if id.Valid {
+				user.Chats = append(user.Chats, int(id.Int64))
+			}
+		}
+
+		users = append(users, user)
+	}
+	if err = rows.Err(); err != nil {
+		log.Println("getUsers err error")
+		return nil, err
+	}
+	return users, nil
+}
+
+func (s *PostgresStore) GetAuthors(ctx context.Context, arr []int) (map[int]types.AuthorJSON, error) {
+	// hot authors come from the cache
+	found, missing := s.authors.get(arr)
+	if len(missing) == 0 {
+		return found, nil
+	}
+
+	// exec query
+	query := `select id, username, display_name, case when show_last_seen then last_seen end from users where id = any($1)`
+	rows, err := s.db.QueryContext(ctx, query, pq.Array(missing))
+	if err != nil {
+		log.Println("getAuthors query err")
+		return nil, err
+	}
+	defer rows.Close()
+
+	// iterate rows
+	loaded := map[int]types.AuthorJSON{}
+	for rows.Next() {
+		// scan author id, names and last seen
+		author := types.AuthorJSON{}
+		var lastSeen sql.NullTime
+		if err := rows.Scan(&author.Id, &author.Username, &author.DisplayName, &lastSeen); err != nil {
+			log.Println("getAuthors scan err")
+			return nil, err
+		}
+
+		if lastSeen.Valid {
+			t := lastSeen.Time.UTC()
+			author.LastSeen = &t
+		}
+
+		loaded[author.Id] = author
+	}
+	if err = rows.Err(); err != nil {
+		log.Println("getAuthors err error")
+		return nil, err
+	}
+
+	// deleted users as the placeholder, which isn't cached
+	s.authors.put(loaded)
+	for _, id := range missing {
+		author, ok := loaded[id]
+		if !ok {
+			author = types.DeletedUser
+		}
+		found[id] = author
+	}
+	return found, nil
+}
+
+func (s *PostgresStore) TouchLastSeen(ctx context.Context, id int, at time.Time) error {
+	// exec query
+	query := `update users set last_seen=$1 where id=$2`
+	if _, err := s.db.ExecContext(ctx, query, at.UTC(), id); err != nil {
+		log.Println("touchLastSeen error")
+		return err
+	}
+	s.authors.forget(id)
+	return nil
+}
+
+func (s *PostgresStore) SetShowLastSeen(ctx context.Context, id int, show bool) error {
+	// exec query
+	query := `update users set show_last_seen=$1 where id=$2`
+	res, err := s.db.ExecContext(ctx, query, show, id)
+	if err != nil {
+		log.Println("setShowLastSeen error")
+		return err
+	}
+	s.authors.forget(id)
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// GetProfile returns the public profile of a user, last seen only when
+// the user shares it
+func (s *PostgresStore) GetProfile(ctx context.Context, id int) (*types.ProfileJSON, error) {
+	// exec query
+	query := `select id, username, display_name, bio, pronouns, link, case when show_last_seen then last_seen end from users where id = $1`
+	row := s.db.QueryRowContext(ctx, query, id)
+
+	// scan row
+	profile := new(types.ProfileJSON)
+	var lastSeen sql.NullTime
+	if err := row.Scan(&profile.Id, &profile.Username, &profile.DisplayName, &profile.Bio, &profile.Pronouns, &profile.Link, &lastSeen); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		log.Println("getProfile scan error")
+		return nil, err
+	}
+	if lastSeen.Valid {
+		t := lastSeen.Time.UTC()
+		profile.LastSeen = &t
+	}
+	return profile, nil
+}
+
+func (s *PostgresStore) SetProfile(ctx context.Context, id int, profile types.ProfileRequest) error {
+	// exec query
+	query := `update users set display_name=$1, bio=$2, pronouns=$3, link=$4 where id=$5`
+	res, err := s.db.ExecContext(ctx, query, profile.DisplayName, profile.Bio, profile.Pronouns, profile.Link, id)
+	if err != nil {
+		log.Println("setProfile error")
+		return err
+	}
+	s.authors.forget(id)
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *PostgresStore) UpdateUserRole(ctx context.Context, id int, role string) error {
+	// exec query
+	query := `update users set role=$1 where id=$2`
+	res, err := s.db.ExecContext(ctx, query, role, id)
+	if err != nil {
+		log.Println("updateUserRole error")
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *PostgresStore) SetRoleByEmail(ctx context.Context, emails []string, role string) error {
+	// exec query
+	query := `update users set role=$1 where lower(email) in (select lower(e) from unnest($2::text[]) e)`
+	if _, err := s.db.ExecContext(ctx, query, role, pq.Array(emails)); err != nil {
+		log.Println("setRoleByEmail error")
+		return err
+	}
+	return nil
+}
+
+// ListUsers returns a page of the users whose username, email or display
+// name contain q, all of them when it is empty, ordered by id starting after
+// the given id, and the total number of matching users
+func (s *PostgresStore) ListUsers(ctx context.Context, q string, after int, limit int) ([]types.User, int, error) {
+	// exec query
+	match := `($3 = '' or username ilike '%' || $3 || '%' or email ilike '%' || $3 || '%' or display_name ilike '%' || $3 || '%') and ($4 < 0 or workspace_id = $4)`
+	query := `select id, username, email, password, ` + chatIds + `, role, time_zone, display_name, disabled, bot, (select count(*) from users where ` + match + `)
+	from users where id > $1 and ` + match + `
+	order by id
+	limit $2`
+	rows, err := s.db.QueryContext(ctx, query, after, limit, escapeLike(q), workspaceScope(ctx))
+	if err != nil {
+		log.Println("listUsers query error")
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	// iterate rows
+	users := []types.User{}
+	total := 0
+	for rows.Next() {
+		user := types.User{Chats: []int{}}
+
+		// scan row
+		nullArray := []sql.NullInt64{}
+		if err := rows.Scan(&user.Id, &user.Username, &user.Email, &user.Password, pq.Array(&nullArray), &user.Role, &user.TimeZone, &user.DisplayName, &user.Disabled, &user.Bot, &total); err != nil {
+			log.Println("listUsers scan error")
+			return nil, 0, err
+		}
+
+		// decode sql array
+		for _, id := range nullArray {
+			if id.Valid {
+				user.Chats = append(user.Chats, int(id.Int64))
+			}
+		}
+
+		users = append(users, user)
+	}
+	if err = rows.Err(); err != nil {
+		log.Println("listUsers err error")
+		return nil, 0, err
+	}
+	return users, total, nil
+}
+
+func (s *PostgresStore) CreateChat(ctx context.Context, newChat types.Chat, user types.User) (*types.Chat, error) {
+	// exec query
+	query := `insert into chat
+	(password, visibility, name, topic, workspace_id)
+	values ($1, $2, $3, $4, $5)
+	returning id, password, visibility, name, topic`
+
+	u := []types.AuthorJSON{{
+		Id:          user.Id,
+		Username:    user.Username,
+		DisplayName: user.DisplayName,
+	}}
+
+	// exec queries, the creator is the first member and an admin
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		log.Println("createChat begin error")
+		return nil, err
+	}
+	defer tx.Rollback()
+	row := tx.QueryRowContext(ctx, query, newChat.Password, newChat.Visibility, newChat.Name, newChat.Topic, workspaceOf(ctx))
+
+	chat := &types.Chat{Messages: []types.MessageJSON{}, Users: u, Tags: []string{}}
+
+	// scan row
+	if err := row.Scan(&chat.Id, &chat.Password, &chat.Visibility, &chat.Name, &chat.Topic); err != nil {
+		log.Println("createChat error")
+		return nil, err
+	}
+	if _, err = tx.ExecContext(ctx, `insert into chat_members (chat_id, user_id, role) values ($1, $2, $3)`, chat.Id, user.Id, types.MemberRoleAdmin); err != nil {
+		log.Println("createChat member error")
+		return nil, storageError(err)
+	}
+	created := types.ChatCreatedJSON{Id: chat.Id, Name: chat.Name, Topic: chat.Topic, Visibility: chat.Visibility, Creator: u[0]}
+	if err = addOutboxEvent(ctx, tx, types.OutboxChatCreated, chat.Id, created); err != nil {
+		log.Println("createChat outbox error")
+		return nil, err
+	}
+	if err = tx.Commit(); err != nil {
+		log.Println("createChat commit error")
+		return nil, err
+	}
+
+	// return chat
+	return chat, nil
+}
+
+// GetChatById, GetChats and GetUsers read from a replica when there is one
+func (s *PostgresStore) GetChatById(ctx context.Context, id int) (*types.Chat, error) {
+	var chat *types.Chat
+	err := s.read(ctx, func(db *PostgresStore) (err error) {
+		chat, err = db.getChatById(ctx, id)
+		return err
+	})
+	return chat, err
+}
+
+func (s *PostgresStore) getChatById(ctx context.Context, id int) (*types.Chat, error) {
+	// exec query
+	query := `select id, password, ` + memberIds + `, visibility, category,
+	array(select tag from chat_tags where chat_id = chat.id order by tag), name, topic, welcome, announcement, ` + chatImages + `
+	from chat where id = $1 limit 1`
+	row := s.db.QueryRowContext(ctx, query, id)
+
+	chat := &types.Chat{Users: []types.AuthorJSON{}, Tags: []string{}}
+
+	// scan row
+	nullArray := []sql.NullInt64{}
+	var images []byte
+	if err := row.Scan(&chat.Id, &chat.Password, pq.Array(&nullArray), &chat.Visibility, &chat.Category, pq.Array(&chat.Tags), &chat.Name, &chat.Topic, &chat.Welcome, &chat.Announcement, &images); err != nil {
+		log.Println("getChatById scan error")
+		return nil, storageError(err)
+	}
+	if err := json.Unmarshal(images, &chat.Images); err != nil {
+		log.Println("getChatById images error")
+		return nil, err
+	}
+
+	// get messages
+	messages, err := s.getMessages(ctx, []int{chat.Id})
+	if err != nil {
+		log.Println("getChatById messages error")
+		return nil, err
+	}
+	chat.Messages = messages[chat.Id]
+
+	// decode sql array
+	usersId := []int{}
+	for _, id := range nullArray {
+		if id.Valid {
+			usersId = append(usersId, int(id.Int64))
+		}
+	}
+
+	// get users
+	authors, err := s.GetAuthors(ctx, usersId)
+	if err != nil {
+		log.Println("getChatById authors error")
+		return nil, err
+	}
+	chat.Users = authorList(authors, usersId)
+
+	return chat, nil
+}
+
+func (s *PostgresStore) GetChats(ctx context.Context, arr []int) ([]types.Chat, error) {
+	var chats []types.Chat
+	err := s.read(ctx, func(db *PostgresStore) (err error) {
+		chats, err = db.getChats(ctx, arr)
+		return err
+	})
+	return chats, err
+}
+
+// chatListMessages is how many of each chat's latest messages come with the
+// chat list, older ones are paged through the chat's messages
+const chatListMessages = 50
+
+func (s *PostgresStore) getChats(ctx context.Context, arr []int) ([]types.Chat, error) {
+	// exec query
+	query := `select id, password, ` + memberIds + `, visibility, category,
+	array(select tag from chat_tags where chat_id = chat.id order by tag), name, topic, announcement, ` + chatImages + `
+	from chat where id = any($1)`
+	rows, err := s.db.QueryContext(ctx, query, pq.Array(arr))
+	if err != nil {
+		log.Println("getChats error")
+		return nil, err
+	}
+	defer rows.Close()
+
+	// get messages
+	messages, err := s.getLatestMessages(ctx, arr, chatListMessages)
+	if err != nil {
+		log.Println("getChats messages error")
+		return nil, err
+	}
+
+	// go through rows
+	chats := []types.Chat{}
+	membersOf := [][]int{}
+	for rows.Next() {
+
+		chat := types.Chat{Users: []types.AuthorJSON{}, Tags: []string{}}
+
+		// scan row
+		nullArray := []sql.NullInt64{}
+		var images []byte
+		if err := rows.Scan(&chat.Id, &chat.Password, pq.Array(&nullArray), &chat.Visibility, &chat.Category, pq.Array(&chat.Tags), &chat.Name, &chat.Topic, &chat.Announcement, &images); err != nil {
+			log.Println("getChats scan error")
+			return nil, err
+		}
+		if err := json.Unmarshal(images, &chat.Images); err != nil {
+			log.Println("getChats images error")
+			return nil, err
+		}
+		chat.Messages = messages[chat.Id]
+
+		// decode sql array
+		usersId := []int{}
+		for _, id := range nullArray {
+			if id.Valid {
+				usersId = append(usersId, int(id.Int64))
+			}
+		}
+
+		chats = append(chats, chat)
+		membersOf = append(membersOf, usersId)
+	}
+	if err = rows.Err(); err != nil {
+		log.Println("getChats rows.err error")
+		return nil, err
+	}
+
+	// get users of all the chats at once
+	usersId := []int{}
+	for _, members := range membersOf {
+		usersId = append(usersId, members...)
+	}
+	authors, err := s.GetAuthors(ctx, usersId)
+	if err != nil {
+		log.Println("getChats author error")
+		return nil, err
+	}
+	for i := range chats {
+		chats[i].Users = authorList(authors, membersOf[i])
+	}
+
+	// return chats
+	return chats, nil
+}
+
+// chatSummaries selects the summaries of the chats c as seen by user $1,
+// m is their membership (null when they aren't a member), only the last
+// message is decoded
+var chatSummaries = `select c.id, c.name, (select count(*) from chat_members where chat_id = c.id),
+	c.message_count,
+	(select count(*) from (
+		select 1 from messages where chat_id = c.id and m.user_id is not null and id > m.last_read and author_id <> $1 limit ` + strconv.Itoa(types.MaxUnread) + `
+	) u),
+	l.id, l.chat_id, l.author_id, l.author_name, l.author_display_name, l.text, l.created_at, l.edited_at,
+	c.last_message_id, c.last_author_id, c.last_author_name, coalesce((select display_name from users where users.id = c.last_author_id), ''), c.last_excerpt, c.last_message_at
+	from chat c
+	left join chat_members m on m.chat_id = c.id and m.user_id = $1
+	left join lateral (
+		select ` + messageColumns + ` from messages where chat_id = c.id order by created_at desc, id desc limit 1
+	) l on true`
+
+// GetChatSummaries returns the summaries of the chats with the unread
+// count of the user
+func (s *PostgresStore) GetChatSummaries(ctx context.Context, userId int, arr []int) ([]types.ChatSummaryJSON, error) {
+	// exec query
+	query := chatSummaries + `
+	where c.id = any($2)
+	order by c.id`
+	rows, err := s.db.QueryContext(ctx, query, userId, pq.Array(arr))
+	if err != nil {
+		log.Println("getChatSummaries query error")
+		return nil, err
+	}
+	return scanChatSummaries("getChatSummaries", rows)
+}
+
+// GetUserChats pages through the chats of the user, with the most recent
+// activity (last message, or joining) or by name first
+func (s *PostgresStore) GetUserChats(ctx context.Context, userId int, sort string, offset int, limit int) ([]types.ChatSummaryJSON, error) {
+	// exec query
+	order := `coalesce(c.last_message_at, m.joined_at) desc, c.id desc`
+	if sort == ChatsByName {
+		order = `lower(c.name), c.id`
+	}
+	query := chatSummaries + `
+	where m.user_id is not null
+	order by ` + order + `
+	offset $2 limit $3`
+	rows, err := s.db.QueryContext(ctx, query, userId, offset, limit)
+	if err != nil {
+		log.Println("getUserChats query error")
+		return nil, err
+	}
+	return scanChatSummaries("getUserChats", rows)
+}
+
+func scanChatSummaries(name string, rows *sql.Rows) ([]types.ChatSummaryJSON, error) {
+	defer rows.Close()
+
+	// iterate rows
+	result := []types.ChatSummaryJSON{}
+	for rows.Next() {
+		summary := types.ChatSummaryJSON{}
+
+		// scan row, the last message columns are null in empty chats
+		var lastId, lastChatId, lastAuthorId sql.NullInt64
+		var lastAuthorName, lastAuthorDisplayName, lastText sql.NullString
+		var lastCreatedAt, lastEditedAt sql.NullTime
+		var previewId, previewAuthorId sql.NullInt64
+		var previewAuthorName, previewExcerpt sql.NullString
+		var previewDisplayName string
+		var previewAt sql.NullTime
+		if err := rows.Scan(&summary.Id, &summary.Name, &summary.MemberCount, &summary.MessageCount, &summary.Unread, &lastId, &lastChatId, &lastAuthorId, &lastAuthorName, &lastAuthorDisplayName, &lastText, &lastCreatedAt, &lastEditedAt,
+			&previewId, &previewAuthorId, &previewAuthorName, &previewDisplayName, &previewExcerpt, &previewAt); err != nil {
+			log.Println(name + " scan error")
+			return nil, err
+		}
+		if lastId.Valid {
+			summary.LastMessage = &types.MessageJSON{
+				Id:        lastId.Int64,
+				ChatId:    int(lastChatId.Int64),
+				Text:      lastText.String,
+				Author:    types.AuthorJSON{Id: int(lastAuthorId.Int64), Username: lastAuthorName.String, DisplayName: lastAuthorDisplayName.String},
+				CreatedAt: lastCreatedAt.Time.UTC(),
+			}
+			if lastEditedAt.Valid {
+				editedAt := lastEditedAt.Time.UTC()
+				summary.LastMessage.EditedAt = &editedAt
+			}
+		}
+		if previewId.Valid {
+			summary.Preview = &types.PreviewJSON{
+				MessageId: previewId.Int64,
+				Author:    types.AuthorJSON{Id: int(previewAuthorId.Int64), Username: previewAuthorName.String, DisplayName: previewDisplayName},
+				Excerpt:   previewExcerpt.String,
+				CreatedAt: previewAt.Time.UTC(),
+			}
+		}
+
+		result = append(result, summary)
+	}
+	if err := rows.Err(); err != nil {
+		log.Println(name + " err error")
+		return nil, err
+	}
+	return result, nil
+}
+
+func (s *PostgresStore) SetChatVisibility(ctx context.Context, id int, visibility string) error {
+	// exec query
+	query := `update chat set visibility=$1 where id=$2`
+	res, err := s.db.ExecContext(ctx, query, visibility, id)
+	if err != nil {
+		log.Println("setChatVisibility error")
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *PostgresStore) SetChatInfo(ctx context.Context, id int, name string, topic string) error {
+	// exec query
+	query := `update chat set name=$1, topic=$2 where id=$3`
+	res, err := s.db.ExecContext(ctx, query, name, topic, id)
+	if err != nil {
+		log.Println("setChatInfo error")
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *PostgresStore) SetChatWelcome(ctx context.Context, id int, text string) error {
+	// exec query
+	query := `update chat set welcome=$1 where id=$2`
+	res, err := s.db.ExecContext(ctx, query, text, id)
+	if err != nil {
+		log.Println("setChatWelcome error")
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *PostgresStore) SetChatAnnouncement(ctx context.Context, id int, announcement bool) error {
+	// exec query
+	query := `update chat set announcement=$1 where id=$2`
+	res, err := s.db.ExecContext(ctx, query, announcement, id)
+	if err != nil {
+		log.Println("setChatAnnouncement error")
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// DeleteChat deletes a chat with its messages, the memberships go with it
+func (s *PostgresStore) DeleteChat(ctx context.Context, id int) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		log.Println("deleteChat begin error")
+		return err
+	}
+	defer tx.Rollback()
+
+	// exec queries
+	res, err := tx.ExecContext(ctx, `delete from chat where id = $1`, id)
+	if err != nil {
+		log.Println("deleteChat error")
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrNotFound
+	}
+	for _, table := range []string{"messages", "chat_member_roles", "chat_tags", "chat_activity", "chat_mutes", "message_edits", "message_reactions", "bookmarks"} {
+		if _, err = tx.ExecContext(ctx, `delete from `+table+` where chat_id = $1`, id); err != nil {
+			log.Println("deleteChat " + table + " error")
+			return err
+		}
+	}
+	if err = addOutboxEvent(ctx, tx, types.OutboxChatDeleted, id, map[string]int{"chatId": id}); err != nil {
+		log.Println("deleteChat outbox error")
+		return err
+	}
+	return tx.Commit()
+}
+
+// SearchChats fuzzy matches q against the names and topics of public chats
+// and the given chats, best matches first
+func (s *PostgresStore) SearchChats(ctx context.Context, q string, chats []int, limit int) ([]types.ChatInfoJSON, error) {
+	// exec query, ilike catches short queries the trigram similarity misses
+	query := `select id, name, topic, visibility, category,
+	array(select tag from chat_tags where chat_id = chat.id order by tag),
+	(select count(*) from chat_members where chat_id = chat.id)
+	from chat
+	where (visibility = $1 or id = any($2))
+	and ($5 < 0 or workspace_id = $5)
+	and (name % $3 or topic % $3 or name ilike '%' || $3 || '%' or topic ilike '%' || $3 || '%')
+	order by greatest(similarity(name, $3), similarity(topic, $3)) desc, id desc
+	limit $4`
+	rows, err := s.db.QueryContext(ctx, query, types.VisibilityPublic, pq.Array(chats), q, limit, workspaceScope(ctx))
+	if err != nil {
+		log.Println("searchChats query error")
+		return nil, err
+	}
+	defer rows.Close()
+
+	// iterate rows
+	result := []types.ChatInfoJSON{}
+	for rows.Next() {
+		chat := types.ChatInfoJSON{Tags: []string{}}
+		if err := rows.Scan(&chat.Id, &chat.Name, &chat.Topic, &chat.Visibility, &chat.Category, pq.Array(&chat.Tags), &chat.MemberCount); err != nil {
+			log.Println("searchChats scan error")
+			return nil, err
+		}
+		result = append(result, chat)
+	}
+	if err = rows.Err(); err != nil {
+		log.Println("searchChats err error")
+		return nil, err
+	}
+	return result, nil
+}
+
+// SetChatTags replaces the category and tags of a chat
+func (s *PostgresStore) SetChatTags(ctx context.Context, id int, category string, tags []string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		log.Println("setChatTags begin error")
+		return err
+	}
+	defer tx.Rollback()
+
+	// exec queries
+	res, err := tx.ExecContext(ctx, `update chat set category=$1 where id=$2`, category, id)
+	if err != nil {
+		log.Println("setChatTags category error")
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrNotFound
+	}
+	if _, err = tx.ExecContext(ctx, `delete from chat_tags where chat_id = $1`, id); err != nil {
+		log.Println("setChatTags delete error")
+		return err
+	}
+	query := `insert into chat_tags (chat_id, tag) select $1, unnest($2::varchar[]) on conflict do nothing`
+	if _, err = tx.ExecContext(ctx, query, id, pq.Array(tags)); err != nil {
+		log.Println("setChatTags insert error")
+		return err
+	}
+	return tx.Commit()
+}
+
+// GetPublicChats returns a page of public chats with ids below before,
+// filtered by tag and category when they are set, and the total matching
+func (s *PostgresStore) GetPublicChats(ctx context.Context, tag string, category string, before int, limit int) ([]types.ChatInfoJSON, int, error) {
+	// exec query
+	query := `select id, name, topic, visibility, category, array(select tag from chat_tags where chat_id = c.id order by tag), members, total
+	from (
+		select id, name, topic, visibility, category, (select count(*) from chat_members where chat_id = chat.id) as members, count(*) over () as total
+		from chat
+		where visibility = $1
+		and ($2 = '' or id in (select chat_id from chat_tags where tag = $2))
+		and ($3 = '' or category = $3)
+		and ($6 < 0 or workspace_id = $6)
+	) c
+	where ($4 = 0 or id < $4)
+	order by id desc
+	limit $5`
+	rows, err := s.db.QueryContext(ctx, query, types.VisibilityPublic, tag, category, before, limit, workspaceScope(ctx))
+	if err != nil {
+		log.Println("getPublicChats query error")
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	// iterate rows
+	result := []types.ChatInfoJSON{}
+	total := 0
+	for rows.Next() {
+		chat := types.ChatInfoJSON{Tags: []string{}}
+		if err := rows.Scan(&chat.Id, &chat.Name, &chat.Topic, &chat.Visibility, &chat.Category, pq.Array(&chat.Tags), &chat.MemberCount, &total); err != nil {
+			log.Println("getPublicChats scan error")
+			return nil, 0, err
+		}
+		result = append(result, chat)
+	}
+	if err = rows.Err(); err != nil {
+		log.Println("getPublicChats err error")
+		return nil, 0, err
+	}
+	return result, total, nil
+}
+
+// UpdateChatActivity recomputes the activity of every chat from the
+// messages sent after since, an active member weighs as much as 5 messages
+func (s *PostgresStore) UpdateChatActivity(ctx context.Context, since time.Time) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		log.Println("updateChatActivity begin error")
+		return err
+	}
+	defer tx.Rollback()
+
+	// exec queries
+	if _, err = tx.ExecContext(ctx, `delete from chat_activity`); err != nil {
+		log.Println("updateChatActivity delete error")
+		return err
+	}
+	query := `insert into chat_activity (chat_id, messages, members, score)
+	select chat_id, count(*), count(distinct user_id), count(*) + 5 * count(distinct user_id)
+	from changes
+	where type = $1 and created_at > $2
+	group by chat_id`
+	if _, err = tx.ExecContext(ctx, query, "message_created", since.UTC()); err != nil {
+		log.Println("updateChatActivity insert error")
+		return err
+	}
+	return tx.Commit()
+}
+
+// GetTrendingChats returns the public chats with the highest activity score
+func (s *PostgresStore) GetTrendingChats(ctx context.Context, limit int) ([]types.TrendingChatJSON, error) {
+	// exec query
+	query := `select c.id, c.name, c.topic, c.visibility, c.category,
+	array(select tag from chat_tags where chat_id = c.id order by tag),
+	(select count(*) from chat_members where chat_id = c.id), a.score, a.messages, a.members
+	from chat_activity a
+	join chat c on c.id = a.chat_id
+	where c.visibility = $1 and ($3 < 0 or c.workspace_id = $3)
+	order by a.score desc, c.id desc
+	limit $2`
+	rows, err := s.db.QueryContext(ctx, query, types.VisibilityPublic, limit, workspaceScope(ctx))
+	if err != nil {
+		log.Println("getTrendingChats query error")
+		return nil, err
+	}
+	defer rows.Close()
+
+	// iterate rows
+	result := []types.TrendingChatJSON{}
+	for rows.Next() {
+		chat := types.TrendingChatJSON{ChatInfoJSON: types.ChatInfoJSON{Tags: []string{}}}
+		if err := rows.Scan(&chat.Id, &chat.Name, &chat.Topic, &chat.Visibility, &chat.Category, pq.Array(&chat.Tags), &chat.MemberCount, &chat.Score, &chat.RecentMessages, &chat.ActiveMembers); err != nil {
+			log.Println("getTrendingChats scan error")
+			return nil, err
+		}
+		result = append(result, chat)
+	}
+	if err = rows.Err(); err != nil {
+		log.Println("getTrendingChats err error")
+		return nil, err
+	}
+	return result, nil
+}
+
+func (s *PostgresStore) GetMemberRole(ctx context.Context, chatId int, userId int) (string, error) {
+	// exec query, non members have the default role
+	query := `select coalesce(
+		(select role from chat_members where chat_id = $1 and user_id = $2),
+		$3)`
+	role := ""
+	if err := s.db.QueryRowContext(ctx, query, chatId, userId, types.MemberRoleMember).Scan(&role); err != nil {
+		log.Println("getMemberRole error")
+		return "", err
+	}
+	return role, nil
+}
+
+func (s *PostgresStore) SetMemberRole(ctx context.Context, chatId int, userId int, role string) error {
+	// exec query
+	query := `update chat_members set role = $3 where chat_id = $1 and user_id = $2`
+	res, err := s.db.ExecContext(ctx, query, chatId, userId, role)
+	if err != nil {
+		log.Println("setMemberRole error")
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// AddMessage appends the message to its chat and returns the id it was given
+// AddMessage stores the message and its message.created outbox event
+func (s *PostgresStore) AddMessage(ctx context.Context, message types.MessageJSON) (int64, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		log.Println("addMessage begin error")
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	// exec queries, the chat has to exist
+	query := `insert into messages (chat_id, author_id, author_name, text, created_at)
+	select id, $2, $3, $4, $5 from chat where id = $1
+	returning id`
+	row := tx.QueryRowContext(ctx, query, message.ChatId, message.Author.Id, message.Author.Username, message.Text, message.CreatedAt.UTC())
+	if err = row.Scan(&message.Id); err != nil {
+		log.Println("addMessage error")
+		return 0, storageError(err)
+	}
+	if err = countMessage(ctx, tx, message); err != nil {
+		log.Println("addMessage count error")
+		return 0, err
+	}
+	if err = countWorkspaceMessage(ctx, tx, message); err != nil {
+		log.Println("addMessage usage error")
+		return 0, err
+	}
+	if err = addOutboxEvent(ctx, tx, types.OutboxMessageCreated, message.ChatId, message); err != nil {
+		log.Println("addMessage outbox error")
+		return 0, err
+	}
+	if err = tx.Commit(); err != nil {
+		return 0, err
+	}
+	return message.Id, nil
+}
+
+// messageColumns are read by scanMessage, the display name is the
+// author's current one
+const messageColumns = `id, chat_id, author_id, author_name, ` + authorDisplayName + ` as author_display_name, text, created_at, edited_at`
+
+const authorDisplayName = `coalesce((select display_name from users where users.id = messages.author_id), '')`
+
+type scanner interface {
+	Scan(...any) error
+}
+
+func scanMessage(row scanner) (types.MessageJSON, error) {
+	m := types.MessageJSON{}
+	var editedAt sql.NullTime
+	if err := row.Scan(&m.Id, &m.ChatId, &m.Author.Id, &m.Author.Username, &m.Author.DisplayName, &m.Text, &m.CreatedAt, &editedAt); err != nil {
+		return m, err
+	}
+	m.CreatedAt = m.CreatedAt.UTC()
+	if editedAt.Valid {
+		t := editedAt.Time.UTC()
+		m.EditedAt = &t
+	}
+	return m, nil
+}
+
+// getMessages returns the messages of each chat in the order they were sent
+func (s *PostgresStore) getMessages(ctx context.Context, chats []int) (map[int][]types.MessageJSON, error) {
+	result := map[int][]types.MessageJSON{}
+	for _, id := range chats {
+		result[id] = []types.MessageJSON{}
+	}
+
+	// exec query
+	query := `select ` + messageColumns + ` from messages where chat_id = any($1) order by chat_id, created_at, id`
+	rows, err := s.db.QueryContext(ctx, query, pq.Array(chats))
+	if err != nil {
+		log.Println("getMessages query error")
+		return nil, err
+	}
+	defer rows.Close()
+
+	// iterate rows
+	for rows.Next() {
+		m, err := scanMessage(rows)
+		if err != nil {
+			log.Println("getMessages scan error")
+			return nil, err
+		}
+		result[m.ChatId] = append(result[m.ChatId], m)
+	}
+	if err = rows.Err(); err != nil {
+		log.Println("getMessages err error")
+		return nil, err
+	}
+	return result, nil
+}
+
+// getLatestMessages returns up to limit of the latest messages of each chat,
+// oldest first
+func (s *PostgresStore) getLatestMessages(ctx context.Context, chats []int, limit int) (map[int][]types.MessageJSON, error) {
+	result := map[int][]types.MessageJSON{}
+	for _, id := range chats {
+		result[id] = []types.MessageJSON{}
+	}
+
+	// exec query, each chat walks its index back from the latest message
+	query := `select ` + messageColumns + ` from unnest($1::integer[]) as chats(chat)
+	cross join lateral (select * from messages where chat_id = chats.chat order by created_at desc, id desc limit $2) as messages
+	order by chat_id, created_at, id`
+	rows, err := s.db.QueryContext(ctx, query, pq.Array(chats), limit)
+	if err != nil {
+		log.Println("getLatestMessages query error")
+		return nil, err
+	}
+	defer rows.Close()
+
+	// iterate rows
+	for rows.Next() {
+		m, err := scanMessage(rows)
+		if err != nil {
+			log.Println("getLatestMessages scan error")
+			return nil, err
+		}
+		result[m.ChatId] = append(result[m.ChatId], m)
+	}
+	if err = rows.Err(); err != nil {
+		log.Println("getLatestMessages err error")
+		return nil, err
+	}
+	return result, nil
+}
+
+// ExportMessages calls fn with every message of the chat in the order
+// they were sent, one row at a time, and stops at the first error of fn
+func (s *PostgresStore) ExportMessages(ctx context.Context, chatId int, fn func(types.MessageJSON) error) error {
+	// check chat
+	var exists bool
+	if err := s.db.QueryRowContext(ctx, `select exists (select 1 from chat where id = $1)`, chatId).Scan(&exists); err != nil {
+		log.Println("exportMessages chat error")
+		return err
+	}
+	if !exists {
+		return ErrNotFound
+	}
+
+	// exec query
+	query := `select ` + messageColumns + ` from messages where chat_id = $1 order by created_at, id`
+	rows, err := s.db.QueryContext(ctx, query, chatId)
+	if err != nil {
+		log.Println("exportMessages query error")
+		return err
+	}
+	defer rows.Close()
+
+	// iterate rows
+	for rows.Next() {
+		m, err := scanMessage(rows)
+		if err != nil {
+			log.Println("exportMessages scan error")
+			return err
+		}
+		if err = fn(m); err != nil {
+			return err
+		}
+	}
+	if err = rows.Err(); err != nil {
+		log.Println("exportMessages err error")
+		return err
+	}
+	return nil
+}
+
+// EditMessage replaces the text of a message written by authorId and
+// keeps the previous text in the edit history
+func (s *PostgresStore) EditMessage(ctx context.Context, chatId int, messageId int64, authorId int, text string, at time.Time) (*types.MessageJSON, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		log.Println("editMessage begin error")
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// get message, locked until commit
+	query := `select ` + messageColumns + ` from messages where chat_id = $1 and id = $2 and author_id = $3 for update`
+	message, err := scanMessage(tx.QueryRowContext(ctx, query, chatId, messageId, authorId))
+	if err != nil {
+		log.Println("editMessage scan error")
+		return nil, storageError(err)
+	}
+
+	// keep previous text
+	query = `insert into message_edits (chat_id, message_id, text, edited_at) values ($1, $2, $3, $4)`
+	if _, err = tx.ExecContext(ctx, query, chatId, messageId, message.Text, at.UTC()); err != nil {
+		log.Println("editMessage history error")
+		return nil, err
+	}
+
+	// update message
+	editedAt := at.UTC()
+	query = `update messages set text = $1, edited_at = $2 where chat_id = $3 and id = $4`
+	if _, err = tx.ExecContext(ctx, query, text, editedAt, chatId, messageId); err != nil {
+		log.Println("editMessage update error")
+		return nil, err
+	}
+	message.Text, message.EditedAt = text, &editedAt
+	query = `update chat set last_excerpt = $1 where id = $2 and last_message_id = $3`
+	if _, err = tx.ExecContext(ctx, query, types.Excerpt(text), chatId, messageId); err != nil {
+		log.Println("editMessage preview error")
+		return nil, err
+	}
+	if err = addOutboxEvent(ctx, tx, types.OutboxMessageEdited, chatId, message); err != nil {
+		log.Println("editMessage outbox error")
+		return nil, err
+	}
+	return &message, tx.Commit()
+}
+
+// GetMessageHistory returns the previous versions of a message, oldest first,
+// ErrNotFound when the message isn't in the chat
+func (s *PostgresStore) GetMessageHistory(ctx context.Context, chatId int, messageId int64) ([]types.MessageEditJSON, error) {
+	// exec queries
+	var exists bool
+	query := `select exists (select 1 from messages where chat_id = $1 and id = $2)`
+	if err := s.db.QueryRowContext(ctx, query, chatId, messageId).Scan(&exists); err != nil {
+		log.Println("getMessageHistory exists error")
+		return nil, err
+	}
+	if !exists {
+		return nil, ErrNotFound
+	}
+	query = `select text, edited_at from message_edits where chat_id = $1 and message_id = $2 order by id`
+	rows, err := s.db.QueryContext(ctx, query, chatId, messageId)
+	if err != nil {
+		log.Println("getMessageHistory query error")
+		return nil, err
+	}
+	defer rows.Close()
+
+	// iterate rows
+	result := []types.MessageEditJSON{}
+	for rows.Next() {
+		edit := types.MessageEditJSON{}
+		if err := rows.Scan(&edit.Text, &edit.EditedAt); err != nil {
+			log.Println("getMessageHistory scan error")
+			return nil, err
+		}
+		edit.EditedAt = edit.EditedAt.UTC()
+		result = append(result, edit)
+	}
+	if err = rows.Err(); err != nil {
+		log.Println("getMessageHistory err error")
+		return nil, err
+	}
+	return result, nil
+}
+
+// AddReaction reacts to a message of the chat, reacting twice with the
+// same emoji is a no-op
+func (s *PostgresStore) AddReaction(ctx context.Context, chatId int, messageId int64, userId int, emoji string) error {
+	// exec query, the message has to be in the chat
+	query := `insert into message_reactions (chat_id, message_id, user_id, emoji)
+	select chat_id, id, $3, $4 from messages
+	where chat_id = $1 and id = $2
+	on conflict (message_id, emoji, user_id) do update set emoji = excluded.emoji`
+	res, err := s.db.ExecContext(ctx, query, chatId, messageId, userId, emoji)
+	if err != nil {
+		log.Println("addReaction error")
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *PostgresStore) RemoveReaction(ctx context.Context, chatId int, messageId int64, userId int, emoji string) error {
+	// exec query
+	query := `delete from message_reactions where chat_id = $1 and message_id = $2 and user_id = $3 and emoji = $4`
+	res, err := s.db.ExecContext(ctx, query, chatId, messageId, userId, emoji)
+	if err != nil {
+		log.Println("removeReaction error")
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// GetReactionSummary counts the reactions on a message per emoji, most
+// used first, and marks the ones userId made
+func (s *PostgresStore) GetReactionSummary(ctx context.Context, chatId int, messageId int64, userId int) ([]types.ReactionJSON, error) {
+	// exec query
+	query := `select emoji, count(*), bool_or(user_id = $3)
+	from message_reactions
+	where chat_id = $1 and message_id = $2
+	group by emoji
+	order by count(*) desc, min(created_at)`
+	rows, err := s.db.QueryContext(ctx, query, chatId, messageId, userId)
+	if err != nil {
+		log.Println("getReactionSummary query error")
+		return nil, err
+	}
+	defer rows.Close()
+
+	// iterate rows
+	result := []types.ReactionJSON{}
+	for rows.Next() {
+		reaction := types.ReactionJSON{}
+		if err := rows.Scan(&reaction.Emoji, &reaction.Count, &reaction.Reacted); err != nil {
+			log.Println("getReactionSummary scan error")
+			return nil, err
+		}
+		result = append(result, reaction)
+	}
+	if err = rows.Err(); err != nil {
+		log.Println("getReactionSummary err error")
+		return nil, err
+	}
+	return result, nil
+}
+
+// GetReactionUsers returns a page of the users who reacted with emoji,
+// ordered by id and starting after the given user id
+func (s *PostgresStore) GetReactionUsers(ctx context.Context, chatId int, messageId int64, emoji string, after int, limit int) ([]types.AuthorJSON, error) {
+	// exec query
+	query := `select u.id, u.username, u.display_name
+	from message_reactions r
+	join users u on u.id = r.user_id
+	where r.chat_id = $1 and r.message_id = $2 and r.emoji = $3 and r.user_id > $4
+	order by r.user_id
+	limit $5`
+	rows, err := s.db.QueryContext(ctx, query, chatId, messageId, emoji, after, limit)
+	if err != nil {
+		log.Println("getReactionUsers query error")
+		return nil, err
+	}
+	defer rows.Close()
+
+	// iterate rows
+	result := []types.AuthorJSON{}
+	for rows.Next() {
+		author := types.AuthorJSON{}
+		if err := rows.Scan(&author.Id, &author.Username, &author.DisplayName); err != nil {
+			log.Println("getReactionUsers scan error")
+			return nil, err
+		}
+		result = append(result, author)
+	}
+	if err = rows.Err(); err != nil {
+		log.Println("getReactionUsers err error")
+		return nil, err
+	}
+	return result, nil
+}
+
+// CreateBookmark bookmarks a message of the chat, bookmarking it twice
+// is a no-op
+func (s *PostgresStore) CreateBookmark(ctx context.Context, userId int, chatId int, messageId int64) error {
+	// exec query, the message has to be in the chat
+	query := `insert into bookmarks (user_id, chat_id, message_id)
+	select $1, chat_id, id from messages
+	where chat_id = $2 and id = $3
+	on conflict (user_id, message_id) do update set chat_id = excluded.chat_id`
+	res, err := s.db.ExecContext(ctx, query, userId, chatId, messageId)
+	if err != nil {
+		log.Println("createBookmark error")
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *PostgresStore) DeleteBookmark(ctx context.Context, userId int, messageId int64) error {
+	// exec query
+	query := `delete from bookmarks where user_id = $1 and message_id = $2`
+	res, err := s.db.ExecContext(ctx, query, userId, messageId)
+	if err != nil {
+		log.Println("deleteBookmark error")
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// GetBookmarks returns a page of the user's bookmarks in the given chats,
+// newest first with ids below before
+func (s *PostgresStore) GetBookmarks(ctx context.Context, userId int, chats []int, before int64, limit int) ([]types.BookmarkJSON, error) {
+	// exec query
+	query := `select b.id, b.created_at, messages.id, messages.chat_id, messages.author_id, messages.author_name, ` + authorDisplayName + `,
+	messages.text, messages.created_at, messages.edited_at
+	from bookmarks b
+	join messages on messages.chat_id = b.chat_id and messages.id = b.message_id
+	where b.user_id = $1 and b.chat_id = any($2) and ($3 = 0 or b.id < $3)
+	order by b.id desc
+	limit $4`
+	rows, err := s.db.QueryContext(ctx, query, userId, pq.Array(chats), before, limit)
+	if err != nil {
+		log.Println("getBookmarks query error")
+		return nil, err
+	}
+	defer rows.Close()
+
+	// iterate rows
+	result := []types.BookmarkJSON{}
+	for rows.Next() {
+		bookmark := types.BookmarkJSON{}
+		m := &bookmark.Message
+		var editedAt sql.NullTime
+		if err := rows.Scan(&bookmark.Id, &bookmark.CreatedAt, &m.Id, &m.ChatId, &m.Author.Id, &m.Author.Username, &m.Author.DisplayName, &m.Text, &m.CreatedAt, &editedAt); err != nil {
+			log.Println("getBookmarks scan error")
+			return nil, err
+		}
+		bookmark.CreatedAt, m.CreatedAt = bookmark.CreatedAt.UTC(), m.CreatedAt.UTC()
+		if editedAt.Valid {
+			t := editedAt.Time.UTC()
+			m.EditedAt = &t
+		}
+		result = append(result, bookmark)
+	}
+	if err = rows.Err(); err != nil {
+		log.Println("getBookmarks err error")
+		return nil, err
+	}
+	return result, nil
+}
+
+// CreateReceipts marks the message as sent to each of the recipients
+func (s *PostgresStore) CreateReceipts(ctx context.Context, message types.MessageJSON, usersId []int) error {
+	// exec query
+	query := `insert into message_receipts (message_id, user_id, author_id, status)
+	select $1, unnest($2::integer[]), $3, $4
+	on conflict do nothing`
+	if _, err := s.db.ExecContext(ctx, query, message.Id, pq.Array(usersId), message.Author.Id, types.ReceiptSent); err != nil {
+		log.Println("createReceipts error")
+		return err
+	}
+	return nil
+}
+
+// UpdateReceipt moves the status of the message for the user forward and
+// returns the author to notify, going back from read to delivered is ignored
+func (s *PostgresStore) UpdateReceipt(ctx context.Context, messageId int64, userId int, status string) (int, error) {
+	// exec query
+	query := `update message_receipts set status = $1, updated_at = now()
+	where message_id = $2 and user_id = $3
+	and array_position(array['sent', 'delivered', 'read'], status::text) < array_position(array['sent', 'delivered', 'read'], $1::text)
+	returning author_id`
+	var authorId int
+	if err := s.db.QueryRowContext(ctx, query, status, messageId, userId).Scan(&authorId); err != nil {
+		log.Println("updateReceipt error")
+		return 0, storageError(err)
+	}
+	return authorId, nil
+}
+
+func (s *PostgresStore) GetReceipts(ctx context.Context, messagesId []int64) ([]types.ReceiptJSON, error) {
+	// exec query
+	query := `select message_id, user_id, status from message_receipts where message_id = any($1) order by message_id, user_id`
+	rows, err := s.db.QueryContext(ctx, query, pq.Array(messagesId))
+	if err != nil {
+		log.Println("getReceipts query error")
+		return nil, err
+	}
+	defer rows.Close()
+
+	// iterate rows
+	result := []types.ReceiptJSON{}
+	for rows.Next() {
+		receipt := types.ReceiptJSON{}
+		if err := rows.Scan(&receipt.MessageId, &receipt.UserId, &receipt.Status); err != nil {
+			log.Println("getReceipts scan error")
+			return nil, err
+		}
+		result = append(result, receipt)
+	}
+	if err = rows.Err(); err != nil {
+		log.Println("getReceipts err error")
+		return nil, err
+	}
+	return result, nil
+}
+
+// StatsDays is how many days, today included, the messages per day and
+// active chats of the stats cover
+const StatsDays = 30
+
+// statsSince is the start of the first day the stats cover
+func statsSince(now time.Time) time.Time {
+	return now.UTC().Truncate(24*time.Hour).AddDate(0, 0, 1-StatsDays)
+}
+
+// messagesPerDay lists the counts by day from since, days without messages
+// included
+func messagesPerDay(since time.Time, counts map[string]int) []types.DayCountJSON {
+	days := make([]types.DayCountJSON, 0, StatsDays)
+	for i := 0; i < StatsDays; i++ {
+		day := since.AddDate(0, 0, i).Format(time.DateOnly)
+		days = append(days, types.DayCountJSON{Day: day, Count: counts[day]})
+	}
+	return days
+}
+
+func (s *PostgresStore) GetStats(ctx context.Context) (*types.StatsJSON, error) {
+	workspace, since := workspaceScope(ctx), statsSince(time.Now())
+
+	// exec query
+	// the database size is only shown outside of workspaces
+	query := `select
+		(select count(*) from users where $1 < 0 or workspace_id = $1),
+		(select count(*) from chat where $1 < 0 or workspace_id = $1),
+		(select count(*) from chat where ($1 < 0 or workspace_id = $1) and last_message_at >= $2),
+		(select coalesce(sum(message_count), 0) from chat where $1 < 0 or workspace_id = $1),
+		case when $1 <= 0 then pg_database_size(current_database()) else 0 end`
+	row := s.db.QueryRowContext(ctx, query, workspace, since)
+
+	stats := &types.StatsJSON{}
+
+	// scan row
+	if err := row.Scan(&stats.Users, &stats.Chats, &stats.ActiveChats, &stats.Messages, &stats.StorageBytes); err != nil {
+		log.Println("getStats scan error")
+		return nil, err
+	}
+
+	// count messages by day, only the partitions of the window are read
+	query = `select date_trunc('day', m.created_at), count(*) from messages m
+	join chat c on c.id = m.chat_id
+	where m.created_at >= $2 and ($1 < 0 or c.workspace_id = $1)
+	group by 1`
+	rows, err := s.db.QueryContext(ctx, query, workspace, since)
+	if err != nil {
+		log.Println("getStats messages per day error")
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := map[string]int{}
+	for rows.Next() {
+		var day time.Time
+		var n int
+		if err = rows.Scan(&day, &n); err != nil {
+			log.Println("getStats messages per day scan error")
+			return nil, err
+		}
+		counts[day.Format(time.DateOnly)] = n
+	}
+	if err = rows.Err(); err != nil {
+		log.Println("getStats messages per day err error")
+		return nil, err
+	}
+	stats.MessagesPerDay = messagesPerDay(since, counts)
+
+	return stats, nil
+}
+
+func (s *PostgresStore) CreateAnnouncement(ctx context.Context, text string) (*types.AnnouncementJSON, error) {
+	// exec query
+	query := `insert into announcements (text, workspace_id) values ($1, $2) returning id, text, created_at`
+	row := s.db.QueryRowContext(ctx, query, text, workspaceOf(ctx))
+
+	a := &types.AnnouncementJSON{}
+
+	// scan row
+	if err := row.Scan(&a.Id, &a.Text, &a.CreatedAt); err != nil {
+		log.Println("createAnnouncement error")
+		return nil, err
+	}
+	a.CreatedAt = a.CreatedAt.UTC()
+
+	return a, nil
+}
+
+func (s *PostgresStore) GetUnseenAnnouncements(ctx context.Context, userId int) ([]types.AnnouncementJSON, error) {
+	// exec query
+	query := `select a.id, a.text, a.created_at from announcements a
+	join users u on a.id > u.last_announcement and a.workspace_id = u.workspace_id
+	where u.id = $1
+	order by a.id`
+	rows, err := s.db.QueryContext(ctx, query, userId)
+	if err != nil {
+		log.Println("getUnseenAnnouncements query error")
+		return nil, err
+	}
+	defer rows.Close()
+
+	// iterate rows
+	result := []types.AnnouncementJSON{}
+	for rows.Next() {
+		a := types.AnnouncementJSON{}
+		if err := rows.Scan(&a.Id, &a.Text, &a.CreatedAt); err != nil {
+			log.Println("getUnseenAnnouncements scan error")
+			return nil, err
+		}
+		a.CreatedAt = a.CreatedAt.UTC()
+		result = append(result, a)
+	}
+	if err = rows.Err(); err != nil {
+		log.Println("getUnseenAnnouncements err error")
+		return nil, err
+	}
+	return result, nil
+}
+
+func (s *PostgresStore) MarkAnnouncementSeen(ctx context.Context, usersId []int, id int) error {
+	// exec query
+	query := `update users set last_announcement = $1 where id = any($2) and last_announcement < $1`
+	if _, err := s.db.ExecContext(ctx, query, id, pq.Array(usersId)); err != nil {
+		log.Println("markAnnouncementSeen error")
+		return err
+	}
+	return nil
+}
+
+func (s *PostgresStore) CreateChange(ctx context.Context, chatId int, userId int, changeType string, data any) (int64, error) {
+	// encode data
+	djs, err := json.Marshal(data)
+	if err != nil {
+		log.Println("createChange json error")
+		return 0, err
+	}
+
+	// exec query
+	query := `insert into changes (chat_id, user_id, type, data) values ($1, $2, $3, $4) returning id`
+	id := int64(0)
+	if err = s.db.QueryRowContext(ctx, query, chatId, userId, changeType, djs).Scan(&id); err != nil {
+		log.Println("createChange error")
+		return 0, err
+	}
+	return id, nil
+}
+
+func (s *PostgresStore) GetChanges(ctx context.Context, userId int, chats []int, since int64, limit int) ([]types.ChangeJSON, error) {
+	// exec query
+	query := `select id, chat_id, user_id, type, data, created_at from changes
+	where id > $1 and (chat_id = any($2) or user_id = $3)
+	order by id
+	limit $4`
+	rows, err := s.db.QueryContext(ctx, query, since, pq.Array(chats), userId, limit)
+	if err != nil {
+		log.Println("getChanges query error")
+		return nil, err
+	}
+	defer rows.Close()
+
+	// iterate rows
+	result := []types.ChangeJSON{}
+	for rows.Next() {
+		change := types.ChangeJSON{}
+		if err := rows.Scan(&change.Id, &change.ChatId, &change.UserId, &change.Type, &change.Data, &change.CreatedAt); err != nil {
+			log.Println("getChanges scan error")
+			return nil, err
+		}
+		change.CreatedAt = change.CreatedAt.UTC()
+		result = append(result, change)
+	}
+	if err = rows.Err(); err != nil {
+		log.Println("getChanges err error")
+		return nil, err
+	}
+	return result, nil
+}
+
+func (s *PostgresStore) GetDeviceCursor(ctx context.Context, userId int, device string) (int64, error) {
+	// new devices start at the latest change
+	query := `select coalesce(
+		(select cursor from device_cursors where user_id = $1 and device_id = $2),
+		(select max(id) from changes),
+		0)`
+	cursor := int64(0)
+	if err := s.db.QueryRowContext(ctx, query, userId, device).Scan(&cursor); err != nil {
+		log.Println("getDeviceCursor error")
+		return 0, err
+	}
+	return cursor, nil
+}
+
+func (s *PostgresStore) UpdateDeviceCursor(ctx context.Context, userId int, device string, cursor int64) error {
+	// exec query, cursors never move back
+	query := `insert into device_cursors (user_id, device_id, cursor) values ($1, $2, $3)
+	on conflict (user_id, device_id) do update set cursor = greatest(device_cursors.cursor, excluded.cursor)`
+	if _, err := s.db.ExecContext(ctx, query, userId, device, cursor); err != nil {
+		log.Println("updateDeviceCursor error")
+		return err
+	}
+	return nil
+}
+
+func (s *PostgresStore) CreatePushToken(ctx context.Context, userId int, token string, platform string) error {
+	// exec query, a token moves to the user who registered it last
+	query := `insert into push_tokens (token, user_id, platform) values ($1, $2, $3)
+	on conflict (token) do update set user_id = excluded.user_id, platform = excluded.platform`
+	if _, err := s.db.ExecContext(ctx, query, token, userId, platform); err != nil {
+		log.Println("createPushToken error")
+		return err
+	}
+	return nil
+}
+
+func (s *PostgresStore) DeletePushToken(ctx context.Context, userId int, token string) error {
+	// exec query
+	query := `delete from push_tokens where token = $1 and user_id = $2`
+	if _, err := s.db.ExecContext(ctx, query, token, userId); err != nil {
+		log.Println("deletePushToken error")
+		return err
+	}
+	return nil
+}
+
+func (s *PostgresStore) GetPushTokens(ctx context.Context, usersId []int, chatId int) ([]types.PushToken, error) {
+	// exec query, users that muted the chat are skipped
+	query := `select user_id, token, platform from push_tokens
+	where user_id = any($1)
+	and user_id not in (select user_id from chat_mutes where chat_id = $2)`
+	rows, err := s.db.QueryContext(ctx, query, pq.Array(usersId), chatId)
+	if err != nil {
+		log.Println("getPushTokens query error")
+		return nil, err
+	}
+	defer rows.Close()
+
+	// iterate rows
+	result := []types.PushToken{}
+	for rows.Next() {
+		t := types.PushToken{}
+		if err := rows.Scan(&t.UserId, &t.Token, &t.Platform); err != nil {
+			log.Println("getPushTokens scan error")
+			return nil, err
+		}
+		result = append(result, t)
+	}
+	if err = rows.Err(); err != nil {
+		log.Println("getPushTokens err error")
+		return nil, err
+	}
+	return result, nil
+}
+
+func (s *PostgresStore) SetChatMuted(ctx context.Context, userId int, chatId int, muted bool) error {
+	// exec query
+	query := `delete from chat_mutes where user_id = $1 and chat_id = $2`
+	if muted {
+		query = `insert into chat_mutes (user_id, chat_id) values ($1, $2) on conflict do nothing`
+	}
+	if _, err := s.db.ExecContext(ctx, query, userId, chatId); err != nil {
+		log.Println("setChatMuted error")
+		return err
+	}
+	return nil
+}
+
+// GetPreferences returns the preferences of the users, with the defaults
+// for users that never set them
+func (s *PostgresStore) GetPreferences(ctx context.Context, usersId []int) (map[int]types.PreferencesJSON, error) {
+	// exec query
+	query := `select u.id, coalesce(p.notify, 'all'), coalesce(p.email, true), coalesce(p.quiet_hours, '[]'), u.time_zone
+	from users u
+	left join user_preferences p on p.user_id = u.id
+	where u.id = any($1)`
+	rows, err := s.db.QueryContext(ctx, query, pq.Array(usersId))
+	if err != nil {
+		log.Println("getPreferences query error")
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := map[int]types.PreferencesJSON{}
+	for _, id := range usersId {
+		result[id] = types.DefaultPreferences()
+	}
+
+	// iterate rows
+	for rows.Next() {
+		var id int
+		var qjs []byte
+		p := types.PreferencesJSON{QuietHours: []types.QuietHoursJSON{}}
+		if err := rows.Scan(&id, &p.Notify, &p.Email, &qjs, &p.TimeZone); err != nil {
+			log.Println("getPreferences scan error")
+			return nil, err
+		}
+		if err := json.Unmarshal(qjs, &p.QuietHours); err != nil {
+			log.Println("getPreferences json decode error")
+			return nil, err
+		}
+		result[id] = p
+	}
+	if err = rows.Err(); err != nil {
+		log.Println("getPreferences err error")
+		return nil, err
+	}
+	return result, nil
+}
+
+func (s *PostgresStore) SetPreferences(ctx context.Context, userId int, p types.PreferencesJSON) error {
+	// encode quiet hours
+	qjs, err := json.Marshal(p.QuietHours)
+	if err != nil {
+		log.Println("setPreferences json error")
+		return err
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		log.Println("setPreferences begin error")
+		return err
+	}
+	defer tx.Rollback()
+
+	// exec queries, the time zone belongs to the user
+	query := `insert into user_preferences (user_id, notify, email, quiet_hours)
+	values ($1, $2, $3, $4)
+	on conflict (user_id) do update set notify = $2, email = $3, quiet_hours = $4`
+	if _, err = tx.ExecContext(ctx, query, userId, p.Notify, p.Email, qjs); err != nil {
+		log.Println("setPreferences error")
+		return err
+	}
+	if _, err = tx.ExecContext(ctx, `update users set time_zone = $1 where id = $2`, p.TimeZone, userId); err != nil {
+		log.Println("setPreferences time zone error")
+		return err
+	}
+	return tx.Commit()
+}
+
+// CreateNotifications adds the same notification to the inbox of every user
+func (s *PostgresStore) CreateNotifications(ctx context.Context, usersId []int, notificationType string, chatId int, data any) error {
+	// encode data
+	djs, err := json.Marshal(data)
+	if err != nil {
+		log.Println("createNotifications json error")
+		return err
+	}
+
+	// exec query
+	query := `insert into notifications (user_id, type, chat_id, data)
+	select unnest($1::integer[]), $2, $3, $4`
+	if _, err = s.db.ExecContext(ctx, query, pq.Array(usersId), notificationType, chatId, djs); err != nil {
+		log.Println("createNotifications error")
+		return err
+	}
+	return nil
+}
+
+// GetNotifications returns a page of the user's notifications newest first
+// with ids below before
+func (s *PostgresStore) GetNotifications(ctx context.Context, userId int, unreadOnly bool, before int64, limit int) ([]types.NotificationJSON, error) {
+	// exec query
+	query := `select id, type, chat_id, data, read, created_at from notifications
+	where user_id = $1 and (not $2 or not read) and ($3 = 0 or id < $3)
+	order by id desc
+	limit $4`
+	rows, err := s.db.QueryContext(ctx, query, userId, unreadOnly, before, limit)
+	if err != nil {
+		log.Println("getNotifications query error")
+		return nil, err
+	}
+	defer rows.Close()
+
+	// iterate rows
+	result := []types.NotificationJSON{}
+	for rows.Next() {
+		notification := types.NotificationJSON{}
+		if err := rows.Scan(&notification.Id, &notification.Type, &notification.ChatId, &notification.Data, &notification.Read, &notification.CreatedAt); err != nil {
+			log.Println("getNotifications scan error")
+			return nil, err
+		}
+		notification.CreatedAt = notification.CreatedAt.UTC()
+		result = append(result, notification)
+	}
+	if err = rows.Err(); err != nil {
+		log.Println("getNotifications err error")
+		return nil, err
+	}
+	return result, nil
+}
+
+// MarkNotificationsRead marks the given notifications of the user read,
+// all of them when ids is empty
+func (s *PostgresStore) MarkNotificationsRead(ctx context.Context, userId int, ids []int64) error {
+	// exec query
+	query := `update notifications set read = true
+	where user_id = $1 and not read and (cardinality($2::bigint[]) = 0 or id = any($2))`
+	if _, err := s.db.ExecContext(ctx, query, userId, pq.Array(ids)); err != nil {
+		log.Println("markNotificationsRead error")
+		return err
+	}
+	return nil
+}
+
+func (s *PostgresStore) CreatePasskey(ctx context.Context, userId int, credential webauthn.Credential) error {
+	// encode credential
+	cjs, err := json.Marshal(&credential)
+	if err != nil {
+		log.Println("createPasskey json error")
+		return err
+	}
+
+	// exec query
+	query := `insert into passkeys (id, user_id, credential) values ($1, $2, $3)`
+	if _, err = s.db.ExecContext(ctx, query, credential.ID, userId, cjs); err != nil {
+		log.Println("createPasskey error")
+		return storageError(err)
+	}
+	return nil
+}
+
+func (s *PostgresStore) GetPasskeys(ctx context.Context, userId int) ([]webauthn.Credential, error) {
+	// exec query
+	query := `select credential from passkeys where user_id = $1`
+	rows, err := s.db.QueryContext(ctx, query, userId)
+	if err != nil {
+		log.Println("getPasskeys query error")
+		return nil, err
+	}
+	defer rows.Close()
+
+	// iterate rows
+	result := []webauthn.Credential{}
+	for rows.Next() {
+		var cjs []byte
+		if err := rows.Scan(&cjs); err != nil {
+			log.Println("getPasskeys scan error")
+			return nil, err
+		}
+
+		// decode credential
+		credential := webauthn.Credential{}
+		if err := json.Unmarshal(cjs, &credential); err != nil {
+			log.Println("getPasskeys json decode error")
+			return nil, err
+		}
+		result = append(result, credential)
+	}
+	if err = rows.Err(); err != nil {
+		log.Println("getPasskeys err error")
+		return nil, err
+	}
+	return result, nil
+}
+
+func (s *PostgresStore) UpdatePasskey(ctx context.Context, credential webauthn.Credential) error {
+	// encode credential
+	cjs, err := json.Marshal(&credential)
+	if err != nil {
+		log.Println("updatePasskey json error")
+		return err
+	}
+
+	// exec query
+	query := `update passkeys set credential = $1 where id = $2`
+	res, err := s.db.ExecContext(ctx, query, cjs, credential.ID)
+	if err != nil {
+		log.Println("updatePasskey error")
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
@@ -0,0 +1,250 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+
+	"example/gochat/types"
+)
+
+// every query of the fake database waits this long, about a round trip to
+// a database in the same zone
+const benchRoundTrip = 100 * time.Microsecond
+
+// members of each chat, the users of different chats don't overlap
+const benchMembers = 5
+
+// messages of each chat, more than come with the chat list
+const benchMessages = 4 * chatListMessages
+
+// BenchmarkGetChats loads chats the way a login does and reports the
+// queries it takes and the messages it reads, with getChats and with the
+// per chat path it replaced as a baseline. The author cache is emptied
+// before each call, so the members are looked up every time
+func BenchmarkGetChats(b *testing.B) {
+	s, d := benchStore(b)
+	ctx := context.Background()
+	paths := []struct {
+		name     string
+		getChats func(context.Context, []int) ([]types.Chat, error)
+	}{
+		{"path=per-chat", func(ctx context.Context, ids []int) ([]types.Chat, error) { return benchGetChatsPerChat(ctx, s, ids) }},
+		{"path=batched", s.getChats},
+	}
+	for _, path := range paths {
+		for _, n := range []int{1, 10, 100} {
+			ids := make([]int, n)
+			for i := range ids {
+				ids[i] = i + 1
+			}
+			b.Run(fmt.Sprintf("%s/chats=%d", path.name, n), func(b *testing.B) {
+				d.queries.Store(0)
+				d.messages.Store(0)
+				for i := 0; i < b.N; i++ {
+					s.authors = newAuthorCache()
+					chats, err := path.getChats(ctx, ids)
+					if err != nil {
+						b.Fatal(err)
+					}
+					if len(chats) != n || len(chats[0].Users) != benchMembers {
+						b.Fatalf("got %d chats", len(chats))
+					}
+				}
+				b.ReportMetric(float64(d.queries.Load())/float64(b.N), "queries/op")
+				b.ReportMetric(float64(d.messages.Load())/float64(b.N), "messages/op")
+			})
+		}
+	}
+}
+
+// benchGetChatsPerChat is getChats as it was, loading every message and
+// looking the members up chat by chat with the chat rows still open
+func benchGetChatsPerChat(ctx context.Context, s *PostgresStore, arr []int) ([]types.Chat, error) {
+	query := `select id, password, ` + memberIds + `, visibility, category,
+	array(select tag from chat_tags where chat_id = chat.id order by tag), name, topic, announcement, ` + chatImages + `
+	from chat where id = any($1)`
+	rows, err := s.db.QueryContext(ctx, query, pq.Array(arr))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	messages, err := s.getMessages(ctx, arr)
+	if err != nil {
+		return nil, err
+	}
+
+	chats := []types.Chat{}
+	for rows.Next() {
+		chat := types.Chat{Users: []types.AuthorJSON{}, Tags: []string{}}
+		nullArray := []sql.NullInt64{}
+		var images []byte
+		if err := rows.Scan(&chat.Id, &chat.Password, pq.Array(&nullArray), &chat.Visibility, &chat.Category, pq.Array(&chat.Tags), &chat.Name, &chat.Topic, &chat.Announcement, &images); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(images, &chat.Images); err != nil {
+			return nil, err
+		}
+		chat.Messages = messages[chat.Id]
+
+		usersId := []int{}
+		for _, id := range nullArray {
+			if id.Valid {
+				usersId = append(usersId, int(id.Int64))
+			}
+		}
+		authors, err := s.GetAuthors(ctx, usersId)
+		if err != nil {
+			return nil, err
+		}
+		chat.Users = authorList(authors, usersId)
+		chats = append(chats, chat)
+	}
+	return chats, rows.Err()
+}
+
+var registerBenchDriver sync.Once
+
+// benchStore returns a store on a fake database answering the queries of
+// getChats, and the driver counting what it answered
+func benchStore(b *testing.B) (*PostgresStore, *benchDriver) {
+	d := &benchDriver{}
+	registerBenchDriver.Do(func() { sql.Register("gochat-bench", d) })
+	db, err := sql.Open("gochat-bench", "")
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { db.Close() })
+	// sql.Register keeps the first driver, count through it
+	d = db.Driver().(*benchDriver)
+	return &PostgresStore{db: db, authors: newAuthorCache()}, d
+}
+
+type benchDriver struct {
+	queries  atomic.Int64
+	messages atomic.Int64
+}
+
+func (d *benchDriver) Open(string) (driver.Conn, error) {
+	return &benchConn{d: d}, nil
+}
+
+type benchConn struct {
+	d *benchDriver
+}
+
+func (c *benchConn) Prepare(string) (driver.Stmt, error) {
+	return nil, errors.New("prepare not supported")
+}
+
+func (c *benchConn) Close() error {
+	return nil
+}
+
+func (c *benchConn) Begin() (driver.Tx, error) {
+	return nil, errors.New("transactions not supported")
+}
+
+// QueryContext answers the chats, messages and authors queries for the ids
+// in the first argument
+func (c *benchConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	c.d.queries.Add(1)
+	time.Sleep(benchRoundTrip)
+
+	ids := benchIds(args)
+	rows := &benchRows{}
+	switch {
+	case strings.Contains(query, "from chat where id = any"):
+		rows.columns = []string{"id", "password", "members", "visibility", "category", "tags", "name", "topic", "announcement", "images"}
+		for _, id := range ids {
+			members := []string{}
+			for m := 1; m <= benchMembers; m++ {
+				members = append(members, strconv.FormatInt((id-1)*benchMembers+int64(m), 10))
+			}
+			rows.values = append(rows.values, []driver.Value{id, "", []byte("{" + strings.Join(members, ",") + "}"), "public", "", []byte("{}"), "chat", "", false, []byte("{}")})
+		}
+	case strings.Contains(query, "from messages where chat_id = any"):
+		rows.columns = messageCols
+		rows.values = benchChatMessages(ids, benchMessages)
+		c.d.messages.Add(int64(len(rows.values)))
+	case strings.Contains(query, "cross join lateral (select * from messages"):
+		limit, _ := args[1].Value.(int64)
+		rows.columns = messageCols
+		rows.values = benchChatMessages(ids, min(int(limit), benchMessages))
+		c.d.messages.Add(int64(len(rows.values)))
+	case strings.Contains(query, "from users where id = any"):
+		rows.columns = []string{"id", "username", "display_name", "last_seen"}
+		for _, id := range ids {
+			rows.values = append(rows.values, []driver.Value{id, "user" + strconv.FormatInt(id, 10), "", nil})
+		}
+	default:
+		return nil, fmt.Errorf("unexpected query %q", query)
+	}
+	return rows, nil
+}
+
+// messageCols are the columns of messageColumns
+var messageCols = []string{"id", "chat_id", "author_id", "author_name", "author_display_name", "text", "created_at", "edited_at"}
+
+// benchChatMessages returns n messages of each chat, oldest first
+func benchChatMessages(ids []int64, n int) [][]driver.Value {
+	values := [][]driver.Value{}
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, id := range ids {
+		for m := int64(0); m < int64(n); m++ {
+			author := (id-1)*benchMembers + m%benchMembers + 1
+			values = append(values, []driver.Value{id*benchMessages + m, id, author, "user" + strconv.FormatInt(author, 10), "", "hello", start.Add(time.Duration(m) * time.Minute), nil})
+		}
+	}
+	return values
+}
+
+// benchIds reads the ids of a pq.Array argument such as {1,2,3}
+func benchIds(args []driver.NamedValue) []int64 {
+	if len(args) == 0 {
+		return nil
+	}
+	v, _ := args[0].Value.(string)
+	ids := []int64{}
+	for _, field := range strings.Split(strings.Trim(v, "{}"), ",") {
+		if id, err := strconv.ParseInt(field, 10, 64); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+type benchRows struct {
+	columns []string
+	values  [][]driver.Value
+}
+
+func (r *benchRows) Columns() []string {
+	return r.columns
+}
+
+func (r *benchRows) Close() error {
+	return nil
+}
+
+func (r *benchRows) Next(dest []driver.Value) error {
+	if len(r.values) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.values[0])
+	r.values = r.values[1:]
+	return nil
+}
@@ -0,0 +1,264 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"example/gochat/types"
+)
+
+// testPostgres returns a store on a schema of its own in the database at
+// GOCHAT_TEST_POSTGRES, dropped when the test ends. Tests using it are
+// skipped when the variable isn't set
+func testPostgres(t *testing.T) *PostgresStore {
+	t.Helper()
+	dsn := os.Getenv("GOCHAT_TEST_POSTGRES")
+	if dsn == "" {
+		t.Skip("GOCHAT_TEST_POSTGRES not set")
+	}
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	schema := fmt.Sprintf("gochat_test_%d", time.Now().UnixNano())
+	if _, err = db.Exec(`create schema ` + schema); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if _, err := db.Exec(`drop schema ` + schema + ` cascade`); err != nil {
+			t.Error(err)
+		}
+	})
+
+	// extensions stay in public
+	if strings.Contains(dsn, "://") {
+		sep := "?"
+		if strings.Contains(dsn, "?") {
+			sep = "&"
+		}
+		dsn += sep + "search_path=" + schema + ",public"
+	} else {
+		dsn += " search_path=" + schema + ",public"
+	}
+	s, err := NewPostgresStore(dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.db.Close() })
+	if err = s.Init(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// testBolt returns a store on a file removed when the test ends
+func testBolt(t *testing.T) *BoltStore {
+	t.Helper()
+	s, err := NewBoltStore(filepath.Join(t.TempDir(), "gochat.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	if err = s.Init(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// testStores runs a test against each store, postgres only when
+// GOCHAT_TEST_POSTGRES is set
+func testStores(t *testing.T, test func(*testing.T, Storage)) {
+	t.Run("bolt", func(t *testing.T) { test(t, testBolt(t)) })
+	t.Run("postgres", func(t *testing.T) { test(t, testPostgres(t)) })
+}
+
+func TestStats(t *testing.T) {
+	testStores(t, testStats)
+}
+
+func testStats(t *testing.T, s Storage) {
+	ctx := WithWorkspace(context.Background(), 0)
+	now := time.Now().UTC()
+
+	user, err := s.CreateUser(ctx, "alice", "alice@example.com", "hash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	active, err := s.CreateChat(ctx, types.Chat{Name: "active", Visibility: types.VisibilityPublic}, *user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	quiet, err := s.CreateChat(ctx, types.Chat{Name: "quiet", Visibility: types.VisibilityPublic}, *user)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// two days in the window for the active chat, one before it for the
+	// quiet one
+	author := types.AuthorJSON{Id: user.Id, Username: user.Username}
+	for _, m := range []types.MessageJSON{
+		{ChatId: active.Id, Author: author, Text: "today", CreatedAt: now},
+		{ChatId: active.Id, Author: author, Text: "today again", CreatedAt: now},
+		{ChatId: active.Id, Author: author, Text: "before", CreatedAt: now.AddDate(0, 0, -2)},
+		{ChatId: quiet.Id, Author: author, Text: "long ago", CreatedAt: now.AddDate(0, 0, -StatsDays-10)},
+	} {
+		if p, ok := s.(*PostgresStore); ok {
+			if err = createMessagePartition(ctx, p.db, m.CreatedAt); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err = s.AddMessage(ctx, m); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stats, err := s.GetStats(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Users != 1 || stats.Chats != 2 || stats.ActiveChats != 1 || stats.Messages != 4 {
+		t.Fatalf("got %d users, %d chats, %d active, %d messages", stats.Users, stats.Chats, stats.ActiveChats, stats.Messages)
+	}
+	if stats.StorageBytes == 0 {
+		t.Error("no database size outside of workspaces")
+	}
+	if len(stats.MessagesPerDay) != StatsDays {
+		t.Fatalf("got %d days", len(stats.MessagesPerDay))
+	}
+	counts := map[string]int{}
+	for _, d := range stats.MessagesPerDay {
+		counts[d.Day] = d.Count
+	}
+	today, before := now.Format(time.DateOnly), now.AddDate(0, 0, -2).Format(time.DateOnly)
+	if counts[today] != 2 || counts[before] != 1 || stats.MessagesPerDay[StatsDays-1].Day != today {
+		t.Errorf("got %v", stats.MessagesPerDay)
+	}
+
+	// another workspace sees none of it
+	stats, err = s.GetStats(WithWorkspace(context.Background(), user.WorkspaceId+1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Users != 0 || stats.Chats != 0 || stats.Messages != 0 || stats.StorageBytes != 0 {
+		t.Errorf("got %+v", stats)
+	}
+}
+
+func TestAddMember(t *testing.T) {
+	testStores(t, testAddMember)
+}
+
+// racing joins of a user add them once, the others get ErrConflict
+func testAddMember(t *testing.T, s Storage) {
+	ctx := WithWorkspace(context.Background(), 0)
+	owner, err := s.CreateUser(ctx, "alice", "alice@example.com", "hash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	user, err := s.CreateUser(ctx, "bobby", "bobby@example.com", "hash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	chat, err := s.CreateChat(ctx, types.Chat{Name: "room", Visibility: types.VisibilityPublic}, *owner)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const joins = 10
+	errs := make(chan error, joins)
+	for i := 0; i < joins; i++ {
+		go func() { errs <- s.AddMember(ctx, chat.Id, user.Id) }()
+	}
+	added := 0
+	for i := 0; i < joins; i++ {
+		switch err := <-errs; {
+		case err == nil:
+			added++
+		case !errors.Is(err, ErrConflict):
+			t.Fatal(err)
+		}
+	}
+	if added != 1 {
+		t.Errorf("added %d times", added)
+	}
+	if err = s.AddMember(ctx, chat.Id, owner.Id); !errors.Is(err, ErrConflict) {
+		t.Errorf("adding the creator again: got %v", err)
+	}
+
+	chat, err = s.GetChatById(ctx, chat.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chat.Users) != 2 {
+		t.Errorf("got %d members", len(chat.Users))
+	}
+}
+
+func TestGetChats(t *testing.T) {
+	testStores(t, testGetChats)
+}
+
+// the chat list carries the latest messages of each chat, oldest first
+func testGetChats(t *testing.T, s Storage) {
+	ctx := WithWorkspace(context.Background(), 0)
+	now := time.Now().UTC().Truncate(time.Second)
+
+	user, err := s.CreateUser(ctx, "alice", "alice@example.com", "hash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	busy, err := s.CreateChat(ctx, types.Chat{Name: "busy", Visibility: types.VisibilityPublic}, *user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	quiet, err := s.CreateChat(ctx, types.Chat{Name: "quiet", Visibility: types.VisibilityPublic}, *user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sent := chatListMessages + 10
+	if p, ok := s.(*PostgresStore); ok {
+		for _, at := range []time.Time{now.Add(-time.Duration(sent) * time.Second), now} {
+			if err = createMessagePartition(ctx, p.db, at); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	author := types.AuthorJSON{Id: user.Id, Username: user.Username}
+	for i := 0; i < sent; i++ {
+		m := types.MessageJSON{ChatId: busy.Id, Author: author, Text: fmt.Sprint(i), CreatedAt: now.Add(time.Duration(i-sent) * time.Second)}
+		if _, err = s.AddMessage(ctx, m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err = s.AddMessage(ctx, types.MessageJSON{ChatId: quiet.Id, Author: author, Text: "hi", CreatedAt: now}); err != nil {
+		t.Fatal(err)
+	}
+
+	chats, err := s.GetChats(ctx, []int{busy.Id, quiet.Id})
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages := map[int][]types.MessageJSON{}
+	for _, c := range chats {
+		messages[c.Id] = c.Messages
+	}
+	got := messages[busy.Id]
+	if len(got) != chatListMessages {
+		t.Fatalf("got %d messages of the busy chat", len(got))
+	}
+	if got[0].Text != fmt.Sprint(sent-chatListMessages) || got[len(got)-1].Text != fmt.Sprint(sent-1) {
+		t.Errorf("got messages %s to %s", got[0].Text, got[len(got)-1].Text)
+	}
+	if len(messages[quiet.Id]) != 1 {
+		t.Errorf("got %d messages of the quiet chat", len(messages[quiet.Id]))
+	}
+}
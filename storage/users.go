@@ -0,0 +1,128 @@
+package storage
+
+import (
+	"context"
+	"log"
+
+	"example/gochat/types"
+)
+
+func (s *PostgresStore) addUserAccountColumns(ctx context.Context) error {
+	query := `alter table users add column if not exists disabled boolean not null default false;
+	alter table users add column if not exists token_version integer not null default 0`
+
+	_, err := s.db.ExecContext(ctx, query)
+	return err
+}
+
+// SetUserDisabled disables or enables a user, disabling also revokes their
+// tokens so enabling them again doesn't bring old sessions back
+func (s *PostgresStore) SetUserDisabled(ctx context.Context, id int, disabled bool) error {
+	// exec query
+	query := `update users set disabled = $1,
+	token_version = token_version + case when $1 then 1 else 0 end
+	where id = $2`
+	res, err := s.db.ExecContext(ctx, query, disabled, id)
+	if err != nil {
+		log.Println("setUserDisabled error")
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// SetPassword replaces the password hash and revokes the tokens issued
+// until now
+func (s *PostgresStore) SetPassword(ctx context.Context, id int, password string) error {
+	// exec query
+	query := `update users set password = $1, token_version = token_version + 1 where id = $2`
+	res, err := s.db.ExecContext(ctx, query, password, id)
+	if err != nil {
+		log.Println("setPassword error")
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// DeleteUser deletes a user with their memberships and personal data. Their
+// messages stay, anonymized as types.DeletedUser, reactions and receipts
+// stay as they are
+func (s *PostgresStore) DeleteUser(ctx context.Context, id int) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		log.Println("deleteUser begin error")
+		return err
+	}
+	defer tx.Rollback()
+
+	// the chats they leave hear about it
+	rows, err := tx.QueryContext(ctx, `select chat_id from chat_members where user_id = $1`, id)
+	if err != nil {
+		log.Println("deleteUser chats error")
+		return err
+	}
+	chats := []int{}
+	for rows.Next() {
+		var chatId int
+		if err := rows.Scan(&chatId); err != nil {
+			rows.Close()
+			log.Println("deleteUser scan error")
+			return err
+		}
+		chats = append(chats, chatId)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		log.Println("deleteUser err error")
+		return err
+	}
+	for _, chatId := range chats {
+		if err = addMemberEvent(ctx, tx, types.OutboxMemberLeft, chatId, id); err != nil {
+			log.Println("deleteUser outbox error")
+			return err
+		}
+	}
+
+	// messages
+	query := `update messages set author_id = $2, author_name = $3 where author_id = $1`
+	if _, err = tx.ExecContext(ctx, query, id, types.DeletedUser.Id, types.DeletedUser.Username); err != nil {
+		log.Println("deleteUser messages error")
+		return err
+	}
+	query = `update chat set last_author_id = $2, last_author_name = $3 where last_author_id = $1`
+	if _, err = tx.ExecContext(ctx, query, id, types.DeletedUser.Id, types.DeletedUser.Username); err != nil {
+		log.Println("deleteUser previews error")
+		return err
+	}
+	query = `update message_receipts set author_id = $2 where author_id = $1`
+	if _, err = tx.ExecContext(ctx, query, id, types.DeletedUser.Id); err != nil {
+		log.Println("deleteUser receipts error")
+		return err
+	}
+
+	// tables without a foreign key, the others cascade
+	for _, table := range []string{"device_cursors", "push_tokens", "chat_mutes", "passkeys", "chat_member_roles", "bookmarks", "user_preferences", "notifications"} {
+		if _, err = tx.ExecContext(ctx, `delete from `+table+` where user_id = $1`, id); err != nil {
+			log.Println("deleteUser cleanup error")
+			return err
+		}
+	}
+	res, err := tx.ExecContext(ctx, `delete from users where id = $1`, id)
+	if err != nil {
+		log.Println("deleteUser error")
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrNotFound
+	}
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	s.authors.forget(id)
+	return nil
+}
@@ -0,0 +1,255 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"example/gochat/types"
+)
+
+// DefaultWorkspace holds the users and chats of instances that don't use
+// workspaces, and those from before there were any
+const DefaultWorkspace = 0
+
+type workspaceKey struct{}
+
+type unscopedKey struct{}
+
+// WithWorkspace scopes the store calls made with ctx to a workspace: users
+// and chats of other workspaces aren't found, lists leave them out, and new
+// users, chats, announcements and audit entries are created in it
+func WithWorkspace(ctx context.Context, id int) context.Context {
+	return context.WithValue(ctx, workspaceKey{}, id)
+}
+
+// Unscoped marks ctx for the few store calls that see every workspace:
+// finding the user of a login or token before their workspace is known,
+// and background jobs. A WorkspaceStore refuses calls with a context that
+// is neither scoped nor marked, with ErrUnscoped. A scope set later wins
+func Unscoped(ctx context.Context) context.Context {
+	return context.WithValue(ctx, unscopedKey{}, true)
+}
+
+// WorkspaceFrom returns the workspace ctx is scoped to, ok is false for
+// unscoped calls
+func WorkspaceFrom(ctx context.Context) (int, bool) {
+	id, ok := ctx.Value(workspaceKey{}).(int)
+	return id, ok
+}
+
+// scope returns the workspace of ctx, ok is false for a context marked
+// Unscoped. A context that is neither is ErrUnscoped, so a call that lost
+// its workspace can't see the others
+func scope(ctx context.Context) (id int, ok bool, err error) {
+	if id, ok := WorkspaceFrom(ctx); ok {
+		return id, true, nil
+	}
+	if unscoped, _ := ctx.Value(unscopedKey{}).(bool); unscoped {
+		return 0, false, nil
+	}
+	return 0, false, ErrUnscoped
+}
+
+// workspaceScope is the workspace queries are filtered by, -1 for all
+func workspaceScope(ctx context.Context) int {
+	if id, ok := WorkspaceFrom(ctx); ok {
+		return id
+	}
+	return -1
+}
+
+// workspaceOf is the workspace rows created with ctx go to
+func workspaceOf(ctx context.Context) int {
+	id, _ := WorkspaceFrom(ctx)
+	return id
+}
+
+func (s *PostgresStore) createWorkspaceTables(ctx context.Context) error {
+	query := `create table if not exists workspaces (
+		id serial primary key,
+		name varchar(100) not null,
+		slug varchar(30) not null unique,
+		created_at timestamp not null default now()
+	);
+	alter table users add column if not exists workspace_id integer not null default 0;
+	alter table chat add column if not exists workspace_id integer not null default 0;
+	alter table announcements add column if not exists workspace_id integer not null default 0;
+	alter table audit_log add column if not exists workspace_id integer not null default 0;
+	create index if not exists users_workspace_idx on users (workspace_id);
+	create index if not exists chat_workspace_idx on chat (workspace_id)`
+
+	_, err := s.db.ExecContext(ctx, query)
+	return err
+}
+
+// CreateWorkspace returns ErrConflict when the slug is taken
+func (s *PostgresStore) CreateWorkspace(ctx context.Context, name string, slug string) (*types.WorkspaceJSON, error) {
+	// exec query
+	query := `insert into workspaces (name, slug) values ($1, $2)
+	on conflict do nothing
+	returning id, name, slug, created_at`
+	w := &types.WorkspaceJSON{}
+	if err := s.db.QueryRowContext(ctx, query, name, slug).Scan(&w.Id, &w.Name, &w.Slug, &w.CreatedAt); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrConflict
+		}
+		log.Println("createWorkspace error")
+		return nil, err
+	}
+	w.CreatedAt = w.CreatedAt.UTC()
+	return w, nil
+}
+
+func (s *PostgresStore) GetWorkspaces(ctx context.Context) ([]types.WorkspaceJSON, error) {
+	// exec query
+	rows, err := s.db.QueryContext(ctx, `select id, name, slug, `+quotaColumns+`, created_at from workspaces order by id`)
+	if err != nil {
+		log.Println("getWorkspaces query error")
+		return nil, err
+	}
+	defer rows.Close()
+
+	// iterate rows
+	workspaces := []types.WorkspaceJSON{}
+	for rows.Next() {
+		w := types.WorkspaceJSON{}
+		if err := rows.Scan(&w.Id, &w.Name, &w.Slug, &w.Quota.MaxMembers, &w.Quota.MaxMessages, &w.Quota.MaxStorageBytes, &w.CreatedAt); err != nil {
+			log.Println("getWorkspaces scan error")
+			return nil, err
+		}
+		w.CreatedAt = w.CreatedAt.UTC()
+		workspaces = append(workspaces, w)
+	}
+	if err = rows.Err(); err != nil {
+		log.Println("getWorkspaces err error")
+		return nil, err
+	}
+	return workspaces, nil
+}
+
+func (s *PostgresStore) GetWorkspaceBySlug(ctx context.Context, slug string) (*types.WorkspaceJSON, error) {
+	// exec query
+	w := &types.WorkspaceJSON{}
+	err := s.db.QueryRowContext(ctx, `select id, name, slug, `+quotaColumns+`, created_at from workspaces where slug = $1`, slug).Scan(&w.Id, &w.Name, &w.Slug, &w.Quota.MaxMembers, &w.Quota.MaxMessages, &w.Quota.MaxStorageBytes, &w.CreatedAt)
+	if err != nil {
+		if err = storageError(err); !errors.Is(err, ErrNotFound) {
+			log.Println("getWorkspaceBySlug error")
+		}
+		return nil, err
+	}
+	w.CreatedAt = w.CreatedAt.UTC()
+	return w, nil
+}
+
+// GetUserWorkspace and GetChatWorkspace return the workspace a user or
+// chat belongs to, which never changes
+func (s *PostgresStore) GetUserWorkspace(ctx context.Context, userId int) (int, error) {
+	id := 0
+	if err := s.db.QueryRowContext(ctx, `select workspace_id from users where id = $1`, userId).Scan(&id); err != nil {
+		if err = storageError(err); !errors.Is(err, ErrNotFound) {
+			log.Println("getUserWorkspace error")
+		}
+		return 0, err
+	}
+	return id, nil
+}
+
+func (s *PostgresStore) GetChatWorkspace(ctx context.Context, chatId int) (int, error) {
+	id := 0
+	if err := s.db.QueryRowContext(ctx, `select workspace_id from chat where id = $1`, chatId).Scan(&id); err != nil {
+		if err = storageError(err); !errors.Is(err, ErrNotFound) {
+			log.Println("getChatWorkspace error")
+		}
+		return 0, err
+	}
+	return id, nil
+}
+
+func (s *BoltStore) CreateWorkspace(ctx context.Context, name string, slug string) (*types.WorkspaceJSON, error) {
+	var w *types.WorkspaceJSON
+	err := s.update("createWorkspace", func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketWorkspaces)
+		taken := false
+		err := b.ForEach(func(k, v []byte) error {
+			other := types.WorkspaceJSON{}
+			if err := json.Unmarshal(v, &other); err != nil {
+				return err
+			}
+			taken = taken || other.Slug == slug
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if taken {
+			return ErrConflict
+		}
+		id, err := nextId(b)
+		if err != nil {
+			return err
+		}
+		w = &types.WorkspaceJSON{Id: int(id), Name: name, Slug: slug, CreatedAt: time.Now().UTC()}
+		return put(b, itob(id), w)
+	})
+	return w, err
+}
+
+func (s *BoltStore) GetWorkspaces(ctx context.Context) ([]types.WorkspaceJSON, error) {
+	workspaces := []types.WorkspaceJSON{}
+	err := s.view("getWorkspaces", func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketWorkspaces).ForEach(func(k, v []byte) error {
+			w := types.WorkspaceJSON{}
+			if err := json.Unmarshal(v, &w); err != nil {
+				return err
+			}
+			workspaces = append(workspaces, w)
+			return nil
+		})
+	})
+	return workspaces, err
+}
+
+func (s *BoltStore) GetWorkspaceBySlug(ctx context.Context, slug string) (*types.WorkspaceJSON, error) {
+	workspaces, err := s.GetWorkspaces(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, w := range workspaces {
+		if w.Slug == slug {
+			return &w, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (s *BoltStore) GetUserWorkspace(ctx context.Context, userId int) (int, error) {
+	id := 0
+	err := s.view("getUserWorkspace", func(tx *bolt.Tx) error {
+		u, err := getUser(tx, userId)
+		if err != nil {
+			return err
+		}
+		id = u.WorkspaceId
+		return nil
+	})
+	return id, err
+}
+
+func (s *BoltStore) GetChatWorkspace(ctx context.Context, chatId int) (int, error) {
+	id := 0
+	err := s.view("getChatWorkspace", func(tx *bolt.Tx) error {
+		c, err := getChat(tx, chatId)
+		if err != nil {
+			return err
+		}
+		id = c.WorkspaceId
+		return nil
+	})
+	return id, err
+}
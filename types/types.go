@@ -0,0 +1,876 @@
+// Package types holds the models and json payloads shared by the other packages
+package types
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+type User struct {
+	Id       int
+	Username string
+	Email    string
+	Password string
+	Chats    []int
+	Role     string
+	// IANA name, used for quiet hours
+	TimeZone string
+	// free to change, unlike Username
+	DisplayName string
+	// disabled users can't log in or use their tokens
+	Disabled bool
+	// tokens of an older version are rejected, it goes up when the
+	// password changes or the user is disabled
+	TokenVersion int
+	// bots have no password, they use api tokens
+	Bot bool
+	// the workspace the user belongs to, 0 for the default one
+	WorkspaceId int
+}
+
+const (
+	RoleUser      = "user"
+	RoleModerator = "moderator"
+	RoleAdmin     = "admin"
+)
+
+var roleRanks = map[string]int{RoleUser: 0, RoleModerator: 1, RoleAdmin: 2}
+
+// ValidRole reports whether role is one of the known roles
+func ValidRole(role string) bool {
+	_, ok := roleRanks[role]
+	return ok
+}
+
+// HasRole reports whether the user's role is at least role
+func (u *User) HasRole(role string) bool {
+	return roleRanks[u.Role] >= roleRanks[role]
+}
+
+func (u *User) ValidatePassword(pw string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(u.Password), []byte(pw)) == nil
+}
+
+type UserJSON struct {
+	Id            int                `json:"id"`
+	Username      string             `json:"username"`
+	DisplayName   string             `json:"displayName"`
+	Email         string             `json:"email"`
+	Role          string             `json:"role"`
+	WorkspaceId   int                `json:"workspaceId"`
+	TimeZone      string             `json:"timeZone"`
+	Chats         []ChatJSON         `json:"chats"`
+	Announcements []AnnouncementJSON `json:"announcements"`
+	Token         string             `json:"token"`
+}
+
+type Chat struct {
+	Id         int
+	Name       string
+	Topic      string
+	Password   string
+	Messages   []MessageJSON
+	Users      []AuthorJSON
+	Visibility string
+	Category   string
+	Tags       []string
+	// sent to each new member, empty for none
+	Welcome string
+	// public announcement chats also have an atom feed
+	Announcement bool
+	// unix time each image of the chat was last set, by kind
+	Images map[string]int64
+}
+
+// kinds of chat images
+const (
+	ChatImageAvatar = "avatar"
+	ChatImageCover  = "cover"
+)
+
+// ImageUrl is where the image of the given kind is served, the version
+// changes the url whenever the image does so it can be cached for long
+func (c *Chat) ImageUrl(kind string) string {
+	version, ok := c.Images[kind]
+	if !ok {
+		return ""
+	}
+	return fmt.Sprintf("/api/chats/%d/%s?v=%d", c.Id, kind, version)
+}
+
+// membership roles, they only apply inside one chat
+const (
+	MemberRoleMember = "member"
+	// can read and receive events but not post
+	MemberRoleViewer = "viewer"
+	// also sees the previous versions of edited messages, creators of
+	// chats start out as admins
+	MemberRoleAdmin = "admin"
+)
+
+const (
+	// only members can read the chat
+	VisibilityPrivate = "private"
+	// anyone can read the chat, posting still needs membership
+	VisibilityPublic = "public"
+)
+
+func (c *Chat) ValidatePassword(pw string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(c.Password), []byte(pw)) == nil
+}
+
+func (c *Chat) ToJSON() ChatJSON {
+	return ChatJSON{
+		Id:         c.Id,
+		Name:       c.Name,
+		Topic:      c.Topic,
+		Messages:   c.Messages,
+		Users:      c.Users,
+		Visibility: c.Visibility,
+		Category:   c.Category,
+		Tags:       c.Tags,
+		AvatarUrl:  c.ImageUrl(ChatImageAvatar),
+		CoverUrl:   c.ImageUrl(ChatImageCover),
+		FeedUrl:    c.FeedUrl(),
+	}
+}
+
+// FeedUrl is where the atom feed of the chat is served, empty unless the
+// chat is public and marked as announcements
+func (c *Chat) FeedUrl() string {
+	if !c.Announcement || c.Visibility != VisibilityPublic {
+		return ""
+	}
+	return fmt.Sprintf("/feeds/chats/%d.atom", c.Id)
+}
+
+type ChatJSON struct {
+	Id         int           `json:"id"`
+	Name       string        `json:"name"`
+	Topic      string        `json:"topic"`
+	Messages   []MessageJSON `json:"messages"`
+	Users      []AuthorJSON  `json:"users"`
+	Visibility string        `json:"visibility"`
+	Category   string        `json:"category"`
+	Tags       []string      `json:"tags"`
+	AvatarUrl  string        `json:"avatarUrl,omitempty"`
+	CoverUrl   string        `json:"coverUrl,omitempty"`
+	FeedUrl    string        `json:"feedUrl,omitempty"`
+}
+
+type MessageJSON struct {
+	// generated by the database, unique across chats
+	Id     int64      `json:"id"`
+	ChatId int        `json:"chatId"`
+	Text   string     `json:"text"`
+	Author AuthorJSON `json:"author"`
+	// set by the server in UTC, zero for messages older than the field
+	CreatedAt time.Time `json:"createdAt"`
+	// set when the author edits the text
+	EditedAt *time.Time `json:"editedAt,omitempty"`
+	// per recipient status, only tracked in small chats
+	Receipts []ReceiptJSON `json:"receipts,omitempty"`
+}
+
+// delivery states of a message for one recipient, in order
+const (
+	ReceiptSent      = "sent"
+	ReceiptDelivered = "delivered"
+	ReceiptRead      = "read"
+)
+
+type ReceiptJSON struct {
+	MessageId int64  `json:"messageId"`
+	UserId    int    `json:"userId"`
+	Status    string `json:"status"`
+}
+
+// ReactionJSON counts the reactions with one emoji on a message
+type ReactionJSON struct {
+	Emoji string `json:"emoji"`
+	Count int    `json:"count"`
+	// whether the caller is one of them
+	Reacted bool `json:"reacted"`
+}
+
+type ReactionRequest struct {
+	Emoji string `json:"emoji"`
+}
+
+// ReactionEventJSON is sent to chat members when a reaction is added or removed
+type ReactionEventJSON struct {
+	ChatId    int    `json:"chatId"`
+	MessageId int64  `json:"messageId"`
+	UserId    int    `json:"userId"`
+	Emoji     string `json:"emoji"`
+	Added     bool   `json:"added"`
+}
+
+type BookmarkJSON struct {
+	Id        int64       `json:"id"`
+	Message   MessageJSON `json:"message"`
+	CreatedAt time.Time   `json:"createdAt"`
+}
+
+// MessageEditJSON is a previous version of an edited message
+type MessageEditJSON struct {
+	Text     string    `json:"text"`
+	EditedAt time.Time `json:"editedAt"`
+}
+
+// MemberJSON is one entry of a chat member list
+type MemberJSON struct {
+	Id          int    `json:"id"`
+	Username    string `json:"username"`
+	DisplayName string `json:"displayName,omitempty"`
+	Role        string `json:"role"`
+	// zero for members who joined before the field
+	JoinedAt time.Time `json:"joinedAt"`
+	// connected over a websocket right now
+	Online bool `json:"online"`
+	// only set for users who share it
+	LastSeen *time.Time `json:"lastSeen,omitempty"`
+}
+
+type AuthorJSON struct {
+	Id       int    `json:"id"`
+	Username string `json:"username"`
+	// shown instead of the username when set
+	DisplayName string `json:"displayName,omitempty"`
+	// only set in member lists, and only for users who share it
+	LastSeen *time.Time `json:"lastSeen,omitempty"`
+}
+
+// DeletedUser is the author of the messages of deleted accounts, the
+// username has a space so no one can register it
+var DeletedUser = AuthorJSON{Id: 0, Username: "Deleted user"}
+
+// which messages are pushed to a user
+const (
+	NotifyAll      = "all"
+	NotifyMentions = "mentions"
+	NotifyNone     = "none"
+)
+
+type PreferencesJSON struct {
+	Notify string `json:"notify"`
+	Email  bool   `json:"email"`
+	// no push or email notifications inside any of these windows
+	QuietHours []QuietHoursJSON `json:"quietHours"`
+	// IANA name the quiet hours are read in, e.g. "Europe/Athens",
+	// stored on the user
+	TimeZone string `json:"timeZone"`
+}
+
+// QuietHoursJSON is a recurring window from start to end, "15:04" in the
+// user's time zone, on the given week days (0 is sunday) or every day
+// when there are none, a window where end is before start spans midnight
+type QuietHoursJSON struct {
+	Start string `json:"start"`
+	End   string `json:"end"`
+	Days  []int  `json:"days,omitempty"`
+}
+
+// DefaultPreferences are used for users that never changed theirs
+func DefaultPreferences() PreferencesJSON {
+	return PreferencesJSON{Notify: NotifyAll, Email: true, QuietHours: []QuietHoursJSON{}, TimeZone: "UTC"}
+}
+
+// kinds of notifications in the inbox
+const (
+	NotificationMention      = "mention"
+	NotificationInvite       = "invite"
+	NotificationJoinApproval = "join_approval"
+	NotificationSystem       = "system"
+)
+
+type NotificationJSON struct {
+	Id        int64           `json:"id"`
+	Type      string          `json:"type"`
+	ChatId    int             `json:"chatId,omitempty"`
+	Data      json.RawMessage `json:"data"`
+	Read      bool            `json:"read"`
+	CreatedAt time.Time       `json:"createdAt"`
+}
+
+// kinds of entries in the activity feed
+const (
+	ActivityAddedToChat = "added_to_chat"
+	ActivityMention     = "mention"
+	ActivityRoleChanged = "role_changed"
+)
+
+// ActivityJSON is an entry of the activity feed of a user, data depends
+// on the type
+type ActivityJSON struct {
+	Id        int64           `json:"id"`
+	Type      string          `json:"type"`
+	ChatId    int             `json:"chatId,omitempty"`
+	Data      json.RawMessage `json:"data"`
+	CreatedAt time.Time       `json:"createdAt"`
+}
+
+// admin actions kept in the audit log
+const (
+	AuditChatPurged       = "chat.purged"
+	AuditChatExported     = "chat.exported"
+	AuditChatJoinLocked   = "chat.join_locked"
+	AuditBotCreated       = "bot.created"
+	AuditAPITokenIssued   = "api_token.issued"
+	AuditAPITokenRevoked  = "api_token.revoked"
+	AuditResponderAdded   = "responder.added"
+	AuditResponderRemoved = "responder.removed"
+	AuditWorkspaceCreated = "workspace.created"
+	AuditWorkspaceAdmin   = "workspace.admin"
+	AuditWorkspaceQuota   = "workspace.quota"
+)
+
+// AuditEntryJSON records an admin action, the actor is kept as they were
+// at the time
+type AuditEntryJSON struct {
+	Id        int64           `json:"id"`
+	Action    string          `json:"action"`
+	Actor     AuthorJSON      `json:"actor"`
+	ChatId    int             `json:"chatId,omitempty"`
+	Data      json.RawMessage `json:"data"`
+	CreatedAt time.Time       `json:"createdAt"`
+}
+
+// PurgeRequest deletes the messages of a chat sent before an RFC3339 time,
+// or all of them without one
+type PurgeRequest struct {
+	Before string `json:"before"`
+}
+
+type PurgeJSON struct {
+	Deleted int `json:"deleted"`
+}
+
+// ReadNotificationsRequest marks the listed notifications read, or all
+// of them when ids is empty
+type ReadNotificationsRequest struct {
+	Ids []int64 `json:"ids"`
+}
+
+type PrivacyRequest struct {
+	ShowLastSeen bool `json:"showLastSeen"`
+}
+
+// ProfileRequest replaces the profile, an empty display name shows the
+// username
+type ProfileRequest struct {
+	DisplayName string `json:"displayName"`
+	Bio         string `json:"bio"`
+	Pronouns    string `json:"pronouns"`
+	Link        string `json:"link"`
+}
+
+// ProfileJSON is what everyone can see of a user
+type ProfileJSON struct {
+	Id          int    `json:"id"`
+	Username    string `json:"username"`
+	DisplayName string `json:"displayName"`
+	Bio         string `json:"bio"`
+	Pronouns    string `json:"pronouns"`
+	Link        string `json:"link"`
+	// only for users who share it
+	LastSeen *time.Time `json:"lastSeen,omitempty"`
+}
+
+type LoginRequest struct {
+	Email    string `json:"email"`
+	Password string `json:"password"`
+}
+
+type RegisterRequest struct {
+	Username string `json:"username"`
+	Email    string `json:"email"`
+	Password string `json:"password"`
+	// slug of the workspace to join, the default workspace when empty
+	Workspace string `json:"workspace"`
+}
+
+type CreateChatRequest struct {
+	Name       string   `json:"name"`
+	Topic      string   `json:"topic"`
+	Password   string   `json:"password"`
+	Visibility string   `json:"visibility"`
+	Category   string   `json:"category"`
+	Tags       []string `json:"tags"`
+}
+
+// TrendingChatJSON is a public chat with its recent activity
+type TrendingChatJSON struct {
+	ChatInfoJSON
+	Score          int `json:"score"`
+	RecentMessages int `json:"recentMessages"`
+	ActiveMembers  int `json:"activeMembers"`
+}
+
+type WelcomeRequest struct {
+	Text string `json:"text"`
+}
+
+type ChatAnnouncementRequest struct {
+	Announcement bool `json:"announcement"`
+}
+
+type UpdateChatRequest struct {
+	Name  string `json:"name"`
+	Topic string `json:"topic"`
+}
+
+type TagsRequest struct {
+	Category string   `json:"category"`
+	Tags     []string `json:"tags"`
+}
+
+// ChatInfoJSON describes a chat in the directory and search results
+type ChatInfoJSON struct {
+	Id          int      `json:"id"`
+	Name        string   `json:"name"`
+	Topic       string   `json:"topic"`
+	Visibility  string   `json:"visibility"`
+	Category    string   `json:"category"`
+	Tags        []string `json:"tags"`
+	MemberCount int      `json:"memberCount"`
+}
+
+type VisibilityRequest struct {
+	Visibility string `json:"visibility"`
+}
+
+type JoinChatRequest struct {
+	Id       int    `json:"id"`
+	Password string `json:"password"`
+}
+
+type AnnouncementRequest struct {
+	Text string `json:"text"`
+}
+
+type AnnouncementJSON struct {
+	Id        int       `json:"id"`
+	Text      string    `json:"text"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+type EventJSON struct {
+	Id   int64  `json:"id,omitempty"`
+	Type string `json:"type"`
+	Data any    `json:"data"`
+}
+
+type ClientEventJSON struct {
+	Type string `json:"type"`
+	Id   int64  `json:"id"`
+	// set on delivered and read receipts
+	MessageId int64 `json:"messageId"`
+}
+
+type BatchChatsRequest struct {
+	Ids []int `json:"ids"`
+}
+
+// ReadMarkerJSON is the last message of a chat the user has read, 0 when
+// they read none
+type ReadMarkerJSON struct {
+	ChatId    int   `json:"chatId"`
+	MessageId int64 `json:"messageId"`
+}
+
+// ReadAllRequest marks the listed chats read, or all of the user's chats
+// when chatIds is empty
+type ReadAllRequest struct {
+	ChatIds []int `json:"chatIds"`
+}
+
+// ListJSON wraps every list response, nextCursor is passed back as
+// ?cursor= to get the next page and is left out on the last one
+type ListJSON[T any] struct {
+	Data       []T    `json:"data"`
+	NextCursor string `json:"nextCursor,omitempty"`
+	// only set by lists that can also be paged backwards
+	PrevCursor string `json:"prevCursor,omitempty"`
+	Total      int    `json:"total"`
+}
+
+type ChatSummaryJSON struct {
+	Id           int    `json:"id"`
+	Name         string `json:"name"`
+	MemberCount  int    `json:"memberCount"`
+	MessageCount int    `json:"messageCount"`
+	// messages from others after the last one the user read, counted up
+	// to MaxUnread
+	Unread      int          `json:"unread"`
+	LastMessage *MessageJSON `json:"lastMessage"`
+	// the last message shortened for chat lists, null in empty chats
+	Preview *PreviewJSON `json:"preview"`
+}
+
+// MaxUnread caps unread counts, clients show it as 99+
+const MaxUnread = 100
+
+// PreviewJSON is the last message of a chat as chat lists show it
+type PreviewJSON struct {
+	MessageId int64      `json:"messageId"`
+	Author    AuthorJSON `json:"author"`
+	Excerpt   string     `json:"excerpt"`
+	CreatedAt time.Time  `json:"createdAt"`
+}
+
+// ChatPreviewJSON is the data of chat_preview events, sent to the members
+// when the last message of a chat changes
+type ChatPreviewJSON struct {
+	ChatId  int          `json:"chatId"`
+	Preview *PreviewJSON `json:"preview"`
+}
+
+// MaxExcerpt is the length of previews in characters
+const MaxExcerpt = 100
+
+// Excerpt puts the text on one line and shortens it to MaxExcerpt
+// characters
+func Excerpt(text string) string {
+	runes := []rune(strings.Join(strings.Fields(text), " "))
+	if len(runes) <= MaxExcerpt {
+		return string(runes)
+	}
+	return strings.TrimRight(string(runes[:MaxExcerpt-1]), " ") + "…"
+}
+
+// Preview returns the preview of the message
+func (m *MessageJSON) Preview() *PreviewJSON {
+	return &PreviewJSON{MessageId: m.Id, Author: m.Author, Excerpt: Excerpt(m.Text), CreatedAt: m.CreatedAt}
+}
+
+type SendMessageRequest struct {
+	Text string `json:"text"`
+}
+
+// integration events, written to the outbox with the change they describe
+const (
+	OutboxChatCreated    = "chat.created"
+	OutboxChatDeleted    = "chat.deleted"
+	OutboxMemberJoined   = "member.joined"
+	OutboxMemberLeft     = "member.left"
+	OutboxMessageCreated = "message.created"
+	OutboxMessageEdited  = "message.edited"
+	OutboxQuotaExceeded  = "workspace.quota_exceeded"
+)
+
+type OutboxEventJSON struct {
+	Id        int64           `json:"id"`
+	Type      string          `json:"type"`
+	ChatId    int             `json:"chatId"`
+	Data      json.RawMessage `json:"data"`
+	CreatedAt time.Time       `json:"createdAt"`
+}
+
+// MemberEventJSON is the data of member.joined and member.left
+type MemberEventJSON struct {
+	ChatId int        `json:"chatId"`
+	User   AuthorJSON `json:"user"`
+}
+
+type ChatCreatedJSON struct {
+	Id         int        `json:"id"`
+	Name       string     `json:"name"`
+	Topic      string     `json:"topic"`
+	Visibility string     `json:"visibility"`
+	Creator    AuthorJSON `json:"creator"`
+}
+
+type ChangeJSON struct {
+	Id        int64           `json:"id"`
+	ChatId    int             `json:"chatId"`
+	UserId    int             `json:"userId"`
+	Type      string          `json:"type"`
+	Data      json.RawMessage `json:"data"`
+	CreatedAt time.Time       `json:"createdAt"`
+}
+
+type SyncJSON struct {
+	Changes []ChangeJSON `json:"changes"`
+	Cursor  string       `json:"cursor"`
+	HasMore bool         `json:"hasMore"`
+}
+
+type PushTokenRequest struct {
+	Token    string `json:"token"`
+	Platform string `json:"platform"`
+}
+
+type PushToken struct {
+	UserId   int
+	Token    string
+	Platform string
+}
+
+type PasskeyBeginJSON struct {
+	SessionId string `json:"sessionId"`
+	Options   any    `json:"options"`
+}
+
+type JWKSJSON struct {
+	Keys []JWKJSON `json:"keys"`
+}
+
+// JWKJSON fields are in lexical order, the required members of a key
+// marshal to its rfc 7638 thumbprint input
+type JWKJSON struct {
+	Crv string `json:"crv,omitempty"`
+	E   string `json:"e,omitempty"`
+	Kty string `json:"kty"`
+	N   string `json:"n,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+	Kid string `json:"kid,omitempty"`
+	Use string `json:"use,omitempty"`
+	Alg string `json:"alg,omitempty"`
+}
+
+type RoleRequest struct {
+	Role string `json:"role"`
+}
+
+type DisableUserRequest struct {
+	Disabled bool `json:"disabled"`
+}
+
+// PasswordResetJSON holds the password an admin hands to a user whose
+// password was reset, it isn't shown again
+type PasswordResetJSON struct {
+	TemporaryPassword string `json:"temporaryPassword"`
+}
+
+type PasswordRequest struct {
+	CurrentPassword string `json:"currentPassword"`
+	NewPassword     string `json:"newPassword"`
+}
+
+// ReadyJSON tells a load balancer whether an instance takes connections
+type ReadyJSON struct {
+	// ok, full or unavailable while storage is down
+	Status         string `json:"status"`
+	Connections    int    `json:"connections"`
+	MaxConnections int    `json:"maxConnections"`
+	// instances known through the broker, this one included
+	Nodes              int `json:"nodes"`
+	ClusterConnections int `json:"clusterConnections"`
+}
+
+// RuntimeJSON is a snapshot of the go runtime, sizes are in bytes
+type RuntimeJSON struct {
+	GoVersion    string     `json:"goVersion"`
+	Uptime       string     `json:"uptime"`
+	Goroutines   int        `json:"goroutines"`
+	GOMAXPROCS   int        `json:"gomaxprocs"`
+	HeapAlloc    uint64     `json:"heapAlloc"`
+	HeapInuse    uint64     `json:"heapInuse"`
+	HeapObjects  uint64     `json:"heapObjects"`
+	Sys          uint64     `json:"sys"`
+	NumGC        uint32     `json:"numGC"`
+	PauseTotalNs uint64     `json:"pauseTotalNs"`
+	LastGC       *time.Time `json:"lastGC"`
+	Connections  int        `json:"connections"`
+	// websocket connections using compression: message bytes, bytes
+	// sent and sent per message byte
+	CompressedPayloadBytes int64   `json:"compressedPayloadBytes"`
+	CompressedWireBytes    int64   `json:"compressedWireBytes"`
+	CompressionRatio       float64 `json:"compressionRatio"`
+}
+
+// AdminUserJSON is a user as listed to admins
+type AdminUserJSON struct {
+	Id       int    `json:"id"`
+	Username string `json:"username"`
+	Email    string `json:"email"`
+	Role     string `json:"role"`
+	TimeZone string `json:"timeZone"`
+	Chats    []int  `json:"chats"`
+	Disabled bool   `json:"disabled"`
+	Bot      bool   `json:"bot,omitempty"`
+}
+
+// CreateBotRequest creates a bot account, which has no email or password
+type CreateBotRequest struct {
+	Username string `json:"username"`
+}
+
+// scopes of api tokens
+const (
+	// GET requests only
+	ScopeRead = "read"
+	// sending messages only
+	ScopeSend = "send"
+)
+
+// CreateAPITokenRequest issues an api token to a bot, the name says what
+// uses it
+type CreateAPITokenRequest struct {
+	Name  string `json:"name"`
+	Scope string `json:"scope"`
+}
+
+// APITokenJSON describes an api token, the token itself is only returned
+// when it is created
+type APITokenJSON struct {
+	Id        int       `json:"id"`
+	Name      string    `json:"name"`
+	Scope     string    `json:"scope"`
+	CreatedAt time.Time `json:"createdAt"`
+	Token     string    `json:"token,omitempty"`
+}
+
+// ResponderJSON is an auto-responder of a chat: the bot answers messages
+// containing the trigger with the response template, at most once per
+// cooldown
+type ResponderJSON struct {
+	Id              int       `json:"id"`
+	ChatId          int       `json:"chatId"`
+	BotId           int       `json:"botId"`
+	Trigger         string    `json:"trigger"`
+	Response        string    `json:"response"`
+	CooldownSeconds int       `json:"cooldownSeconds"`
+	CreatedAt       time.Time `json:"createdAt"`
+}
+
+type CreateResponderRequest struct {
+	BotId           int    `json:"botId"`
+	Trigger         string `json:"trigger"`
+	Response        string `json:"response"`
+	CooldownSeconds int    `json:"cooldownSeconds"`
+}
+
+// WorkspaceJSON is a community hosted on the instance, its users and chats
+// don't see those of other workspaces
+type WorkspaceJSON struct {
+	Id        int                `json:"id"`
+	Name      string             `json:"name"`
+	Slug      string             `json:"slug"`
+	Quota     WorkspaceQuotaJSON `json:"quota"`
+	CreatedAt time.Time          `json:"createdAt"`
+}
+
+type CreateWorkspaceRequest struct {
+	Name string `json:"name"`
+	Slug string `json:"slug"`
+}
+
+// WorkspaceAdminRequest makes a user of the workspace its admin
+type WorkspaceAdminRequest struct {
+	Email string `json:"email"`
+}
+
+// WorkspaceQuotaJSON limits what a workspace can use, 0 is unlimited
+type WorkspaceQuotaJSON struct {
+	MaxMembers int `json:"maxMembers"`
+	// messages sent in a calendar month, in UTC
+	MaxMessages     int   `json:"maxMessages"`
+	MaxStorageBytes int64 `json:"maxStorageBytes"`
+}
+
+// WorkspaceUsageJSON is what a workspace uses, for billing. Members don't
+// include bots, messages are those sent in the month even if deleted since,
+// and storage is the current size of message texts and chat images
+type WorkspaceUsageJSON struct {
+	WorkspaceId  int                `json:"workspaceId"`
+	Month        string             `json:"month"`
+	Members      int                `json:"members"`
+	Messages     int                `json:"messages"`
+	StorageBytes int64              `json:"storageBytes"`
+	Quota        WorkspaceQuotaJSON `json:"quota"`
+}
+
+// QuotaExceededJSON is the data of workspace.quota_exceeded, quota is
+// members, messages or storage
+type QuotaExceededJSON struct {
+	WorkspaceId int    `json:"workspaceId"`
+	Month       string `json:"month"`
+	Quota       string `json:"quota"`
+	Limit       int64  `json:"limit"`
+	Usage       int64  `json:"usage"`
+}
+
+// BanRequest bans a single address or a cidr range
+type BanRequest struct {
+	Ip string `json:"ip"`
+}
+
+type StatsJSON struct {
+	Users int `json:"users"`
+	Chats int `json:"chats"`
+	// chats with a message in the last storage.StatsDays days
+	ActiveChats int `json:"activeChats"`
+	Messages    int `json:"messages"`
+	// oldest first, one entry for each of the last storage.StatsDays days
+	MessagesPerDay []DayCountJSON `json:"messagesPerDay"`
+	StorageBytes   int64          `json:"storageBytes"`
+	Connections    int            `json:"connections"`
+}
+
+type DayCountJSON struct {
+	// UTC, e.g. 2024-01-02
+	Day   string `json:"day"`
+	Count int    `json:"count"`
+}
+
+// SCIMUserJSON is a user as identity providers provision it over scim 2.0,
+// id is the gochat user id
+type SCIMUserJSON struct {
+	Schemas     []string      `json:"schemas"`
+	Id          string        `json:"id,omitempty"`
+	UserName    string        `json:"userName"`
+	Name        *SCIMName     `json:"name,omitempty"`
+	DisplayName string        `json:"displayName,omitempty"`
+	Emails      []SCIMEmail   `json:"emails,omitempty"`
+	Active      *bool         `json:"active,omitempty"`
+	Meta        *SCIMMetaJSON `json:"meta,omitempty"`
+}
+
+type SCIMName struct {
+	Formatted string `json:"formatted,omitempty"`
+}
+
+type SCIMEmail struct {
+	Value   string `json:"value"`
+	Primary bool   `json:"primary,omitempty"`
+}
+
+type SCIMMetaJSON struct {
+	ResourceType string `json:"resourceType"`
+	Location     string `json:"location"`
+}
+
+// SCIMListJSON is a page of a scim search, startIndex counts from 1
+type SCIMListJSON struct {
+	Schemas      []string       `json:"schemas"`
+	TotalResults int            `json:"totalResults"`
+	StartIndex   int            `json:"startIndex"`
+	ItemsPerPage int            `json:"itemsPerPage"`
+	Resources    []SCIMUserJSON `json:"Resources"`
+}
+
+// SCIMPatchRequest changes some attributes of a user, an operation without
+// a path has the attributes in its value
+type SCIMPatchRequest struct {
+	Operations []SCIMPatchOp `json:"Operations"`
+}
+
+type SCIMPatchOp struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	Value json.RawMessage `json:"value"`
+}
+
+type SCIMErrorJSON struct {
+	Schemas  []string `json:"schemas"`
+	Status   string   `json:"status"`
+	ScimType string   `json:"scimType,omitempty"`
+	Detail   string   `json:"detail"`
+}